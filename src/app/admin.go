@@ -0,0 +1,390 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+	"github.com/andy74139/webserver/src/domain/entity/user"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+const (
+	adminListDefaultLimit = 20
+	adminListMaxLimit     = 100
+)
+
+type responseAdminUser struct {
+	ID          string              `json:"id" example:"01B6C691-EE6E-48F2-B2DE-AFC1DA180EFE" description:"User ID"`
+	Name        string              `json:"name" example:"User123456" description:"User name"`
+	Roles       []string            `json:"roles" example:"user" description:"Roles of the user"`
+	Identities  []*responseIdentity `json:"identities" description:"Devices and SSO accounts linked to the user"`
+	CreatedAt   time.Time           `json:"created_at" description:"Registered time"`
+	SuspendedAt *time.Time          `json:"suspended_at,omitempty" description:"Suspended time, empty if not suspended"`
+	DeletedAt   *time.Time          `json:"deleted_at,omitempty" description:"Deleted time, empty if not deleted"`
+}
+
+func newResponseAdminUser(user1 *user.User) *responseAdminUser {
+	resp := &responseAdminUser{
+		ID:         user1.ID.String(),
+		Name:       user1.Name,
+		Roles:      user1.Roles,
+		Identities: newResponseIdentities(user1.Identities),
+		CreatedAt:  user1.CreatedAt,
+	}
+	if !user1.SuspendedAt.IsZero() {
+		resp.SuspendedAt = &user1.SuspendedAt
+	}
+	if !user1.DeletedAt.IsZero() {
+		resp.DeletedAt = &user1.DeletedAt
+	}
+	return resp
+}
+
+type responseAdminListUsers struct {
+	Users []*responseAdminUser `json:"users" description:"Users ordered by registered time"`
+	Total int                  `json:"total" example:"1" description:"Count of all matched users"`
+}
+
+// @Title List users
+// @Description Lists and searches users, for operators.
+// @Tags admin
+// @Resource admin
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param q query string false "User ID, or part of user name"
+// @Param include_deleted query bool false "Include deleted users"
+// @Param offset query int false "Offset of the page"
+// @Param limit query int false "Size of the page, 20 by default, at most 100"
+// @Success 200 object responseAdminListUsers "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /api/admin/v1/users [get]
+func (a *app) adminListUsers(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	filter := &user.ListFilter{
+		Query:          ctx.Query("q"),
+		IncludeDeleted: ctx.Query("include_deleted") == "true",
+		Limit:          adminListDefaultLimit,
+	}
+	if offset := ctx.Query("offset"); offset != "" {
+		value, err := strconv.Atoi(offset)
+		if err != nil || value < 0 {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid offset"})
+			return
+		}
+		filter.Offset = value
+	}
+	if limit := ctx.Query("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value <= 0 || value > adminListMaxLimit {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		filter.Limit = value
+	}
+
+	users, total, err := a.userSvc.List(ctx, filter)
+	if err != nil {
+		logger.Errorw("userSvc.List error", "filter", filter, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	resp := &responseAdminListUsers{Users: make([]*responseAdminUser, 0, len(users)), Total: total}
+	for _, user1 := range users {
+		resp.Users = append(resp.Users, newResponseAdminUser(user1))
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// @Title Look up user
+// @Description Gets the user by the device, or by the SSO account, for operators.
+// @Tags admin
+// @Resource admin
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param platform query string false "Platform of the device"
+// @Param device_id query string false "Device ID"
+// @Param sso_provider query string false "SSO provider"
+// @Param sso_account_id query string false "Account ID of the SSO provider"
+// @Success 200 object responseAdminUser "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 500 "Internal Server Error"
+// @Router /api/admin/v1/users/lookup [get]
+func (a *app) adminLookupUser(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	var userID uuid.UUID
+	var err error
+	if deviceID := ctx.Query("device_id"); deviceID != "" {
+		userID, err = a.userSvc.GetIDByDevice(ctx, ctx.Query("platform"), deviceID)
+	} else if ssoAccountID := ctx.Query("sso_account_id"); ssoAccountID != "" {
+		userID, err = a.userSvc.GetIDBySSO(ctx, ctx.Query("sso_provider"), ssoAccountID)
+	} else {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "device_id or sso_account_id is required"})
+		return
+	}
+	if errors.Is(err, user.ErrNotFound) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	} else if err != nil {
+		logger.Errorw("userSvc lookup error", "query", ctx.Request.URL.RawQuery, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	a.adminWriteUser(ctx, userID)
+}
+
+// @Title Get user
+// @Description Gets the user, for operators.
+// @Tags admin
+// @Resource admin
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param id path string true "User ID"
+// @Success 200 object responseAdminUser "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 500 "Internal Server Error"
+// @Router /api/admin/v1/users/{id} [get]
+func (a *app) adminGetUser(ctx *gin.Context) {
+	userID, ok := getUserIDParam(ctx)
+	if !ok {
+		return
+	}
+	a.adminWriteUser(ctx, userID)
+}
+
+type requestAdminUpdateUser struct {
+	Name  string   `json:"name,omitempty" example:"User123456" description:"User name, unchanged if empty"`
+	Roles []string `json:"roles,omitempty" example:"user" description:"Roles of the user, unchanged if empty. It takes effect when tokens of the user are refreshed"`
+}
+
+// @Title Update user
+// @Description Updates the name or the roles of the user, for operators.
+// @Tags admin
+// @Resource admin
+// @Accept json
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param id path string true "User ID"
+// @Param request body requestAdminUpdateUser true "Update request"
+// @Success 200 object responseAdminUser "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 500 "Internal Server Error"
+// @Router /api/admin/v1/users/{id} [put]
+func (a *app) adminUpdateUser(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, ok := getUserIDParam(ctx)
+	if !ok {
+		return
+	}
+	req := &requestAdminUpdateUser{}
+	if err := ctx.BindJSON(req); err != nil {
+		logger.Debugw("unknown request body", "request", ctx.Request)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+	for _, role := range req.Roles {
+		if !auth.IsValidRole(role) {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown role: " + role})
+			return
+		}
+	}
+
+	if req.Name != "" {
+		err := a.userSvc.Update(ctx, &user.User{ID: userID, Name: req.Name})
+		if !a.adminCheckUserError(ctx, userID, "userSvc.Update", err) {
+			return
+		}
+	}
+	if len(req.Roles) > 0 {
+		err := a.userSvc.SetRoles(ctx, userID, req.Roles)
+		if !a.adminCheckUserError(ctx, userID, "userSvc.SetRoles", err) {
+			return
+		}
+	}
+	logger.Infow("user updated by operator", "user_id", userID, "request", req)
+
+	a.adminWriteUser(ctx, userID)
+}
+
+// @Title Delete user
+// @Description Soft-deletes the user, and revokes all tokens of it, for operators.
+// @Tags admin
+// @Resource admin
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param id path string true "User ID"
+// @Success 200 "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 500 "Internal Server Error"
+// @Router /api/admin/v1/users/{id} [delete]
+func (a *app) adminDeleteUser(ctx *gin.Context) {
+	userID, ok := getUserIDParam(ctx)
+	if !ok {
+		return
+	}
+	err := a.userSvc.Delete(ctx, userID)
+	if !a.adminCheckUserError(ctx, userID, "userSvc.Delete", err) {
+		return
+	}
+	a.adminRevokeUserTokens(ctx, userID)
+}
+
+// @Title Suspend user
+// @Description Suspends the user, which can't login until unsuspended, and revokes all tokens of it, for operators.
+// @Tags admin
+// @Resource admin
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param id path string true "User ID"
+// @Success 200 "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 500 "Internal Server Error"
+// @Router /api/admin/v1/users/{id}/suspend [post]
+func (a *app) adminSuspendUser(ctx *gin.Context) {
+	userID, ok := getUserIDParam(ctx)
+	if !ok {
+		return
+	}
+	err := a.userSvc.Suspend(ctx, userID)
+	if !a.adminCheckUserError(ctx, userID, "userSvc.Suspend", err) {
+		return
+	}
+	a.adminRevokeUserTokens(ctx, userID)
+}
+
+// @Title Unsuspend user
+// @Description Lifts the suspension of the user, for operators.
+// @Tags admin
+// @Resource admin
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param id path string true "User ID"
+// @Success 200 "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 500 "Internal Server Error"
+// @Router /api/admin/v1/users/{id}/unsuspend [post]
+func (a *app) adminUnsuspendUser(ctx *gin.Context) {
+	userID, ok := getUserIDParam(ctx)
+	if !ok {
+		return
+	}
+	err := a.userSvc.Unsuspend(ctx, userID)
+	if !a.adminCheckUserError(ctx, userID, "userSvc.Unsuspend", err) {
+		return
+	}
+	infra.GetLogger(ctx).Infow("user unsuspended by operator", "user_id", userID)
+	ctx.Status(http.StatusOK)
+}
+
+// @Title Restore user
+// @Description Restores the soft-deleted user, for operators.
+// @Tags admin
+// @Resource admin
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param id path string true "User ID"
+// @Success 200 "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 500 "Internal Server Error"
+// @Router /api/admin/v1/users/{id}/restore [post]
+func (a *app) adminRestoreUser(ctx *gin.Context) {
+	userID, ok := getUserIDParam(ctx)
+	if !ok {
+		return
+	}
+	err := a.userSvc.Restore(ctx, userID)
+	if !a.adminCheckUserError(ctx, userID, "userSvc.Restore", err) {
+		return
+	}
+	infra.GetLogger(ctx).Infow("user restored by operator", "user_id", userID)
+	ctx.Status(http.StatusOK)
+}
+
+// @Title Force logout user
+// @Description Revokes all tokens and API keys of the user on all devices, for operators.
+// @Tags admin
+// @Resource admin
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param id path string true "User ID"
+// @Success 200 "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /api/admin/v1/users/{id}/logout [post]
+func (a *app) adminLogoutUser(ctx *gin.Context) {
+	userID, ok := getUserIDParam(ctx)
+	if !ok {
+		return
+	}
+	a.adminRevokeUserTokens(ctx, userID)
+}
+
+// getUserIDParam is a shared method for admin endpoint methods, it parses the user ID in path.
+func getUserIDParam(ctx *gin.Context) (uuid.UUID, bool) {
+	userID, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid user ID"})
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// adminCheckUserError is a shared method for admin endpoint methods, it writes the error response of user service.
+func (a *app) adminCheckUserError(ctx *gin.Context, userID uuid.UUID, method string, err error) bool {
+	if errors.Is(err, user.ErrNotFound) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return false
+	} else if err != nil {
+		infra.GetLogger(ctx).Errorw(method+" error", "user_id", userID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func (a *app) adminWriteUser(ctx *gin.Context, userID uuid.UUID) {
+	user1, err := a.userSvc.Get(ctx, userID)
+	if !a.adminCheckUserError(ctx, userID, "userSvc.Get", err) {
+		return
+	}
+	ctx.JSON(http.StatusOK, newResponseAdminUser(user1))
+}
+
+func (a *app) adminRevokeUserTokens(ctx *gin.Context, userID uuid.UUID) {
+	logger := infra.GetLogger(ctx)
+
+	if err := a.authSvc.RevokeUserTokens(ctx, userID); err != nil {
+		logger.Errorw("authSvc.RevokeUserTokens error", "user_id", userID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	logger.Infow("user tokens revoked by operator", "user_id", userID, "path", ctx.FullPath())
+	ctx.Status(http.StatusOK)
+}
@@ -0,0 +1,150 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+	"github.com/andy74139/webserver/src/domain/entity/client"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+type responseAdminClient struct {
+	ID           string    `json:"id" example:"5f0c6c2e-3b8e-4a41-9d53-2f7d3c1b8a90" description:"Client ID"`
+	Name         string    `json:"name" example:"billing" description:"Client name"`
+	Scopes       []string  `json:"scopes" example:"token:introspect" description:"Scopes granted to the client"`
+	RedirectURIs []string  `json:"redirect_uris" example:"https://app.example.com/callback" description:"Allowed redirect URIs of the authorization code flow"`
+	IsPublic     bool      `json:"is_public" example:"false" description:"Is the client without secret, e.g. a single-page app"`
+	IsFirstParty bool      `json:"is_first_party" example:"false" description:"Is the client our own app, users aren't asked to consent to it"`
+	CreatedAt    time.Time `json:"created_at" description:"Registered time"`
+	Secret       string    `json:"secret,omitempty" description:"Client secret, it is returned only when the client is registered"`
+}
+
+func newResponseAdminClient(client1 *client.Client) *responseAdminClient {
+	return &responseAdminClient{
+		ID:           client1.ID,
+		Name:         client1.Name,
+		Scopes:       client1.Scopes,
+		RedirectURIs: client1.RedirectURIs,
+		IsPublic:     client1.IsPublic,
+		IsFirstParty: client1.IsFirstParty,
+		CreatedAt:    client1.CreatedAt,
+	}
+}
+
+type requestAdminCreateClient struct {
+	Name         string   `json:"name" example:"billing" description:"Client name"`
+	Scopes       []string `json:"scopes" example:"token:introspect" description:"Scopes granted to the client"`
+	RedirectURIs []string `json:"redirect_uris,omitempty" example:"https://app.example.com/callback" description:"Allowed redirect URIs of the authorization code flow, they are matched exactly"`
+	IsPublic     bool     `json:"is_public,omitempty" example:"false" description:"Registers a client without secret, e.g. a single-page app, it is verified by PKCE only"`
+	IsFirstParty bool     `json:"is_first_party,omitempty" example:"false" description:"Registers our own app, users aren't asked to consent to it"`
+}
+
+// @Title Register client
+// @Description Registers an OAuth client of other services or web apps, for operators. The client secret is returned only once, public clients have no secret.
+// @Tags admin
+// @Resource admin
+// @Accept json
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param request body requestAdminCreateClient true "Register request"
+// @Success 201 object responseAdminClient "Created"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /api/admin/v1/clients [post]
+func (a *app) adminCreateClient(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	req := &requestAdminCreateClient{}
+	if err := ctx.BindJSON(req); err != nil || req.Name == "" {
+		logger.Debugw("unknown request body", "request", ctx.Request)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !auth.IsValidScope(scope) {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown scope: " + scope})
+			return
+		}
+	}
+
+	client1, secret, err := a.clientSvc.Create(ctx, &client.Registration{
+		Name:         req.Name,
+		Scopes:       req.Scopes,
+		RedirectURIs: req.RedirectURIs,
+		IsPublic:     req.IsPublic,
+		IsFirstParty: req.IsFirstParty,
+	})
+	if errors.Is(err, client.ErrInvalidRedirectURI) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		logger.Errorw("clientSvc.Create error", "request", req, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	logger.Infow("client registered by operator", "client_id", client1.ID, "scopes", client1.Scopes)
+
+	resp := newResponseAdminClient(client1)
+	resp.Secret = secret
+	ctx.JSON(http.StatusCreated, resp)
+}
+
+// @Title List clients
+// @Description Lists OAuth clients of other services, for operators.
+// @Tags admin
+// @Resource admin
+// @Produce json
+// @Header defaultRequestHeaders
+// @Success 200 array []responseAdminClient "OK"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /api/admin/v1/clients [get]
+func (a *app) adminListClients(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	clients, err := a.clientSvc.List(ctx)
+	if err != nil {
+		logger.Errorw("clientSvc.List error", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]*responseAdminClient, 0, len(clients))
+	for _, client1 := range clients {
+		resp = append(resp, newResponseAdminClient(client1))
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// @Title Delete client
+// @Description Deletes the OAuth client, its credentials can't be used afterward, for operators.
+// @Tags admin
+// @Resource admin
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param id path string true "Client ID"
+// @Success 200 "OK"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 500 "Internal Server Error"
+// @Router /api/admin/v1/clients/{id} [delete]
+func (a *app) adminDeleteClient(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	clientID := ctx.Param("id")
+	if err := a.clientSvc.Delete(ctx, clientID); errors.Is(err, client.ErrNotFound) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "client not found"})
+		return
+	} else if err != nil {
+		logger.Errorw("clientSvc.Delete error", "client_id", clientID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	logger.Infow("client deleted by operator", "client_id", clientID)
+	ctx.Status(http.StatusOK)
+}
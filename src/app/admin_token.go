@@ -0,0 +1,111 @@
+package app
+
+import (
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/audit"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+type responseTokenCutoff struct {
+	ValidAfter *time.Time `json:"valid_after,omitempty" description:"Tokens issued before it are revoked, it is absent if tokens are never revoked globally"`
+}
+
+// @Title Get token cutoff
+// @Description Gets the global cutoff of tokens, tokens and refresh tokens of all users and clients issued before it are revoked, for operators.
+// @Tags admin
+// @Resource admin
+// @Produce json
+// @Header defaultRequestHeaders
+// @Success 200 object responseTokenCutoff "OK"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /api/admin/v1/tokens/cutoff [get]
+func (a *app) adminGetTokenCutoff(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	validAfter, err := a.authSvc.GetGlobalTokensValidAfter(ctx)
+	if err != nil {
+		logger.Errorw("authSvc.GetGlobalTokensValidAfter error", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.JSON(http.StatusOK, newResponseTokenCutoff(validAfter))
+}
+
+type requestAdminRevokeAllTokens struct {
+	Reason string `json:"reason" example:"signing key leaked" description:"Reason of revoking all tokens, it is written to the audit log"`
+}
+
+// @Title Revoke all tokens
+// @Description Sets the global cutoff of tokens to now, for emergencies, e.g. leaked signing keys. Tokens, refresh tokens and API keys of all users and clients, including the operator, are revoked, and everyone logs in again. All instances see it at once. The cutoff is rounded up to the next second, tokens issued until then are revoked as well, and new tokens are issued at the cutoff.
+// @Tags admin
+// @Resource admin
+// @Accept json
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param request body requestAdminRevokeAllTokens true "Revoke request"
+// @Success 200 object responseTokenCutoff "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /api/admin/v1/tokens/cutoff [post]
+func (a *app) adminRevokeAllTokens(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	actorID, _, _, ok := a.verifyAuthOrAPIKey(ctx)
+	if !ok {
+		return
+	}
+	req := &requestAdminRevokeAllTokens{}
+	if err := ctx.BindJSON(req); err != nil || req.Reason == "" || len(req.Reason) > maxAuditReasonLength {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+
+	validAfter, err := a.authSvc.RevokeAllTokens(ctx)
+	if err != nil {
+		logger.Errorw("authSvc.RevokeAllTokens error", "error", err, "actor_id", actorID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	logger.Warnw("all tokens revoked by operator", "valid_after", validAfter, "actor_id", actorID, "reason", req.Reason)
+
+	// the cutoff is kept even if auditing fails, it is for emergencies
+	if err := a.auditSvc.Record(ctx, &audit.Event{
+		Action:  audit.ActionTokensRevokeAll,
+		ActorID: actorID,
+		UserID:  uuid.Nil,
+		Detail:  req.Reason,
+		IP:      ctx.ClientIP(),
+	}); err != nil {
+		logger.Errorw("auditSvc.Record error", "error", err, "actor_id", actorID)
+	}
+	ctx.JSON(http.StatusOK, newResponseTokenCutoff(validAfter))
+}
+
+func newResponseTokenCutoff(validAfter time.Time) *responseTokenCutoff {
+	if validAfter.IsZero() {
+		return &responseTokenCutoff{}
+	}
+	return &responseTokenCutoff{ValidAfter: &validAfter}
+}
+
+// @Title Get metrics
+// @Description Gets metrics of the instance in expvar format, e.g. auth_global_tokens_valid_after, the global cutoff of tokens seen by the instance in unix seconds, and auth_global_tokens_revoked, the number of tokens rejected by it, for operators.
+// @Tags admin
+// @Resource admin
+// @Produce json
+// @Header defaultRequestHeaders
+// @Success 200 "OK"
+// @Failure 403 "Forbidden"
+// @Router /api/admin/v1/metrics [get]
+func (a *app) adminGetMetrics(ctx *gin.Context) {
+	expvar.Handler().ServeHTTP(ctx.Writer, ctx.Request)
+}
@@ -0,0 +1,289 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/apikey"
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// verifyAuthOrAPIKey is a shared method for middlewares, it verifies the API key if it is given, or the authorization token.
+// Endpoint methods behind the middlewares read the result by verifyAuth.
+func (a *app) verifyAuthOrAPIKey(ctx *gin.Context) (uuid.UUID, *auth.Claims, bool, bool) {
+	logger := infra.GetLogger(ctx)
+
+	keyString := ctx.GetHeader(apiKeyHeader)
+	if keyString == "" {
+		return a.verifyAuth(ctx)
+	}
+
+	result, err := a.verifyAPIKeyCached(ctx, keyString)
+	if err != nil {
+		logger.Errorw("verifyAPIKeyCached error", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return uuid.Nil, nil, false, false
+	} else if result == nil {
+		logger.Debugw("invalid api key")
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return uuid.Nil, nil, false, false
+	}
+	ctx.Set(verifiedAuthKey, result)
+	return result.userID, result.claims, result.isSuggestRefresh, true
+}
+
+// verifyAPIKeyCached verifies the API key with cache, it returns nil without error if the key isn't valid.
+// The API key is represented as claims, so that endpoint methods handle it as an authorization token.
+func (a *app) verifyAPIKeyCached(ctx *gin.Context, keyString string) (*verifiedAuth, error) {
+	cacheKey := getTokenCacheKey("apikey", keyString)
+	if result, ok := a.tokenCache.Get(cacheKey); ok {
+		return result, nil
+	}
+
+	key, err := a.apiKeySvc.Verify(ctx, keyString)
+	if errors.Is(err, apikey.ErrInvalidKey) {
+		a.tokenCache.Set(cacheKey, nil, time.Now().Add(tokenCacheDuration))
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("apiKeySvc.Verify error: %w", err)
+	}
+	if isValid, err := a.userSvc.CheckValidLoginUser(ctx, key.UserID); err != nil {
+		return nil, fmt.Errorf("userSvc.CheckValidLoginUser error: %w", err)
+	} else if !isValid {
+		a.tokenCache.Set(cacheKey, nil, time.Now().Add(tokenCacheDuration))
+		return nil, nil
+	}
+	// logging out everywhere and the global cutoff revoke keys created before them
+	if err := a.authSvc.VerifyIssuedAt(ctx, key.UserID, key.CreatedAt); errors.Is(err, auth.ErrRevokedToken) {
+		a.tokenCache.Set(cacheKey, nil, time.Now().Add(tokenCacheDuration))
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("authSvc.VerifyIssuedAt error: %w", err)
+	}
+
+	claims := &auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject: key.UserID.String(),
+			ID:      key.ID.String(),
+		},
+		Roles: key.Roles,
+		Scope: strings.Join(key.Scopes, " "),
+	}
+	expiresAt := time.Now().Add(tokenCacheDuration)
+	if !key.ExpiresAt.IsZero() {
+		claims.ExpiresAt = jwt.NewNumericDate(key.ExpiresAt)
+		if key.ExpiresAt.Before(expiresAt) {
+			expiresAt = key.ExpiresAt
+		}
+	}
+	result := &verifiedAuth{userID: key.UserID, claims: claims}
+	a.tokenCache.Set(cacheKey, result, expiresAt)
+	return result, nil
+}
+
+type responseAPIKey struct {
+	ID         string     `json:"id" example:"9c750e98-c456-4ac0-865c-d3d9d68016b5" description:"API key ID"`
+	Name       string     `json:"name" example:"nightly-report" description:"API key name"`
+	Prefix     string     `json:"prefix" example:"k3v9x2ab" description:"Prefix of the key, to identify the key, i.e. wsk_<prefix>_<secret>"`
+	Scopes     []string   `json:"scopes" example:"account:read" description:"Scopes of the key, limited by roles of the user"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" description:"Expiration time, empty if it never expires"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" description:"Last used time, empty if never used"`
+	CreatedAt  time.Time  `json:"created_at" description:"Created time"`
+	Key        string     `json:"key,omitempty" example:"wsk_k3v9x2ab_q3Vb0xk2HqL9tC5aP8R1nWmZ4yE7uJdS6fGhT0iKoNc" description:"The key, it is returned only when the key is created"`
+}
+
+func newResponseAPIKey(key *apikey.APIKey) *responseAPIKey {
+	resp := &responseAPIKey{
+		ID:        key.ID.String(),
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt,
+	}
+	if !key.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &key.ExpiresAt
+	}
+	if !key.LastUsedAt.IsZero() {
+		resp.LastUsedAt = &key.LastUsedAt
+	}
+	return resp
+}
+
+// @Title List API keys
+// @Description Lists API keys of the account.
+// @Tags apikey
+// @Resource apikey
+// @Produce json
+// @Header defaultRequestHeaders
+// @Success 200 array []responseAPIKey "OK"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/apikeys [get]
+func (a *app) listAPIKeys(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	keys, err := a.apiKeySvc.List(ctx, userID)
+	if err != nil {
+		logger.Errorw("apiKeySvc.List error", "user_id", userID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]*responseAPIKey, 0, len(keys))
+	for _, key := range keys {
+		resp = append(resp, newResponseAPIKey(key))
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+type requestCreateAPIKey struct {
+	Name      string   `json:"name" example:"nightly-report" description:"API key name"`
+	Scopes    []string `json:"scopes" example:"account:read" description:"Scopes of the key, they must be granted to the caller"`
+	ExpiresIn int64    `json:"expires_in,omitempty" example:"7776000" description:"Seconds until the key expires, it never expires if empty"`
+}
+
+// @Title Create API key
+// @Description Creates an API key of the account, for backend jobs and partner services. It is sent in the X-API-Key header, and is returned only once. API keys and tokens of OAuth clients can't create API keys.
+// @Tags apikey
+// @Resource apikey
+// @Accept json
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param request body requestCreateAPIKey true "Create request"
+// @Success 201 object responseAPIKey "Created"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/apikeys [post]
+func (a *app) createAPIKey(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, claims, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	req := &requestCreateAPIKey{}
+	if err := ctx.BindJSON(req); err != nil || req.Name == "" || len(req.Scopes) == 0 || req.ExpiresIn < 0 {
+		logger.Debugw("unknown request body", "request", ctx.Request)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !auth.IsValidScope(scope) {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown scope: " + scope})
+			return
+		} else if !claims.HasScope(scope) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "insufficient scope: " + scope})
+			return
+		}
+	}
+	var expiresAt time.Time
+	if req.ExpiresIn > 0 {
+		expiresAt = time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
+	}
+
+	key, keyString, err := a.apiKeySvc.Create(ctx, userID, req.Name, req.Scopes, expiresAt)
+	if err != nil {
+		logger.Errorw("apiKeySvc.Create error", "user_id", userID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	resp := newResponseAPIKey(key)
+	resp.Key = keyString
+	ctx.JSON(http.StatusCreated, resp)
+}
+
+// @Title Rotate API key
+// @Description Creates a new API key of the same name and scopes, the old key is still valid for 24 hours. The new key is returned only once.
+// @Tags apikey
+// @Resource apikey
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param id path string true "API key ID"
+// @Success 201 object responseAPIKey "Created"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/apikeys/{id}/rotate [post]
+func (a *app) rotateAPIKey(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+	keyID, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid api key ID"})
+		return
+	}
+
+	key, keyString, err := a.apiKeySvc.Rotate(ctx, userID, keyID)
+	if errors.Is(err, apikey.ErrNotFound) || errors.Is(err, apikey.ErrInvalidKey) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+		return
+	} else if err != nil {
+		logger.Errorw("apiKeySvc.Rotate error", "user_id", userID, "api_key_id", keyID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	resp := newResponseAPIKey(key)
+	resp.Key = keyString
+	ctx.JSON(http.StatusCreated, resp)
+}
+
+// @Title Delete API key
+// @Description Deletes the API key, it is rejected within 10 seconds.
+// @Tags apikey
+// @Resource apikey
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param id path string true "API key ID"
+// @Success 200 "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/apikeys/{id} [delete]
+func (a *app) deleteAPIKey(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+	keyID, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid api key ID"})
+		return
+	}
+
+	if err := a.apiKeySvc.Delete(ctx, userID, keyID); errors.Is(err, apikey.ErrNotFound) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+		return
+	} else if err != nil {
+		logger.Errorw("apiKeySvc.Delete error", "user_id", userID, "api_key_id", keyID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
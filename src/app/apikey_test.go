@@ -0,0 +1,67 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+func (s *AppSuite) TestCreateAPIKeyDeniesClients() {
+	ctx := context.TODO()
+	userID := uuid.New()
+	body := &requestCreateAPIKey{Name: "nightly-report", Scopes: []string{auth.ScopeAccountRead}}
+
+	// tokens of the authorization code flow carry the client
+	clientToken, err := s.app.authSvc.CreateToken(ctx, userID, &auth.SessionInfo{
+		Platform: platformOAuth,
+		ClientID: "5f0c6c2e-3b8e-4a41-9d53-2f7d3c1b8a90",
+		Scopes:   []string{auth.ScopeAccountRead, auth.ScopeAccountWrite},
+	})
+	s.Require().NoError(err)
+	resp := s.request(http.MethodPost, "/api/v1/account/apikeys/", clientToken.AccessToken, body)
+	s.Equal(http.StatusForbidden, resp.Code, resp.Body.String())
+	resp = s.request(http.MethodDelete, "/api/v1/account/", clientToken.AccessToken, nil)
+	s.Equal(http.StatusForbidden, resp.Code, resp.Body.String())
+
+	// API keys can't mint API keys either
+	_, keyString, err := s.app.apiKeySvc.Create(ctx, userID, "job", []string{auth.ScopeAccountRead, auth.ScopeAccountWrite}, time.Time{})
+	s.Require().NoError(err)
+	resp = s.requestWithHeader(http.MethodPost, "/api/v1/account/apikeys/", "", body, http.Header{apiKeyHeader: {keyString}})
+	s.Equal(http.StatusForbidden, resp.Code, resp.Body.String())
+
+	// logins of the user can
+	token, err := s.app.authSvc.CreateToken(ctx, userID, &auth.SessionInfo{Platform: "android", DeviceID: "123456"})
+	s.Require().NoError(err)
+	resp = s.request(http.MethodPost, "/api/v1/account/apikeys/", token.AccessToken, body)
+	s.Equal(http.StatusCreated, resp.Code, resp.Body.String())
+}
+
+func (s *AppSuite) TestAPIKeyRevokedByLogoutEverywhere() {
+	ctx := context.TODO()
+	userID := uuid.New()
+	_, keyString, err := s.app.apiKeySvc.Create(ctx, userID, "job", []string{auth.ScopeAccountRead}, time.Time{})
+	s.Require().NoError(err)
+	header := http.Header{apiKeyHeader: {keyString}}
+	resp := s.requestWithHeader(http.MethodGet, "/api/v1/account/identities", "", nil, header)
+	s.Require().Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+	// keys created before logging out everywhere are revoked, after the verification cache expires
+	s.Require().NoError(s.app.authSvc.RevokeUserTokens(ctx, userID))
+	s.app.tokenCache = infra.NewTTLCache[string, *verifiedAuth](tokenCacheSize)
+	resp = s.requestWithHeader(http.MethodGet, "/api/v1/account/identities", "", nil, header)
+	s.Equal(http.StatusForbidden, resp.Code, resp.Body.String())
+
+	// so are keys of other users by the global cutoff
+	otherID := uuid.New()
+	_, otherKeyString, err := s.app.apiKeySvc.Create(ctx, otherID, "job", []string{auth.ScopeAccountRead}, time.Time{})
+	s.Require().NoError(err)
+	_, err = s.app.authSvc.RevokeAllTokens(ctx)
+	s.Require().NoError(err)
+	resp = s.requestWithHeader(http.MethodGet, "/api/v1/account/identities", "", nil, http.Header{apiKeyHeader: {otherKeyString}})
+	s.Equal(http.StatusForbidden, resp.Code, resp.Body.String())
+}
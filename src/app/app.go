@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
@@ -18,12 +19,47 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/andy74139/webserver/src/config"
+	"github.com/andy74139/webserver/src/domain/entity/apikey"
+	"github.com/andy74139/webserver/src/domain/entity/audit"
 	"github.com/andy74139/webserver/src/domain/entity/auth"
+	"github.com/andy74139/webserver/src/domain/entity/client"
+	"github.com/andy74139/webserver/src/domain/entity/mail"
+	"github.com/andy74139/webserver/src/domain/entity/mfa"
+	"github.com/andy74139/webserver/src/domain/entity/oauth"
+	"github.com/andy74139/webserver/src/domain/entity/otp"
+	"github.com/andy74139/webserver/src/domain/entity/password"
+	"github.com/andy74139/webserver/src/domain/entity/ratelimit"
+	"github.com/andy74139/webserver/src/domain/entity/sso"
+	"github.com/andy74139/webserver/src/domain/entity/transfer"
 	"github.com/andy74139/webserver/src/domain/entity/user"
+	"github.com/andy74139/webserver/src/domain/entity/webauthn"
+	"github.com/andy74139/webserver/src/domain/repository/apikey"
+	"github.com/andy74139/webserver/src/domain/repository/audit"
 	"github.com/andy74139/webserver/src/domain/repository/auth"
+	"github.com/andy74139/webserver/src/domain/repository/client"
+	"github.com/andy74139/webserver/src/domain/repository/mfa"
+	"github.com/andy74139/webserver/src/domain/repository/oauth"
+	"github.com/andy74139/webserver/src/domain/repository/otp"
+	"github.com/andy74139/webserver/src/domain/repository/password"
+	"github.com/andy74139/webserver/src/domain/repository/ratelimit"
+	"github.com/andy74139/webserver/src/domain/repository/sso"
+	"github.com/andy74139/webserver/src/domain/repository/transfer"
 	"github.com/andy74139/webserver/src/domain/repository/user"
+	"github.com/andy74139/webserver/src/domain/repository/webauthn"
+	"github.com/andy74139/webserver/src/domain/service/apikey"
+	"github.com/andy74139/webserver/src/domain/service/audit"
 	"github.com/andy74139/webserver/src/domain/service/auth"
+	"github.com/andy74139/webserver/src/domain/service/client"
+	"github.com/andy74139/webserver/src/domain/service/mail"
+	"github.com/andy74139/webserver/src/domain/service/mfa"
+	"github.com/andy74139/webserver/src/domain/service/oauth"
+	"github.com/andy74139/webserver/src/domain/service/otp"
+	"github.com/andy74139/webserver/src/domain/service/password"
+	"github.com/andy74139/webserver/src/domain/service/ratelimit"
+	"github.com/andy74139/webserver/src/domain/service/sso"
+	"github.com/andy74139/webserver/src/domain/service/transfer"
 	"github.com/andy74139/webserver/src/domain/service/user"
+	"github.com/andy74139/webserver/src/domain/service/webauthn"
 	"github.com/andy74139/webserver/src/infra"
 )
 
@@ -42,11 +78,42 @@ type App interface {
 	Stop(context.Context) error
 }
 
+const revocationGCInterval = time.Hour
+
+// revocationWarmUpInterval keeps the revocation cache warm, the warm state expires in 15 minutes.
+const revocationWarmUpInterval = time.Minute * 10
+
+// rate limit rules of login and registration endpoints, rules of the same name share counts among endpoints
+var (
+	registerRateLimit        = ratelimit.Rule{Name: "register", Key: ratelimit.KeyIP, Limit: 10, Window: time.Hour}
+	loginIPRateLimit         = ratelimit.Rule{Name: "login", Key: ratelimit.KeyIP, Limit: 30, Window: time.Minute}
+	loginDeviceRateLimit     = ratelimit.Rule{Name: "login", Key: ratelimit.KeyDevice, Limit: 10, Window: time.Minute}
+	loginAccountRateLimit    = ratelimit.Rule{Name: "login", Key: ratelimit.KeyAccount, Limit: 10, Window: time.Minute}
+	sendCodeIPRateLimit      = ratelimit.Rule{Name: "send_code", Key: ratelimit.KeyIP, Limit: 10, Window: 10 * time.Minute}
+	sendCodeAccountRateLimit = ratelimit.Rule{Name: "send_code", Key: ratelimit.KeyAccount, Limit: 5, Window: time.Hour}
+	challengeRateLimit       = ratelimit.Rule{Name: "challenge", Key: ratelimit.KeyIP, Limit: 30, Window: time.Minute}
+)
+
 type app struct {
-	server *http.Server
+	server   *http.Server
+	stopJobs context.CancelFunc
+
+	userSvc     user.Service
+	authSvc     auth.Service
+	ssoSvc      sso.Service
+	clientSvc   client.Service
+	apiKeySvc   apikey.Service
+	passwordSvc password.Service
+	otpSvc      otp.Service
+	mfaSvc      mfa.Service
+	webAuthnSvc webauthn.Service
+	transferSvc transfer.Service
+	oauthSvc    oauth.Service
+	auditSvc    audit.Service
 
-	userSvc user.Service
-	authSvc auth.Service
+	rateLimitSvc ratelimit.Service
+
+	tokenCache *infra.TTLCache[string, *verifiedAuth]
 }
 
 func New() App {
@@ -68,7 +135,12 @@ func (a *app) Start(ctx context.Context) error {
 	infra.SetDefaultLogger(logger)
 	ctx = infra.SetLogger(ctx, logger)
 
-	a.setDomainServices()
+	a.setDomainServices(ctx)
+	if validAfter, err := a.authSvc.GetGlobalTokensValidAfter(ctx); err != nil {
+		logger.Errorw("authSvc.GetGlobalTokensValidAfter error", "error", err)
+	} else if !validAfter.IsZero() {
+		logger.Warnw("tokens issued before the global cutoff are revoked", "valid_after", validAfter)
+	}
 
 	// HTTP server
 	router := a.getRouter(ctx)
@@ -91,6 +163,7 @@ func (a *app) Stop(ctx context.Context) error {
 	if a.server == nil {
 		return errors.New("app not started")
 	}
+	a.stopJobs()
 
 	return a.server.Shutdown(ctx)
 }
@@ -109,22 +182,106 @@ func (a *app) getRouter(ctx context.Context) *gin.Engine {
 	accountRouter := router.Group("/api/v1/account")
 	accountRouter.POST("/",
 		infra.SetGinLogger("account_create"),
+		a.RateLimit(registerRateLimit),
 		a.registerByDevice,
 	)
 	accountRouter.GET("/",
 		infra.SetGinLogger("account_get_info"),
+		a.RequireScopes(auth.ScopeAccountRead),
 		a.getUserInfo,
 	)
 	accountRouter.PUT("/",
 		infra.SetGinLogger("account_update_info"),
+		a.RequireScopes(auth.ScopeAccountWrite),
 		a.updateUserInfo,
 	)
+	accountRouter.POST("/email",
+		infra.SetGinLogger("account_create_by_email"),
+		a.RateLimit(registerRateLimit),
+		a.registerByEmail,
+	)
+	accountRouter.POST("/email/verification",
+		infra.SetGinLogger("account_email_verification_create"),
+		a.RateLimit(sendCodeIPRateLimit),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.sendEmailVerification,
+	)
+	accountRouter.PUT("/email/verification",
+		infra.SetGinLogger("account_email_verification_update"),
+		a.RateLimit(loginIPRateLimit),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.verifyEmail,
+	)
+	accountRouter.PUT("/password",
+		infra.SetGinLogger("account_update_password"),
+		a.RateLimit(loginIPRateLimit),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.changePassword,
+	)
 	accountRouter.PUT("/sso",
 		infra.SetGinLogger("account_update_sso"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
 		a.addSSO,
 	)
+	accountRouter.GET("/identities",
+		infra.SetGinLogger("account_identity_list"),
+		a.RequireScopes(auth.ScopeAccountRead),
+		a.listIdentities,
+	)
+	accountRouter.POST("/identities/devices",
+		infra.SetGinLogger("account_identity_link_device"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.linkDevice,
+	)
+	accountRouter.DELETE("/identities/:id",
+		infra.SetGinLogger("account_identity_unlink"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.unlinkIdentity,
+	)
+	accountRouter.POST("/merge",
+		infra.SetGinLogger("account_merge"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.mergeAccount,
+	)
+	accountRouter.POST("/transfer",
+		infra.SetGinLogger("account_transfer_create"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.createTransferCode,
+	)
+	accountRouter.POST("/transfer/redeem",
+		infra.SetGinLogger("account_transfer_redeem"),
+		a.RateLimit(loginIPRateLimit, loginDeviceRateLimit),
+		a.redeemTransferCode,
+	)
+	accountRouter.GET("/consents",
+		infra.SetGinLogger("account_consent_list"),
+		a.RequireScopes(auth.ScopeAccountRead),
+		a.listConsents,
+	)
+	accountRouter.DELETE("/consents/:client_id",
+		infra.SetGinLogger("account_consent_delete"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.revokeConsent,
+	)
 	accountRouter.DELETE("/",
 		infra.SetGinLogger("account_delete"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
 		a.deleteAccount,
 	)
 
@@ -132,12 +289,110 @@ func (a *app) getRouter(ctx context.Context) *gin.Engine {
 	authRouter := router.Group("/api/v1/account/auth")
 	authRouter.POST("/",
 		infra.SetGinLogger("account_auth_create_by_device"),
+		a.RateLimit(loginIPRateLimit, loginDeviceRateLimit),
 		a.loginByDevice,
 	)
 	authRouter.POST("/sso",
 		infra.SetGinLogger("account_auth_create_by_sso"),
+		a.RateLimit(loginIPRateLimit),
 		a.loginBySSO,
 	)
+	authRouter.POST("/sso/nonce",
+		infra.SetGinLogger("account_auth_create_sso_nonce"),
+		a.RateLimit(loginIPRateLimit),
+		a.createSSONonce,
+	)
+	authRouter.POST("/email",
+		infra.SetGinLogger("account_auth_create_by_email"),
+		a.RateLimit(loginIPRateLimit, loginAccountRateLimit),
+		a.loginByEmail,
+	)
+	authRouter.POST("/otp",
+		infra.SetGinLogger("account_auth_otp_create"),
+		a.RateLimit(sendCodeIPRateLimit, sendCodeAccountRateLimit),
+		a.sendLoginOTP,
+	)
+	authRouter.POST("/otp/verify",
+		infra.SetGinLogger("account_auth_create_by_otp"),
+		a.RateLimit(loginIPRateLimit, loginAccountRateLimit),
+		a.loginByOTP,
+	)
+	authRouter.GET("/mfa",
+		infra.SetGinLogger("account_auth_mfa_get"),
+		a.RequireScopes(auth.ScopeAccountRead),
+		a.getMFAStatus,
+	)
+	authRouter.DELETE("/mfa",
+		infra.SetGinLogger("account_auth_mfa_delete"),
+		a.RateLimit(loginIPRateLimit),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.disableMFA,
+	)
+	authRouter.POST("/mfa/totp",
+		infra.SetGinLogger("account_auth_mfa_totp_create"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.enrollTOTP,
+	)
+	authRouter.PUT("/mfa/totp",
+		infra.SetGinLogger("account_auth_mfa_totp_update"),
+		a.RateLimit(loginIPRateLimit),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.confirmTOTP,
+	)
+	authRouter.POST("/mfa/recovery-codes",
+		infra.SetGinLogger("account_auth_mfa_recovery_codes_create"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.regenerateRecoveryCodes,
+	)
+	authRouter.POST("/mfa/verify",
+		infra.SetGinLogger("account_auth_create_by_mfa"),
+		a.RateLimit(loginIPRateLimit),
+		a.verifyMFALogin,
+	)
+	authRouter.GET("/passkeys",
+		infra.SetGinLogger("account_auth_passkey_list"),
+		a.RequireScopes(auth.ScopeAccountRead),
+		a.listPasskeys,
+	)
+	authRouter.DELETE("/passkeys/:id",
+		infra.SetGinLogger("account_auth_passkey_delete"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.deletePasskey,
+	)
+	authRouter.POST("/passkeys/registration/begin",
+		infra.SetGinLogger("account_auth_passkey_registration_create"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.beginPasskeyRegistration,
+	)
+	authRouter.POST("/passkeys/registration/finish",
+		infra.SetGinLogger("account_auth_passkey_create"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.finishPasskeyRegistration,
+	)
+	authRouter.POST("/passkeys/login/begin",
+		infra.SetGinLogger("account_auth_passkey_login_create"),
+		a.RateLimit(challengeRateLimit),
+		a.beginPasskeyLogin,
+	)
+	authRouter.POST("/passkeys/login/finish",
+		infra.SetGinLogger("account_auth_create_by_passkey"),
+		a.RateLimit(loginIPRateLimit),
+		a.loginByPasskey,
+	)
 	authRouter.PUT("/",
 		infra.SetGinLogger("account_auth_update_refresh_token"),
 		a.refreshAuthToken,
@@ -146,11 +401,211 @@ func (a *app) getRouter(ctx context.Context) *gin.Engine {
 		infra.SetGinLogger("account_auth_delete"),
 		a.logout,
 	)
+	authRouter.DELETE("/all",
+		infra.SetGinLogger("account_auth_delete_all"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.logoutAll,
+	)
+	authRouter.GET("/sessions",
+		infra.SetGinLogger("account_auth_session_list"),
+		a.RequireScopes(auth.ScopeAccountRead),
+		a.listSessions,
+	)
+	authRouter.DELETE("/sessions/:id",
+		infra.SetGinLogger("account_auth_session_delete"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.revokeSession,
+	)
+
+	// account API keys, for backend jobs and partner services
+	apiKeyRouter := router.Group("/api/v1/account/apikeys")
+	apiKeyRouter.GET("/",
+		infra.SetGinLogger("account_apikey_list"),
+		a.RequireScopes(auth.ScopeAccountRead),
+		a.listAPIKeys,
+	)
+	apiKeyRouter.POST("/",
+		infra.SetGinLogger("account_apikey_create"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.createAPIKey,
+	)
+	apiKeyRouter.POST("/:id/rotate",
+		infra.SetGinLogger("account_apikey_rotate"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.rotateAPIKey,
+	)
+	apiKeyRouter.DELETE("/:id",
+		infra.SetGinLogger("account_apikey_delete"),
+		a.RequireScopes(auth.ScopeAccountWrite),
+		a.DenyClientTokens(),
+		a.DenyImpersonation(),
+		a.deleteAPIKey,
+	)
+
+	// admin, user management for operators
+	adminUserRouter := router.Group("/api/admin/v1/users")
+	adminUserRouter.GET("/",
+		infra.SetGinLogger("admin_user_list"),
+		a.RequireRole(auth.RoleAdmin, auth.RoleSupport),
+		a.RequireScopes(auth.ScopeAdminRead),
+		a.adminListUsers,
+	)
+	adminUserRouter.GET("/lookup",
+		infra.SetGinLogger("admin_user_lookup"),
+		a.RequireRole(auth.RoleAdmin, auth.RoleSupport),
+		a.RequireScopes(auth.ScopeAdminRead),
+		a.adminLookupUser,
+	)
+	adminUserRouter.GET("/:id",
+		infra.SetGinLogger("admin_user_get"),
+		a.RequireRole(auth.RoleAdmin, auth.RoleSupport),
+		a.RequireScopes(auth.ScopeAdminRead),
+		a.adminGetUser,
+	)
+	adminUserRouter.PUT("/:id",
+		infra.SetGinLogger("admin_user_update"),
+		a.RequireRole(auth.RoleAdmin),
+		a.RequireScopes(auth.ScopeAdminWrite),
+		a.adminUpdateUser,
+	)
+	adminUserRouter.DELETE("/:id",
+		infra.SetGinLogger("admin_user_delete"),
+		a.RequireRole(auth.RoleAdmin),
+		a.RequireScopes(auth.ScopeAdminWrite),
+		a.adminDeleteUser,
+	)
+	adminUserRouter.POST("/:id/suspend",
+		infra.SetGinLogger("admin_user_suspend"),
+		a.RequireRole(auth.RoleAdmin),
+		a.RequireScopes(auth.ScopeAdminWrite),
+		a.adminSuspendUser,
+	)
+	adminUserRouter.POST("/:id/unsuspend",
+		infra.SetGinLogger("admin_user_unsuspend"),
+		a.RequireRole(auth.RoleAdmin),
+		a.RequireScopes(auth.ScopeAdminWrite),
+		a.adminUnsuspendUser,
+	)
+	adminUserRouter.POST("/:id/restore",
+		infra.SetGinLogger("admin_user_restore"),
+		a.RequireRole(auth.RoleAdmin),
+		a.RequireScopes(auth.ScopeAdminWrite),
+		a.adminRestoreUser,
+	)
+	adminUserRouter.POST("/:id/logout",
+		infra.SetGinLogger("admin_user_logout"),
+		a.RequireRole(auth.RoleAdmin),
+		a.RequireScopes(auth.ScopeAdminWrite),
+		a.adminLogoutUser,
+	)
+	adminUserRouter.POST("/:id/impersonate",
+		infra.SetGinLogger("admin_user_impersonate"),
+		a.RequireRole(auth.RoleAdmin, auth.RoleSupport),
+		a.RequireScopes(auth.ScopeAdminRead),
+		a.DenyClientTokens(),
+		a.adminImpersonateUser,
+	)
+	adminUserRouter.GET("/:id/audit-logs",
+		infra.SetGinLogger("admin_user_audit_log_list"),
+		a.RequireRole(auth.RoleAdmin, auth.RoleSupport),
+		a.RequireScopes(auth.ScopeAdminRead),
+		a.adminListAuditLogs,
+	)
+
+	// admin, oauth clients for operators
+	adminClientRouter := router.Group("/api/admin/v1/clients")
+	adminClientRouter.POST("/",
+		infra.SetGinLogger("admin_client_create"),
+		a.RequireRole(auth.RoleAdmin),
+		a.RequireScopes(auth.ScopeAdminWrite),
+		a.adminCreateClient,
+	)
+	adminClientRouter.GET("/",
+		infra.SetGinLogger("admin_client_list"),
+		a.RequireRole(auth.RoleAdmin, auth.RoleSupport),
+		a.RequireScopes(auth.ScopeAdminRead),
+		a.adminListClients,
+	)
+	adminClientRouter.DELETE("/:id",
+		infra.SetGinLogger("admin_client_delete"),
+		a.RequireRole(auth.RoleAdmin),
+		a.RequireScopes(auth.ScopeAdminWrite),
+		a.adminDeleteClient,
+	)
+
+	// admin, global token cutoff and metrics for operators
+	adminRouter := router.Group("/api/admin/v1")
+	adminRouter.GET("/tokens/cutoff",
+		infra.SetGinLogger("admin_token_cutoff_get"),
+		a.RequireRole(auth.RoleAdmin, auth.RoleSupport),
+		a.RequireScopes(auth.ScopeAdminRead),
+		a.adminGetTokenCutoff,
+	)
+	adminRouter.POST("/tokens/cutoff",
+		infra.SetGinLogger("admin_token_cutoff_update"),
+		a.RequireRole(auth.RoleAdmin),
+		a.RequireScopes(auth.ScopeAdminWrite),
+		a.adminRevokeAllTokens,
+	)
+	adminRouter.GET("/metrics",
+		infra.SetGinLogger("admin_metrics_get"),
+		a.RequireRole(auth.RoleAdmin, auth.RoleSupport),
+		a.RequireScopes(auth.ScopeAdminRead),
+		a.adminGetMetrics,
+	)
+
+	// oauth, for other services
+	oauthRouter := router.Group("/oauth")
+	oauthRouter.POST("/introspect",
+		infra.SetGinLogger("oauth_introspect"),
+		a.introspectToken,
+	)
+	oauthRouter.GET("/authorize",
+		infra.SetGinLogger("oauth_authorize_get"),
+		a.getAuthorize,
+	)
+	oauthRouter.POST("/authorize",
+		infra.SetGinLogger("oauth_authorize"),
+		a.authorize,
+	)
+	oauthRouter.POST("/token",
+		infra.SetGinLogger("oauth_token"),
+		a.RateLimit(loginIPRateLimit),
+		a.createOAuthToken,
+	)
+
+	// service, for other services by tokens of the client credentials grant
+	serviceRouter := router.Group("/api/service/v1")
+	serviceRouter.GET("/users/:id",
+		infra.SetGinLogger("service_user_get"),
+		a.RequireClientScopes(auth.ScopeUsersRead),
+		a.serviceGetUser,
+	)
+
+	// forward auth, for reverse proxies
+	router.GET("/api/v1/auth/verify",
+		infra.SetGinLogger("auth_verify"),
+		a.verifyForwardAuth,
+	)
+
+	// public keys to verify authorization tokens
+	router.GET("/.well-known/jwks.json",
+		infra.SetGinLogger("jwks_get"),
+		a.getJWKS,
+	)
 
 	return router
 }
 
-func (a *app) setDomainServices() {
+func (a *app) setDomainServices(ctx context.Context) {
 	// db and cache connections
 	dsn := config.GetContainerDSN()
 	sqldb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(dsn)))
@@ -170,9 +625,53 @@ func (a *app) setDomainServices() {
 	if err != nil {
 		panic(fmt.Errorf("user_repo.NewPostgresRepo error: %w", err))
 	}
-	authRepo, err := auth_repo.NewRedisRepo(rdb)
+	authRepo, err := auth_repo.NewCompositeRepo(rdb, db)
+	if err != nil {
+		panic(fmt.Errorf("auth_repo.NewCompositeRepo error: %w", err))
+	}
+	clientRepo, err := client_repo.NewPostgresRepo(db)
+	if err != nil {
+		panic(fmt.Errorf("client_repo.NewPostgresRepo error: %w", err))
+	}
+	apiKeyRepo, err := apikey_repo.NewPostgresRepo(db)
+	if err != nil {
+		panic(fmt.Errorf("apikey_repo.NewPostgresRepo error: %w", err))
+	}
+	passwordRepo, err := password_repo.NewPostgresRepo(db)
+	if err != nil {
+		panic(fmt.Errorf("password_repo.NewPostgresRepo error: %w", err))
+	}
+	mfaRepo, err := mfa_repo.NewPostgresRepo(db)
+	if err != nil {
+		panic(fmt.Errorf("mfa_repo.NewPostgresRepo error: %w", err))
+	}
+	otpRepo, err := otp_repo.NewRedisRepo(rdb)
 	if err != nil {
-		panic(fmt.Errorf("auth_repo.NewRedisRepo error: %w", err))
+		panic(fmt.Errorf("otp_repo.NewRedisRepo error: %w", err))
+	}
+	webAuthnRepo, err := webauthn_repo.NewCompositeRepo(rdb, db)
+	if err != nil {
+		panic(fmt.Errorf("webauthn_repo.NewCompositeRepo error: %w", err))
+	}
+	rateLimitRepo, err := ratelimit_repo.NewRedisRepo(rdb)
+	if err != nil {
+		panic(fmt.Errorf("ratelimit_repo.NewRedisRepo error: %w", err))
+	}
+	transferRepo, err := transfer_repo.NewRedisRepo(rdb)
+	if err != nil {
+		panic(fmt.Errorf("transfer_repo.NewRedisRepo error: %w", err))
+	}
+	ssoRepo, err := sso_repo.NewRedisRepo(rdb)
+	if err != nil {
+		panic(fmt.Errorf("sso_repo.NewRedisRepo error: %w", err))
+	}
+	oauthRepo, err := oauth_repo.NewCompositeRepo(rdb, db)
+	if err != nil {
+		panic(fmt.Errorf("oauth_repo.NewCompositeRepo error: %w", err))
+	}
+	auditRepo, err := audit_repo.NewPostgresRepo(db)
+	if err != nil {
+		panic(fmt.Errorf("audit_repo.NewPostgresRepo error: %w", err))
 	}
 
 	// services
@@ -180,8 +679,152 @@ func (a *app) setDomainServices() {
 	if err != nil {
 		panic(fmt.Errorf("user_svc.New error: %w", err))
 	}
-	authSvc := auth_svc.New(authRepo)
+	keyDir, activeKeyID, retiredKeyIDs := config.GetJWTKeyConfig()
+	keySet, err := auth_svc.LoadKeySet(keyDir, activeKeyID, retiredKeyIDs)
+	if err != nil {
+		panic(fmt.Errorf("auth_svc.LoadKeySet error: %w", err))
+	}
+	authSvc := auth_svc.New(authRepo, keySet, userSvc)
+
+	ssoProviders := []sso.Provider{}
+	for _, providerConfig := range config.GetSSOProviders() {
+		provider, err := sso_svc.NewOIDCProvider(sso_svc.OIDCConfig{
+			Name:         providerConfig.Name,
+			Issuer:       providerConfig.Issuer,
+			ClientID:     providerConfig.ClientID,
+			ClientSecret: providerConfig.ClientSecret,
+		})
+		if err != nil {
+			panic(fmt.Errorf("sso_svc.NewOIDCProvider %s error: %w", providerConfig.Name, err))
+		}
+		ssoProviders = append(ssoProviders, provider)
+	}
+	ssoSvc, err := sso_svc.New(ssoRepo, ssoProviders...)
+	if err != nil {
+		panic(fmt.Errorf("sso_svc.New error: %w", err))
+	}
+
+	clientSvc, err := client_svc.New(clientRepo)
+	if err != nil {
+		panic(fmt.Errorf("client_svc.New error: %w", err))
+	}
+	apiKeySvc, err := apikey_svc.New(apiKeyRepo, userSvc)
+	if err != nil {
+		panic(fmt.Errorf("apikey_svc.New error: %w", err))
+	}
+	passwordPolicy := config.GetPasswordPolicy()
+	passwordSvc, err := password_svc.New(passwordRepo, password.Policy{
+		MinLength:      passwordPolicy.MinLength,
+		MaxLength:      passwordPolicy.MaxLength,
+		MinCharClasses: passwordPolicy.MinCharClasses,
+	})
+	if err != nil {
+		panic(fmt.Errorf("password_svc.New error: %w", err))
+	}
+
+	var mailSender mail.Sender
+	if smtpConfig := config.GetSMTPConfig(); smtpConfig.Host != "" {
+		mailSender, err = mail_svc.NewSMTPSender(mail_svc.SMTPConfig{
+			Host:     smtpConfig.Host,
+			Port:     smtpConfig.Port,
+			Username: smtpConfig.Username,
+			Password: smtpConfig.Password,
+			From:     smtpConfig.From,
+		})
+		if err != nil {
+			panic(fmt.Errorf("mail_svc.NewSMTPSender error: %w", err))
+		}
+	} else {
+		infra.GetLogger(ctx).Warn("SMTP_HOST is empty, emails are kept in memory and not sent")
+		mailSender = mail_svc.NewMemorySender()
+	}
+	otpSecret, otpLinkURL := config.GetOTPConfig()
+	otpSvc, err := otp_svc.New(otpRepo, mailSender, otp_svc.Config{
+		Secret:  []byte(otpSecret),
+		LinkURL: otpLinkURL,
+	})
+	if err != nil {
+		panic(fmt.Errorf("otp_svc.New error: %w", err))
+	}
+	mfaIssuer, mfaSecretKey := config.GetMFAConfig()
+	mfaSvc, err := mfa_svc.New(mfaRepo, mfaIssuer, []byte(mfaSecretKey))
+	if err != nil {
+		panic(fmt.Errorf("mfa_svc.New error: %w", err))
+	}
+	rpID, rpName, origins := config.GetWebAuthnConfig()
+	webAuthnSvc, err := webauthn_svc.New(webAuthnRepo, webauthn_svc.Config{
+		RelyingPartyID:   rpID,
+		RelyingPartyName: rpName,
+		Origins:          origins,
+	})
+	if err != nil {
+		panic(fmt.Errorf("webauthn_svc.New error: %w", err))
+	}
+	rateLimitSvc, err := ratelimit_svc.New(rateLimitRepo, ratelimit_svc.Config{})
+	if err != nil {
+		panic(fmt.Errorf("ratelimit_svc.New error: %w", err))
+	}
+	transferSvc, err := transfer_svc.New(transferRepo)
+	if err != nil {
+		panic(fmt.Errorf("transfer_svc.New error: %w", err))
+	}
+	oauthSvc, err := oauth_svc.New(oauthRepo)
+	if err != nil {
+		panic(fmt.Errorf("oauth_svc.New error: %w", err))
+	}
+	auditSvc, err := audit_svc.New(auditRepo)
+	if err != nil {
+		panic(fmt.Errorf("audit_svc.New error: %w", err))
+	}
 
 	a.userSvc = userSvc
 	a.authSvc = authSvc
+	a.ssoSvc = ssoSvc
+	a.clientSvc = clientSvc
+	a.apiKeySvc = apiKeySvc
+	a.passwordSvc = passwordSvc
+	a.otpSvc = otpSvc
+	a.mfaSvc = mfaSvc
+	a.webAuthnSvc = webAuthnSvc
+	a.transferSvc = transferSvc
+	a.oauthSvc = oauthSvc
+	a.auditSvc = auditSvc
+	a.rateLimitSvc = rateLimitSvc
+	a.tokenCache = infra.NewTTLCache[string, *verifiedAuth](tokenCacheSize)
+
+	// background jobs
+	jobCtx, cancel := context.WithCancel(ctx)
+	a.stopJobs = cancel
+	go runRevocationJobs(jobCtx, authRepo)
+}
+
+// runRevocationJobs warms up the revocation cache, and deletes expired revocations periodically.
+func runRevocationJobs(ctx context.Context, repo auth_repo.CompositeRepo) {
+	logger := infra.GetLogger(ctx)
+	warmUp := func() {
+		if err := repo.WarmUp(ctx); err != nil {
+			// revocations are read from db until the cache is warm
+			logger.Errorw("auth repo WarmUp error", "error", err)
+		}
+	}
+	warmUp()
+
+	warmUpTicker := time.NewTicker(revocationWarmUpInterval)
+	defer warmUpTicker.Stop()
+	ticker := time.NewTicker(revocationGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-warmUpTicker.C:
+			warmUp()
+		case <-ticker.C:
+			if rows, err := repo.DeleteExpired(ctx); err != nil {
+				logger.Errorw("auth repo DeleteExpired error", "error", err)
+			} else {
+				logger.Infow("expired revocations deleted", "rows", rows)
+			}
+		}
+	}
 }
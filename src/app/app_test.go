@@ -0,0 +1,313 @@
+package app
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+
+	"github.com/andy74139/webserver/src/domain/entity/apikey"
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+	"github.com/andy74139/webserver/src/domain/entity/password"
+	"github.com/andy74139/webserver/src/domain/entity/user"
+	"github.com/andy74139/webserver/src/domain/entity/webauthn"
+	"github.com/andy74139/webserver/src/domain/service/auth"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+// AppSuite tests endpoint methods through the router, with the auth service on an in-memory repository and fake
+// services of other domains.
+type AppSuite struct {
+	suite.Suite
+
+	app    *app
+	router *gin.Engine
+	users  *fakeUserSvc
+}
+
+func TestAppSuite(t *testing.T) {
+	suite.Run(t, new(AppSuite))
+}
+
+func (s *AppSuite) SetupTest() {
+	gin.SetMode(gin.TestMode)
+	logger := zap.NewNop().Sugar()
+	infra.SetDefaultLogger(logger)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	s.Require().NoError(err)
+	keySet, err := auth_svc.NewKeySet(map[string]crypto.Signer{"ed": key}, "ed", nil)
+	s.Require().NoError(err)
+
+	s.users = &fakeUserSvc{identities: map[uuid.UUID][]*user.Identity{}, suspended: map[uuid.UUID]bool{}}
+	s.app = &app{
+		userSvc:     s.users,
+		authSvc:     auth_svc.New(newFakeAuthRepo(), keySet, s.users),
+		passwordSvc: fakePasswordSvc{},
+		webAuthnSvc: fakeWebAuthnSvc{},
+		apiKeySvc:   &fakeAPIKeySvc{keys: map[string]*apikey.APIKey{}},
+		tokenCache:  infra.NewTTLCache[string, *verifiedAuth](tokenCacheSize),
+	}
+	s.router = s.app.getRouter(infra.SetLogger(context.Background(), logger))
+}
+
+// request sends the request to the router, body is marshaled to JSON if it isn't nil.
+func (s *AppSuite) request(method string, path string, token string, body any) *httptest.ResponseRecorder {
+	return s.requestWithHeader(method, path, token, body, nil)
+}
+
+// requestWithHeader is request with more headers.
+func (s *AppSuite) requestWithHeader(method string, path string, token string, body any, header http.Header) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		s.Require().NoError(err)
+		reader = strings.NewReader(string(b))
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	return resp
+}
+
+// fakeUserSvc is a user.Service of users with identities, other methods aren't implemented.
+type fakeUserSvc struct {
+	user.Service
+
+	mu         sync.Mutex
+	identities map[uuid.UUID][]*user.Identity
+	suspended  map[uuid.UUID]bool
+}
+
+func (f *fakeUserSvc) addIdentity(userID uuid.UUID, kind string, provider string, subject string) *user.Identity {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	identity := &user.Identity{ID: uuid.New(), Kind: kind, Provider: provider, Subject: subject, LinkedAt: time.Now()}
+	f.identities[userID] = append(f.identities[userID], identity)
+	return identity
+}
+
+func (f *fakeUserSvc) GetRoles(ctx context.Context, id uuid.UUID) ([]string, error) {
+	return []string{auth.RoleUser}, nil
+}
+
+func (f *fakeUserSvc) CheckValidLoginUser(ctx context.Context, id uuid.UUID) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.suspended[id], nil
+}
+
+func (f *fakeUserSvc) ListIdentities(ctx context.Context, id uuid.UUID) ([]*user.Identity, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*user.Identity{}, f.identities[id]...), nil
+}
+
+func (f *fakeUserSvc) UnlinkIdentity(ctx context.Context, id uuid.UUID, identityID uuid.UUID, hasOtherLoginMethods bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	identities := f.identities[id]
+	for i, identity := range identities {
+		if identity.ID == identityID {
+			if len(identities) == 1 && !hasOtherLoginMethods {
+				return user.ErrLastIdentity
+			}
+			f.identities[id] = append(identities[:i:i], identities[i+1:]...)
+			return nil
+		}
+	}
+	return user.ErrNotFound
+}
+
+// fakeAPIKeySvc is an apikey.Service of API keys in memory, other methods aren't implemented.
+type fakeAPIKeySvc struct {
+	apikey.Service
+
+	mu   sync.Mutex
+	keys map[string]*apikey.APIKey
+}
+
+func (f *fakeAPIKeySvc) Create(ctx context.Context, userID uuid.UUID, name string, scopes []string, expiresAt time.Time) (*apikey.APIKey, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := &apikey.APIKey{ID: uuid.New(), UserID: userID, Name: name, Scopes: scopes, Roles: []string{auth.RoleUser}, ExpiresAt: expiresAt, CreatedAt: time.Now()}
+	keyString := "wsk_test_" + uuid.NewString()
+	f.keys[keyString] = key
+	return key, keyString, nil
+}
+
+func (f *fakeAPIKeySvc) Verify(ctx context.Context, keyString string) (*apikey.APIKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key, ok := f.keys[keyString]
+	if !ok {
+		return nil, apikey.ErrInvalidKey
+	}
+	return key, nil
+}
+
+// fakePasswordSvc is a password.Service of users without passwords.
+type fakePasswordSvc struct {
+	password.Service
+}
+
+func (fakePasswordSvc) GetByUserID(ctx context.Context, userID uuid.UUID) (*password.Credential, error) {
+	return nil, password.ErrNotFound
+}
+
+// fakeWebAuthnSvc is a webauthn.Service of users without passkeys.
+type fakeWebAuthnSvc struct {
+	webauthn.Service
+}
+
+func (fakeWebAuthnSvc) ListCredentials(ctx context.Context, userID uuid.UUID) ([]*webauthn.Credential, error) {
+	return nil, nil
+}
+
+// fakeAuthRepo is an in-memory auth.Repository.
+type fakeAuthRepo struct {
+	mu            sync.Mutex
+	revoked       map[string]bool
+	refreshTokens map[string]*auth.RefreshToken
+	watermarks    map[uuid.UUID]time.Time
+	sessions      map[string]*auth.Session
+}
+
+func newFakeAuthRepo() *fakeAuthRepo {
+	return &fakeAuthRepo{
+		revoked:       map[string]bool{},
+		refreshTokens: map[string]*auth.RefreshToken{},
+		watermarks:    map[uuid.UUID]time.Time{},
+		sessions:      map[string]*auth.Session{},
+	}
+}
+
+func (r *fakeAuthRepo) SetRevoked(ctx context.Context, jwtID string, expiryDuration time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.revoked[jwtID] = true
+	return nil
+}
+
+func (r *fakeAuthRepo) IsRevoked(ctx context.Context, jwtID string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.revoked[jwtID], nil
+}
+
+func (r *fakeAuthRepo) SetRefreshToken(ctx context.Context, tokenHash string, token *auth.RefreshToken, expiryDuration time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	token1 := *token
+	r.refreshTokens[tokenHash] = &token1
+	return nil
+}
+
+func (r *fakeAuthRepo) UseRefreshToken(ctx context.Context, tokenHash string) (*auth.RefreshToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	token, ok := r.refreshTokens[tokenHash]
+	if !ok {
+		return nil, auth.ErrNotFound
+	}
+	result := *token
+	token.IsUsed = true
+	return &result, nil
+}
+
+func (r *fakeAuthRepo) SetTokensValidAfter(ctx context.Context, userID uuid.UUID, validAfter time.Time, expiryDuration time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if validAfter.After(r.watermarks[userID]) {
+		r.watermarks[userID] = validAfter
+	}
+	return nil
+}
+
+func (r *fakeAuthRepo) GetTokensValidAfter(ctx context.Context, userID uuid.UUID) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.watermarks[userID], nil
+}
+
+func (r *fakeAuthRepo) SetGlobalTokensValidAfter(ctx context.Context, validAfter time.Time, expiryDuration time.Duration) error {
+	return r.SetTokensValidAfter(ctx, uuid.Nil, validAfter, expiryDuration)
+}
+
+func (r *fakeAuthRepo) GetGlobalTokensValidAfter(ctx context.Context) (time.Time, error) {
+	return r.GetTokensValidAfter(ctx, uuid.Nil)
+}
+
+func (r *fakeAuthRepo) SetSession(ctx context.Context, session *auth.Session, expiryDuration time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	session1 := *session
+	r.sessions[session.ID] = &session1
+	return nil
+}
+
+func (r *fakeAuthRepo) GetSession(ctx context.Context, sessionID string) (*auth.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	session, ok := r.sessions[sessionID]
+	if !ok {
+		return nil, auth.ErrNotFound
+	}
+	result := *session
+	return &result, nil
+}
+
+func (r *fakeAuthRepo) ListSessions(ctx context.Context, userID uuid.UUID) ([]*auth.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions := []*auth.Session{}
+	for _, session := range r.sessions {
+		if session.UserID == userID {
+			result := *session
+			sessions = append(sessions, &result)
+		}
+	}
+	return sessions, nil
+}
+
+func (r *fakeAuthRepo) DeleteSession(ctx context.Context, userID uuid.UUID, sessionID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, sessionID)
+	return nil
+}
+
+func (r *fakeAuthRepo) DeleteUserSessions(ctx context.Context, userID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, session := range r.sessions {
+		if session.UserID == userID {
+			delete(r.sessions, id)
+		}
+	}
+	return nil
+}
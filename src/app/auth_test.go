@@ -0,0 +1,30 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+func (s *AppSuite) TestRefreshAuthTokenRejectsSuspendedUser() {
+	ctx := context.TODO()
+	userID := uuid.New()
+	token, err := s.app.authSvc.CreateToken(ctx, userID, nil)
+	s.Require().NoError(err)
+
+	// the user is suspended, the refresh token is rejected even if tokens are not revoked
+	s.users.mu.Lock()
+	s.users.suspended[userID] = true
+	s.users.mu.Unlock()
+	resp := s.request(http.MethodPut, "/api/v1/account/auth/", "", &requestRefreshAuthToken{RefreshToken: token.RefreshToken})
+	s.Equal(http.StatusForbidden, resp.Code, resp.Body.String())
+
+	s.users.mu.Lock()
+	s.users.suspended[userID] = false
+	s.users.mu.Unlock()
+	token, err = s.app.authSvc.CreateToken(ctx, userID, nil)
+	s.Require().NoError(err)
+	resp = s.request(http.MethodPut, "/api/v1/account/auth/", "", &requestRefreshAuthToken{RefreshToken: token.RefreshToken})
+	s.Equal(http.StatusOK, resp.Code, resp.Body.String())
+}
@@ -0,0 +1,569 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+	"github.com/andy74139/webserver/src/domain/entity/client"
+	"github.com/andy74139/webserver/src/domain/entity/oauth"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+// platformOAuth is the platform of login sessions created by the authorization code flow.
+const platformOAuth = "oauth"
+
+// Grant type and token type of the token exchange (RFC 8693).
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+type requestAuthorize struct {
+	ResponseType        string `json:"response_type" form:"response_type" example:"code" description:"Must be code"`
+	ClientID            string `json:"client_id" form:"client_id" example:"5f0c6c2e-3b8e-4a41-9d53-2f7d3c1b8a90" description:"Client ID"`
+	RedirectURI         string `json:"redirect_uri" form:"redirect_uri" example:"https://app.example.com/callback" description:"Redirect URI, it must be registered by the client"`
+	Scope               string `json:"scope" form:"scope" example:"account:read" description:"Space-separated scopes, all scopes of the client if empty"`
+	State               string `json:"state" form:"state" description:"Opaque value of the client, it is returned with the code"`
+	CodeChallenge       string `json:"code_challenge" form:"code_challenge" example:"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" description:"PKCE code challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method" form:"code_challenge_method" example:"S256" description:"Must be S256"`
+}
+
+type requestApproveAuthorize struct {
+	requestAuthorize
+	Approve bool `json:"approve" example:"true" description:"Does the user approve the authorization, it is sent true without asking the user if consent_required is false"`
+}
+
+type responseAuthorize struct {
+	ClientID        string   `json:"client_id" example:"5f0c6c2e-3b8e-4a41-9d53-2f7d3c1b8a90" description:"Client ID"`
+	ClientName      string   `json:"client_name" example:"billing" description:"Client name, it is shown to the user"`
+	Scopes          []string `json:"scopes" example:"account:read" description:"Requested scopes"`
+	ConsentRequired bool     `json:"consent_required" example:"true" description:"Should the user be asked to approve, false if the user consented to the scopes or the client is our own app"`
+}
+
+type responseAuthorizeRedirect struct {
+	RedirectURI string `json:"redirect_uri" example:"https://app.example.com/callback?code=SplxlOBeZQQYbYS6WxSbIA&state=xyz" description:"Redirect URI with the code or the error, the user agent is redirected to it"`
+}
+
+type responseOAuthToken struct {
+	AccessToken     string `json:"access_token" description:"Authorization token"`
+	TokenType       string `json:"token_type" example:"Bearer" description:"Type of the token"`
+	ExpiresIn       int64  `json:"expires_in" example:"900" description:"Seconds until the authorization token expires"`
+	RefreshToken    string `json:"refresh_token,omitempty" description:"Refresh token, it is rotated by each refresh. Tokens of the client credentials grant and the token exchange have no refresh token"`
+	Scope           string `json:"scope" example:"account:read" description:"Space-separated scopes of the token"`
+	IssuedTokenType string `json:"issued_token_type,omitempty" example:"urn:ietf:params:oauth:token-type:access_token" description:"Type of the exchanged token, for the token exchange"`
+}
+
+// @Title Get authorization request
+// @Description Verifies the authorization request of the authorization code flow with PKCE (RFC 6749 4.1, RFC 7636), for the consent page of the user. Invalid clients and redirect URIs are responded with 400, other errors are responded with the redirect URI of the error.
+// @Tags oauth
+// @Resource oauth
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param response_type query string true "Must be code"
+// @Param client_id query string true "Client ID"
+// @Param redirect_uri query string true "Redirect URI, it must be registered by the client"
+// @Param scope query string false "Space-separated scopes, all scopes of the client if empty"
+// @Param state query string false "Opaque value of the client"
+// @Param code_challenge query string true "PKCE code challenge"
+// @Param code_challenge_method query string true "Must be S256"
+// @Success 200 object responseAuthorize "OK"
+// @Failure 400 object responseAuthorizeRedirect "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /oauth/authorize [get]
+func (a *app) getAuthorize(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, ok := a.verifyAuthorizeUser(ctx)
+	if !ok {
+		return
+	}
+	req := &requestAuthorize{}
+	if err := ctx.ShouldBindQuery(req); err != nil {
+		logger.Debugw("unknown request query", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+		return
+	}
+	client1, scopes, ok := a.verifyAuthorizeRequest(ctx, req)
+	if !ok {
+		return
+	}
+
+	consentRequired, ok := a.isConsentRequired(ctx, userID, client1, scopes)
+	if !ok {
+		return
+	}
+	ctx.JSON(http.StatusOK, &responseAuthorize{
+		ClientID:        client1.ID,
+		ClientName:      client1.Name,
+		Scopes:          scopes,
+		ConsentRequired: consentRequired,
+	})
+}
+
+// @Title Authorize client
+// @Description Approves or denies the authorization request of the user, and responds the redirect URI with the authorization code, which expires in 1 minute. Approved scopes are recorded as the consent of the user.
+// @Tags oauth
+// @Resource oauth
+// @Accept json
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param request body requestApproveAuthorize true "Authorization request and the approval"
+// @Success 200 object responseAuthorizeRedirect "OK"
+// @Failure 400 object responseAuthorizeRedirect "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /oauth/authorize [post]
+func (a *app) authorize(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, ok := a.verifyAuthorizeUser(ctx)
+	if !ok {
+		return
+	}
+	req := &requestApproveAuthorize{}
+	if err := ctx.BindJSON(req); err != nil {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+		return
+	}
+	client1, scopes, ok := a.verifyAuthorizeRequest(ctx, &req.requestAuthorize)
+	if !ok {
+		return
+	}
+
+	if !req.Approve {
+		logger.Infow("authorization denied", "user_id", userID, "client_id", client1.ID)
+		ctx.JSON(http.StatusOK, &responseAuthorizeRedirect{
+			RedirectURI: getAuthorizeRedirectURI(req.RedirectURI, url.Values{"error": {"access_denied"}}, req.State),
+		})
+		return
+	}
+	if !client1.IsFirstParty {
+		if err := a.oauthSvc.GrantConsent(ctx, userID, client1.ID, scopes); err != nil {
+			logger.Errorw("oauthSvc.GrantConsent error", "error", err, "user_id", userID, "client_id", client1.ID)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	code, err := a.oauthSvc.CreateCode(ctx, &oauth.AuthorizationRequest{
+		UserID:        userID,
+		ClientID:      client1.ID,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        scopes,
+		CodeChallenge: req.CodeChallenge,
+	})
+	if errors.Is(err, oauth.ErrInvalidCodeChallenge) {
+		abortAuthorizeRedirect(ctx, req.RedirectURI, "invalid_request", req.State)
+		return
+	} else if err != nil {
+		logger.Errorw("oauthSvc.CreateCode error", "error", err, "user_id", userID, "client_id", client1.ID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	logger.Infow("client authorized", "user_id", userID, "client_id", client1.ID, "scopes", scopes)
+	ctx.JSON(http.StatusOK, &responseAuthorizeRedirect{
+		RedirectURI: getAuthorizeRedirectURI(req.RedirectURI, url.Values{"code": {code}}, req.State),
+	})
+}
+
+// verifyAuthorizeUser verifies the authorization token of the user, tokens of clients can't authorize clients, and
+// operators impersonating the user can't either.
+func (a *app) verifyAuthorizeUser(ctx *gin.Context) (uuid.UUID, bool) {
+	logger := infra.GetLogger(ctx)
+
+	userID, claims, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return uuid.Nil, false
+	}
+	if claims.ClientID != "" || claims.IsImpersonation() || !claims.HasScope(auth.ScopeAccountWrite) {
+		logger.Debugw("token can't authorize clients", "user_id", userID, "client_id", claims.ClientID)
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+// verifyAuthorizeRequest verifies the client and the redirect URI first, errors are never redirected to unverified
+// redirect URIs (RFC 6749 4.1.2.1). It returns the requested scopes.
+func (a *app) verifyAuthorizeRequest(ctx *gin.Context, req *requestAuthorize) (*client.Client, []string, bool) {
+	logger := infra.GetLogger(ctx)
+
+	client1, err := a.clientSvc.Get(ctx, req.ClientID)
+	if errors.Is(err, client.ErrNotFound) || req.ClientID == "" {
+		logger.Debugw("unknown client", "client_id", req.ClientID)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_client"})
+		return nil, nil, false
+	} else if err != nil {
+		logger.Errorw("clientSvc.Get error", "error", err, "client_id", req.ClientID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	if !client1.HasRedirectURI(req.RedirectURI) {
+		logger.Debugw("unknown redirect URI", "client_id", client1.ID, "redirect_uri", req.RedirectURI)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "unknown redirect_uri"})
+		return nil, nil, false
+	}
+
+	if req.ResponseType != "code" {
+		abortAuthorizeRedirect(ctx, req.RedirectURI, "unsupported_response_type", req.State)
+		return nil, nil, false
+	}
+	// PKCE is required for all clients, and the plain method isn't allowed (RFC 9700 2.1.1)
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		abortAuthorizeRedirect(ctx, req.RedirectURI, "invalid_request", req.State)
+		return nil, nil, false
+	}
+	scopes := strings.Fields(req.Scope)
+	if len(scopes) == 0 {
+		scopes = client1.Scopes
+	}
+	for _, scope := range scopes {
+		if !client1.HasScope(scope) {
+			abortAuthorizeRedirect(ctx, req.RedirectURI, "invalid_scope", req.State)
+			return nil, nil, false
+		}
+	}
+	return client1, scopes, true
+}
+
+// isConsentRequired returns whether the user should approve the scopes for the client.
+func (a *app) isConsentRequired(ctx *gin.Context, userID uuid.UUID, client1 *client.Client, scopes []string) (bool, bool) {
+	logger := infra.GetLogger(ctx)
+
+	if client1.IsFirstParty {
+		return false, true
+	}
+	hasConsent, err := a.oauthSvc.HasConsent(ctx, userID, client1.ID, scopes)
+	if err != nil {
+		logger.Errorw("oauthSvc.HasConsent error", "error", err, "user_id", userID, "client_id", client1.ID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return false, false
+	}
+	return !hasConsent, true
+}
+
+// abortAuthorizeRedirect responds the error with the redirect URI of the error, the user agent is redirected to the client.
+func abortAuthorizeRedirect(ctx *gin.Context, redirectURI string, errorCode string, state string) {
+	ctx.AbortWithStatusJSON(http.StatusBadRequest, &responseAuthorizeRedirect{
+		RedirectURI: getAuthorizeRedirectURI(redirectURI, url.Values{"error": {errorCode}}, state),
+	})
+}
+
+// getAuthorizeRedirectURI adds the parameters and the state to the query of the redirect URI, the query of the
+// registered redirect URI is kept (RFC 6749 3.1.2).
+func getAuthorizeRedirectURI(redirectURI string, params url.Values, state string) string {
+	if state != "" {
+		params.Set("state", state)
+	}
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		// SHOULD NOT BE HERE, redirect URIs are verified at registration
+		return redirectURI
+	}
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// @Title Create OAuth token
+// @Description Exchanges the authorization code with the PKCE code verifier, or the refresh token, for the tokens of the client (RFC 6749 4.1.3, 6). Confidential clients authenticate by the basic authorization header or client_secret, public clients send client_id only. Tokens have the consented scopes within the roles of the user. By the client credentials grant (RFC 6749 4.4), confidential clients get tokens of themselves, which are accepted by service endpoints only. By the token exchange (RFC 8693), clients granted the token:exchange scope exchange tokens of users for 5-minute tokens of the audience service, with down-scoped scopes and the act claim of the client.
+// @Tags oauth
+// @Resource oauth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "authorization_code, refresh_token, client_credentials or urn:ietf:params:oauth:grant-type:token-exchange"
+// @Param code formData string false "Authorization code, for authorization_code"
+// @Param redirect_uri formData string false "Redirect URI of the authorization request, for authorization_code"
+// @Param code_verifier formData string false "PKCE code verifier, for authorization_code"
+// @Param refresh_token formData string false "Refresh token, for refresh_token"
+// @Param scope formData string false "Space-separated scopes, for client_credentials and the token exchange, all scopes of the client or the subject token if empty"
+// @Param subject_token formData string false "Authorization token of the user, for the token exchange"
+// @Param subject_token_type formData string false "Must be urn:ietf:params:oauth:token-type:access_token, for the token exchange"
+// @Param audience formData string false "Client ID of the downstream service, for the token exchange"
+// @Param client_id formData string false "Client ID, if the basic authorization header isn't sent"
+// @Param client_secret formData string false "Client secret of confidential clients, if the basic authorization header isn't sent"
+// @Success 200 object responseOAuthToken "OK"
+// @Failure 400 "Bad Request"
+// @Failure 401 "Unauthorized"
+// @Failure 500 "Internal Server Error"
+// @Router /oauth/token [post]
+func (a *app) createOAuthToken(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	ctx.Header("Cache-Control", "no-store")
+	client1, ok := a.authenticateTokenClient(ctx)
+	if !ok {
+		return
+	}
+
+	var token *auth.TokenPair
+	var err error
+	switch grantType := ctx.PostForm("grant_type"); grantType {
+	case "authorization_code":
+		request, err1 := a.oauthSvc.ExchangeCode(ctx, ctx.PostForm("code"), client1.ID, ctx.PostForm("redirect_uri"), ctx.PostForm("code_verifier"))
+		if errors.Is(err1, oauth.ErrInvalidGrant) {
+			logger.Debugw("invalid authorization code", "client_id", client1.ID)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+			return
+		} else if err1 != nil {
+			logger.Errorw("oauthSvc.ExchangeCode error", "error", err1, "client_id", client1.ID)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if isValid, err1 := a.userSvc.CheckValidLoginUser(ctx, request.UserID); err1 != nil {
+			logger.Errorw("CheckValidLoginUser error", "error", err1, "user_id", request.UserID)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		} else if !isValid {
+			logger.Debugw("user is not valid to login", "user_id", request.UserID)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+			return
+		}
+
+		info := newSessionInfo(ctx, platformOAuth, "")
+		info.ClientID = client1.ID
+		info.Scopes = request.Scopes
+		token, err = a.authSvc.CreateToken(ctx, request.UserID, info)
+	case "refresh_token":
+		info := newSessionInfo(ctx, "", "")
+		info.ClientID = client1.ID
+		token, err = a.authSvc.RefreshToken(ctx, ctx.PostForm("refresh_token"), info)
+		if errors.Is(err, auth.ErrInvalidRefreshToken) || errors.Is(err, auth.ErrRevokedToken) || errors.Is(err, auth.ErrRefreshTokenReused) {
+			logger.Debugw("RefreshToken error", "error", err, "client_id", client1.ID)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+			return
+		}
+	case "client_credentials":
+		if client1.IsPublic {
+			// public clients have no credentials
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unauthorized_client"})
+			return
+		}
+		scopes := strings.Fields(ctx.PostForm("scope"))
+		if len(scopes) == 0 {
+			scopes = client1.Scopes
+		}
+		for _, scope := range scopes {
+			if !client1.HasScope(scope) {
+				logger.Debugw("invalid scope", "client_id", client1.ID, "scope", scope)
+				ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_scope"})
+				return
+			}
+		}
+		token, err = a.authSvc.CreateClientToken(ctx, client1.ID, scopes)
+	case grantTypeTokenExchange:
+		if client1.IsPublic || !client1.HasScope(auth.ScopeTokenExchange) {
+			logger.Debugw("client can't exchange tokens", "client_id", client1.ID)
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unauthorized_client"})
+			return
+		}
+		token, ok = a.exchangeToken(ctx, client1)
+		if !ok {
+			return
+		}
+	default:
+		logger.Debugw("unsupported grant type", "grant_type", grantType, "client_id", client1.ID)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unsupported_grant_type"})
+		return
+	}
+	if err != nil {
+		logger.Errorw("create token error", "error", err, "client_id", client1.ID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	resp := &responseOAuthToken{
+		AccessToken:  token.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(time.Until(token.AccessTokenExpiresAt).Seconds()),
+		RefreshToken: token.RefreshToken,
+		Scope:        token.Scope,
+	}
+	if ctx.PostForm("grant_type") == grantTypeTokenExchange {
+		resp.IssuedTokenType = tokenTypeAccessToken
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// exchangeToken exchanges the subject token of the user for a token of the audience, on behalf of the client.
+// Only access tokens of this server are exchanged, exchanged tokens can't be exchanged again.
+func (a *app) exchangeToken(ctx *gin.Context, client1 *client.Client) (*auth.TokenPair, bool) {
+	logger := infra.GetLogger(ctx)
+
+	subjectToken := ctx.PostForm("subject_token")
+	requestedTokenType := ctx.PostForm("requested_token_type")
+	if subjectToken == "" || ctx.PostForm("subject_token_type") != tokenTypeAccessToken ||
+		(requestedTokenType != "" && requestedTokenType != tokenTypeAccessToken) || ctx.PostForm("actor_token") != "" {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+		return nil, false
+	}
+
+	// the audience is a registered service, which verifies exchanged tokens by introspection or the public keys
+	audience := ctx.PostForm("audience")
+	if _, err := a.clientSvc.Get(ctx, audience); errors.Is(err, client.ErrNotFound) || audience == "" {
+		logger.Debugw("unknown audience", "client_id", client1.ID, "audience", audience)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_target"})
+		return nil, false
+	} else if err != nil {
+		logger.Errorw("clientSvc.Get error", "error", err, "client_id", audience)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+
+	token, err := a.authSvc.ExchangeToken(ctx, subjectToken, client1.ID, audience, strings.Fields(ctx.PostForm("scope")))
+	if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrRevokedToken) {
+		logger.Debugw("invalid subject token", "error", err, "client_id", client1.ID)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "invalid subject_token"})
+		return nil, false
+	} else if errors.Is(err, auth.ErrInvalidScope) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_scope"})
+		return nil, false
+	} else if err != nil {
+		logger.Errorw("authSvc.ExchangeToken error", "error", err, "client_id", client1.ID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+	logger.Infow("token exchanged", "client_id", client1.ID, "audience", audience, "scope", token.Scope)
+	return token, true
+}
+
+// authenticateTokenClient authenticates the client of the token endpoint. Public clients send client_id only, they are
+// verified by PKCE and bound refresh tokens, confidential clients must send their secrets.
+func (a *app) authenticateTokenClient(ctx *gin.Context) (*client.Client, bool) {
+	logger := infra.GetLogger(ctx)
+
+	if _, _, ok := ctx.Request.BasicAuth(); ok || ctx.PostForm("client_secret") != "" {
+		return a.authenticateClient(ctx)
+	}
+
+	clientID := ctx.PostForm("client_id")
+	client1, err := a.clientSvc.Get(ctx, clientID)
+	if errors.Is(err, client.ErrNotFound) || clientID == "" || (err == nil && !client1.IsPublic) {
+		logger.Debugw("invalid public client", "client_id", clientID)
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_client"})
+		return nil, false
+	} else if err != nil {
+		logger.Errorw("clientSvc.Get error", "client_id", clientID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+	return client1, true
+}
+
+type responseConsent struct {
+	ClientID   string    `json:"client_id" example:"5f0c6c2e-3b8e-4a41-9d53-2f7d3c1b8a90" description:"Client ID"`
+	ClientName string    `json:"client_name" example:"billing" description:"Client name"`
+	Scopes     []string  `json:"scopes" example:"account:read" description:"Consented scopes"`
+	CreatedAt  time.Time `json:"created_at" description:"Time of the first consent"`
+}
+
+type responseListConsents struct {
+	Consents []*responseConsent `json:"consents" description:"Consents ordered by time of the first consent"`
+}
+
+// @Title List consents
+// @Description Lists clients the account consented to, and the consented scopes.
+// @Tags account
+// @Resource account
+// @Produce json
+// @Header defaultRequestHeaders
+// @Success 200 object responseListConsents "OK"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/consents [get]
+func (a *app) listConsents(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	consents, err := a.oauthSvc.ListConsents(ctx, userID)
+	if err != nil {
+		logger.Errorw("oauthSvc.ListConsents error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	resp := &responseListConsents{Consents: make([]*responseConsent, 0, len(consents))}
+	for _, consent := range consents {
+		client1, err := a.clientSvc.Get(ctx, consent.ClientID)
+		if errors.Is(err, client.ErrNotFound) {
+			// consents of deleted clients are useless
+			continue
+		} else if err != nil {
+			logger.Errorw("clientSvc.Get error", "error", err, "client_id", consent.ClientID)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		resp.Consents = append(resp.Consents, &responseConsent{
+			ClientID:   client1.ID,
+			ClientName: client1.Name,
+			Scopes:     consent.Scopes,
+			CreatedAt:  consent.CreatedAt,
+		})
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// @Title Revoke consent
+// @Description Revokes the consent to the client, and revokes login sessions of the client. The client must be authorized again.
+// @Tags account
+// @Resource account
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param client_id path string true "Client ID"
+// @Success 200 "OK"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/consents/{client_id} [delete]
+func (a *app) revokeConsent(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	clientID := ctx.Param("client_id")
+	if err := a.oauthSvc.RevokeConsent(ctx, userID, clientID); errors.Is(err, oauth.ErrNotFound) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "consent not found"})
+		return
+	} else if err != nil {
+		logger.Errorw("oauthSvc.RevokeConsent error", "error", err, "user_id", userID, "client_id", clientID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	sessions, err := a.authSvc.ListSessions(ctx, userID)
+	if err != nil {
+		logger.Errorw("authSvc.ListSessions error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	for _, session := range sessions {
+		if session.Info.ClientID != clientID {
+			continue
+		}
+		if err := a.authSvc.RevokeSession(ctx, session.ID); err != nil {
+			logger.Errorw("authSvc.RevokeSession error", "error", err, "session_id", session.ID)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	logger.Infow("consent revoked", "user_id", userID, "client_id", clientID)
+	ctx.Status(http.StatusOK)
+}
@@ -0,0 +1,270 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+	"github.com/andy74139/webserver/src/domain/entity/password"
+	"github.com/andy74139/webserver/src/domain/entity/user"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+type responseIdentity struct {
+	ID       string    `json:"id" example:"5E0F1C1A-3B8D-4E52-9C51-2B7E3C1D9A40" description:"Identity ID"`
+	Kind     string    `json:"kind" example:"device" description:"device or sso"`
+	Provider string    `json:"provider" example:"android" description:"Platform of the device, or the SSO provider"`
+	Subject  string    `json:"subject" example:"123456" description:"Device ID, or the account ID of the SSO provider"`
+	LinkedAt time.Time `json:"linked_at" description:"Linked time"`
+}
+
+type responseListIdentities struct {
+	Identities []*responseIdentity `json:"identities" description:"Identities ordered by linked time"`
+}
+
+func newResponseIdentities(identities []*user.Identity) []*responseIdentity {
+	resp := make([]*responseIdentity, 0, len(identities))
+	for _, identity := range identities {
+		resp = append(resp, &responseIdentity{
+			ID:       identity.ID.String(),
+			Kind:     identity.Kind,
+			Provider: identity.Provider,
+			Subject:  identity.Subject,
+			LinkedAt: identity.LinkedAt,
+		})
+	}
+	return resp
+}
+
+// @Title List identities
+// @Description Lists devices and SSO accounts linked to the account, the account logs in by any of them.
+// @Tags account
+// @Resource account
+// @Produce json
+// @Header defaultRequestHeaders
+// @Success 200 object responseListIdentities "OK"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/identities [get]
+func (a *app) listIdentities(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	identities, err := a.userSvc.ListIdentities(ctx, userID)
+	if err != nil {
+		logger.Errorw("userSvc.ListIdentities error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.JSON(http.StatusOK, &responseListIdentities{Identities: newResponseIdentities(identities)})
+}
+
+type requestLinkDevice struct {
+	Platform string `json:"platform" example:"ios" description:"Platform of the device"`
+	DeviceID string `json:"device_id" example:"654321" description:"Device ID"`
+}
+
+// @Title Link device
+// @Description Links another device to the account, it returns the device secret which is required by logins of the device. Linking a linked device replaces its secret.
+// @Tags account
+// @Resource account
+// @Accept json
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param request body requestLinkDevice true "Link request"
+// @Success 201 object responseRegister "Created"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 409 "Conflict"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/identities/devices [post]
+func (a *app) linkDevice(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	req := &requestLinkDevice{}
+	if err := ctx.BindJSON(req); err != nil || req.Platform == "" || req.DeviceID == "" {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+
+	deviceSecret, err := a.userSvc.AddDevice(ctx, userID, req.Platform, req.DeviceID)
+	if errors.Is(err, user.ErrDeviceTaken) {
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "device is registered"})
+		return
+	} else if err != nil {
+		logger.Errorw("userSvc.AddDevice error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.JSON(http.StatusCreated, &responseRegister{DeviceSecret: deviceSecret})
+}
+
+// @Title Unlink identity
+// @Description Unlinks the device or the SSO account from the account, and revokes login sessions of the device. Unlinking an SSO account revokes all tokens of the account, and a new token is returned. The last identity can be unlinked only if the account has a password or a passkey.
+// @Tags account
+// @Resource account
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param id path string true "Identity ID"
+// @Success 200 object responseAuthToken "OK, for SSO accounts"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 409 "Conflict"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/identities/{id} [delete]
+func (a *app) unlinkIdentity(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, claims, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	identityID, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "identity not found"})
+		return
+	}
+	identities, err := a.userSvc.ListIdentities(ctx, userID)
+	if err != nil {
+		logger.Errorw("userSvc.ListIdentities error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var identity *user.Identity
+	for _, identity1 := range identities {
+		if identity1.ID == identityID {
+			identity = identity1
+			break
+		}
+	}
+	if identity == nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "identity not found"})
+		return
+	}
+
+	hasOtherLoginMethods, ok := a.hasOtherLoginMethods(ctx, userID)
+	if !ok {
+		return
+	}
+	if err := a.userSvc.UnlinkIdentity(ctx, userID, identityID, hasOtherLoginMethods); errors.Is(err, user.ErrLastIdentity) {
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, user.ErrNotFound) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "identity not found"})
+		return
+	} else if err != nil {
+		logger.Errorw("userSvc.UnlinkIdentity error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	logger.Infow("identity unlinked", "user_id", userID, "kind", identity.Kind, "provider", identity.Provider)
+
+	if identity.Kind == user.IdentityKindSSO {
+		// sessions of SSO logins have no device, so all tokens are revoked as linking an SSO account does
+		a.reissueUserTokens(ctx, userID, a.getSessionInfo(ctx, userID, claims.SessionID))
+		return
+	}
+	a.revokeDeviceSessions(ctx, userID, identity.Provider, identity.Subject)
+	ctx.Status(http.StatusOK)
+}
+
+// reissueUserTokens is a shared method for endpoint methods changing login methods, it revokes all tokens of the user,
+// and responds a new token of the session info to the caller.
+func (a *app) reissueUserTokens(ctx *gin.Context, userID uuid.UUID, info *auth.SessionInfo) {
+	logger := infra.GetLogger(ctx)
+
+	if err := a.authSvc.RevokeUserTokens(ctx, userID); err != nil {
+		logger.Errorw("authSvc.RevokeUserTokens error", "user_id", userID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	token, err := a.authSvc.CreateToken(ctx, userID, info)
+	if err != nil {
+		logger.Errorw("CreateToken error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.JSON(http.StatusOK, newResponseAuthToken(token))
+}
+
+// getSessionInfo returns the info of the caller's session, the device is kept by the new token. It returns the info
+// without device if the session is lost.
+func (a *app) getSessionInfo(ctx *gin.Context, userID uuid.UUID, sessionID string) *auth.SessionInfo {
+	logger := infra.GetLogger(ctx)
+
+	sessions, err := a.authSvc.ListSessions(ctx, userID)
+	if err != nil {
+		logger.Errorw("authSvc.ListSessions error", "error", err, "user_id", userID)
+	}
+	for _, session := range sessions {
+		if session.ID == sessionID {
+			return newSessionInfo(ctx, session.Info.Platform, session.Info.DeviceID)
+		}
+	}
+	return newSessionInfo(ctx, "", "")
+}
+
+// hasOtherLoginMethods checks if the user logs in by a password or a passkey, beside devices and SSO accounts.
+func (a *app) hasOtherLoginMethods(ctx *gin.Context, userID uuid.UUID) (bool, bool) {
+	logger := infra.GetLogger(ctx)
+
+	if _, err := a.passwordSvc.GetByUserID(ctx, userID); err == nil {
+		return true, true
+	} else if !errors.Is(err, password.ErrNotFound) {
+		logger.Errorw("passwordSvc.GetByUserID error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return false, false
+	}
+
+	credentials, err := a.webAuthnSvc.ListCredentials(ctx, userID)
+	if err != nil {
+		logger.Errorw("webAuthnSvc.ListCredentials error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return false, false
+	}
+	return len(credentials) > 0, true
+}
+
+// revokeDeviceSessions revokes login sessions of the unlinked device, failures are logged only since the device
+// can't login again.
+func (a *app) revokeDeviceSessions(ctx *gin.Context, userID uuid.UUID, platform string, deviceID string) {
+	logger := infra.GetLogger(ctx)
+
+	sessions, err := a.authSvc.ListSessions(ctx, userID)
+	if err != nil {
+		logger.Errorw("authSvc.ListSessions error", "error", err, "user_id", userID)
+		return
+	}
+	for _, session := range sessions {
+		if session.Info.Platform != platform || session.Info.DeviceID != deviceID {
+			continue
+		}
+		if err := a.authSvc.RevokeSession(ctx, session.ID); err != nil {
+			logger.Errorw("authSvc.RevokeSession error", "error", err, "session_id", session.ID)
+		}
+	}
+}
+
+func hasIdentityKind(identities []*user.Identity, kind string) bool {
+	for _, identity := range identities {
+		if identity.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
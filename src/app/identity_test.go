@@ -0,0 +1,63 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+	"github.com/andy74139/webserver/src/domain/entity/user"
+)
+
+func (s *AppSuite) TestUnlinkSSORevokesTokens() {
+	ctx := context.TODO()
+	userID := uuid.New()
+	s.users.addIdentity(userID, user.IdentityKindDevice, "android", "123456")
+	ssoIdentity := s.users.addIdentity(userID, user.IdentityKindSSO, "google", "sso-123")
+
+	token, err := s.app.authSvc.CreateToken(ctx, userID, &auth.SessionInfo{Platform: "android", DeviceID: "123456"})
+	s.Require().NoError(err)
+	otherToken, err := s.app.authSvc.CreateToken(ctx, userID, &auth.SessionInfo{Platform: "google", DeviceID: ""})
+	s.Require().NoError(err)
+
+	resp := s.request(http.MethodDelete, "/api/v1/account/identities/"+ssoIdentity.ID.String(), token.AccessToken, nil)
+	s.Require().Equal(http.StatusOK, resp.Code, resp.Body.String())
+	newToken := &responseAuthToken{}
+	s.Require().NoError(json.Unmarshal(resp.Body.Bytes(), newToken))
+	s.NotEmpty(newToken.AuthToken)
+
+	// tokens issued before the unlink are rejected, the caller uses the new token
+	for _, token1 := range []string{token.AccessToken, otherToken.AccessToken} {
+		resp = s.request(http.MethodGet, "/api/v1/account/identities", token1, nil)
+		s.Equal(http.StatusForbidden, resp.Code)
+	}
+	resp = s.request(http.MethodGet, "/api/v1/account/identities", newToken.AuthToken, nil)
+	s.Equal(http.StatusOK, resp.Code)
+	sessions, err := s.app.authSvc.ListSessions(ctx, userID)
+	s.Require().NoError(err)
+	s.Require().Len(sessions, 1)
+	s.Equal("android", sessions[0].Info.Platform, "the device of the caller's session is kept")
+}
+
+func (s *AppSuite) TestUnlinkDeviceKeepsOtherTokens() {
+	ctx := context.TODO()
+	userID := uuid.New()
+	deviceIdentity := s.users.addIdentity(userID, user.IdentityKindDevice, "android", "123456")
+	s.users.addIdentity(userID, user.IdentityKindSSO, "google", "sso-123")
+
+	deviceToken, err := s.app.authSvc.CreateToken(ctx, userID, &auth.SessionInfo{Platform: "android", DeviceID: "123456"})
+	s.Require().NoError(err)
+	ssoToken, err := s.app.authSvc.CreateToken(ctx, userID, &auth.SessionInfo{Platform: "google", DeviceID: ""})
+	s.Require().NoError(err)
+
+	resp := s.request(http.MethodDelete, "/api/v1/account/identities/"+deviceIdentity.ID.String(), ssoToken.AccessToken, nil)
+	s.Require().Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+	// sessions of the device are revoked only
+	resp = s.request(http.MethodGet, "/api/v1/account/identities", deviceToken.AccessToken, nil)
+	s.Equal(http.StatusForbidden, resp.Code)
+	resp = s.request(http.MethodGet, "/api/v1/account/identities", ssoToken.AccessToken, nil)
+	s.Equal(http.StatusOK, resp.Code)
+}
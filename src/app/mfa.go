@@ -0,0 +1,395 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+	"github.com/andy74139/webserver/src/domain/entity/mfa"
+	"github.com/andy74139/webserver/src/domain/entity/password"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+// mfaReauthDuration is how long after login the session can disable MFA.
+const mfaReauthDuration = 10 * time.Minute
+
+type responseMFARequired struct {
+	MFARequired bool   `json:"mfa_required" example:"true" description:"The second factor is required, the login is completed by POST /api/v1/account/auth/mfa/verify"`
+	MFAToken    string `json:"mfa_token" description:"Token of the pending login, it is sent in the Authorization header to complete the login"`
+	ExpiresIn   int64  `json:"expires_in" example:"300" description:"Seconds until the pending login expires"`
+	// the device is registered or enrolled before MFA is verified, its secret is returned anyway
+	DeviceSecret string `json:"device_secret,omitempty" description:"New device secret, as responseAuthToken"`
+}
+
+// respondLogin is a shared method for login endpoint methods, it creates an authorization token,
+// or an mfa_pending token if the user enabled MFA.
+func (a *app) respondLogin(ctx *gin.Context, userID uuid.UUID, info *auth.SessionInfo) {
+	a.respondLoginWithDeviceSecret(ctx, userID, info, "")
+}
+
+// respondLoginWithDeviceSecret is respondLogin which returns the new device secret as well, if it isn't empty.
+func (a *app) respondLoginWithDeviceSecret(ctx *gin.Context, userID uuid.UUID, info *auth.SessionInfo, deviceSecret string) {
+	logger := infra.GetLogger(ctx)
+
+	status, err := a.mfaSvc.GetStatus(ctx, userID)
+	if err != nil {
+		logger.Errorw("mfaSvc.GetStatus error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if status.Enabled {
+		token, expiresAt, err := a.authSvc.CreateMFAPendingToken(ctx, userID, info)
+		if err != nil {
+			logger.Errorw("CreateMFAPendingToken error", "error", err, "user_id", userID)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		ctx.JSON(http.StatusOK, &responseMFARequired{
+			MFARequired:  true,
+			MFAToken:     token,
+			ExpiresIn:    int64(time.Until(expiresAt).Seconds()),
+			DeviceSecret: deviceSecret,
+		})
+		return
+	}
+
+	token, err := a.authSvc.CreateToken(ctx, userID, info)
+	if err != nil {
+		logger.Errorw("CreateToken error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	resp := newResponseAuthToken(token)
+	resp.DeviceSecret = deviceSecret
+	ctx.JSON(http.StatusOK, resp)
+}
+
+type requestMFACode struct {
+	Code string `json:"code" example:"123456" description:"TOTP code of the authenticator app, or a recovery code"`
+}
+
+// @Title Complete login by MFA
+// @Description Completes a login waiting for the second factor, by a TOTP code or a recovery code, which creates an authorization token. The mfa_token of the login is sent in the Authorization header.
+// @Tags authorization
+// @Resource authorization
+// @Accept json
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param request body requestMFACode true "Verify request"
+// @Success 200 object responseAuthToken "OK"
+// @Failure 400 "Bad Request"
+// @Failure 401 "Unauthorized"
+// @Failure 403 "Forbidden"
+// @Failure 429 "Too Many Requests"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/mfa/verify [post]
+func (a *app) verifyMFALogin(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	claims, err := a.authSvc.ParseMFAPendingToken(ctx, a.getJWTString(ctx))
+	if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrRevokedToken) {
+		logger.Debugw("ParseMFAPendingToken error", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired mfa token"})
+		return
+	} else if err != nil {
+		logger.Errorw("ParseMFAPendingToken error", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	userID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		// SHOULD NOT BE HERE, the subject is verified
+		logger.Errorw("uuid.Parse error", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	req := &requestMFACode{}
+	if err := ctx.BindJSON(req); err != nil || req.Code == "" {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+	if !a.verifyMFACode(ctx, userID, req.Code) {
+		return
+	}
+	if !a.checkValidLoginUser(ctx, userID) {
+		return
+	}
+
+	// the pending login is completed once
+	if err := a.authSvc.RevokeToken(ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		logger.Errorw("authSvc.RevokeToken error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	token, err := a.authSvc.CreateToken(ctx, userID, newSessionInfo(ctx, claims.MFAPending.Platform, claims.MFAPending.DeviceID))
+	if err != nil {
+		logger.Errorw("CreateToken error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.JSON(http.StatusOK, newResponseAuthToken(token))
+}
+
+type responseMFAStatus struct {
+	Enabled           bool `json:"enabled" example:"true" description:"Whether MFA is enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left" example:"10" description:"Number of unused recovery codes"`
+}
+
+// @Title Get MFA status
+// @Description Gets the MFA status of the account.
+// @Tags authorization
+// @Resource authorization
+// @Produce json
+// @Header defaultRequestHeaders
+// @Success 200 object responseMFAStatus "OK"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/mfa [get]
+func (a *app) getMFAStatus(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	status, err := a.mfaSvc.GetStatus(ctx, userID)
+	if err != nil {
+		logger.Errorw("mfaSvc.GetStatus error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.JSON(http.StatusOK, &responseMFAStatus{
+		Enabled:           status.Enabled,
+		RecoveryCodesLeft: status.RecoveryCodesLeft,
+	})
+}
+
+type responseTOTPEnrollment struct {
+	Secret string `json:"secret" example:"JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP" description:"Base32 TOTP secret, for manual entry"`
+	URI    string `json:"uri" example:"otpauth://totp/WebServer:capoo@example.com?secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP&issuer=WebServer" description:"otpauth URI, usually shown as a QR code"`
+}
+
+// @Title Enroll TOTP
+// @Description Generates a TOTP secret of the account, it is enabled after a code of it is confirmed. Enrolling again replaces the unconfirmed secret.
+// @Tags authorization
+// @Resource authorization
+// @Produce json
+// @Header defaultRequestHeaders
+// @Success 201 object responseTOTPEnrollment "Created"
+// @Failure 403 "Forbidden"
+// @Failure 409 "Conflict"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/mfa/totp [post]
+func (a *app) enrollTOTP(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	accountName, ok := a.getAccountName(ctx, userID)
+	if !ok {
+		return
+	}
+
+	enrollment, err := a.mfaSvc.Enroll(ctx, userID, accountName)
+	if errors.Is(err, mfa.ErrAlreadyEnabled) {
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "mfa is enabled"})
+		return
+	} else if err != nil {
+		logger.Errorw("mfaSvc.Enroll error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.JSON(http.StatusCreated, &responseTOTPEnrollment{Secret: enrollment.Secret, URI: enrollment.URI})
+}
+
+type responseRecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes" example:"abcde-fghij" description:"Recovery codes, each is used once when the authenticator app is lost. They are returned only once."`
+}
+
+// @Title Confirm TOTP
+// @Description Enables MFA by a TOTP code of the enrolled secret, and returns recovery codes.
+// @Tags authorization
+// @Resource authorization
+// @Accept json
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param request body requestMFACode true "Confirm request"
+// @Success 200 object responseRecoveryCodes "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 409 "Conflict"
+// @Failure 429 "Too Many Requests"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/mfa/totp [put]
+func (a *app) confirmTOTP(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	req := &requestMFACode{}
+	if err := ctx.BindJSON(req); err != nil || req.Code == "" {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+
+	recoveryCodes, err := a.mfaSvc.Confirm(ctx, userID, req.Code)
+	if errors.Is(err, mfa.ErrNotFound) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "totp is not enrolled"})
+		return
+	} else if errors.Is(err, mfa.ErrAlreadyEnabled) {
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "mfa is enabled"})
+		return
+	} else if errors.Is(err, mfa.ErrInvalidCode) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid code"})
+		return
+	} else if err != nil {
+		logger.Errorw("mfaSvc.Confirm error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.JSON(http.StatusOK, &responseRecoveryCodes{RecoveryCodes: recoveryCodes})
+}
+
+// @Title Regenerate recovery codes
+// @Description Replaces recovery codes of the account, previous recovery codes are invalid.
+// @Tags authorization
+// @Resource authorization
+// @Accept json
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param request body requestMFACode true "Regenerate request"
+// @Success 200 object responseRecoveryCodes "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/mfa/recovery-codes [post]
+func (a *app) regenerateRecoveryCodes(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	req := &requestMFACode{}
+	if err := ctx.BindJSON(req); err != nil || req.Code == "" {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+	if !a.verifyMFACode(ctx, userID, req.Code) {
+		return
+	}
+
+	recoveryCodes, err := a.mfaSvc.RegenerateRecoveryCodes(ctx, userID)
+	if err != nil {
+		logger.Errorw("mfaSvc.RegenerateRecoveryCodes error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.JSON(http.StatusOK, &responseRecoveryCodes{RecoveryCodes: recoveryCodes})
+}
+
+// @Title Disable MFA
+// @Description Disables MFA of the account by a TOTP code or a recovery code. It requires the session logged in within 10 minutes, otherwise it responds 401 and the user logs in again.
+// @Tags authorization
+// @Resource authorization
+// @Accept json
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param request body requestMFACode true "Disable request"
+// @Success 200 "OK"
+// @Failure 400 "Bad Request"
+// @Failure 401 "Unauthorized"
+// @Failure 403 "Forbidden"
+// @Failure 429 "Too Many Requests"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/mfa [delete]
+func (a *app) disableMFA(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, claims, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+	if !claims.IsAuthenticatedWithin(time.Now(), mfaReauthDuration) {
+		logger.Debugw("reauthentication required", "user_id", userID)
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "reauthentication required"})
+		return
+	}
+
+	req := &requestMFACode{}
+	if err := ctx.BindJSON(req); err != nil || req.Code == "" {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+	if !a.verifyMFACode(ctx, userID, req.Code) {
+		return
+	}
+
+	if err := a.mfaSvc.Disable(ctx, userID); err != nil {
+		logger.Errorw("mfaSvc.Disable error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// verifyMFACode is a shared method for endpoint methods, it verifies a TOTP code or a recovery code of the user.
+func (a *app) verifyMFACode(ctx *gin.Context, userID uuid.UUID, code string) bool {
+	logger := infra.GetLogger(ctx)
+
+	account := "user:" + userID.String()
+	if !a.checkLockout(ctx, account) {
+		return false
+	}
+	err := a.mfaSvc.Verify(ctx, userID, code)
+	if err == nil || errors.Is(err, mfa.ErrInvalidCode) {
+		a.recordCredentialResult(ctx, account, err == nil)
+	}
+
+	if errors.Is(err, mfa.ErrInvalidCode) {
+		logger.Debugw("invalid mfa code", "user_id", userID)
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid code"})
+		return false
+	} else if errors.Is(err, mfa.ErrNotEnabled) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "mfa is not enabled"})
+		return false
+	} else if err != nil {
+		logger.Errorw("mfaSvc.Verify error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// getAccountName is a shared method for endpoint methods, it returns the name shown in authenticators,
+// which is the email if the account has it.
+func (a *app) getAccountName(ctx *gin.Context, userID uuid.UUID) (string, bool) {
+	credential, err := a.passwordSvc.GetByUserID(ctx, userID)
+	if errors.Is(err, password.ErrNotFound) {
+		return userID.String(), true
+	} else if err != nil {
+		infra.GetLogger(ctx).Errorw("passwordSvc.GetByUserID error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return "", false
+	}
+	return credential.Email, true
+}
@@ -0,0 +1,165 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andy74139/webserver/src/domain/entity/password"
+	"github.com/andy74139/webserver/src/domain/entity/ratelimit"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+// RequireScopes is a middleware which requires the authorization token or the API key to be granted all the scopes.
+func (a *app) RequireScopes(scopes ...string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		logger := infra.GetLogger(ctx)
+
+		userID, claims, _, ok := a.verifyAuthOrAPIKey(ctx)
+		if !ok {
+			return
+		}
+		for _, scope := range scopes {
+			if !claims.HasScope(scope) {
+				logger.Debugw("insufficient scope", "user_id", userID, "scope", scope, "token_scope", claims.Scope)
+				ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "insufficient scope: " + scope})
+				return
+			}
+		}
+		ctx.Next()
+	}
+}
+
+// RequireClientScopes is a middleware of service endpoints, which requires the token of the client credentials grant
+// to be granted all the scopes. Tokens of users and API keys are rejected.
+func (a *app) RequireClientScopes(scopes ...string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		logger := infra.GetLogger(ctx)
+
+		client1, claims, ok := a.verifyClientAuth(ctx)
+		if !ok {
+			return
+		}
+		for _, scope := range scopes {
+			if !claims.HasScope(scope) {
+				logger.Debugw("insufficient scope", "client_id", client1.ID, "scope", scope, "token_scope", claims.Scope)
+				ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "insufficient scope: " + scope})
+				return
+			}
+		}
+		ctx.Next()
+	}
+}
+
+// RequireRole is a middleware which requires the user of the authorization token or the API key to have any of the roles.
+func (a *app) RequireRole(roles ...string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		logger := infra.GetLogger(ctx)
+
+		userID, claims, _, ok := a.verifyAuthOrAPIKey(ctx)
+		if !ok {
+			return
+		}
+		if !claims.HasRole(roles...) {
+			logger.Debugw("insufficient role", "user_id", userID, "roles", roles, "token_roles", claims.Roles)
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "insufficient role: requires " + strings.Join(roles, " or ")})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// DenyClientTokens is a middleware of credential-minting and destructive endpoints, e.g. creating API keys or deleting
+// the account, which rejects tokens of OAuth clients and API keys. Their grants are revocable by the user, the
+// credentials minted by them wouldn't be. It is used after RequireScopes.
+func (a *app) DenyClientTokens() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		logger := infra.GetLogger(ctx)
+
+		userID, claims, _, ok := a.verifyAuthOrAPIKey(ctx)
+		if !ok {
+			return
+		}
+		if ctx.GetHeader(apiKeyHeader) != "" {
+			logger.Debugw("api key on credential endpoint", "user_id", userID, "api_key_id", claims.ID)
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "not allowed by api keys"})
+			return
+		} else if claims.ClientID != "" {
+			logger.Debugw("client token on credential endpoint", "user_id", userID, "client_id", claims.ClientID)
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "not allowed by oauth clients"})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// DenyImpersonation is a middleware of destructive endpoints, e.g. deleting the account, which rejects impersonation
+// tokens of operators. It is used after RequireScopes.
+func (a *app) DenyImpersonation() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		logger := infra.GetLogger(ctx)
+
+		userID, claims, _, ok := a.verifyAuthOrAPIKey(ctx)
+		if !ok {
+			return
+		}
+		if claims.IsImpersonation() {
+			logger.Infow("impersonation token on destructive endpoint", "user_id", userID, "actor_id", claims.Actor.Subject)
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "not allowed by impersonation"})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// maxRateLimitBodySize is the max size of request bodies read for keys of rate limits.
+const maxRateLimitBodySize = 64 * 1024
+
+// RateLimit is a middleware which limits requests of the route by the rules, it responds 429 with Retry-After if any rule is exceeded.
+// Device and account keys are read from the JSON request body, i.e. platform and device_id, and email,
+// and rules of absent keys are skipped.
+func (a *app) RateLimit(rules ...ratelimit.Rule) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		keys := getRateLimitKeys(ctx)
+		for _, rule := range rules {
+			if key := keys[rule.Key]; key != "" && !a.checkRateLimit(ctx, rule, key) {
+				return
+			}
+		}
+		ctx.Next()
+	}
+}
+
+// getRateLimitKeys returns keys of the request, the request body is kept for endpoint methods.
+func getRateLimitKeys(ctx *gin.Context) map[ratelimit.KeyType]string {
+	keys := map[ratelimit.KeyType]string{ratelimit.KeyIP: ctx.ClientIP()}
+	if ctx.Request.Body == nil || ctx.Request.Body == http.NoBody {
+		return keys
+	}
+
+	body, err := io.ReadAll(io.LimitReader(ctx.Request.Body, maxRateLimitBodySize))
+	ctx.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), ctx.Request.Body))
+	if err != nil {
+		return keys
+	}
+	fields := struct {
+		Platform string `json:"platform"`
+		DeviceID string `json:"device_id"`
+		Email    string `json:"email"`
+	}{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		// endpoint methods reject it
+		return keys
+	}
+	if fields.DeviceID != "" {
+		keys[ratelimit.KeyDevice] = fields.Platform + ":" + fields.DeviceID
+	}
+	if email, err := password.NormalizeEmail(fields.Email); err == nil {
+		keys[ratelimit.KeyAccount] = email
+	}
+	return keys
+}
@@ -0,0 +1,227 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+	"github.com/andy74139/webserver/src/domain/entity/client"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+const (
+	// tokenCacheDuration bounds how long a revocation takes to be seen by cached verifications
+	tokenCacheDuration = time.Second * 10
+	tokenCacheSize     = 10000
+)
+
+// verifyTokenCached is a shared method for endpoint methods called by other services, it verifies the access token with cache.
+// Tokens exchanged for other services are active only for their audiences.
+// It returns nil without error if the token isn't active.
+func (a *app) verifyTokenCached(ctx *gin.Context, token string, audiences ...string) (*verifiedAuth, error) {
+	key := getTokenCacheKey(strings.Join(append([]string{"jwt"}, audiences...), " "), token)
+	if result, ok := a.tokenCache.Get(key); ok {
+		return result, nil
+	}
+
+	claims, isSuggestRefresh, err := a.authSvc.ParseAndVerifyToken(ctx, token, audiences...)
+	if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrRevokedToken) {
+		// inactive tokens never become active
+		a.tokenCache.Set(key, nil, time.Now().Add(tokenCacheDuration))
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	userID := uuid.Nil
+	if !claims.IsClientSubject() {
+		userID, err = uuid.Parse(claims.Subject)
+		if err != nil {
+			// SHOULD NOT BE HERE, the subject is verified
+			return nil, fmt.Errorf("uuid.Parse error: %w", err)
+		}
+	}
+
+	result := &verifiedAuth{userID: userID, claims: claims, isSuggestRefresh: isSuggestRefresh}
+	expiresAt := time.Now().Add(tokenCacheDuration)
+	if claims.ExpiresAt.Time.Before(expiresAt) {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	a.tokenCache.Set(key, result, expiresAt)
+	return result, nil
+}
+
+// getTokenCacheKey returns the key of the token in the token cache, tokens of different kinds never share results.
+func getTokenCacheKey(kind string, token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return kind + ":" + hex.EncodeToString(sum[:])
+}
+
+// authenticateClient is a shared method for endpoint methods of other services.
+// Client credentials are read from the basic authorization header, or from the form body.
+func (a *app) authenticateClient(ctx *gin.Context) (*client.Client, bool) {
+	logger := infra.GetLogger(ctx)
+
+	clientID, secret, ok := ctx.Request.BasicAuth()
+	if ok {
+		// RFC 6749 2.3.1, credentials are form-urlencoded before basic encoding
+		var err1, err2 error
+		clientID, err1 = url.QueryUnescape(clientID)
+		secret, err2 = url.QueryUnescape(secret)
+		ok = err1 == nil && err2 == nil
+	} else {
+		clientID, secret = ctx.PostForm("client_id"), ctx.PostForm("client_secret")
+		ok = clientID != ""
+	}
+	if !ok {
+		ctx.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_client"})
+		return nil, false
+	}
+
+	client1, err := a.clientSvc.Authenticate(ctx, clientID, secret)
+	if errors.Is(err, client.ErrInvalidCredentials) {
+		logger.Debugw("invalid client credentials", "client_id", clientID)
+		ctx.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_client"})
+		return nil, false
+	} else if err != nil {
+		logger.Errorw("clientSvc.Authenticate error", "client_id", clientID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+	return client1, true
+}
+
+// verifyClientAuth is a shared method for service endpoint methods, it verifies the token of the client credentials
+// grant in the Authorization header. Tokens of users are rejected, and tokens of deleted clients are rejected.
+func (a *app) verifyClientAuth(ctx *gin.Context) (*client.Client, *auth.Claims, bool) {
+	logger := infra.GetLogger(ctx)
+
+	token := a.getJWTString(ctx)
+	if token == "" {
+		ctx.Header("WWW-Authenticate", "Bearer")
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+		return nil, nil, false
+	}
+	result, err := a.verifyTokenCached(ctx, token)
+	if err != nil {
+		logger.Errorw("verifyTokenCached error", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return nil, nil, false
+	} else if result == nil || !result.claims.IsClientSubject() {
+		logger.Debugw("invalid client token")
+		ctx.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+		return nil, nil, false
+	}
+
+	client1, err := a.clientSvc.Get(ctx, result.claims.Subject)
+	if errors.Is(err, client.ErrNotFound) {
+		logger.Debugw("client of token is deleted", "client_id", result.claims.Subject)
+		ctx.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+		return nil, nil, false
+	} else if err != nil {
+		logger.Errorw("clientSvc.Get error", "client_id", result.claims.Subject, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	return client1, result.claims, true
+}
+
+type responseIntrospect struct {
+	Active    bool        `json:"active" example:"true" description:"Is the token valid and not revoked"`
+	Scope     string      `json:"scope,omitempty" example:"account:read account:write" description:"Space-separated scopes of the token"`
+	TokenType string      `json:"token_type,omitempty" example:"Bearer" description:"Type of the token"`
+	Subject   string      `json:"sub,omitempty" example:"01B6C691-EE6E-48F2-B2DE-AFC1DA180EFE" description:"User ID, or the client ID for tokens of clients themselves"`
+	ClientID  string      `json:"client_id,omitempty" example:"5f0c6c2e-3b8e-4a41-9d53-2f7d3c1b8a90" description:"Client the token is issued to, empty for logins of users"`
+	Audience  []string    `json:"aud,omitempty" example:"5f0c6c2e-3b8e-4a41-9d53-2f7d3c1b8a90" description:"Services the token is exchanged for, empty if the token isn't restricted"`
+	Actor     *auth.Actor `json:"act,omitempty" description:"Client acting on behalf of the user, for exchanged tokens, or the operator impersonating the user"`
+	ExpiresAt int64       `json:"exp,omitempty" example:"2047015546" description:"Expiration time in unix seconds"`
+	IssuedAt  int64       `json:"iat,omitempty" example:"2047014646" description:"Issued time in unix seconds"`
+	Issuer    string      `json:"iss,omitempty" example:"https://my.domain.com" description:"Issuer of the token"`
+	JWTID     string      `json:"jti,omitempty" example:"9c750e98-c456-4ac0-865c-d3d9d68016b5" description:"Token ID"`
+}
+
+// @Title Introspect token
+// @Description Verifies the access token for other services, including its revocation (RFC 7662). The client authenticates by its credentials or by its token of the client credentials grant, and must be granted the token:introspect scope. Exchanged tokens are active only for the clients of their audiences. Revocations are seen within 10 seconds.
+// @Tags oauth
+// @Resource oauth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param token formData string true "Access token"
+// @Param token_type_hint formData string false "Type of the token, only access_token is supported"
+// @Success 200 object responseIntrospect "OK"
+// @Failure 400 "Bad Request"
+// @Failure 401 "Unauthorized"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /oauth/introspect [post]
+func (a *app) introspectToken(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	var client1 *client.Client
+	var ok bool
+	if a.getJWTString(ctx) != "" {
+		var claims *auth.Claims
+		client1, claims, ok = a.verifyClientAuth(ctx)
+		if ok && !claims.HasScope(auth.ScopeTokenIntrospect) {
+			logger.Debugw("client token can't introspect", "client_id", client1.ID)
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "insufficient_scope"})
+			return
+		}
+	} else {
+		client1, ok = a.authenticateClient(ctx)
+	}
+	if !ok {
+		return
+	}
+	if !client1.HasScope(auth.ScopeTokenIntrospect) {
+		logger.Debugw("client can't introspect", "client_id", client1.ID)
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "insufficient_scope"})
+		return
+	}
+
+	token := ctx.PostForm("token")
+	if token == "" {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+		return
+	}
+
+	// exchanged tokens are active for the services they are exchanged for
+	result, err := a.verifyTokenCached(ctx, token, client1.ID)
+	if err != nil {
+		logger.Errorw("verifyTokenCached error", "client_id", client1.ID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	if result == nil {
+		ctx.JSON(http.StatusOK, &responseIntrospect{Active: false})
+		return
+	}
+	claims := result.claims
+	ctx.JSON(http.StatusOK, &responseIntrospect{
+		Active:    true,
+		Scope:     claims.Scope,
+		TokenType: "Bearer",
+		Subject:   claims.Subject,
+		ClientID:  claims.ClientID,
+		Audience:  claims.Audience,
+		Actor:     claims.Actor,
+		ExpiresAt: claims.ExpiresAt.Unix(),
+		IssuedAt:  claims.IssuedAt.Unix(),
+		Issuer:    claims.Issuer,
+		JWTID:     claims.ID,
+	})
+}
@@ -0,0 +1,272 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/otp"
+	"github.com/andy74139/webserver/src/domain/entity/password"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+// platformOTP is the platform of login sessions created by one-time codes and magic links.
+const platformOTP = "otp"
+
+type requestSendOTP struct {
+	Email string `json:"email" example:"capoo@example.com" description:"Verified email address of the account"`
+}
+
+// @Title Send login code
+// @Description Sends a one-time code and a magic link to the email, if it is a verified email of an account. It responds the same whether the account exists or not.
+// @Tags authorization
+// @Resource authorization
+// @Accept json
+// @Produce json
+// @Param request body requestSendOTP true "Send request"
+// @Success 202 "Accepted"
+// @Failure 400 "Bad Request"
+// @Failure 429 "Too Many Requests"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/otp [post]
+func (a *app) sendLoginOTP(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	req := &requestSendOTP{}
+	if err := ctx.BindJSON(req); err != nil {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+	email, err := password.NormalizeEmail(req.Email)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid email"})
+		return
+	}
+
+	credential, err := a.passwordSvc.GetByEmail(ctx, email)
+	if errors.Is(err, password.ErrNotFound) || (err == nil && !credential.IsEmailVerified()) {
+		// not to tell whether the account exists
+		logger.Debugw("no verified email, code is not sent")
+		ctx.Status(http.StatusAccepted)
+		return
+	} else if err != nil {
+		logger.Errorw("passwordSvc.GetByEmail error", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !a.sendOTP(ctx, otp.PurposeLogin, email) {
+		return
+	}
+	ctx.Status(http.StatusAccepted)
+}
+
+type requestVerifyOTP struct {
+	Email string `json:"email,omitempty" example:"capoo@example.com" description:"Email address, required with code"`
+	Code  string `json:"code,omitempty" example:"123456" description:"One-time code sent to the email"`
+	Token string `json:"token,omitempty" description:"Token of the magic link, used if code is empty"`
+}
+
+// @Title Login by one-time code
+// @Description Login by a one-time code or the token of a magic link sent to the email, which creates an authorization token. A code is rejected after 5 wrong attempts. If MFA is enabled, it responds responseMFARequired instead.
+// @Tags authorization
+// @Resource authorization
+// @Accept json
+// @Produce json
+// @Param request body requestVerifyOTP true "Login request"
+// @Success 200 object responseAuthToken "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 429 "Too Many Requests"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/otp/verify [post]
+func (a *app) loginByOTP(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	req := &requestVerifyOTP{}
+	if err := ctx.BindJSON(req); err != nil || (req.Code == "" && req.Token == "") {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+
+	email, ok := a.verifyOTP(ctx, otp.PurposeLogin, req)
+	if !ok {
+		return
+	}
+
+	// the email may be changed or unverified after the code is sent
+	credential, err := a.passwordSvc.GetByEmail(ctx, email)
+	if errors.Is(err, password.ErrNotFound) || (err == nil && !credential.IsEmailVerified()) {
+		logger.Debugw("no verified email of the code")
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid or expired code"})
+		return
+	} else if err != nil {
+		logger.Errorw("passwordSvc.GetByEmail error", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !a.checkValidLoginUser(ctx, credential.UserID) {
+		return
+	}
+
+	a.respondLogin(ctx, credential.UserID, newSessionInfo(ctx, platformOTP, ""))
+}
+
+// @Title Send email verification
+// @Description Sends a one-time code and a magic link to the email of the account, to verify the email.
+// @Tags account
+// @Resource account
+// @Produce json
+// @Header defaultRequestHeaders
+// @Success 202 "Accepted"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 409 "Conflict"
+// @Failure 429 "Too Many Requests"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/email/verification [post]
+func (a *app) sendEmailVerification(ctx *gin.Context) {
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	credential, ok := a.getEmailCredential(ctx, userID)
+	if !ok {
+		return
+	}
+	if credential.IsEmailVerified() {
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "email is verified"})
+		return
+	}
+
+	if !a.sendOTP(ctx, otp.PurposeVerifyEmail, credential.Email) {
+		return
+	}
+	ctx.Status(http.StatusAccepted)
+}
+
+// @Title Verify email
+// @Description Verifies the email of the account by the one-time code or the token of the magic link, then the email can login by one-time codes.
+// @Tags account
+// @Resource account
+// @Accept json
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param request body requestVerifyOTP true "Verify request, email is ignored"
+// @Success 200 "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 429 "Too Many Requests"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/email/verification [put]
+func (a *app) verifyEmail(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	req := &requestVerifyOTP{}
+	if err := ctx.BindJSON(req); err != nil || (req.Code == "" && req.Token == "") {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+
+	credential, ok := a.getEmailCredential(ctx, userID)
+	if !ok {
+		return
+	}
+	req.Email = credential.Email
+	email, ok := a.verifyOTP(ctx, otp.PurposeVerifyEmail, req)
+	if !ok {
+		return
+	} else if email != credential.Email {
+		logger.Debugw("magic link of another email", "user_id", userID)
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid or expired code"})
+		return
+	}
+
+	if err := a.passwordSvc.SetEmailVerified(ctx, userID); err != nil {
+		logger.Errorw("passwordSvc.SetEmailVerified error", "user_id", userID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// getEmailCredential is a shared method for endpoint methods, it gets the email credential of the user.
+func (a *app) getEmailCredential(ctx *gin.Context, userID uuid.UUID) (*password.Credential, bool) {
+	logger := infra.GetLogger(ctx)
+
+	credential, err := a.passwordSvc.GetByUserID(ctx, userID)
+	if errors.Is(err, password.ErrNotFound) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "account has no email"})
+		return nil, false
+	} else if err != nil {
+		logger.Errorw("passwordSvc.GetByUserID error", "user_id", userID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return nil, false
+	}
+	return credential, true
+}
+
+// sendOTP is a shared method for endpoint methods, it sends a one-time code to the normalized email.
+func (a *app) sendOTP(ctx *gin.Context, purpose otp.Purpose, email string) bool {
+	logger := infra.GetLogger(ctx)
+
+	if err := a.otpSvc.Send(ctx, purpose, email); errors.Is(err, otp.ErrTooSoon) {
+		ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "code was sent recently"})
+		return false
+	} else if err != nil {
+		logger.Errorw("otpSvc.Send error", "purpose", purpose, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// verifyOTP is a shared method for endpoint methods, it verifies the code, or the token of the magic link, and returns the email.
+func (a *app) verifyOTP(ctx *gin.Context, purpose otp.Purpose, req *requestVerifyOTP) (string, bool) {
+	logger := infra.GetLogger(ctx)
+
+	var email string
+	var err error
+	if req.Code != "" {
+		email, err = password.NormalizeEmail(req.Email)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid email"})
+			return "", false
+		}
+		// codes are short, guesses of new codes are locked out as well
+		account := "email:" + email
+		if !a.checkLockout(ctx, account) {
+			return "", false
+		}
+		err = a.otpSvc.VerifyCode(ctx, purpose, email, req.Code)
+		if err == nil || errors.Is(err, otp.ErrInvalidCode) || errors.Is(err, otp.ErrTooManyAttempts) {
+			a.recordCredentialResult(ctx, account, err == nil)
+		}
+	} else {
+		email, err = a.otpSvc.VerifyLink(ctx, purpose, req.Token)
+	}
+
+	if errors.Is(err, otp.ErrInvalidCode) || errors.Is(err, otp.ErrTooManyAttempts) {
+		logger.Debugw("otp verify error", "purpose", purpose, "error", err)
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return "", false
+	} else if err != nil {
+		logger.Errorw("otp verify error", "purpose", purpose, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return "", false
+	}
+	return email, true
+}
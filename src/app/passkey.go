@@ -0,0 +1,259 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andy74139/webserver/src/domain/entity/webauthn"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+// platformPasskey is the platform of login sessions created by passkeys.
+const platformPasskey = "passkey"
+
+type responsePasskey struct {
+	ID         string     `json:"id" example:"xX0b3H6mJ2yWgk7Lq0Ue4A" description:"Base64url credential ID"`
+	Name       string     `json:"name" example:"My phone" description:"Name of the passkey"`
+	CreatedAt  time.Time  `json:"created_at" description:"Registration time"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" description:"Last login time, empty if never used"`
+}
+
+type responseListPasskeys struct {
+	Passkeys []*responsePasskey `json:"passkeys" description:"Passkeys ordered by registration time"`
+}
+
+func newResponsePasskey(credential *webauthn.Credential) *responsePasskey {
+	resp := &responsePasskey{
+		ID:        credential.ID,
+		Name:      credential.Name,
+		CreatedAt: credential.CreatedAt,
+	}
+	if !credential.LastUsedAt.IsZero() {
+		resp.LastUsedAt = &credential.LastUsedAt
+	}
+	return resp
+}
+
+// @Title List passkeys
+// @Description Lists passkeys of the account.
+// @Tags authorization
+// @Resource authorization
+// @Produce json
+// @Header defaultRequestHeaders
+// @Success 200 object responseListPasskeys "OK"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/passkeys [get]
+func (a *app) listPasskeys(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	credentials, err := a.webAuthnSvc.ListCredentials(ctx, userID)
+	if err != nil {
+		logger.Errorw("webAuthnSvc.ListCredentials error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	resp := &responseListPasskeys{Passkeys: make([]*responsePasskey, 0, len(credentials))}
+	for _, credential := range credentials {
+		resp.Passkeys = append(resp.Passkeys, newResponsePasskey(credential))
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// @Title Delete passkey
+// @Description Deletes a passkey of the account, it can't login any more.
+// @Tags authorization
+// @Resource authorization
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param id path string true "Credential ID"
+// @Success 200 "OK"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/passkeys/{id} [delete]
+func (a *app) deletePasskey(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	credentialID := ctx.Param("id")
+	if err := a.webAuthnSvc.DeleteCredential(ctx, userID, credentialID); errors.Is(err, webauthn.ErrNotFound) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "passkey not found"})
+		return
+	} else if err != nil {
+		logger.Errorw("webAuthnSvc.DeleteCredential error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// @Title Begin passkey registration
+// @Description Creates options of navigator.credentials.create() to register a passkey of the account, the options expire in 5 minutes.
+// @Tags authorization
+// @Resource authorization
+// @Produce json
+// @Header defaultRequestHeaders
+// @Success 200 object webauthn.CreationOptions "OK"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/passkeys/registration/begin [post]
+func (a *app) beginPasskeyRegistration(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+	accountName, ok := a.getAccountName(ctx, userID)
+	if !ok {
+		return
+	}
+
+	options, err := a.webAuthnSvc.BeginRegistration(ctx, userID, accountName)
+	if err != nil {
+		logger.Errorw("webAuthnSvc.BeginRegistration error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.JSON(http.StatusOK, options)
+}
+
+type requestFinishPasskeyRegistration struct {
+	Name       string                        `json:"name" example:"My phone" description:"Name of the passkey"`
+	Credential *webauthn.AttestationResponse `json:"credential" description:"JSON of the created PublicKeyCredential"`
+}
+
+// @Title Finish passkey registration
+// @Description Verifies and saves the passkey created by the options of the registration.
+// @Tags authorization
+// @Resource authorization
+// @Accept json
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param request body requestFinishPasskeyRegistration true "Registration request"
+// @Success 201 object responsePasskey "Created"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 409 "Conflict"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/passkeys/registration/finish [post]
+func (a *app) finishPasskeyRegistration(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	req := &requestFinishPasskeyRegistration{}
+	if err := ctx.BindJSON(req); err != nil || req.Credential == nil {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+	if req.Name == "" {
+		req.Name = "Passkey"
+	}
+
+	credential, err := a.webAuthnSvc.FinishRegistration(ctx, userID, req.Name, req.Credential)
+	if errors.Is(err, webauthn.ErrInvalidChallenge) || errors.Is(err, webauthn.ErrInvalidResponse) {
+		logger.Debugw("webAuthnSvc.FinishRegistration error", "error", err, "user_id", userID)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid passkey registration"})
+		return
+	} else if errors.Is(err, webauthn.ErrCredentialExists) {
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "passkey is registered"})
+		return
+	} else if err != nil {
+		logger.Errorw("webAuthnSvc.FinishRegistration error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.JSON(http.StatusCreated, newResponsePasskey(credential))
+}
+
+// @Title Begin passkey login
+// @Description Creates options of navigator.credentials.get() to login by a passkey, the options expire in 5 minutes.
+// @Tags authorization
+// @Resource authorization
+// @Produce json
+// @Success 200 object webauthn.RequestOptions "OK"
+// @Failure 429 "Too Many Requests"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/passkeys/login/begin [post]
+func (a *app) beginPasskeyLogin(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	options, err := a.webAuthnSvc.BeginLogin(ctx)
+	if err != nil {
+		logger.Errorw("webAuthnSvc.BeginLogin error", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.JSON(http.StatusOK, options)
+}
+
+// @Title Login by passkey
+// @Description Login by the passkey assertion of the login options, which creates an authorization token. MFA isn't required, since passkeys verify the user.
+// @Tags authorization
+// @Resource authorization
+// @Accept json
+// @Produce json
+// @Param request body webauthn.AssertionResponse true "JSON of the PublicKeyCredential"
+// @Success 200 object responseAuthToken "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 429 "Too Many Requests"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/passkeys/login/finish [post]
+func (a *app) loginByPasskey(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	req := &webauthn.AssertionResponse{}
+	if err := ctx.BindJSON(req); err != nil {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+
+	userID, err := a.webAuthnSvc.FinishLogin(ctx, req)
+	if errors.Is(err, webauthn.ErrInvalidChallenge) || errors.Is(err, webauthn.ErrInvalidResponse) {
+		logger.Debugw("webAuthnSvc.FinishLogin error", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid passkey"})
+		return
+	} else if errors.Is(err, webauthn.ErrSignCount) {
+		// the passkey may be cloned, it is kept for the user to check
+		logger.Warnw("passkey sign count is not increased", "credential_id", req.ID)
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid passkey"})
+		return
+	} else if err != nil {
+		logger.Errorw("webAuthnSvc.FinishLogin error", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !a.checkValidLoginUser(ctx, userID) {
+		return
+	}
+
+	token, err := a.authSvc.CreateToken(ctx, userID, newSessionInfo(ctx, platformPasskey, ""))
+	if err != nil {
+		logger.Errorw("CreateToken error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.JSON(http.StatusOK, newResponseAuthToken(token))
+}
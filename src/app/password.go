@@ -0,0 +1,200 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andy74139/webserver/src/domain/entity/password"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+// platformEmail is the platform of login sessions created by email and password.
+const platformEmail = "email"
+
+type requestRegisterByEmail struct {
+	Email    string `json:"email" example:"capoo@example.com" description:"Email address, it is case-insensitive"`
+	Password string `json:"password" example:"capoo-is-cute" description:"Password, it must satisfy the password policy"`
+	Name     string `json:"name,omitempty" example:"Capoo" description:"User name"`
+}
+
+// @Title Register by email
+// @Description Registers an account by email and password, and creates an authorization token.
+// @Tags account
+// @Resource account
+// @Accept json
+// @Produce json
+// @Param request body requestRegisterByEmail true "Register request"
+// @Success 201 object responseAuthToken "Created"
+// @Failure 400 "Bad Request"
+// @Failure 409 "Conflict"
+// @Failure 429 "Too Many Requests"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/email [post]
+func (a *app) registerByEmail(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	req := &requestRegisterByEmail{}
+	if err := ctx.BindJSON(req); err != nil {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+
+	userID, err := a.passwordSvc.Register(ctx, req.Email, req.Password, req.Name)
+	if errors.Is(err, password.ErrInvalidEmail) || errors.Is(err, password.ErrWeakPassword) {
+		logger.Debugw("passwordSvc.Register error", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if errors.Is(err, password.ErrEmailTaken) {
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "email is taken"})
+		return
+	} else if err != nil {
+		logger.Errorw("passwordSvc.Register error", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	token, err := a.authSvc.CreateToken(ctx, userID, newSessionInfo(ctx, platformEmail, ""))
+	if err != nil {
+		logger.Errorw("CreateToken error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, newResponseAuthToken(token))
+}
+
+type requestLoginByEmail struct {
+	Email    string `json:"email" example:"capoo@example.com" description:"Email address"`
+	Password string `json:"password" example:"capoo-is-cute" description:"Password"`
+}
+
+// @Title Login by email
+// @Description Login by email and password, which creates an authorization token. If MFA is enabled, it responds responseMFARequired instead.
+// @Tags authorization
+// @Resource authorization
+// @Accept json
+// @Produce json
+// @Param request body requestLoginByEmail true "Login request"
+// @Success 200 object responseAuthToken "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 429 "Too Many Requests"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/email [post]
+func (a *app) loginByEmail(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	req := &requestLoginByEmail{}
+	if err := ctx.BindJSON(req); err != nil {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+
+	// invalid emails fail the login, they are locked out as they are
+	account := "email:" + req.Email
+	if email, err := password.NormalizeEmail(req.Email); err == nil {
+		account = "email:" + email
+	}
+	if !a.checkLockout(ctx, account) {
+		return
+	}
+
+	userID, err := a.passwordSvc.Login(ctx, req.Email, req.Password)
+	if err == nil || errors.Is(err, password.ErrInvalidCredentials) {
+		a.recordCredentialResult(ctx, account, err == nil)
+	}
+	if errors.Is(err, password.ErrInvalidCredentials) {
+		logger.Debugw("invalid email or password")
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid email or password"})
+		return
+	} else if err != nil {
+		logger.Errorw("passwordSvc.Login error", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !a.checkValidLoginUser(ctx, userID) {
+		return
+	}
+
+	a.respondLogin(ctx, userID, newSessionInfo(ctx, platformEmail, ""))
+}
+
+type requestChangePassword struct {
+	OldPassword string `json:"old_password" example:"capoo-is-cute" description:"Current password"`
+	NewPassword string `json:"new_password" example:"capoo-is-very-cute" description:"New password, it must satisfy the password policy"`
+}
+
+// @Title Change password
+// @Description Changes the password of the account, it logs out all devices and returns a new authorization token.
+// @Tags account
+// @Resource account
+// @Accept json
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param request body requestChangePassword true "Change password request"
+// @Success 200 object responseAuthToken "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 429 "Too Many Requests"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/password [put]
+func (a *app) changePassword(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	req := &requestChangePassword{}
+	if err := ctx.BindJSON(req); err != nil {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+
+	account := "user:" + userID.String()
+	if !a.checkLockout(ctx, account) {
+		return
+	}
+
+	err := a.passwordSvc.ChangePassword(ctx, userID, req.OldPassword, req.NewPassword)
+	if errors.Is(err, password.ErrInvalidCredentials) {
+		a.recordCredentialResult(ctx, account, false)
+	}
+	if errors.Is(err, password.ErrNotFound) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "account has no password"})
+		return
+	} else if errors.Is(err, password.ErrInvalidCredentials) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid password"})
+		return
+	} else if errors.Is(err, password.ErrWeakPassword) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		logger.Errorw("passwordSvc.ChangePassword error", "user_id", userID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// credential is changed, logs out all devices, and gives the caller a new token
+	if err := a.authSvc.RevokeUserTokens(ctx, userID); err != nil {
+		logger.Errorw("authSvc.RevokeUserTokens error", "user_id", userID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	token, err := a.authSvc.CreateToken(ctx, userID, newSessionInfo(ctx, platformEmail, ""))
+	if err != nil {
+		logger.Errorw("CreateToken error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, newResponseAuthToken(token))
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andy74139/webserver/src/domain/entity/user"
+)
+
+type responseServiceUser struct {
+	ID          string     `json:"id" example:"01B6C691-EE6E-48F2-B2DE-AFC1DA180EFE" description:"User ID"`
+	Name        string     `json:"name" example:"User123456" description:"User name"`
+	Roles       []string   `json:"roles" example:"user" description:"Roles of the user"`
+	CreatedAt   time.Time  `json:"created_at" description:"Registered time"`
+	SuspendedAt *time.Time `json:"suspended_at,omitempty" description:"Suspended time, empty if not suspended"`
+}
+
+func newResponseServiceUser(user1 *user.User) *responseServiceUser {
+	resp := &responseServiceUser{
+		ID:        user1.ID.String(),
+		Name:      user1.Name,
+		Roles:     user1.Roles,
+		CreatedAt: user1.CreatedAt,
+	}
+	if !user1.SuspendedAt.IsZero() {
+		resp.SuspendedAt = &user1.SuspendedAt
+	}
+	return resp
+}
+
+// @Title Get user for services
+// @Description Gets the user for other services, e.g. cron workers. It requires a token of the client credentials grant with the users:read scope, tokens of users are rejected.
+// @Tags service
+// @Resource service
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param id path string true "User ID"
+// @Success 200 object responseServiceUser "OK"
+// @Failure 400 "Bad Request"
+// @Failure 401 "Unauthorized"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 500 "Internal Server Error"
+// @Router /api/service/v1/users/{id} [get]
+func (a *app) serviceGetUser(ctx *gin.Context) {
+	userID, ok := getUserIDParam(ctx)
+	if !ok {
+		return
+	}
+	user1, err := a.userSvc.Get(ctx, userID)
+	if !a.adminCheckUserError(ctx, userID, "userSvc.Get", err) {
+		return
+	}
+	ctx.JSON(http.StatusOK, newResponseServiceUser(user1))
+}
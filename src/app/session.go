@@ -0,0 +1,117 @@
+package app
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andy74139/webserver/src/infra"
+)
+
+type responseSession struct {
+	ID         string    `json:"id" example:"9c750e98-c456-4ac0-865c-d3d9d68016b5" description:"Session ID"`
+	Platform   string    `json:"platform" example:"android" description:"Platform of the device"`
+	DeviceID   string    `json:"device_id" example:"123456" description:"Device ID"`
+	IP         string    `json:"ip" example:"203.0.113.1" description:"IP address of the last use"`
+	UserAgent  string    `json:"user_agent" example:"okhttp/4.12.0" description:"User agent of the last use"`
+	ClientID   string    `json:"client_id,omitempty" example:"5f0c6c2e-3b8e-4a41-9d53-2f7d3c1b8a90" description:"OAuth client of the session, empty for logins of the account"`
+	CreatedAt  time.Time `json:"created_at" description:"Login time"`
+	LastUsedAt time.Time `json:"last_used_at" description:"Time of the last login or refresh"`
+	IsCurrent  bool      `json:"is_current" example:"true" description:"Is the session of the authorization token"`
+}
+
+type responseListSessions struct {
+	Sessions []*responseSession `json:"sessions" description:"Sessions ordered by last used time, latest first"`
+}
+
+// @Title List sessions
+// @Description Lists login sessions of the account on all devices.
+// @Tags authorization
+// @Resource authorization
+// @Produce json
+// @Header defaultRequestHeaders
+// @Success 200 object responseListSessions "OK"
+// @Failure 403 "Forbidden"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/sessions [get]
+func (a *app) listSessions(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, claims, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	sessions, err := a.authSvc.ListSessions(ctx, userID)
+	if err != nil {
+		logger.Errorw("ListSessions error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	resp := &responseListSessions{Sessions: make([]*responseSession, 0, len(sessions))}
+	for _, session := range sessions {
+		resp.Sessions = append(resp.Sessions, &responseSession{
+			ID:         session.ID,
+			Platform:   session.Info.Platform,
+			DeviceID:   session.Info.DeviceID,
+			IP:         session.Info.IP,
+			UserAgent:  session.Info.UserAgent,
+			ClientID:   session.Info.ClientID,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			IsCurrent:  session.ID == claims.SessionID,
+		})
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// @Title Revoke session
+// @Description Revokes the authorization token and the refresh token of a login session of the account, e.g. of a lost device.
+// @Tags authorization
+// @Resource authorization
+// @Produce json
+// @Header defaultRequestHeaders
+// @Param id path string true "Session ID"
+// @Success 200 "OK"
+// @Failure 403 "Forbidden"
+// @Failure 404 "Not Found"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/auth/sessions/{id} [delete]
+func (a *app) revokeSession(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	// only sessions of the account can be revoked
+	sessionID := ctx.Param("id")
+	sessions, err := a.authSvc.ListSessions(ctx, userID)
+	if err != nil {
+		logger.Errorw("ListSessions error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	isFound := false
+	for _, session := range sessions {
+		if session.ID == sessionID {
+			isFound = true
+			break
+		}
+	}
+	if !isFound {
+		logger.Debugw("session not found", "user_id", userID, "session_id", sessionID)
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+
+	if err := a.authSvc.RevokeSession(ctx, sessionID); err != nil {
+		logger.Errorw("RevokeSession error", "error", err, "session_id", sessionID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
@@ -0,0 +1,147 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/andy74139/webserver/src/domain/entity/transfer"
+	"github.com/andy74139/webserver/src/domain/entity/user"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+// transferReauthDuration is how long after login the session can create transfer codes.
+const transferReauthDuration = 10 * time.Minute
+
+type responseTransferCode struct {
+	Code      string `json:"code" example:"ABCD-EFGH-JKLM" description:"One-time transfer code, it is entered on the new device"`
+	ExpiresIn int64  `json:"expires_in" example:"900" description:"Seconds until the code expires"`
+}
+
+// @Title Create transfer code
+// @Description Creates a one-time code to move the device account to a new device, devices of the account are replaced by the new one. The session must login within 10 minutes.
+// @Tags account
+// @Resource account
+// @Produce json
+// @Header defaultRequestHeaders
+// @Success 201 object responseTransferCode "Created"
+// @Failure 401 "Unauthorized"
+// @Failure 403 "Forbidden"
+// @Failure 409 "Conflict"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/transfer [post]
+func (a *app) createTransferCode(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	userID, claims, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+	// a stolen token can't take the account over
+	if !claims.IsAuthenticatedWithin(time.Now(), transferReauthDuration) {
+		logger.Debugw("reauthentication required", "user_id", userID)
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "reauthentication required"})
+		return
+	}
+
+	user1, err := a.userSvc.Get(ctx, userID)
+	if err != nil {
+		logger.Errorw("userSvc.Get error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	} else if !hasIdentityKind(user1.Identities, user.IdentityKindDevice) {
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "account is not a device account"})
+		return
+	}
+
+	code, expiresAt, err := a.transferSvc.CreateCode(ctx, userID)
+	if err != nil {
+		logger.Errorw("transferSvc.CreateCode error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.JSON(http.StatusCreated, &responseTransferCode{
+		Code:      code,
+		ExpiresIn: int64(time.Until(expiresAt).Seconds()),
+	})
+}
+
+type requestRedeemTransferCode struct {
+	Code     string `json:"code" example:"ABCD-EFGH-JKLM" description:"Transfer code, it is case-insensitive and dashes are optional"`
+	Platform string `json:"platform" example:"android" description:"Platform of the new device"`
+	DeviceID string `json:"device_id" example:"654321" description:"Device ID of the new device"`
+}
+
+// @Title Redeem transfer code
+// @Description Moves the device account of the transfer code to the new device, which unlinks and logs out all other devices and creates an authorization token with the new device secret. If MFA is enabled, it responds responseMFARequired instead.
+// @Tags account
+// @Resource account
+// @Accept json
+// @Produce json
+// @Param request body requestRedeemTransferCode true "Redeem request"
+// @Success 200 object responseAuthToken "OK"
+// @Failure 400 "Bad Request"
+// @Failure 403 "Forbidden"
+// @Failure 409 "Conflict"
+// @Failure 429 "Too Many Requests"
+// @Failure 500 "Internal Server Error"
+// @Router /api/v1/account/transfer/redeem [post]
+func (a *app) redeemTransferCode(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+
+	req := &requestRedeemTransferCode{}
+	if err := ctx.BindJSON(req); err != nil || req.Code == "" || req.Platform == "" || req.DeviceID == "" {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+
+	// the code isn't consumed if the new device has an account
+	if _, err := a.userSvc.GetIDByDevice(ctx, req.Platform, req.DeviceID); err == nil {
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "device is registered"})
+		return
+	} else if !errors.Is(err, user.ErrNotFound) {
+		logger.Errorw("userSvc.GetIDByDevice error", "error", err, "platform", req.Platform, "device_id", req.DeviceID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	userID, err := a.transferSvc.RedeemCode(ctx, req.Code)
+	if errors.Is(err, transfer.ErrInvalidCode) {
+		logger.Debugw("invalid transfer code")
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		logger.Errorw("transferSvc.RedeemCode error", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !a.checkValidLoginUser(ctx, userID) {
+		return
+	}
+
+	deviceSecret, err := a.userSvc.SetDevice(ctx, userID, req.Platform, req.DeviceID)
+	if errors.Is(err, user.ErrDeviceTaken) {
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "device is registered"})
+		return
+	} else if errors.Is(err, user.ErrNotFound) {
+		// devices of the account are unlinked after the code is created
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "account is not a device account"})
+		return
+	} else if err != nil {
+		logger.Errorw("userSvc.SetDevice error", "error", err, "user_id", userID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	logger.Infow("account transferred", "user_id", userID, "platform", req.Platform)
+
+	// the old device can't login by the old secret, and its sessions are revoked as well
+	if err := a.authSvc.RevokeUserTokens(ctx, userID); err != nil {
+		logger.Errorw("authSvc.RevokeUserTokens error", "user_id", userID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	a.respondLoginWithDeviceSecret(ctx, userID, newSessionInfo(ctx, req.Platform, req.DeviceID), deviceSecret)
+}
@@ -1,10 +1,12 @@
 package app
 
 import (
+	"errors"
 	"io"
 	"math/rand"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -18,11 +20,17 @@ type requestRegister struct {
 	Name     string `json:"name,omitempty" example:"User123456" description:"User name"`
 }
 
+type responseRegister struct {
+	DeviceSecret string `json:"device_secret" example:"n8Vq3kR0tLx7bY2cW5zA1fH6jD9sE4uG0iP3oK7mQ2w" description:"Device secret, it is returned once and required by device logins"`
+}
+
 // @Title Register user
-// @Description Register user by device
+// @Description Register user by device, it returns the device secret
 // @Param  request  body  requestRegister  true  "Request body"
-// @Success  201  "Created"
+// @Success  201  object  responseRegister  "Created"
 // @Failure  400  "Bad Request"
+// @Failure  409  "Conflict"
+// @Failure  429  "Too Many Requests"
 // @Failure  500  "Internal Server Error"
 // @Resource account
 // @Route /api/v1/account [post]
@@ -42,20 +50,24 @@ func (a *app) registerByDevice(ctx *gin.Context) {
 		return
 	}
 
-	err := a.userSvc.Create(ctx, req.Platform, req.DeviceID, req.Name)
-	if err != nil {
+	deviceSecret, err := a.userSvc.Create(ctx, req.Platform, req.DeviceID, req.Name)
+	if errors.Is(err, user.ErrDeviceTaken) {
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "device is registered"})
+		return
+	} else if err != nil {
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		logger.Errorw("Create error", "req", req, "error", err)
 		return
 	}
 
-	ctx.Status(http.StatusCreated)
+	ctx.JSON(http.StatusCreated, &responseRegister{DeviceSecret: deviceSecret})
 }
 
 type responseGetUserInfo struct {
-	ID               string `json:"id" example:"01B6C691-EE6E-48F2-B2DE-AFC1DA180EFE" description:"User ID"`
-	Name             string `json:"name" example:"User123456" description:"User name"`
-	IsSuggestRefresh bool   `json:"is_suggest_refresh" example:"false" description:"Is authorization token suggest to refresh"`
+	ID               string   `json:"id" example:"01B6C691-EE6E-48F2-B2DE-AFC1DA180EFE" description:"User ID"`
+	Name             string   `json:"name" example:"User123456" description:"User name"`
+	Roles            []string `json:"roles" example:"user" description:"Roles of the user"`
+	IsSuggestRefresh bool     `json:"is_suggest_refresh" example:"false" description:"Is authorization token suggest to refresh"`
 }
 
 // @Title Get user info
@@ -83,6 +95,7 @@ func (a *app) getUserInfo(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, &responseGetUserInfo{
 		ID:               user1.ID.String(),
 		Name:             user1.Name,
+		Roles:            user1.Roles,
 		IsSuggestRefresh: isSuggestRefresh,
 	})
 }
@@ -127,49 +140,58 @@ func (a *app) updateUserInfo(ctx *gin.Context) {
 	})
 }
 
+// @Title Add SSO
+// @Description Link the SSO account to the account, it logs in by SSO afterward. Other login methods of the account are kept. All tokens of the account are revoked, and a new token is returned.
+// @Header defaultRequestHeaders
+// @Param  request  body  requestSSO  true  "Request body"
+// @Success  200  object  responseAuthToken  "OK"
+// @Failure  400  "Bad Request"
+// @Failure  403  "Forbidden"
+// @Failure  409  "Conflict"
+// @Failure  500  "Internal Server Error"
+// @Resource account
+// @Route /api/v1/account/sso [put]
 func (a *app) addSSO(ctx *gin.Context) {
-	panic("UNDONE")
-
-	//logger := infra.GetLogger(ctx)
-	//userID, _, isSuggestRefresh, ok := a.verifyAuth(ctx)
-	//if !ok {
-	//	return
-	//}
-	//
-	//type request struct {
-	//	Platform string `json:"platform"`
-	//	DeviceID string `json:"device_id"`
-	//}
-	//req := &request{}
-	//if err := ctx.BindJSON(req); err != nil {
-	//	// TODO: check can still read body after BindJSON
-	//	if body, err2 := io.ReadAll(ctx.Request.Body); err2 != nil {
-	//		logger.Debugw("failed to read request body", "request", ctx.Request, "BindJSON error", err, "ReadAll error", err2)
-	//	} else {
-	//		logger.Debugw("BindJSON error", "body", body, "error", err)
-	//	}
-	//
-	//	ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
-	//	return
-	//}
-	//
-	//// TODO: get sso account id
-	//ssoAccountID := ""
-	//
-	//err := a.userSvc.AddSSO(ctx, userID, req.Platform, ssoAccountID)
-	//if err != nil {
-	//	logger.Errorw("userSvc.AddSSO error", "user_id", userID, "error", err)
-	//	ctx.AbortWithStatus(http.StatusInternalServerError)
-	//	return
-	//}
-	//
-	//ctx.JSON(http.StatusOK, gin.H{
-	//	"is_suggest_refresh": isSuggestRefresh,
-	//})
+	logger := infra.GetLogger(ctx)
+	userID, _, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+
+	req := &requestSSO{}
+	if err := ctx.BindJSON(req); err != nil {
+		// TODO: check can still read body after BindJSON
+		if body, err2 := io.ReadAll(ctx.Request.Body); err2 != nil {
+			logger.Debugw("failed to read request body", "request", ctx.Request, "BindJSON error", err, "ReadAll error", err2)
+		} else {
+			logger.Debugw("BindJSON error", "body", body, "error", err)
+		}
+
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+
+	identity, ok := a.verifySSO(ctx, req)
+	if !ok {
+		return
+	}
+
+	if err := a.userSvc.AddSSO(ctx, userID, identity.Provider, identity.Subject); errors.Is(err, user.ErrSSOTaken) {
+		logger.Debugw("sso account is linked to another user", "user_id", userID, "sso_provider", identity.Provider)
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "sso account is linked to another user"})
+		return
+	} else if err != nil {
+		logger.Errorw("userSvc.AddSSO error", "user_id", userID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// login method is changed, logs out all devices, and gives the caller a new token
+	a.reissueUserTokens(ctx, userID, newSessionInfo(ctx, identity.Provider, ""))
 }
 
 // @Title Delete user
-// @Description Remove the account
+// @Description Remove the account, and revoke all tokens of it
 // @Header defaultRequestHeaders
 // @Success  200  "OK"
 // @Failure  403  "Forbidden"
@@ -188,10 +210,89 @@ func (a *app) deleteAccount(ctx *gin.Context) {
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	if err := a.authSvc.RevokeUserTokens(ctx, userID); err != nil {
+		logger.Errorw("authSvc.RevokeUserTokens error", "user_id", userID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
 	//TODO: 204 No Content
 	ctx.Status(http.StatusOK)
 }
 
+// mergeReauthDuration is how long after login the session can merge the account into another account.
+const mergeReauthDuration = 10 * time.Minute
+
+// @Title Merge account
+// @Description Merges the account into the existing account of the SSO account, e.g. a guest device account signs in by SSO later. Devices, SSO accounts and passkeys are moved to the SSO account, the password and TOTP are moved only if the SSO account has none, and consents to OAuth clients and API keys are revoked. Then the account is removed, all tokens of it are revoked, and the session logs in to the SSO account, which responds responseMFARequired instead if MFA is enabled. The session must login within 10 minutes.
+// @Header defaultRequestHeaders
+// @Param  request  body  requestSSO  true  "SSO credential of the account merged into"
+// @Success  200  object  responseAuthToken  "OK"
+// @Failure  400  "Bad Request"
+// @Failure  401  "Unauthorized"
+// @Failure  403  "Forbidden"
+// @Failure  404  "Not Found"
+// @Failure  409  "Conflict"
+// @Failure  500  "Internal Server Error"
+// @Resource account
+// @Route /api/v1/account/merge [post]
+func (a *app) mergeAccount(ctx *gin.Context) {
+	logger := infra.GetLogger(ctx)
+	sourceID, claims, _, ok := a.verifyAuth(ctx)
+	if !ok {
+		return
+	}
+	// the session proves the source account, a stolen token can't move it away
+	if !claims.IsAuthenticatedWithin(time.Now(), mergeReauthDuration) {
+		logger.Debugw("reauthentication required", "user_id", sourceID)
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "reauthentication required"})
+		return
+	}
+
+	req := &requestSSO{}
+	if err := ctx.BindJSON(req); err != nil {
+		logger.Debugw("unknown request body", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unknown request body"})
+		return
+	}
+	// the SSO credential proves the target account
+	identity, ok := a.verifySSO(ctx, req)
+	if !ok {
+		return
+	}
+	targetID, err := a.userSvc.GetIDBySSO(ctx, identity.Provider, identity.Subject)
+	if errors.Is(err, user.ErrNotFound) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user not exist"})
+		return
+	} else if err != nil {
+		logger.Errorw("userSvc.GetIDBySSO error", "error", err, "sso_provider", identity.Provider)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !a.checkValidLoginUser(ctx, targetID) {
+		return
+	}
+
+	if err := a.userSvc.Merge(ctx, sourceID, targetID); errors.Is(err, user.ErrMergeSelf) {
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "sso account is linked to the account"})
+		return
+	} else if errors.Is(err, user.ErrNotFound) {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user not exist"})
+		return
+	} else if err != nil {
+		logger.Errorw("userSvc.Merge error", "error", err, "user_id", sourceID, "target_user_id", targetID)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	logger.Infow("account merged", "user_id", sourceID, "target_user_id", targetID)
+
+	if err := a.authSvc.RevokeUserTokens(ctx, sourceID); err != nil {
+		logger.Errorw("authSvc.RevokeUserTokens error", "user_id", sourceID, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	a.respondLogin(ctx, targetID, newSessionInfo(ctx, identity.Provider, ""))
+}
+
 func (a *app) getJWTString(ctx *gin.Context) string {
 	auth := ctx.Request.Header.Get("Authorization")
 	if !strings.HasPrefix(auth, "Bearer ") {
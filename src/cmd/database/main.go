@@ -43,7 +43,12 @@ func main() {
 
 	switch cmd {
 	case "migrate":
-		panic("not implemented")
+		// TODO: migrations of altered columns, it only creates new tables and columns now
+		sqldb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(config.GetLocalDSN())))
+		db := bun.NewDB(sqldb, pgdialect.New())
+		if err := createSchema(ctx, db); err != nil {
+			logger.Fatal("createSchema error", zap.Error(err))
+		}
 	case "init":
 		sqldb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(config.GetLocalDSN())))
 		db := bun.NewDB(sqldb, pgdialect.New())
@@ -71,15 +76,73 @@ func main() {
 func createSchema(ctx context.Context, db *bun.DB) error {
 	models := []interface{}{
 		(*database.User)(nil),
+		(*database.UserIdentity)(nil),
+		(*database.UserMerge)(nil),
+		(*database.AuditLog)(nil),
+		(*database.RevokedToken)(nil),
+		(*database.TokenWatermark)(nil),
+		(*database.OAuthClient)(nil),
+		(*database.OAuthConsent)(nil),
+		(*database.APIKey)(nil),
+		(*database.PasswordCredential)(nil),
+		(*database.MFATOTP)(nil),
+		(*database.WebAuthnCredential)(nil),
 	}
 
 	for _, model := range models {
-		_, err := db.NewCreateTable().Model(model).Exec(ctx)
+		_, err := db.NewCreateTable().Model(model).IfNotExists().Exec(ctx)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+
+	// columns added to existing tables
+	columns := []struct {
+		model  interface{}
+		column string
+	}{
+		{(*database.User)(nil), "roles varchar(64)[] NOT NULL DEFAULT '{user}'"},
+		{(*database.User)(nil), "suspended_at timestamptz"},
+		{(*database.User)(nil), "device_secret_hash varchar(64)"},
+		{(*database.OAuthClient)(nil), "redirect_uris varchar(2048)[] NOT NULL DEFAULT '{}'"},
+		{(*database.OAuthClient)(nil), "is_public boolean NOT NULL DEFAULT false"},
+		{(*database.OAuthClient)(nil), "is_first_party boolean NOT NULL DEFAULT false"},
+	}
+	for _, column := range columns {
+		_, err := db.NewAddColumn().Model(column.model).ColumnExpr(column.column).IfNotExists().Exec(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return migrateUserIdentities(ctx, db)
+}
+
+// migrateUserIdentities moves devices and SSO accounts of users to user_identity. The columns of users are cleared
+// after copied, so that running it again doesn't relink unlinked identities.
+func migrateUserIdentities(ctx context.Context, db *bun.DB) error {
+	queries := []string{
+		// old rows aren't unique, the device or the SSO account goes to the latest active user
+		`INSERT INTO user_identity (user_id, kind, provider, subject, secret_hash, linked_at)
+		SELECT id, 'device', platform, device_id, device_secret_hash, created_at FROM "user"
+		WHERE platform IS NOT NULL AND device_id IS NOT NULL
+		ORDER BY deleted_at IS NOT NULL, created_at DESC
+		ON CONFLICT DO NOTHING`,
+		`INSERT INTO user_identity (user_id, kind, provider, subject, linked_at)
+		SELECT id, 'sso', sso_provider, sso_account_id, created_at FROM "user"
+		WHERE sso_provider IS NOT NULL AND sso_account_id IS NOT NULL
+		ORDER BY deleted_at IS NOT NULL, created_at DESC
+		ON CONFLICT DO NOTHING`,
+		`UPDATE "user" SET platform = NULL, device_id = NULL, device_secret_hash = NULL, sso_provider = NULL, sso_account_id = NULL
+		WHERE platform IS NOT NULL OR device_id IS NOT NULL OR sso_provider IS NOT NULL OR sso_account_id IS NOT NULL`,
+	}
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		for _, query := range queries {
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return fmt.Errorf("migrate user identities error: %w", err)
+			}
+		}
+		return nil
+	})
 }
 
 func createDefaultData(ctx context.Context, db *bun.DB) error {
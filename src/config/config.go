@@ -2,14 +2,20 @@ package config
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
 
+const envFileName = "env"
+
 var envFile map[string]string
 
 func init() {
-	env, err := godotenv.Read("env")
+	env, err := godotenv.Read(findEnvFile())
 	if err != nil {
 		panic("error loading env file")
 	}
@@ -18,6 +24,25 @@ func init() {
 
 }
 
+// findEnvFile finds the env file in the working directory or its parents, so tests of packages read the env file of the repo.
+func findEnvFile() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return envFileName
+	}
+	for {
+		path := filepath.Join(dir, envFileName)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return envFileName
+		}
+		dir = parent
+	}
+}
+
 func GetLocalDSN() string {
 	name := getEnvPanic("DB_NAME")
 	port := getEnvPanic("DB_PORT")
@@ -45,6 +70,126 @@ func GetWebServerPort() string {
 	return webPort
 }
 
+// GetJWTKeyConfig returns the directory of JWT signing keys, the active key ID, and the retired key IDs.
+func GetJWTKeyConfig() (string, string, []string) {
+	dir := getEnvPanic("JWT_KEY_DIR")
+	activeKeyID := getEnvPanic("JWT_ACTIVE_KEY_ID")
+	retiredKeyIDs := getEnvList("JWT_RETIRED_KEY_IDS")
+	return dir, activeKeyID, retiredKeyIDs
+}
+
+// GetAuthCookieName returns the name of the cookie of authorization tokens, for reverse proxies.
+func GetAuthCookieName() string {
+	if name := getEnv("AUTH_COOKIE_NAME"); name != "" {
+		return name
+	}
+	return "auth_token"
+}
+
+type PasswordPolicy struct {
+	MinLength      int
+	MaxLength      int
+	MinCharClasses int
+}
+
+// GetPasswordPolicy returns the password policy of email accounts.
+func GetPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:      getEnvInt("PASSWORD_MIN_LENGTH", 10),
+		MaxLength:      getEnvInt("PASSWORD_MAX_LENGTH", 128),
+		MinCharClasses: getEnvInt("PASSWORD_MIN_CHAR_CLASSES", 2),
+	}
+}
+
+// GetOTPConfig returns the secret of one-time codes and magic links, and the page URL of magic links.
+func GetOTPConfig() (string, string) {
+	secret := getEnvPanic("OTP_SECRET")
+	linkURL := getEnvPanic("OTP_LINK_URL")
+	return secret, linkURL
+}
+
+// GetMFAConfig returns the issuer shown in authenticator apps, and the key to encrypt TOTP secrets.
+func GetMFAConfig() (string, string) {
+	issuer := getEnv("MFA_ISSUER")
+	if issuer == "" {
+		issuer = "WebServer"
+	}
+	secretKey := getEnvPanic("MFA_SECRET_KEY")
+	return issuer, secretKey
+}
+
+// GetWebAuthnConfig returns the relying party ID and name of passkeys, and the allowed origins of web clients.
+func GetWebAuthnConfig() (string, string, []string) {
+	rpID := getEnvPanic("WEBAUTHN_RP_ID")
+	rpName := getEnv("WEBAUTHN_RP_NAME")
+	origins := getEnvList("WEBAUTHN_ORIGINS")
+	return rpID, rpName, origins
+}
+
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// GetSMTPConfig returns the SMTP server to send emails, the host is empty if emails aren't sent.
+func GetSMTPConfig() SMTPConfig {
+	return SMTPConfig{
+		Host:     getEnv("SMTP_HOST"),
+		Port:     getEnv("SMTP_PORT"),
+		Username: getEnv("SMTP_USERNAME"),
+		Password: getEnv("SMTP_PASSWORD"),
+		From:     getEnv("MAIL_FROM"),
+	}
+}
+
+type SSOProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+}
+
+// GetSSOProviders returns OpenID Connect providers listed in SSO_PROVIDERS.
+// Each provider is configured by SSO_<NAME>_ISSUER, SSO_<NAME>_CLIENT_ID and SSO_<NAME>_CLIENT_SECRET.
+func GetSSOProviders() []SSOProvider {
+	providers := []SSOProvider{}
+	for _, name := range getEnvList("SSO_PROVIDERS") {
+		prefix := "SSO_" + strings.ToUpper(name) + "_"
+		providers = append(providers, SSOProvider{
+			Name:         name,
+			Issuer:       getEnvPanic(prefix + "ISSUER"),
+			ClientID:     getEnvPanic(prefix + "CLIENT_ID"),
+			ClientSecret: getEnv(prefix + "CLIENT_SECRET"),
+		})
+	}
+	return providers
+}
+
+func getEnvList(arg string) []string {
+	result := []string{}
+	for _, val := range strings.Split(getEnv(arg), ",") {
+		if val = strings.TrimSpace(val); val != "" {
+			result = append(result, val)
+		}
+	}
+	return result
+}
+
+func getEnvInt(arg string, defaultValue int) int {
+	val := getEnv(arg)
+	if val == "" {
+		return defaultValue
+	}
+	result, err := strconv.Atoi(val)
+	if err != nil {
+		panic(fmt.Errorf("env variable %s is not an integer: %w", arg, err))
+	}
+	return result
+}
+
 func getEnv(arg string) string {
 	val, ok := envFile[arg]
 	if !ok {
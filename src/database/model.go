@@ -18,13 +18,20 @@ type User struct {
 	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
 	UpdatedAt time.Time `bun:",nullzero"`
 	DeletedAt time.Time `bun:",soft_delete,nullzero"`
+	// SuspendedAt is set when the user is suspended by operators, suspended users can't login.
+	SuspendedAt time.Time `bun:"suspended_at,nullzero"`
 
-	ID           uuid.UUID `bun:"id,pk,type:uuid,default:uuid_generate_v4()"`
-	Name         string    `bun:"name,notnull,type:varchar(256)"`
-	Platform     *string   `bun:"platform,type:varchar(256)"`
-	DeviceID     *string   `bun:"device_id,type:varchar(256)"`
-	SSOProvider  *string   `bun:"sso_provider,type:varchar(256)"`
-	SSOAccountID *string   `bun:"sso_account_id,type:varchar(256)"`
+	ID    uuid.UUID `bun:"id,pk,type:uuid,default:uuid_generate_v4()"`
+	Name  string    `bun:"name,notnull,type:varchar(256)"`
+	Roles []string  `bun:"roles,array,nullzero,notnull,type:varchar(64)[],default:'{user}'"`
+	// Deprecated: login methods are in UserIdentity, the columns are kept for migrating existing databases.
+	Platform         *string `bun:"platform,type:varchar(256)"`
+	DeviceID         *string `bun:"device_id,type:varchar(256)"`
+	DeviceSecretHash *string `bun:"device_secret_hash,type:varchar(64)"`
+	SSOProvider      *string `bun:"sso_provider,type:varchar(256)"`
+	SSOAccountID     *string `bun:"sso_account_id,type:varchar(256)"`
+
+	Identities []*UserIdentity `bun:"rel:has-many,join:id=user_id"`
 }
 
 var _ bun.BeforeAppendModelHook = (*User)(nil)
@@ -38,3 +45,151 @@ func (m *User) BeforeAppendModel(ctx context.Context, query bun.Query) error {
 	}
 	return nil
 }
+
+// UserIdentity is a device or an SSO account linked to a user, a user can link many of them.
+type UserIdentity struct {
+	bun.BaseModel `bun:"table:user_identity"`
+
+	ID     uuid.UUID `bun:"id,pk,type:uuid,default:uuid_generate_v4()"`
+	UserID uuid.UUID `bun:"user_id,notnull,type:uuid"`
+	// Kind is "device" or "sso"
+	Kind string `bun:"kind,notnull,unique:kind_provider_subject,type:varchar(16)"`
+	// Provider is the platform of the device, or the SSO provider
+	Provider string `bun:"provider,notnull,unique:kind_provider_subject,type:varchar(256)"`
+	// Subject is the device ID, or the account ID of the SSO provider
+	Subject string `bun:"subject,notnull,unique:kind_provider_subject,type:varchar(256)"`
+	// SecretHash is the hash of the secret issued to the device, it is NULL for SSO accounts and devices registered before device secrets.
+	SecretHash *string   `bun:"secret_hash,type:varchar(64)"`
+	LinkedAt   time.Time `bun:"linked_at,nullzero,notnull,default:current_timestamp"`
+}
+
+// UserMerge records a user merged into another user, the source user is soft-deleted by the merge.
+type UserMerge struct {
+	bun.BaseModel `bun:"table:user_merge"`
+
+	ID           uuid.UUID `bun:"id,pk,type:uuid,default:uuid_generate_v4()"`
+	SourceUserID uuid.UUID `bun:"source_user_id,notnull,type:uuid"`
+	TargetUserID uuid.UUID `bun:"target_user_id,notnull,type:uuid"`
+	MergedAt     time.Time `bun:"merged_at,nullzero,notnull,default:current_timestamp"`
+}
+
+// AuditLog is an operation of staff on a user, e.g. impersonation, rows are inserted only.
+type AuditLog struct {
+	bun.BaseModel `bun:"table:audit_log"`
+
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	ID      uuid.UUID `bun:"id,pk,type:uuid"`
+	Action  string    `bun:"action,notnull,type:varchar(64)"`
+	ActorID uuid.UUID `bun:"actor_id,notnull,type:uuid"`
+	UserID  uuid.UUID `bun:"user_id,notnull,type:uuid"`
+	Detail  string    `bun:"detail,notnull,type:varchar(1024)"`
+	IP      string    `bun:"ip,notnull,type:varchar(64)"`
+}
+
+// RevokedToken persists revoked token and session IDs, the cache of revocations can be rebuilt from it.
+type RevokedToken struct {
+	bun.BaseModel `bun:"table:revoked_token"`
+
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	ID        string    `bun:"id,pk,type:varchar(256)"`
+	ExpiresAt time.Time `bun:"expires_at,notnull"`
+}
+
+// TokenWatermark persists the time before which tokens of the user are invalid.
+type TokenWatermark struct {
+	bun.BaseModel `bun:"table:token_watermark"`
+
+	UserID     uuid.UUID `bun:"user_id,pk,type:uuid"`
+	ValidAfter time.Time `bun:"valid_after,notnull"`
+	ExpiresAt  time.Time `bun:"expires_at,notnull"`
+}
+
+// OAuthClient is a registered client of other services, the secret is stored hashed.
+type OAuthClient struct {
+	bun.BaseModel `bun:"table:oauth_client"`
+
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	ID         string   `bun:"id,pk,type:varchar(64)"`
+	Name       string   `bun:"name,notnull,type:varchar(256)"`
+	SecretHash string   `bun:"secret_hash,notnull,type:varchar(64)"`
+	Scopes     []string `bun:"scopes,array,notnull,type:varchar(64)[]"`
+	// RedirectURIs are allowed redirect URIs of the authorization code flow
+	RedirectURIs []string `bun:"redirect_uris,array,notnull,type:varchar(2048)[],default:'{}'"`
+	// IsPublic clients have no secret, the secret hash is empty
+	IsPublic     bool `bun:"is_public,notnull,default:false"`
+	IsFirstParty bool `bun:"is_first_party,notnull,default:false"`
+}
+
+// OAuthConsent is the scopes a user consented to for a client.
+type OAuthConsent struct {
+	bun.BaseModel `bun:"table:oauth_consent"`
+
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero"`
+
+	UserID   uuid.UUID `bun:"user_id,pk,type:uuid"`
+	ClientID string    `bun:"client_id,pk,type:varchar(64)"`
+	Scopes   []string  `bun:"scopes,array,notnull,type:varchar(64)[]"`
+}
+
+// APIKey is a long-lived key of a user, the key string is stored hashed.
+type APIKey struct {
+	bun.BaseModel `bun:"table:api_key"`
+
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	ID         uuid.UUID `bun:"id,pk,type:uuid"`
+	UserID     uuid.UUID `bun:"user_id,notnull,type:uuid"`
+	Name       string    `bun:"name,notnull,type:varchar(256)"`
+	Prefix     string    `bun:"prefix,notnull,unique,type:varchar(16)"`
+	Hash       string    `bun:"hash,notnull,type:varchar(64)"`
+	Scopes     []string  `bun:"scopes,array,notnull,type:varchar(64)[]"`
+	ExpiresAt  time.Time `bun:"expires_at,nullzero"`
+	LastUsedAt time.Time `bun:"last_used_at,nullzero"`
+}
+
+// PasswordCredential is the email and password login of a user.
+type PasswordCredential struct {
+	bun.BaseModel `bun:"table:password_credential"`
+
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero"`
+
+	UserID          uuid.UUID `bun:"user_id,pk,type:uuid"`
+	Email           string    `bun:"email,notnull,unique,type:varchar(320)"`
+	PasswordHash    string    `bun:"password_hash,notnull,type:varchar(256)"`
+	EmailVerifiedAt time.Time `bun:"email_verified_at,nullzero"`
+}
+
+// MFATOTP is the TOTP second factor of a user, the secret is stored encrypted and recovery codes are stored hashed.
+type MFATOTP struct {
+	bun.BaseModel `bun:"table:mfa_totp"`
+
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero"`
+
+	UserID             uuid.UUID `bun:"user_id,pk,type:uuid"`
+	SecretCiphertext   string    `bun:"secret_ciphertext,notnull,type:varchar(256)"`
+	RecoveryCodeHashes []string  `bun:"recovery_code_hashes,array,notnull,type:varchar(64)[],default:'{}'"`
+	LastUsedStep       int64     `bun:"last_used_step,notnull,default:0"`
+	ConfirmedAt        time.Time `bun:"confirmed_at,nullzero"`
+}
+
+// WebAuthnCredential is a passkey of a user, the public key is the COSE key of the credential.
+type WebAuthnCredential struct {
+	bun.BaseModel `bun:"table:webauthn_credential"`
+
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	ID         string    `bun:"id,pk,type:varchar(1400)"`
+	UserID     uuid.UUID `bun:"user_id,notnull,type:uuid"`
+	Name       string    `bun:"name,notnull,type:varchar(256)"`
+	PublicKey  []byte    `bun:"public_key,notnull,type:bytea"`
+	Algorithm  int       `bun:"algorithm,notnull"`
+	SignCount  int64     `bun:"sign_count,notnull,default:0"`
+	AAGUID     uuid.UUID `bun:"aaguid,notnull,type:uuid"`
+	LastUsedAt time.Time `bun:"last_used_at,nullzero"`
+}
@@ -1,9 +1,86 @@
 package rediskey
 
 const (
-	revokeAuthPrefix = "revoke_auth_"
+	revokeAuthPrefix        = "revoke_auth_"
+	revokeAuthWarmKey       = "revoke_warm_auth"
+	revokeAuthGenerationKey = "revoke_generation_auth"
+	refreshTokenPrefix      = "refresh_token_"
+	tokenWatermarkPrefix    = "token_valid_after_"
+	sessionPrefix           = "session_"
+	userSessionsPrefix      = "user_sessions_"
+	otpChallengePrefix      = "otp_challenge_"
+	webAuthnChallengePrefix = "webauthn_challenge_"
+	rateLimitPrefix         = "rate_limit_"
+	loginFailuresPrefix     = "login_failures_"
+	loginLockoutPrefix      = "login_lockout_"
+	transferCodePrefix      = "transfer_code_"
+	oauthCodePrefix         = "oauth_code_"
+	ssoNoncePrefix          = "sso_nonce_"
 )
 
 func GetRevokeAuthPrefix() string {
 	return revokeAuthPrefix
 }
+
+// GetRevokeAuthWarmKey is the key marking that all revocations are loaded into cache.
+func GetRevokeAuthWarmKey() string {
+	return revokeAuthWarmKey
+}
+
+// GetRevokeAuthGenerationKey is the counter of cache misses of revocations, a warm-up started before a miss can't
+// mark the cache warm.
+func GetRevokeAuthGenerationKey() string {
+	return revokeAuthGenerationKey
+}
+
+func GetRefreshTokenPrefix() string {
+	return refreshTokenPrefix
+}
+
+func GetTokenWatermarkPrefix() string {
+	return tokenWatermarkPrefix
+}
+
+func GetSessionPrefix() string {
+	return sessionPrefix
+}
+
+// GetUserSessionsPrefix is the prefix of the set of session IDs of a user.
+func GetUserSessionsPrefix() string {
+	return userSessionsPrefix
+}
+
+func GetOTPChallengePrefix() string {
+	return otpChallengePrefix
+}
+
+func GetWebAuthnChallengePrefix() string {
+	return webAuthnChallengePrefix
+}
+
+func GetRateLimitPrefix() string {
+	return rateLimitPrefix
+}
+
+// GetLoginFailuresPrefix is the prefix of failed credential attempts of an account.
+func GetLoginFailuresPrefix() string {
+	return loginFailuresPrefix
+}
+
+func GetLoginLockoutPrefix() string {
+	return loginLockoutPrefix
+}
+
+func GetTransferCodePrefix() string {
+	return transferCodePrefix
+}
+
+// GetOAuthCodePrefix is the prefix of authorization codes of the authorization code flow.
+func GetOAuthCodePrefix() string {
+	return oauthCodePrefix
+}
+
+// GetSSONoncePrefix is the prefix of nonces issued for SSO ID tokens.
+func GetSSONoncePrefix() string {
+	return ssoNoncePrefix
+}
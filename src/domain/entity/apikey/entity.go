@@ -0,0 +1,55 @@
+package apikey
+
+// API key domain handles long-lived keys of users, for backend jobs and partner services calling APIs on behalf of the user.
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrInvalidKey = errors.New("invalid api key")
+)
+
+type Service interface {
+	// Create creates an API key, and returns it with the key string, the key string can't be read afterward.
+	// The key never expires if expiresAt is zero.
+	Create(ctx context.Context, userID uuid.UUID, name string, scopes []string, expiresAt time.Time) (*APIKey, string, error)
+	List(ctx context.Context, userID uuid.UUID) ([]*APIKey, error)
+	// Rotate creates a new key of the same name and scopes, the old key is kept valid for a grace period.
+	Rotate(ctx context.Context, userID uuid.UUID, id uuid.UUID) (*APIKey, string, error)
+	Delete(ctx context.Context, userID uuid.UUID, id uuid.UUID) error
+	// Verify verifies the key string, scopes of the returned key are limited by the current roles of the owner.
+	// The last used time of the key is updated at most once a minute.
+	Verify(ctx context.Context, key string) (*APIKey, error)
+}
+
+type Repository interface {
+	Create(ctx context.Context, key *APIKey) error
+	Get(ctx context.Context, userID uuid.UUID, id uuid.UUID) (*APIKey, error)
+	GetByPrefix(ctx context.Context, prefix string) (*APIKey, error)
+	List(ctx context.Context, userID uuid.UUID) ([]*APIKey, error)
+	SetExpiresAt(ctx context.Context, id uuid.UUID, expiresAt time.Time) error
+	SetLastUsedAt(ctx context.Context, id uuid.UUID, lastUsedAt time.Time) error
+	Delete(ctx context.Context, userID uuid.UUID, id uuid.UUID) error
+}
+
+type APIKey struct {
+	ID     uuid.UUID
+	UserID uuid.UUID
+	Name   string
+	// Prefix identifies the key in key strings, i.e. wsk_<prefix>_<secret>
+	Prefix string
+	// Hash is the sha256 hash of the key string, the key string isn't stored
+	Hash   string
+	Scopes []string
+	// Roles of the owner, it is set by Verify
+	Roles      []string
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	CreatedAt  time.Time
+}
@@ -0,0 +1,50 @@
+package audit
+
+// Audit domain records operations of staff on users, e.g. impersonation, records are never updated or deleted.
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidEvent = errors.New("invalid audit event")
+)
+
+// Actions of audit events.
+const (
+	// ActionImpersonationIssue is an impersonation token issued to the actor for the user
+	ActionImpersonationIssue = "impersonation.issue"
+	// ActionImpersonationUse is a request of the actor with an impersonation token of the user
+	ActionImpersonationUse = "impersonation.use"
+	// ActionTokensRevokeAll is the global cutoff set by the actor, tokens of all users are revoked
+	ActionTokensRevokeAll = "tokens.revoke_all"
+)
+
+type Service interface {
+	// Record records the event, the ID and the time are set by it. It returns ErrInvalidEvent if the action or the actor is empty.
+	Record(ctx context.Context, event *Event) error
+	// ListByUser lists latest events of the user, or of the actor, latest first.
+	ListByUser(ctx context.Context, userID uuid.UUID, limit int) ([]*Event, error)
+}
+
+type Repository interface {
+	Create(ctx context.Context, event *Event) error
+	ListByUser(ctx context.Context, userID uuid.UUID, limit int) ([]*Event, error)
+}
+
+type Event struct {
+	ID     uuid.UUID
+	Action string
+	// ActorID is the staff doing the action
+	ActorID uuid.UUID
+	// UserID is the user the action is done on, it is nil for actions on all users
+	UserID uuid.UUID
+	// Detail is the reason of the action, or the request of using an impersonation token
+	Detail    string
+	IP        string
+	CreatedAt time.Time
+}
@@ -10,17 +10,174 @@ import (
 )
 
 type Service interface {
-	CreateToken(ctx context.Context, userID uuid.UUID) (string, error)
-	ParseToken(ctx context.Context, jwtToken string) (*jwt.RegisteredClaims, error)
-	ParseAndVerifyToken(ctx context.Context, jwtToken string) (*jwt.RegisteredClaims, bool, error)
+	CreateToken(ctx context.Context, userID uuid.UUID, info *SessionInfo) (*TokenPair, error)
+	RefreshToken(ctx context.Context, refreshToken string, info *SessionInfo) (*TokenPair, error)
+	// CreateClientToken creates a token of the client itself by the client credentials grant, the subject is the client.
+	// It has no refresh token, and the client gets another token by its credentials.
+	CreateClientToken(ctx context.Context, clientID string, scopes []string) (*TokenPair, error)
+	ParseToken(ctx context.Context, jwtToken string) (*Claims, error)
+	// ParseAndVerifyToken verifies the token, and returns whether refreshing is suggested.
+	// Tokens with audiences are accepted only if any of their audiences is in audiences, so tokens exchanged for other
+	// services are rejected without audiences. Tokens without audiences are accepted by all.
+	ParseAndVerifyToken(ctx context.Context, jwtToken string, audiences ...string) (*Claims, bool, error)
+	// ExchangeToken exchanges the token of a user for a short-lived token of the audience on behalf of the actor client
+	// (RFC 8693). The token has the scopes within the scopes of the subject token, or all of them if scopes are empty,
+	// and it returns ErrInvalidScope otherwise. It has no refresh token.
+	ExchangeToken(ctx context.Context, subjectToken string, actorClientID string, audience string, scopes []string) (*TokenPair, error)
+	// CreateImpersonationToken creates a short-lived token of the user for the support staff of actorID, who sees the
+	// app as the user does. It has the scopes of regular users only, and no session or refresh token.
+	CreateImpersonationToken(ctx context.Context, userID uuid.UUID, actorID uuid.UUID) (*TokenPair, error)
 	RevokeToken(ctx context.Context, jwtID string, jwtExpiryTime time.Time) error
+	RevokeSession(ctx context.Context, sessionID string) error
+	// RevokeUserTokens revokes tokens and refresh tokens of the user issued until now, i.e. logs out everywhere. The
+	// watermark is rounded up to the next second, tokens created afterward are issued at it and kept valid.
+	RevokeUserTokens(ctx context.Context, userID uuid.UUID) error
+	// RevokeAllTokens revokes tokens and refresh tokens of all users and clients issued until now, so everyone logs
+	// in again. It returns the cutoff, which is rounded up to the next second and seen by all instances at once.
+	RevokeAllTokens(ctx context.Context) (time.Time, error)
+	// GetGlobalTokensValidAfter returns the cutoff of RevokeAllTokens, or zero time if tokens are never revoked globally.
+	GetGlobalTokensValidAfter(ctx context.Context) (time.Time, error)
+	// VerifyIssuedAt returns ErrRevokedToken if credentials of the user issued at issuedAt, e.g. API keys, are revoked
+	// by RevokeUserTokens or RevokeAllTokens.
+	VerifyIssuedAt(ctx context.Context, userID uuid.UUID, issuedAt time.Time) error
+	ListSessions(ctx context.Context, userID uuid.UUID) ([]*Session, error)
+	GetJWKS(ctx context.Context) *JWKS
+	// CreateMFAPendingToken creates a short-lived token of a login waiting for the second factor, it is rejected by ParseAndVerifyToken.
+	CreateMFAPendingToken(ctx context.Context, userID uuid.UUID, info *SessionInfo) (string, time.Time, error)
+	// ParseMFAPendingToken verifies a token created by CreateMFAPendingToken.
+	ParseMFAPendingToken(ctx context.Context, jwtToken string) (*Claims, error)
 }
 
 type Repository interface {
 	SetRevoked(ctx context.Context, jwtID string, expiryDuration time.Duration) error
 	IsRevoked(ctx context.Context, jwtID string) (bool, error)
+	SetRefreshToken(ctx context.Context, tokenHash string, token *RefreshToken, expiryDuration time.Duration) error
+	// UseRefreshToken marks the refresh token used, and returns it with IsUsed of whether it was used before.
+	UseRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error)
+	// SetTokensValidAfter invalidates tokens of the user issued before validAfter.
+	SetTokensValidAfter(ctx context.Context, userID uuid.UUID, validAfter time.Time, expiryDuration time.Duration) error
+	// GetTokensValidAfter returns zero time if tokens of the user are never invalidated.
+	GetTokensValidAfter(ctx context.Context, userID uuid.UUID) (time.Time, error)
+	// SetGlobalTokensValidAfter invalidates tokens of all users and clients issued before validAfter.
+	SetGlobalTokensValidAfter(ctx context.Context, validAfter time.Time, expiryDuration time.Duration) error
+	// GetGlobalTokensValidAfter returns zero time if tokens are never invalidated globally.
+	GetGlobalTokensValidAfter(ctx context.Context) (time.Time, error)
+	SetSession(ctx context.Context, session *Session, expiryDuration time.Duration) error
+	GetSession(ctx context.Context, sessionID string) (*Session, error)
+	ListSessions(ctx context.Context, userID uuid.UUID) ([]*Session, error)
+	DeleteSession(ctx context.Context, userID uuid.UUID, sessionID string) error
+	DeleteUserSessions(ctx context.Context, userID uuid.UUID) error
+}
+
+// Claims of access tokens.
+// SessionID is shared by all tokens refreshed from the same login, revoking it revokes the whole token family.
+// Scope is space-separated scopes granted by Roles, which are the roles of the user when the token is issued.
+// ClientID is the OAuth client the token is issued to, its scopes are limited to the scopes the user consented to.
+// AuthTime is the login time of the session, it is kept by refreshing, endpoints of sensitive operations check it.
+// SubjectType is empty for users, or SubjectTypeClient for tokens of clients themselves, whose subject is the client ID.
+// Actor is the client acting on behalf of the user, for tokens of the token exchange, which have the audience, or the
+// support staff impersonating the user.
+type Claims struct {
+	jwt.RegisteredClaims
+	SubjectType string           `json:"sub_type,omitempty"`
+	SessionID   string           `json:"sid,omitempty"`
+	Roles       []string         `json:"roles,omitempty"`
+	Scope       string           `json:"scope,omitempty"`
+	ClientID    string           `json:"client_id,omitempty"`
+	Actor       *Actor           `json:"act,omitempty"`
+	AuthTime    *jwt.NumericDate `json:"auth_time,omitempty"`
+	MFAPending  *MFAPending      `json:"mfa_pending,omitempty"`
+}
+
+// Actor is the act claim of RFC 8693 4.1, Subject is the client ID of the actor, or the user ID if SubjectType is
+// SubjectTypeUser.
+type Actor struct {
+	Subject     string `json:"sub"`
+	SubjectType string `json:"sub_type,omitempty"`
+}
+
+const (
+	// SubjectTypeClient is the subject type of tokens of the client credentials grant, and of actors of exchanged tokens.
+	SubjectTypeClient = "client_id"
+	// SubjectTypeUser is the subject type of actors of impersonation tokens, the subject type of users is empty in claims.
+	SubjectTypeUser = "user"
+)
+
+// MFAPending is the login of an mfa_pending token, the session is created by it after the second factor is verified.
+type MFAPending struct {
+	Platform string `json:"platform,omitempty"`
+	DeviceID string `json:"device_id,omitempty"`
+}
+
+// IsClientSubject returns whether the token is of a client itself, not of a user.
+// User IDs and client IDs are both UUIDs, the subject is a user ID only if it returns false.
+func (c *Claims) IsClientSubject() bool {
+	return c.SubjectType == SubjectTypeClient
+}
+
+// IsImpersonation returns whether the token is of the support staff impersonating the user, the staff is the actor.
+func (c *Claims) IsImpersonation() bool {
+	return c.Actor != nil && c.Actor.SubjectType == SubjectTypeUser
+}
+
+// IsAuthenticatedWithin returns whether the session logged in within the duration before now.
+// Tokens of OAuth clients never are, sensitive operations aren't delegated to clients.
+func (c *Claims) IsAuthenticatedWithin(now time.Time, duration time.Duration) bool {
+	return c.ClientID == "" && c.AuthTime != nil && now.Sub(c.AuthTime.Time) <= duration
+}
+
+type TokenPair struct {
+	AccessToken           string
+	AccessTokenExpiresAt  time.Time
+	RefreshToken          string
+	RefreshTokenExpiresAt time.Time
+	// Scope is space-separated scopes of the access token
+	Scope string
+}
+
+// SessionInfo is the client of a login session.
+// ClientID and Scopes are set for sessions of OAuth clients, tokens of them have scopes within Scopes.
+type SessionInfo struct {
+	Platform  string
+	DeviceID  string
+	IP        string
+	UserAgent string
+	ClientID  string
+	Scopes    []string
+}
+
+// Session is a login on a device, its tokens share the session ID.
+type Session struct {
+	ID     string
+	UserID uuid.UUID
+	// JWTID is the ID of the latest access token of the session
+	JWTID      string
+	Info       SessionInfo
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+}
+
+// RefreshToken is the server-side record of an opaque refresh token.
+// ClientID and Scopes are of the session, a refresh token of a client is used by the client only.
+type RefreshToken struct {
+	UserID    uuid.UUID
+	SessionID string
+	ClientID  string
+	Scopes    []string
+	// AuthTime is the login time of the session
+	AuthTime  time.Time
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	IsUsed    bool
 }
 
 var (
-	ErrRevokedToken = errors.New("revoked token")
+	ErrNotFound            = errors.New("not found")
+	ErrInvalidToken        = errors.New("invalid token")
+	ErrRevokedToken        = errors.New("revoked token")
+	ErrUnknownKey          = errors.New("unknown signing key")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+	ErrInvalidScope        = errors.New("invalid scope")
 )
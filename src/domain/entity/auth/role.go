@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Roles of users, a user can have many roles.
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+// Scopes of tokens, they are granted by roles of users, or to clients.
+const (
+	ScopeAccountRead  = "account:read"
+	ScopeAccountWrite = "account:write"
+	ScopeAdminRead    = "admin:read"
+	ScopeAdminWrite   = "admin:write"
+	// ScopeTokenIntrospect is granted to clients, not to users
+	ScopeTokenIntrospect = "token:introspect"
+	// ScopeUsersRead is granted to clients, which read users by tokens of the client credentials grant
+	ScopeUsersRead = "users:read"
+	// ScopeTokenExchange is granted to clients, e.g. the API gateway, which exchange tokens of users for downstream services
+	ScopeTokenExchange = "token:exchange"
+)
+
+var allScopes = []string{ScopeAccountRead, ScopeAccountWrite, ScopeAdminRead, ScopeAdminWrite, ScopeTokenIntrospect, ScopeUsersRead, ScopeTokenExchange}
+
+var roleScopes = map[string][]string{
+	RoleUser:    {ScopeAccountRead, ScopeAccountWrite},
+	RoleSupport: {ScopeAccountRead, ScopeAccountWrite, ScopeAdminRead},
+	RoleAdmin:   {ScopeAccountRead, ScopeAccountWrite, ScopeAdminRead, ScopeAdminWrite},
+}
+
+// RoleProvider provides roles of users, tokens are issued with scopes of the roles.
+type RoleProvider interface {
+	GetRoles(ctx context.Context, userID uuid.UUID) ([]string, error)
+}
+
+// UserProvider provides roles and login states of users, refresh tokens of users who can't login are rejected.
+type UserProvider interface {
+	RoleProvider
+	// CheckValidLoginUser returns false if the user is e.g. suspended or deleted.
+	CheckValidLoginUser(ctx context.Context, userID uuid.UUID) (bool, error)
+}
+
+// IsValidRole returns whether the role is known.
+func IsValidRole(role string) bool {
+	_, ok := roleScopes[role]
+	return ok
+}
+
+// IsValidScope returns whether the scope is known.
+func IsValidScope(scope string) bool {
+	return slices.Contains(allScopes, scope)
+}
+
+// ScopesOfRoles returns scopes granted by the roles in a stable order, unknown roles grant nothing.
+func ScopesOfRoles(roles []string) []string {
+	scopes := []string{}
+	for _, role := range roles {
+		for _, scope := range roleScopes[role] {
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	slices.Sort(scopes)
+	return scopes
+}
+
+// HasScope returns whether the token is granted the scope.
+func (c *Claims) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(c.Scope), scope)
+}
+
+// HasRole returns whether the user of the token has any of the roles.
+func (c *Claims) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if slices.Contains(c.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package client
+
+// Client domain handles OAuth clients, which are other services calling our APIs with client credentials,
+// or web apps obtaining tokens of users by the authorization code flow.
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrInvalidCredentials = errors.New("invalid client credentials")
+	ErrInvalidRedirectURI = errors.New("invalid redirect URI")
+)
+
+type Service interface {
+	// Create registers a client, and returns it with its secret, the secret can't be read afterward.
+	// Public clients have no secret, and it returns ErrInvalidRedirectURI for redirect URIs which aren't absolute or have fragments.
+	Create(ctx context.Context, registration *Registration) (*Client, string, error)
+	// Authenticate verifies the client credentials, public clients can't be authenticated.
+	Authenticate(ctx context.Context, clientID string, secret string) (*Client, error)
+	Get(ctx context.Context, clientID string) (*Client, error)
+	List(ctx context.Context) ([]*Client, error)
+	Delete(ctx context.Context, clientID string) error
+}
+
+type Repository interface {
+	Create(ctx context.Context, client *Client) error
+	Get(ctx context.Context, clientID string) (*Client, error)
+	List(ctx context.Context) ([]*Client, error)
+	Delete(ctx context.Context, clientID string) error
+}
+
+type Client struct {
+	ID   string
+	Name string
+	// SecretHash is the sha256 hash of the secret, the secret isn't stored
+	SecretHash string
+	// Scopes granted to the client
+	Scopes []string
+	// RedirectURIs are allowed redirect URIs of the authorization code flow, they are matched exactly
+	RedirectURIs []string
+	// IsPublic is true for clients which can't keep a secret, e.g. single-page apps, they are verified by PKCE only
+	IsPublic bool
+	// IsFirstParty is true for our own apps, users aren't asked to consent to them
+	IsFirstParty bool
+	CreatedAt    time.Time
+}
+
+// Registration is the client to register.
+type Registration struct {
+	Name         string
+	Scopes       []string
+	RedirectURIs []string
+	IsPublic     bool
+	IsFirstParty bool
+}
+
+// HasScope returns whether the client is granted the scope.
+func (c *Client) HasScope(scope string) bool {
+	return slices.Contains(c.Scopes, scope)
+}
+
+// HasRedirectURI returns whether the redirect URI is allowed, it is compared exactly (RFC 9700 2.1).
+func (c *Client) HasRedirectURI(redirectURI string) bool {
+	return slices.Contains(c.RedirectURIs, redirectURI)
+}
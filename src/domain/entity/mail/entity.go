@@ -0,0 +1,18 @@
+package mail
+
+// Mail domain sends emails to users, e.g. one-time codes.
+
+import (
+	"context"
+)
+
+type Sender interface {
+	Send(ctx context.Context, message *Message) error
+}
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
@@ -0,0 +1,70 @@
+package mfa
+
+// MFA domain handles the second factor of login, TOTP (RFC 6238) and recovery codes.
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNotFound       = errors.New("not found")
+	ErrAlreadyEnabled = errors.New("mfa is enabled")
+	ErrNotEnabled     = errors.New("mfa is not enabled")
+	ErrInvalidCode    = errors.New("invalid code")
+)
+
+type Service interface {
+	// Enroll generates a TOTP secret of the user, it is enabled after a code of it is confirmed.
+	Enroll(ctx context.Context, userID uuid.UUID, accountName string) (*Enrollment, error)
+	// Confirm enables TOTP of the user by a code of the enrolled secret, and returns recovery codes.
+	Confirm(ctx context.Context, userID uuid.UUID, code string) ([]string, error)
+	GetStatus(ctx context.Context, userID uuid.UUID) (*Status, error)
+	// Verify verifies a TOTP code or a recovery code of the user, a code can't be used twice.
+	Verify(ctx context.Context, userID uuid.UUID, code string) error
+	Disable(ctx context.Context, userID uuid.UUID) error
+	// RegenerateRecoveryCodes replaces recovery codes of the user.
+	RegenerateRecoveryCodes(ctx context.Context, userID uuid.UUID) ([]string, error)
+}
+
+type Repository interface {
+	// SetPending sets the secret of an unconfirmed TOTP, it returns ErrAlreadyEnabled if the TOTP of the user is confirmed.
+	SetPending(ctx context.Context, userID uuid.UUID, secretCiphertext string) error
+	Get(ctx context.Context, userID uuid.UUID) (*TOTP, error)
+	Confirm(ctx context.Context, userID uuid.UUID, step int64, recoveryCodeHashes []string) error
+	// UseStep records the time step of a used code, and returns false if the step or a later step was used.
+	UseStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error)
+	// UseRecoveryCode removes the recovery code, and returns false if the user doesn't have it.
+	UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash string) (bool, error)
+	SetRecoveryCodes(ctx context.Context, userID uuid.UUID, recoveryCodeHashes []string) error
+	Delete(ctx context.Context, userID uuid.UUID) error
+}
+
+// TOTP of a user, the secret is stored encrypted and recovery codes are stored hashed.
+type TOTP struct {
+	UserID             uuid.UUID
+	SecretCiphertext   string
+	RecoveryCodeHashes []string
+	// LastUsedStep is the time step of the last used code, codes of it and earlier steps are rejected
+	LastUsedStep int64
+	ConfirmedAt  time.Time
+	CreatedAt    time.Time
+}
+
+func (t *TOTP) IsEnabled() bool {
+	return !t.ConfirmedAt.IsZero()
+}
+
+// Enrollment is shown to the user once, the URI is usually shown as a QR code.
+type Enrollment struct {
+	Secret string
+	URI    string
+}
+
+type Status struct {
+	Enabled           bool
+	RecoveryCodesLeft int
+}
@@ -0,0 +1,80 @@
+package oauth
+
+// OAuth domain issues authorization codes of the authorization code flow with PKCE (RFC 6749, RFC 7636),
+// and keeps consents of users to clients. It doesn't issue tokens, callers create tokens of exchanged codes.
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidGrant is returned for unknown, expired or used codes, and codes of other clients, redirect URIs or verifiers.
+	ErrInvalidGrant = errors.New("invalid grant")
+	// ErrInvalidCodeChallenge is returned for code challenges which aren't S256 challenges.
+	ErrInvalidCodeChallenge = errors.New("invalid code challenge")
+)
+
+type Service interface {
+	// CreateCode creates a one-time authorization code of the request, and returns it.
+	// It returns ErrInvalidCodeChallenge if the code challenge isn't a base64url SHA-256 hash.
+	CreateCode(ctx context.Context, request *AuthorizationRequest) (string, error)
+	// ExchangeCode consumes the code and returns its request, the client, the redirect URI and the PKCE verifier must
+	// match the request, or it returns ErrInvalidGrant.
+	ExchangeCode(ctx context.Context, code string, clientID string, redirectURI string, codeVerifier string) (*AuthorizationRequest, error)
+
+	// HasConsent returns whether the user consented to all the scopes for the client.
+	HasConsent(ctx context.Context, userID uuid.UUID, clientID string, scopes []string) (bool, error)
+	// GrantConsent adds the scopes to the consent of the user for the client.
+	GrantConsent(ctx context.Context, userID uuid.UUID, clientID string, scopes []string) error
+	ListConsents(ctx context.Context, userID uuid.UUID) ([]*Consent, error)
+	// RevokeConsent deletes the consent, it returns ErrNotFound if the user didn't consent to the client.
+	RevokeConsent(ctx context.Context, userID uuid.UUID, clientID string) error
+}
+
+type Repository interface {
+	SetCode(ctx context.Context, codeHash string, request *AuthorizationRequest, expiryDuration time.Duration) error
+	// UseCode deletes the code and returns its request, so a code is exchanged once. It returns ErrNotFound if there is no such code.
+	UseCode(ctx context.Context, codeHash string) (*AuthorizationRequest, error)
+
+	// AddConsentScopes creates the consent, or adds the scopes to it.
+	AddConsentScopes(ctx context.Context, userID uuid.UUID, clientID string, scopes []string) error
+	// GetConsent returns ErrNotFound if there is no such consent.
+	GetConsent(ctx context.Context, userID uuid.UUID, clientID string) (*Consent, error)
+	ListConsents(ctx context.Context, userID uuid.UUID) ([]*Consent, error)
+	DeleteConsent(ctx context.Context, userID uuid.UUID, clientID string) error
+}
+
+// AuthorizationRequest is an authorization of the user to the client, which is approved by the user.
+type AuthorizationRequest struct {
+	UserID      uuid.UUID
+	ClientID    string
+	RedirectURI string
+	Scopes      []string
+	// CodeChallenge is the S256 code challenge of PKCE, the plain method isn't supported
+	CodeChallenge string
+}
+
+// Consent is the scopes a user consented to for a client, the user isn't asked again for these scopes.
+type Consent struct {
+	UserID    uuid.UUID
+	ClientID  string
+	Scopes    []string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// HasScopes returns whether the user consented to all the scopes.
+func (c *Consent) HasScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		if !slices.Contains(c.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package otp
+
+// OTP domain sends one-time codes and magic links to emails, and verifies them.
+// It doesn't know users, callers normalize the email and resolve its user.
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrInvalidCode     = errors.New("invalid or expired code")
+	ErrTooManyAttempts = errors.New("too many attempts")
+	ErrTooSoon         = errors.New("code was sent recently")
+)
+
+// Purpose separates codes of different flows, a code of one purpose can't be used for another.
+type Purpose string
+
+const (
+	PurposeLogin       Purpose = "login"
+	PurposeVerifyEmail Purpose = "verify_email"
+)
+
+type Service interface {
+	// Send sends a one-time code and a magic link to the email, it replaces the previous code of the purpose.
+	Send(ctx context.Context, purpose Purpose, email string) error
+	// VerifyCode verifies the code sent to the email, a valid code is consumed.
+	VerifyCode(ctx context.Context, purpose Purpose, email string, code string) error
+	// VerifyLink verifies the token of a magic link and returns the email, a valid token is consumed.
+	VerifyLink(ctx context.Context, purpose Purpose, token string) (string, error)
+}
+
+type Repository interface {
+	SetChallenge(ctx context.Context, challengeID string, challenge *Challenge, expiryDuration time.Duration) error
+	GetChallenge(ctx context.Context, challengeID string) (*Challenge, error)
+	// IncrAttempts increases the attempts of the challenge, and returns the increased attempts.
+	IncrAttempts(ctx context.Context, challengeID string) (int, error)
+	// DeleteChallenge deletes the challenge, and returns false if it doesn't exist, so only one of concurrent calls consumes it.
+	DeleteChallenge(ctx context.Context, challengeID string) (bool, error)
+}
+
+// Challenge is a sent code, the code is kept hashed.
+type Challenge struct {
+	CodeHash string
+	// LinkNonce is in the magic link, the link is valid while the challenge has the nonce
+	LinkNonce string
+	Attempts  int
+	SentAt    time.Time
+}
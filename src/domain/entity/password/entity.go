@@ -0,0 +1,111 @@
+package password
+
+// Password domain handles email and password credentials of users.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrEmailTaken         = errors.New("email is taken")
+	ErrInvalidEmail       = errors.New("invalid email")
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrWeakPassword       = errors.New("weak password")
+)
+
+type Service interface {
+	// Register creates a user with the email and password, and returns the user ID.
+	Register(ctx context.Context, email string, password string, name string) (uuid.UUID, error)
+	// Login verifies the email and password, and returns the user ID.
+	Login(ctx context.Context, email string, password string) (uuid.UUID, error)
+	ChangePassword(ctx context.Context, userID uuid.UUID, oldPassword string, newPassword string) error
+	GetByEmail(ctx context.Context, email string) (*Credential, error)
+	GetByUserID(ctx context.Context, userID uuid.UUID) (*Credential, error)
+	// SetEmailVerified marks the email of the user as verified, e.g. the user received a one-time code by the email.
+	SetEmailVerified(ctx context.Context, userID uuid.UUID) error
+}
+
+type Repository interface {
+	// Create creates a user with the credential, and returns the user ID.
+	Create(ctx context.Context, credential *Credential, name string) (uuid.UUID, error)
+	GetByEmail(ctx context.Context, email string) (*Credential, error)
+	GetByUserID(ctx context.Context, userID uuid.UUID) (*Credential, error)
+	SetPasswordHash(ctx context.Context, userID uuid.UUID, passwordHash string) error
+	SetEmailVerifiedAt(ctx context.Context, userID uuid.UUID, verifiedAt time.Time) error
+}
+
+type Credential struct {
+	UserID uuid.UUID
+	// Email is normalized to lower case
+	Email string
+	// PasswordHash is the argon2id hash in PHC string format
+	PasswordHash    string
+	EmailVerifiedAt time.Time
+	CreatedAt       time.Time
+}
+
+func (c *Credential) IsEmailVerified() bool {
+	return !c.EmailVerifiedAt.IsZero()
+}
+
+// NormalizeEmail validates the email address, and lowers its case.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
+
+// Policy is the password policy, character classes are lower case, upper case, digit and others.
+type Policy struct {
+	MinLength      int
+	MaxLength      int
+	MinCharClasses int
+}
+
+// Validate returns ErrWeakPassword with the reason if the password doesn't satisfy the policy.
+func (p *Policy) Validate(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return fmt.Errorf("%w: at least %d characters", ErrWeakPassword, p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return fmt.Errorf("%w: at most %d characters", ErrWeakPassword, p.MaxLength)
+	}
+
+	var hasLower, hasUpper, hasDigit, hasOther bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		default:
+			hasOther = true
+		}
+	}
+	classes := 0
+	for _, has := range []bool{hasLower, hasUpper, hasDigit, hasOther} {
+		if has {
+			classes++
+		}
+	}
+	if classes < p.MinCharClasses {
+		return fmt.Errorf("%w: at least %d of lower case, upper case, digit and symbol characters", ErrWeakPassword, p.MinCharClasses)
+	}
+	return nil
+}
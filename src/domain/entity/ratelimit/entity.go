@@ -0,0 +1,55 @@
+package ratelimit
+
+// Rate limit domain limits requests by sliding windows, and locks accounts out after repeated failed credential attempts.
+// Keys are opaque to it, callers decide what a key is, e.g. a client IP, a device, or an account.
+
+import (
+	"context"
+	"time"
+)
+
+// KeyType is what the requests of a rule are counted by.
+type KeyType string
+
+const (
+	KeyIP      KeyType = "ip"
+	KeyDevice  KeyType = "device"
+	KeyAccount KeyType = "account"
+)
+
+// Rule allows at most Limit requests of a key in any Window.
+type Rule struct {
+	// Name separates counts of rules, rules of the same name share counts
+	Name   string
+	Key    KeyType
+	Limit  int
+	Window time.Duration
+}
+
+type Service interface {
+	// Allow counts a request of the key, it returns false and the duration to retry after if the rule is exceeded.
+	// Rejected requests aren't counted.
+	Allow(ctx context.Context, rule Rule, key string) (bool, time.Duration, error)
+
+	// GetLockout returns the remaining lockout duration of the account, 0 if it isn't locked out.
+	GetLockout(ctx context.Context, account string) (time.Duration, error)
+	// RecordFailure counts a failed credential attempt of the account, and locks it out if the failures reach the threshold.
+	// Lockout durations grow exponentially with further failures. It returns the lockout duration, 0 if it isn't locked out.
+	RecordFailure(ctx context.Context, account string) (time.Duration, error)
+	// RecordSuccess resets the failures of the account.
+	RecordSuccess(ctx context.Context, account string) error
+}
+
+type Repository interface {
+	// AddEvent adds an event of the key at the time to the sliding window, if the window has less than limit events.
+	// Otherwise, it returns false and the duration until the oldest event leaves the window.
+	AddEvent(ctx context.Context, key string, at time.Time, limit int, window time.Duration) (bool, time.Duration, error)
+
+	// IncrFailures increases the failures of the account, and returns the increased failures.
+	// The failures are reset after expiryDuration without failures.
+	IncrFailures(ctx context.Context, account string, expiryDuration time.Duration) (int, error)
+	DeleteFailures(ctx context.Context, account string) error
+	SetLockout(ctx context.Context, account string, duration time.Duration) error
+	// GetLockout returns the remaining lockout duration, 0 if it isn't locked out.
+	GetLockout(ctx context.Context, account string) (time.Duration, error)
+}
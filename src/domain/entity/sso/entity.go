@@ -0,0 +1,56 @@
+package sso
+
+// SSO domain verifies credentials issued by external identity providers,
+// and resolves the account ID of the provider. It doesn't manage users.
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown sso provider")
+	ErrInvalidToken    = errors.New("invalid sso token")
+)
+
+type Service interface {
+	// CreateNonce issues a one-time nonce to be sent to the provider, and returns it with its expiry time.
+	CreateNonce(ctx context.Context) (string, time.Time, error)
+	// Verify consumes the nonce of the credential, and verifies the credential against it.
+	Verify(ctx context.Context, credential *Credential) (*Identity, error)
+}
+
+type Repository interface {
+	SetNonce(ctx context.Context, nonceHash string, expiryDuration time.Duration) error
+	// UseNonce deletes the nonce, so a nonce is used once. It returns ErrInvalidToken if there is no such nonce.
+	UseNonce(ctx context.Context, nonceHash string) error
+}
+
+// Provider is an identity provider, e.g. an OpenID Connect issuer.
+type Provider interface {
+	Name() string
+	// VerifyIDToken verifies an ID token issued to us. The nonce is required and must match the token.
+	VerifyIDToken(ctx context.Context, idToken string, nonce string) (*Identity, error)
+	// ExchangeCode exchanges an authorization code for an ID token, and verifies it.
+	ExchangeCode(ctx context.Context, code string, redirectURI string, codeVerifier string, nonce string) (*Identity, error)
+}
+
+// Credential is either an ID token, or an authorization code with its redirect URI.
+// Nonce is issued by CreateNonce, it is required for both.
+type Credential struct {
+	Provider     string
+	IDToken      string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	Nonce        string
+}
+
+// Identity is the account of a provider.
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
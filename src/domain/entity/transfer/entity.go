@@ -0,0 +1,29 @@
+package transfer
+
+// Transfer domain issues one-time codes to move an account to a new device.
+// It doesn't know devices, callers rebind the device of the user of a redeemed code.
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidCode = errors.New("invalid or expired code")
+)
+
+type Service interface {
+	// CreateCode creates a one-time transfer code of the user, and returns it with its expiry time.
+	CreateCode(ctx context.Context, userID uuid.UUID) (string, time.Time, error)
+	// RedeemCode consumes the code, and returns the user of it.
+	RedeemCode(ctx context.Context, code string) (uuid.UUID, error)
+}
+
+type Repository interface {
+	SetCode(ctx context.Context, codeHash string, userID uuid.UUID, expiryDuration time.Duration) error
+	// UseCode deletes the code and returns its user, so a code is redeemed once. It returns ErrInvalidCode if there is no such code.
+	UseCode(ctx context.Context, codeHash string) (uuid.UUID, error)
+}
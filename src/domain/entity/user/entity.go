@@ -7,37 +7,122 @@ package user
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 var (
-	ErrNotFound = errors.New("not found")
+	ErrNotFound            = errors.New("not found")
+	ErrInvalidDeviceSecret = errors.New("invalid device secret")
+	ErrDeviceTaken         = errors.New("device is registered by another user")
+	ErrSSOTaken            = errors.New("sso account is linked to another user")
+	ErrLastIdentity        = errors.New("last login method can't be unlinked")
+	ErrMergeSelf           = errors.New("user can't be merged into itself")
+)
+
+// Kinds of identities, the login methods linked to users.
+const (
+	IdentityKindDevice = "device"
+	IdentityKindSSO    = "sso"
 )
 
 type Service interface {
-	Create(ctx context.Context, platform string, deviceID string, name string) error
+	// Create registers a device account, and returns the device secret, which is required by later device logins.
+	Create(ctx context.Context, platform string, deviceID string, name string) (string, error)
 	Get(ctx context.Context, id uuid.UUID) (*User, error)
 	GetIDByDevice(ctx context.Context, platform string, deviceID string) (uuid.UUID, error) // TODO: check if only get user ID
+	// LoginByDevice verifies the device secret, and returns the user of the device.
+	// A device registered before device secrets has none, the login enrolls it and returns the new secret, otherwise the returned secret is empty.
+	LoginByDevice(ctx context.Context, platform string, deviceID string, deviceSecret string) (uuid.UUID, string, error)
+	// SetDevice moves the device account to another device, e.g. a new phone, and returns the new device secret.
+	// Other devices of the user are unlinked. It returns ErrNotFound if the user has no device, and ErrDeviceTaken if the device is of another user.
+	SetDevice(ctx context.Context, id uuid.UUID, platform string, deviceID string) (string, error)
+	// AddDevice links another device to the user, and returns the device secret. It returns ErrDeviceTaken if the device is of another user.
+	AddDevice(ctx context.Context, id uuid.UUID, platform string, deviceID string) (string, error)
 	GetIDBySSO(ctx context.Context, ssoProvider string, ssoAccountID string) (uuid.UUID, error)
 	CheckValidLoginUser(ctx context.Context, id uuid.UUID) (bool, error)
+	GetRoles(ctx context.Context, id uuid.UUID) ([]string, error)
 	Update(ctx context.Context, user *User) error
+	// AddSSO links the SSO account to the user, linking a linked account is a no-op. It returns ErrSSOTaken if the account is of another user.
 	AddSSO(ctx context.Context, id uuid.UUID, provider string, providerAccountID string) error
+	ListIdentities(ctx context.Context, id uuid.UUID) ([]*Identity, error)
+	// UnlinkIdentity unlinks the device or SSO account from the user. The last identity is unlinked only if the user
+	// has other login methods, e.g. a password, otherwise it returns ErrLastIdentity.
+	UnlinkIdentity(ctx context.Context, id uuid.UUID, identityID uuid.UUID, hasOtherLoginMethods bool) error
 	Delete(ctx context.Context, id uuid.UUID) error
+	// Merge moves identities and passkeys of the source user to the target user, records the merge, and deletes the
+	// source user. The password and the TOTP of the source user are moved only if the target user has none.
+	// OAuth consents and API keys of the source user are revoked. Tokens of the source user should be revoked by the caller.
+	Merge(ctx context.Context, sourceID uuid.UUID, targetID uuid.UUID) error
+
+	// for operators
+	List(ctx context.Context, filter *ListFilter) ([]*User, int, error)
+	SetRoles(ctx context.Context, id uuid.UUID, roles []string) error
+	Suspend(ctx context.Context, id uuid.UUID) error
+	Unsuspend(ctx context.Context, id uuid.UUID) error
+	Restore(ctx context.Context, id uuid.UUID) error
 }
 
 type Repository interface {
-	Create(ctx context.Context, platform string, deviceID string, name string) error
+	Create(ctx context.Context, platform string, deviceID string, name string, deviceSecretHash string) error
 	Get(ctx context.Context, id uuid.UUID) (*User, error)
 	GetIDByDevice(ctx context.Context, platform string, deviceID string) (uuid.UUID, error)
+	// GetDeviceSecretHash returns the user of the device and the hash of its secret, the hash is empty if the device has no secret.
+	GetDeviceSecretHash(ctx context.Context, platform string, deviceID string) (uuid.UUID, string, error)
+	// SetDeviceSecretHash sets the hash of the device secret if the device has none, it returns false if the device has one.
+	SetDeviceSecretHash(ctx context.Context, platform string, deviceID string, deviceSecretHash string) (bool, error)
+	// SetDevice replaces devices of the user by the device and the hash of its secret, it returns ErrNotFound if the user has no device.
+	SetDevice(ctx context.Context, id uuid.UUID, platform string, deviceID string, deviceSecretHash string) error
+	// AddIdentity links the identity to the user, the secret hash is only for devices.
+	// It returns false if the identity is of another user. Linking a linked identity replaces the secret hash, and the identity of a deleted user is taken over.
+	AddIdentity(ctx context.Context, id uuid.UUID, kind string, provider string, subject string, secretHash string) (bool, error)
 	GetIDBySSO(ctx context.Context, ssoProvider string, ssoAccountID string) (uuid.UUID, error)
 	CheckValidLoginUser(ctx context.Context, id uuid.UUID) (bool, error)
+	GetRoles(ctx context.Context, id uuid.UUID) ([]string, error)
 	Update(ctx context.Context, user *User) error
-	AddSSO(ctx context.Context, id uuid.UUID, provider string, providerAccountID string) error
+	ListIdentities(ctx context.Context, id uuid.UUID) ([]*Identity, error)
+	// DeleteIdentity unlinks the identity of the user, it returns ErrLastIdentity if it is the last one and isLastAllowed is false.
+	DeleteIdentity(ctx context.Context, id uuid.UUID, identityID uuid.UUID, isLastAllowed bool) error
 	Delete(ctx context.Context, id uuid.UUID) error
+	// Merge moves owned data of the source user to the target user, revokes OAuth consents and API keys of the source
+	// user, records the merge, and deletes the source user in a transaction.
+	Merge(ctx context.Context, sourceID uuid.UUID, targetID uuid.UUID) error
+
+	// for operators
+	List(ctx context.Context, filter *ListFilter) ([]*User, int, error)
+	SetRoles(ctx context.Context, id uuid.UUID, roles []string) error
+	Suspend(ctx context.Context, id uuid.UUID) error
+	Unsuspend(ctx context.Context, id uuid.UUID) error
+	Restore(ctx context.Context, id uuid.UUID) error
 }
 
 type User struct {
+	ID          uuid.UUID
+	Name        string
+	Roles       []string
+	Identities  []*Identity
+	CreatedAt   time.Time
+	SuspendedAt time.Time
+	DeletedAt   time.Time
+}
+
+// Identity is a device or an SSO account linked to a user, the user logs in by any of them.
+type Identity struct {
 	ID   uuid.UUID
-	Name string
+	Kind string
+	// Provider is the platform of the device, or the SSO provider
+	Provider string
+	// Subject is the device ID, or the account ID of the SSO provider
+	Subject  string
+	LinkedAt time.Time
+}
+
+// ListFilter filters users for operators, users are ordered by created time.
+type ListFilter struct {
+	// Query matches user ID, or part of user name
+	Query          string
+	IncludeDeleted bool
+	Offset         int
+	Limit          int
 }
@@ -0,0 +1,143 @@
+package webauthn
+
+// WebAuthn domain registers passkeys of users and verifies them for login (WebAuthn Level 2).
+// Only discoverable credentials with user verification are supported, attestations aren't verified.
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrInvalidChallenge = errors.New("invalid or expired challenge")
+	ErrInvalidResponse  = errors.New("invalid authenticator response")
+	ErrCredentialExists = errors.New("credential is registered")
+	// ErrSignCount means the sign count isn't increased, the authenticator may be cloned
+	ErrSignCount = errors.New("sign count is not increased")
+)
+
+type Service interface {
+	// BeginRegistration creates options of navigator.credentials.create() to register a passkey of the user.
+	BeginRegistration(ctx context.Context, userID uuid.UUID, userName string) (*CreationOptions, error)
+	// FinishRegistration verifies the created credential of the options, and saves it.
+	FinishRegistration(ctx context.Context, userID uuid.UUID, name string, response *AttestationResponse) (*Credential, error)
+	// BeginLogin creates options of navigator.credentials.get(), any passkey of the relying party can answer it.
+	BeginLogin(ctx context.Context) (*RequestOptions, error)
+	// FinishLogin verifies the assertion of the options, and returns the user of the credential.
+	FinishLogin(ctx context.Context, response *AssertionResponse) (uuid.UUID, error)
+	ListCredentials(ctx context.Context, userID uuid.UUID) ([]*Credential, error)
+	DeleteCredential(ctx context.Context, userID uuid.UUID, credentialID string) error
+}
+
+type Repository interface {
+	SetChallenge(ctx context.Context, challenge string, session *Challenge, expiryDuration time.Duration) error
+	// UseChallenge deletes the challenge and returns it, so a challenge is answered once.
+	UseChallenge(ctx context.Context, challenge string) (*Challenge, error)
+	// CreateCredential returns ErrCredentialExists if the credential ID is registered.
+	CreateCredential(ctx context.Context, credential *Credential) error
+	GetCredential(ctx context.Context, credentialID string) (*Credential, error)
+	ListCredentials(ctx context.Context, userID uuid.UUID) ([]*Credential, error)
+	// UpdateSignCount sets the sign count and last used time, it returns false if the sign count isn't increased,
+	// except both counts are 0, i.e. the authenticator doesn't count.
+	UpdateSignCount(ctx context.Context, credentialID string, signCount uint32, lastUsedAt time.Time) (bool, error)
+	DeleteCredential(ctx context.Context, userID uuid.UUID, credentialID string) error
+}
+
+const (
+	ChallengeTypeCreate = "webauthn.create"
+	ChallengeTypeGet    = "webauthn.get"
+)
+
+// Challenge is an issued challenge of a ceremony, Type is the client data type answering it.
+type Challenge struct {
+	Type string
+	// UserID is the registering user, it is empty for login
+	UserID uuid.UUID
+}
+
+// Credential is a registered passkey, PublicKey is the COSE key of the credential.
+type Credential struct {
+	// ID is the base64url credential ID
+	ID         string
+	UserID     uuid.UUID
+	Name       string
+	PublicKey  []byte
+	Algorithm  int
+	SignCount  uint32
+	AAGUID     uuid.UUID
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+// Options and responses are JSON of WebAuthn Level 3 toJSON(), binary values are base64url encoded.
+
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type      string `json:"type"`
+	Algorithm int    `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+type CreationOptions struct {
+	RelyingParty           RelyingParty           `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	Challenge              string                 `json:"challenge"`
+	Parameters             []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RelyingPartyID   string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+type AttestationResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
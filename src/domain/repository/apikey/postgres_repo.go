@@ -0,0 +1,117 @@
+package apikey_repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+
+	"github.com/andy74139/webserver/src/database"
+	"github.com/andy74139/webserver/src/domain/entity/apikey"
+)
+
+// postgresql API key repository
+type postgresRepo struct {
+	db *bun.DB
+}
+
+func NewPostgresRepo(db *bun.DB) (apikey.Repository, error) {
+	if db == nil {
+		return nil, errors.New("db is nil")
+	}
+	return &postgresRepo{db: db}, nil
+}
+
+func (r *postgresRepo) Create(ctx context.Context, key *apikey.APIKey) error {
+	model := &database.APIKey{
+		ID:        key.ID,
+		UserID:    key.UserID,
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Hash:      key.Hash,
+		Scopes:    key.Scopes,
+		ExpiresAt: key.ExpiresAt,
+	}
+	if _, err := r.db.NewInsert().Model(model).Returning("created_at").Exec(ctx); err != nil {
+		return fmt.Errorf("insert api key error: %w", err)
+	}
+	key.CreatedAt = model.CreatedAt
+	return nil
+}
+
+func (r *postgresRepo) Get(ctx context.Context, userID uuid.UUID, id uuid.UUID) (*apikey.APIKey, error) {
+	return r.get(ctx, r.db.NewSelect().Where("id = ? AND user_id = ?", id, userID))
+}
+
+func (r *postgresRepo) GetByPrefix(ctx context.Context, prefix string) (*apikey.APIKey, error) {
+	return r.get(ctx, r.db.NewSelect().Where("prefix = ?", prefix))
+}
+
+func (r *postgresRepo) get(ctx context.Context, query *bun.SelectQuery) (*apikey.APIKey, error) {
+	model := &database.APIKey{}
+	if err := query.Model(model).Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, apikey.ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	return newAPIKey(model), nil
+}
+
+func (r *postgresRepo) List(ctx context.Context, userID uuid.UUID) ([]*apikey.APIKey, error) {
+	models := []*database.APIKey{}
+	if err := r.db.NewSelect().Model(&models).Where("user_id = ?", userID).Order("created_at").Scan(ctx); err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	keys := make([]*apikey.APIKey, 0, len(models))
+	for _, model := range models {
+		keys = append(keys, newAPIKey(model))
+	}
+	return keys, nil
+}
+
+func (r *postgresRepo) SetExpiresAt(ctx context.Context, id uuid.UUID, expiresAt time.Time) error {
+	query := r.db.NewUpdate().Model(&database.APIKey{}).Set("expires_at = ?", expiresAt).Where("id = ?", id)
+	if _, err := query.Exec(ctx); err != nil {
+		return fmt.Errorf("update error: %w", err)
+	}
+	return nil
+}
+
+func (r *postgresRepo) SetLastUsedAt(ctx context.Context, id uuid.UUID, lastUsedAt time.Time) error {
+	query := r.db.NewUpdate().Model(&database.APIKey{}).Set("last_used_at = ?", lastUsedAt).Where("id = ?", id)
+	if _, err := query.Exec(ctx); err != nil {
+		return fmt.Errorf("update error: %w", err)
+	}
+	return nil
+}
+
+func (r *postgresRepo) Delete(ctx context.Context, userID uuid.UUID, id uuid.UUID) error {
+	query := r.db.NewDelete().Model(&database.APIKey{}).Where("id = ? AND user_id = ?", id, userID)
+	if result, err := query.Exec(ctx); err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	} else if rows, err2 := result.RowsAffected(); err2 != nil {
+		// SHOULD NOT BE HERE for postgres
+		return fmt.Errorf("RowsAffected error: %w", err2)
+	} else if rows == 0 {
+		return fmt.Errorf("no api key %s: %w", id, apikey.ErrNotFound)
+	}
+	return nil
+}
+
+func newAPIKey(model *database.APIKey) *apikey.APIKey {
+	return &apikey.APIKey{
+		ID:         model.ID,
+		UserID:     model.UserID,
+		Name:       model.Name,
+		Prefix:     model.Prefix,
+		Hash:       model.Hash,
+		Scopes:     model.Scopes,
+		ExpiresAt:  model.ExpiresAt,
+		LastUsedAt: model.LastUsedAt,
+		CreatedAt:  model.CreatedAt,
+	}
+}
@@ -0,0 +1,65 @@
+package audit_repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+
+	"github.com/andy74139/webserver/src/database"
+	"github.com/andy74139/webserver/src/domain/entity/audit"
+)
+
+// postgresql audit repository, rows are inserted only.
+type postgresRepo struct {
+	db *bun.DB
+}
+
+func NewPostgresRepo(db *bun.DB) (audit.Repository, error) {
+	if db == nil {
+		return nil, errors.New("db is nil")
+	}
+	return &postgresRepo{db: db}, nil
+}
+
+func (r *postgresRepo) Create(ctx context.Context, event *audit.Event) error {
+	model := &database.AuditLog{
+		CreatedAt: event.CreatedAt,
+		ID:        event.ID,
+		Action:    event.Action,
+		ActorID:   event.ActorID,
+		UserID:    event.UserID,
+		Detail:    event.Detail,
+		IP:        event.IP,
+	}
+	if _, err := r.db.NewInsert().Model(model).Exec(ctx); err != nil {
+		return fmt.Errorf("insert audit log error: %w", err)
+	}
+	return nil
+}
+
+func (r *postgresRepo) ListByUser(ctx context.Context, userID uuid.UUID, limit int) ([]*audit.Event, error) {
+	var models []*database.AuditLog
+	query := r.db.NewSelect().Model(&models).
+		Where("user_id = ? OR actor_id = ?", userID, userID).
+		Order("created_at DESC").
+		Limit(limit)
+	if err := query.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	events := make([]*audit.Event, 0, len(models))
+	for _, model := range models {
+		events = append(events, &audit.Event{
+			ID:        model.ID,
+			Action:    model.Action,
+			ActorID:   model.ActorID,
+			UserID:    model.UserID,
+			Detail:    model.Detail,
+			IP:        model.IP,
+			CreatedAt: model.CreatedAt,
+		})
+	}
+	return events, nil
+}
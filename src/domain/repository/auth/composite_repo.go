@@ -0,0 +1,288 @@
+package auth_repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/uptrace/bun"
+
+	"github.com/andy74139/webserver/src/database"
+	"github.com/andy74139/webserver/src/database/redis"
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+)
+
+var now = time.Now
+
+// warmKeyExpiryDuration bounds how long the cache is trusted without a warm-up, e.g. when a missed write can't mark
+// the cache cold in redis either. WarmUp should be called more often than it.
+const warmKeyExpiryDuration = time.Minute * 15
+
+// CompositeRepo is an auth.Repository which persists revocations and token watermarks to postgresql, and caches them in redis.
+type CompositeRepo interface {
+	auth.Repository
+	// WarmUp loads all unexpired revocations and token watermarks into cache, and marks the cache warm for 15 minutes.
+	WarmUp(ctx context.Context) error
+	// DeleteExpired deletes expired revocations and token watermarks from db.
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+// compositeRepo writes revocations to db and cache, and reads from cache.
+// A miss in cache is trusted only when the cache is warm, i.e. all revocations and watermarks in db have been loaded.
+// Otherwise, e.g. redis is down or flushed, it falls back to db and warms the cache up in background.
+type compositeRepo struct {
+	*redisRepo
+	db revocationStore
+
+	isWarming atomic.Bool
+	// coldGeneration counts writes missed by the cache, the instance doesn't trust the cache until a warm-up started
+	// after the last of them succeeds, even if redis still has the warm key, i.e. marking it cold failed as well
+	coldGeneration atomic.Int64
+	warmGeneration atomic.Int64
+}
+
+// revocationStore is the durable storage of compositeRepo.
+type revocationStore interface {
+	SetRevoked(ctx context.Context, jwtID string, expiresAt time.Time) error
+	GetRevoked(ctx context.Context, jwtID string) (time.Time, error)
+	ListRevoked(ctx context.Context, afterID string, limit int) ([]*database.RevokedToken, error)
+	SetTokensValidAfter(ctx context.Context, userID uuid.UUID, validAfter time.Time, expiresAt time.Time) error
+	GetTokensValidAfter(ctx context.Context, userID uuid.UUID) (*database.TokenWatermark, error)
+	ListTokenWatermarks(ctx context.Context, afterUserID uuid.UUID, limit int) ([]*database.TokenWatermark, error)
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+func NewCompositeRepo(rdb *redis.Client, db *bun.DB) (CompositeRepo, error) {
+	if rdb == nil {
+		return nil, errors.New("redis repository can't be nil")
+	}
+	dbRepo, err := newPostgresRepo(db)
+	if err != nil {
+		return nil, err
+	}
+	return &compositeRepo{redisRepo: &redisRepo{cache: rdb}, db: dbRepo}, nil
+}
+
+func (r *compositeRepo) SetRevoked(ctx context.Context, jwtID string, expiryDuration time.Duration) error {
+	if err := r.db.SetRevoked(ctx, jwtID, now().Add(expiryDuration)); err != nil {
+		return fmt.Errorf("db.SetRevoked error: %w", err)
+	}
+
+	if err := r.redisRepo.SetRevoked(ctx, jwtID, expiryDuration); err != nil {
+		return r.markCacheCold(ctx, err)
+	}
+	return nil
+}
+
+func (r *compositeRepo) IsRevoked(ctx context.Context, jwtID string) (bool, error) {
+	pipe := r.cache.Pipeline()
+	revokedCmd := pipe.Exists(ctx, getAuthTokenRedisKey(jwtID))
+	warmCmd := pipe.Exists(ctx, rediskey.GetRevokeAuthWarmKey())
+	_, cacheErr := pipe.Exec(ctx)
+	if cacheErr == nil {
+		if revokedCmd.Val() > 0 {
+			return true, nil
+		} else if warmCmd.Val() > 0 && !r.isCold() {
+			return false, nil
+		}
+		r.warmUpInBackground()
+	}
+
+	expiresAt, err := r.db.GetRevoked(ctx, jwtID)
+	if err != nil {
+		return false, fmt.Errorf("db.GetRevoked error: %w, cache error: %v", err, cacheErr)
+	}
+	if expiresAt.IsZero() {
+		return false, nil
+	}
+	if cacheErr == nil {
+		// ignore error, it is read from db again next time
+		_ = r.redisRepo.SetRevoked(ctx, jwtID, expiresAt.Sub(now()))
+	}
+	return true, nil
+}
+
+func (r *compositeRepo) SetTokensValidAfter(ctx context.Context, userID uuid.UUID, validAfter time.Time, expiryDuration time.Duration) error {
+	if err := r.db.SetTokensValidAfter(ctx, userID, validAfter, now().Add(expiryDuration)); err != nil {
+		return fmt.Errorf("db.SetTokensValidAfter error: %w", err)
+	}
+
+	if err := r.redisRepo.SetTokensValidAfter(ctx, userID, validAfter, expiryDuration); err != nil {
+		return r.markCacheCold(ctx, err)
+	}
+	return nil
+}
+
+func (r *compositeRepo) GetTokensValidAfter(ctx context.Context, userID uuid.UUID) (time.Time, error) {
+	pipe := r.cache.Pipeline()
+	watermarkCmd := pipe.Get(ctx, getTokenWatermarkRedisKey(userID))
+	warmCmd := pipe.Exists(ctx, rediskey.GetRevokeAuthWarmKey())
+	_, cacheErr := pipe.Exec(ctx)
+	if cacheErr == nil || errors.Is(cacheErr, redis.Nil) {
+		if validAfter, err := watermarkCmd.Int64(); err == nil {
+			return time.Unix(validAfter, 0), nil
+		} else if warmCmd.Val() > 0 && !r.isCold() {
+			return time.Time{}, nil
+		}
+		cacheErr = nil
+		r.warmUpInBackground()
+	}
+
+	watermark, err := r.db.GetTokensValidAfter(ctx, userID)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("db.GetTokensValidAfter error: %w, cache error: %v", err, cacheErr)
+	}
+	if watermark == nil {
+		return time.Time{}, nil
+	}
+	if cacheErr == nil {
+		// ignore error, it is read from db again next time
+		_ = r.redisRepo.SetTokensValidAfter(ctx, userID, watermark.ValidAfter, watermark.ExpiresAt.Sub(now()))
+	}
+	return watermark.ValidAfter, nil
+}
+
+// SetGlobalTokensValidAfter persists the global watermark as the watermark of the nil user ID, so it is cached, warmed
+// up and deleted after expired as watermarks of users.
+func (r *compositeRepo) SetGlobalTokensValidAfter(ctx context.Context, validAfter time.Time, expiryDuration time.Duration) error {
+	return r.SetTokensValidAfter(ctx, uuid.Nil, validAfter, expiryDuration)
+}
+
+func (r *compositeRepo) GetGlobalTokensValidAfter(ctx context.Context) (time.Time, error) {
+	return r.GetTokensValidAfter(ctx, uuid.Nil)
+}
+
+// markCacheCold is called when the cache misses a write, the cache mustn't be trusted until warmed up again.
+// The generations are increased, so a running warm-up which may have read db before the write doesn't mark it warm.
+// The instance marks it cold first, since redis may miss this write as well.
+func (r *compositeRepo) markCacheCold(ctx context.Context, cacheErr error) error {
+	r.coldGeneration.Add(1)
+	pipe := r.cache.TxPipeline()
+	pipe.Incr(ctx, rediskey.GetRevokeAuthGenerationKey())
+	pipe.Del(ctx, rediskey.GetRevokeAuthWarmKey())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("cache write error: %w, Del warm key error: %w", cacheErr, err)
+	}
+	return nil
+}
+
+// setWarmScript marks the cache warm only if the generation is not changed since the warm-up started.
+var setWarmScript = redis.NewScript(`
+local generation = redis.call("GET", KEYS[1]) or "0"
+if generation ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[2], ARGV[2], "PX", ARGV[3])
+return 1
+`)
+
+// isCold returns whether the instance missed writes after the last warm-up.
+func (r *compositeRepo) isCold() bool {
+	return r.coldGeneration.Load() != r.warmGeneration.Load()
+}
+
+// setWarm trusts the cache again, unless writes are missed after the warm-up started.
+func (r *compositeRepo) setWarm(coldGeneration int64) {
+	for {
+		warmGeneration := r.warmGeneration.Load()
+		if warmGeneration >= coldGeneration || r.warmGeneration.CompareAndSwap(warmGeneration, coldGeneration) {
+			return
+		}
+	}
+}
+
+func (r *compositeRepo) WarmUp(ctx context.Context) error {
+	coldGeneration := r.coldGeneration.Load()
+	generation, err := r.cache.Get(ctx, rediskey.GetRevokeAuthGenerationKey()).Result()
+	if errors.Is(err, redis.Nil) {
+		generation = "0"
+	} else if err != nil {
+		return fmt.Errorf("cache Get generation error: %w", err)
+	}
+
+	afterID := ""
+	for {
+		revoked, err := r.db.ListRevoked(ctx, afterID, revokedTokenBatchSize)
+		if err != nil {
+			return fmt.Errorf("db.ListRevoked error: %w", err)
+		}
+
+		pipe := r.cache.Pipeline()
+		for _, token := range revoked {
+			pipe.Set(ctx, getAuthTokenRedisKey(token.ID), nil, token.ExpiresAt.Sub(now()))
+		}
+		if len(revoked) > 0 {
+			if _, err := pipe.Exec(ctx); err != nil {
+				return fmt.Errorf("cache Set error: %w", err)
+			}
+		}
+
+		if len(revoked) < revokedTokenBatchSize {
+			break
+		}
+		afterID = revoked[len(revoked)-1].ID
+	}
+
+	// watermarks are listed after the nil user ID, the global watermark is loaded first
+	global, err := r.db.GetTokensValidAfter(ctx, uuid.Nil)
+	if err != nil {
+		return fmt.Errorf("db.GetTokensValidAfter error: %w", err)
+	} else if global != nil {
+		if err := r.redisRepo.SetGlobalTokensValidAfter(ctx, global.ValidAfter, global.ExpiresAt.Sub(now())); err != nil {
+			return fmt.Errorf("cache SetGlobalTokensValidAfter error: %w", err)
+		}
+	}
+	afterUserID := uuid.Nil
+	for {
+		watermarks, err := r.db.ListTokenWatermarks(ctx, afterUserID, revokedTokenBatchSize)
+		if err != nil {
+			return fmt.Errorf("db.ListTokenWatermarks error: %w", err)
+		}
+
+		pipe := r.cache.Pipeline()
+		for _, watermark := range watermarks {
+			setTokensValidAfter(ctx, pipe, watermark.UserID, watermark.ValidAfter, watermark.ExpiresAt.Sub(now()))
+		}
+		if len(watermarks) > 0 {
+			if _, err := pipe.Exec(ctx); err != nil {
+				return fmt.Errorf("cache Set error: %w", err)
+			}
+		}
+
+		if len(watermarks) < revokedTokenBatchSize {
+			break
+		}
+		afterUserID = watermarks[len(watermarks)-1].UserID
+	}
+
+	keys := []string{rediskey.GetRevokeAuthGenerationKey(), rediskey.GetRevokeAuthWarmKey()}
+	isWarm, err := setWarmScript.Run(ctx, r.cache, keys, generation, now().Unix(), warmKeyExpiryDuration.Milliseconds()).Int()
+	if err != nil {
+		return fmt.Errorf("setWarmScript error: %w", err)
+	} else if isWarm == 0 {
+		return errors.New("cache missed writes during warm-up, it is retried by the next cache miss")
+	}
+	r.setWarm(coldGeneration)
+	return nil
+}
+
+func (r *compositeRepo) warmUpInBackground() {
+	if !r.isWarming.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer r.isWarming.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		// ignore error, it is retried by the next cache miss
+		_ = r.WarmUp(ctx)
+	}()
+}
+
+func (r *compositeRepo) DeleteExpired(ctx context.Context) (int64, error) {
+	return r.db.DeleteExpired(ctx)
+}
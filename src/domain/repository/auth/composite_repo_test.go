@@ -0,0 +1,223 @@
+package auth_repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/andy74139/webserver/src/database"
+	"github.com/andy74139/webserver/src/database/redis"
+)
+
+type CompositeRepoSuite struct {
+	suite.Suite
+}
+
+func TestCompositeRepoSuite(t *testing.T) {
+	suite.Run(t, new(CompositeRepoSuite))
+}
+
+var errRedisDown = errors.New("redis is down")
+
+// fakeRedis is a redis.Hook serving plain commands from memory, scripts aren't supported. Commands fail while it is down.
+type fakeRedis struct {
+	mu     sync.Mutex
+	isDown bool
+	values map[string]string
+}
+
+func (f *fakeRedis) setDown(isDown bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.isDown = isDown
+}
+
+func (f *fakeRedis) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errRedisDown
+	}
+}
+
+func (f *fakeRedis) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.process(cmd)
+	}
+}
+
+func (f *fakeRedis) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		var firstErr error
+		for _, cmd := range cmds {
+			if err := f.process(cmd); err != nil && !errors.Is(err, redis.Nil) && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+}
+
+func (f *fakeRedis) process(cmd redis.Cmder) error {
+	if f.isDown {
+		cmd.SetErr(errRedisDown)
+		return errRedisDown
+	}
+	args := cmd.Args()
+	key := ""
+	if len(args) > 1 {
+		key, _ = args[1].(string)
+	}
+	switch cmd.Name() {
+	case "multi", "exec":
+	case "exists":
+		count := int64(0)
+		for _, arg := range args[1:] {
+			if _, ok := f.values[arg.(string)]; ok {
+				count++
+			}
+		}
+		cmd.(*redis.IntCmd).SetVal(count)
+	case "get":
+		value, ok := f.values[key]
+		if !ok {
+			cmd.SetErr(redis.Nil)
+			return redis.Nil
+		}
+		cmd.(*redis.StringCmd).SetVal(value)
+	case "set":
+		f.values[key] = fmt.Sprint(args[2])
+		cmd.(*redis.StatusCmd).SetVal("OK")
+	case "del":
+		count := int64(0)
+		for _, arg := range args[1:] {
+			if _, ok := f.values[arg.(string)]; ok {
+				delete(f.values, arg.(string))
+				count++
+			}
+		}
+		cmd.(*redis.IntCmd).SetVal(count)
+	case "incr":
+		cmd.(*redis.IntCmd).SetVal(1)
+	default:
+		err := errors.New("unsupported command: " + cmd.Name())
+		cmd.SetErr(err)
+		return err
+	}
+	return nil
+}
+
+// fakeStore is an in-memory revocationStore.
+type fakeStore struct {
+	mu         sync.Mutex
+	revoked    map[string]time.Time
+	watermarks map[uuid.UUID]*database.TokenWatermark
+}
+
+func (s *fakeStore) SetRevoked(ctx context.Context, jwtID string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked[jwtID] = expiresAt
+	return nil
+}
+
+func (s *fakeStore) GetRevoked(ctx context.Context, jwtID string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revoked[jwtID], nil
+}
+
+func (s *fakeStore) ListRevoked(ctx context.Context, afterID string, limit int) ([]*database.RevokedToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	revoked := []*database.RevokedToken{}
+	for id, expiresAt := range s.revoked {
+		revoked = append(revoked, &database.RevokedToken{ID: id, ExpiresAt: expiresAt})
+	}
+	return revoked, nil
+}
+
+func (s *fakeStore) SetTokensValidAfter(ctx context.Context, userID uuid.UUID, validAfter time.Time, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watermarks[userID] = &database.TokenWatermark{UserID: userID, ValidAfter: validAfter, ExpiresAt: expiresAt}
+	return nil
+}
+
+func (s *fakeStore) GetTokensValidAfter(ctx context.Context, userID uuid.UUID) (*database.TokenWatermark, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.watermarks[userID], nil
+}
+
+func (s *fakeStore) ListTokenWatermarks(ctx context.Context, afterUserID uuid.UUID, limit int) ([]*database.TokenWatermark, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	watermarks := []*database.TokenWatermark{}
+	for _, watermark := range s.watermarks {
+		watermarks = append(watermarks, watermark)
+	}
+	return watermarks, nil
+}
+
+func (s *fakeStore) DeleteExpired(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func (s *CompositeRepoSuite) TestMissedWriteWhileRedisDown() {
+	ctx := context.TODO()
+	cache := &fakeRedis{values: map[string]string{rediskey.GetRevokeAuthWarmKey(): "1"}}
+	rdb := redis.NewClient(&redis.Options{Addr: "localhost:6379", MaxRetries: -1})
+	rdb.AddHook(cache)
+	repo := &compositeRepo{
+		redisRepo: &redisRepo{cache: rdb},
+		db:        &fakeStore{revoked: map[string]time.Time{}, watermarks: map[uuid.UUID]*database.TokenWatermark{}},
+	}
+
+	isRevoked, err := repo.IsRevoked(ctx, "jwt-1")
+	s.Require().NoError(err)
+	s.False(isRevoked)
+
+	// both the revocation and marking the cache cold are missed by redis
+	cache.setDown(true)
+	s.Error(repo.SetRevoked(ctx, "jwt-1", time.Hour))
+	userID, validAfter := uuid.New(), time.Now().Truncate(time.Second)
+	s.Error(repo.SetTokensValidAfter(ctx, userID, validAfter, time.Hour))
+
+	// redis recovers with the stale warm key, the instance reads db until a warm-up succeeds
+	cache.setDown(false)
+	isRevoked, err = repo.IsRevoked(ctx, "jwt-1")
+	s.Require().NoError(err)
+	s.True(isRevoked)
+	watermark, err := repo.GetTokensValidAfter(ctx, userID)
+	s.Require().NoError(err)
+	s.Equal(validAfter, watermark)
+	s.Eventually(func() bool { return !repo.isWarming.Load() }, time.Second, time.Millisecond*10)
+	s.True(repo.isCold(), "the warm-up fails without script support")
+}
+
+func (s *CompositeRepoSuite) TestWarmUpDuringMissedWrite() {
+	repo := &compositeRepo{}
+
+	// a write is missed after the warm-up started, the warm-up doesn't trust the cache
+	coldGeneration := repo.coldGeneration.Load()
+	repo.coldGeneration.Add(1)
+	repo.setWarm(coldGeneration)
+	s.True(repo.isCold())
+
+	// the next warm-up does
+	repo.setWarm(repo.coldGeneration.Load())
+	s.False(repo.isCold())
+	repo.setWarm(coldGeneration)
+	s.False(repo.isCold(), "an earlier warm-up finishing late doesn't go backward")
+}
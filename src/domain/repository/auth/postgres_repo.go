@@ -0,0 +1,111 @@
+package auth_repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+
+	"github.com/andy74139/webserver/src/database"
+)
+
+const revokedTokenBatchSize = 1000
+
+// postgresql revocation repository, it is the durable storage of revocations.
+type postgresRepo struct {
+	db *bun.DB
+}
+
+func newPostgresRepo(db *bun.DB) (*postgresRepo, error) {
+	if db == nil {
+		return nil, errors.New("db is nil")
+	}
+	return &postgresRepo{db: db}, nil
+}
+
+func (r *postgresRepo) SetRevoked(ctx context.Context, jwtID string, expiresAt time.Time) error {
+	revoked := &database.RevokedToken{ID: jwtID, ExpiresAt: expiresAt}
+	query := r.db.NewInsert().Model(revoked).
+		On("CONFLICT (id) DO UPDATE").
+		Set("expires_at = GREATEST(revoked_token.expires_at, EXCLUDED.expires_at)")
+	if _, err := query.Exec(ctx); err != nil {
+		return fmt.Errorf("insert revoked token error: %w", err)
+	}
+	return nil
+}
+
+// GetRevoked returns the expiry time of the revocation, or zero time if it isn't revoked.
+func (r *postgresRepo) GetRevoked(ctx context.Context, jwtID string) (time.Time, error) {
+	revoked := []*database.RevokedToken{}
+	err := r.db.NewSelect().Model(&revoked).Where("id = ? AND expires_at > ?", jwtID, now()).Limit(1).Scan(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("select error: %w", err)
+	} else if len(revoked) == 0 {
+		return time.Time{}, nil
+	}
+	return revoked[0].ExpiresAt, nil
+}
+
+// ListRevoked returns unexpired revocations ordered by ID, after the ID.
+func (r *postgresRepo) ListRevoked(ctx context.Context, afterID string, limit int) ([]*database.RevokedToken, error) {
+	revoked := []*database.RevokedToken{}
+	query := r.db.NewSelect().Model(&revoked).Where("id > ? AND expires_at > ?", afterID, now()).Order("id").Limit(limit)
+	if err := query.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	return revoked, nil
+}
+
+func (r *postgresRepo) SetTokensValidAfter(ctx context.Context, userID uuid.UUID, validAfter time.Time, expiresAt time.Time) error {
+	watermark := &database.TokenWatermark{UserID: userID, ValidAfter: validAfter, ExpiresAt: expiresAt}
+	query := r.db.NewInsert().Model(watermark).
+		On("CONFLICT (user_id) DO UPDATE").
+		Set("valid_after = GREATEST(token_watermark.valid_after, EXCLUDED.valid_after)").
+		Set("expires_at = GREATEST(token_watermark.expires_at, EXCLUDED.expires_at)")
+	if _, err := query.Exec(ctx); err != nil {
+		return fmt.Errorf("insert token watermark error: %w", err)
+	}
+	return nil
+}
+
+// GetTokensValidAfter returns the watermark, or nil if there is no unexpired watermark.
+func (r *postgresRepo) GetTokensValidAfter(ctx context.Context, userID uuid.UUID) (*database.TokenWatermark, error) {
+	watermarks := []*database.TokenWatermark{}
+	err := r.db.NewSelect().Model(&watermarks).Where("user_id = ? AND expires_at > ?", userID, now()).Limit(1).Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	} else if len(watermarks) == 0 {
+		return nil, nil
+	}
+	return watermarks[0], nil
+}
+
+// ListTokenWatermarks returns unexpired watermarks ordered by user ID, after the user ID.
+func (r *postgresRepo) ListTokenWatermarks(ctx context.Context, afterUserID uuid.UUID, limit int) ([]*database.TokenWatermark, error) {
+	watermarks := []*database.TokenWatermark{}
+	query := r.db.NewSelect().Model(&watermarks).Where("user_id > ? AND expires_at > ?", afterUserID, now()).Order("user_id").Limit(limit)
+	if err := query.Scan(ctx); err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	return watermarks, nil
+}
+
+func (r *postgresRepo) DeleteExpired(ctx context.Context) (int64, error) {
+	var total int64
+	for _, model := range []any{(*database.RevokedToken)(nil), (*database.TokenWatermark)(nil)} {
+		result, err := r.db.NewDelete().Model(model).Where("expires_at <= ?", now()).Exec(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("delete error: %w", err)
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			// SHOULD NOT BE HERE for postgres
+			return 0, fmt.Errorf("RowsAffected error: %w", err)
+		}
+		total += rows
+	}
+	return total, nil
+}
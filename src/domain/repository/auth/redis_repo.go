@@ -4,15 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 
 	"github.com/andy74139/webserver/src/database/redis"
 	"github.com/andy74139/webserver/src/domain/entity/auth"
 )
 
-// postgresql account repository
+// redis auth repository, revocations are lost if redis is flushed, see compositeRepo for durable revocations.
 type redisRepo struct {
 	cache *redis.Client
 }
@@ -25,7 +28,6 @@ func NewRedisRepo(rdb *redis.Client) (auth.Repository, error) {
 }
 
 func (r *redisRepo) SetRevoked(ctx context.Context, jwtID string, expiryDuration time.Duration) error {
-	// TODO: cache-aside with db, to keep revoking token if cache being down
 	key := getAuthTokenRedisKey(jwtID)
 	if err := r.cache.Set(ctx, key, nil, expiryDuration).Err(); err != nil {
 		return fmt.Errorf("Set error: %w", err)
@@ -42,6 +44,292 @@ func (r *redisRepo) IsRevoked(ctx context.Context, jwtID string) (bool, error) {
 	return true, nil
 }
 
+func (r *redisRepo) SetRefreshToken(ctx context.Context, tokenHash string, token *auth.RefreshToken, expiryDuration time.Duration) error {
+	key := getRefreshTokenRedisKey(tokenHash)
+	pipe := r.cache.TxPipeline()
+	pipe.HSet(ctx, key,
+		"user_id", token.UserID.String(),
+		"session_id", token.SessionID,
+		"client_id", token.ClientID,
+		"scope", strings.Join(token.Scopes, " "),
+		"auth_time", token.AuthTime.Unix(),
+		"issued_at", token.IssuedAt.Unix(),
+		"expires_at", token.ExpiresAt.Unix(),
+		"used", 0,
+	)
+	pipe.Expire(ctx, key, expiryDuration)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("HSet error: %w", err)
+	}
+	return nil
+}
+
+// useRefreshTokenScript increases the used count atomically, so only one of concurrent refreshes sees a fresh token.
+var useRefreshTokenScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return nil
+end
+redis.call("HINCRBY", KEYS[1], "used", 1)
+return redis.call("HGETALL", KEYS[1])
+`)
+
+func (r *redisRepo) UseRefreshToken(ctx context.Context, tokenHash string) (*auth.RefreshToken, error) {
+	result, err := useRefreshTokenScript.Run(ctx, r.cache, []string{getRefreshTokenRedisKey(tokenHash)}).StringSlice()
+	if errors.Is(err, redis.Nil) {
+		return nil, auth.ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("useRefreshTokenScript error: %w", err)
+	}
+
+	fields := map[string]string{}
+	for i := 0; i+1 < len(result); i += 2 {
+		fields[result[i]] = result[i+1]
+	}
+
+	userID, err := uuid.Parse(fields["user_id"])
+	if err != nil {
+		return nil, fmt.Errorf("uuid.Parse error: %w", err)
+	}
+	issuedAt, err := strconv.ParseInt(fields["issued_at"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse issued_at error: %w", err)
+	}
+	expiresAt, err := strconv.ParseInt(fields["expires_at"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse expires_at error: %w", err)
+	}
+	used, err := strconv.Atoi(fields["used"])
+	if err != nil {
+		return nil, fmt.Errorf("parse used error: %w", err)
+	}
+	// tokens issued before auth_time was recorded take the issued time
+	authTime := issuedAt
+	if value, ok := fields["auth_time"]; ok {
+		if authTime, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, fmt.Errorf("parse auth_time error: %w", err)
+		}
+	}
+
+	return &auth.RefreshToken{
+		UserID:    userID,
+		SessionID: fields["session_id"],
+		ClientID:  fields["client_id"],
+		Scopes:    parseScopes(fields["client_id"], fields["scope"]),
+		AuthTime:  time.Unix(authTime, 0),
+		IssuedAt:  time.Unix(issuedAt, 0),
+		ExpiresAt: time.Unix(expiresAt, 0),
+		IsUsed:    used > 1,
+	}, nil
+}
+
+// setTokensValidAfterScript only moves a watermark forward, so a late write of an older watermark can't un-revoke
+// tokens. Expired watermarks are not set.
+var setTokensValidAfterScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if (current and tonumber(current) >= tonumber(ARGV[1])) or tonumber(ARGV[2]) <= 0 then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+func (r *redisRepo) SetTokensValidAfter(ctx context.Context, userID uuid.UUID, validAfter time.Time, expiryDuration time.Duration) error {
+	if err := setTokensValidAfter(ctx, r.cache, userID, validAfter, expiryDuration).Err(); err != nil {
+		return fmt.Errorf("setTokensValidAfterScript error: %w", err)
+	}
+	return nil
+}
+
+// setTokensValidAfter runs setTokensValidAfterScript by the client or a pipeline, the script is sent in full to
+// pipelines since they can't retry a missing script.
+func setTokensValidAfter(ctx context.Context, c redis.Scripter, userID uuid.UUID, validAfter time.Time, expiryDuration time.Duration) *redis.Cmd {
+	keys := []string{getTokenWatermarkRedisKey(userID)}
+	args := []any{validAfter.Unix(), expiryDuration.Milliseconds()}
+	if _, ok := c.(redis.Pipeliner); ok {
+		return setTokensValidAfterScript.Eval(ctx, c, keys, args...)
+	}
+	return setTokensValidAfterScript.Run(ctx, c, keys, args...)
+}
+
+func (r *redisRepo) GetTokensValidAfter(ctx context.Context, userID uuid.UUID) (time.Time, error) {
+	validAfter, err := r.cache.Get(ctx, getTokenWatermarkRedisKey(userID)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, fmt.Errorf("Get error: %w", err)
+	}
+	return time.Unix(validAfter, 0), nil
+}
+
+// SetGlobalTokensValidAfter stores the global watermark as the watermark of the nil user ID, which no user has.
+func (r *redisRepo) SetGlobalTokensValidAfter(ctx context.Context, validAfter time.Time, expiryDuration time.Duration) error {
+	return r.SetTokensValidAfter(ctx, uuid.Nil, validAfter, expiryDuration)
+}
+
+func (r *redisRepo) GetGlobalTokensValidAfter(ctx context.Context) (time.Time, error) {
+	return r.GetTokensValidAfter(ctx, uuid.Nil)
+}
+
+func (r *redisRepo) SetSession(ctx context.Context, session *auth.Session, expiryDuration time.Duration) error {
+	key := getSessionRedisKey(session.ID)
+	userKey := getUserSessionsRedisKey(session.UserID)
+	pipe := r.cache.TxPipeline()
+	pipe.HSet(ctx, key,
+		"user_id", session.UserID.String(),
+		"jwt_id", session.JWTID,
+		"platform", session.Info.Platform,
+		"device_id", session.Info.DeviceID,
+		"ip", session.Info.IP,
+		"user_agent", session.Info.UserAgent,
+		"client_id", session.Info.ClientID,
+		"scope", strings.Join(session.Info.Scopes, " "),
+		"created_at", session.CreatedAt.Unix(),
+		"last_used_at", session.LastUsedAt.Unix(),
+		"expires_at", session.ExpiresAt.Unix(),
+	)
+	pipe.Expire(ctx, key, expiryDuration)
+	pipe.SAdd(ctx, userKey, session.ID)
+	// sessions set lives as long as the latest session
+	pipe.ExpireGT(ctx, userKey, expiryDuration)
+	pipe.ExpireNX(ctx, userKey, expiryDuration)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("HSet error: %w", err)
+	}
+	return nil
+}
+
+func (r *redisRepo) GetSession(ctx context.Context, sessionID string) (*auth.Session, error) {
+	fields, err := r.cache.HGetAll(ctx, getSessionRedisKey(sessionID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("HGetAll error: %w", err)
+	} else if len(fields) == 0 {
+		return nil, auth.ErrNotFound
+	}
+	return parseSession(sessionID, fields)
+}
+
+func (r *redisRepo) ListSessions(ctx context.Context, userID uuid.UUID) ([]*auth.Session, error) {
+	userKey := getUserSessionsRedisKey(userID)
+	sessionIDs, err := r.cache.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("SMembers error: %w", err)
+	}
+
+	pipe := r.cache.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(sessionIDs))
+	for i, sessionID := range sessionIDs {
+		cmds[i] = pipe.HGetAll(ctx, getSessionRedisKey(sessionID))
+	}
+	if len(sessionIDs) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("HGetAll error: %w", err)
+		}
+	}
+
+	sessions := []*auth.Session{}
+	expiredIDs := []any{}
+	for i, cmd := range cmds {
+		if len(cmd.Val()) == 0 {
+			expiredIDs = append(expiredIDs, sessionIDs[i])
+			continue
+		}
+		session, err := parseSession(sessionIDs[i], cmd.Val())
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if len(expiredIDs) > 0 {
+		if err := r.cache.SRem(ctx, userKey, expiredIDs...).Err(); err != nil {
+			return nil, fmt.Errorf("SRem error: %w", err)
+		}
+	}
+	return sessions, nil
+}
+
+func (r *redisRepo) DeleteSession(ctx context.Context, userID uuid.UUID, sessionID string) error {
+	pipe := r.cache.TxPipeline()
+	pipe.Del(ctx, getSessionRedisKey(sessionID))
+	pipe.SRem(ctx, getUserSessionsRedisKey(userID), sessionID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("Del error: %w", err)
+	}
+	return nil
+}
+
+func (r *redisRepo) DeleteUserSessions(ctx context.Context, userID uuid.UUID) error {
+	userKey := getUserSessionsRedisKey(userID)
+	sessionIDs, err := r.cache.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return fmt.Errorf("SMembers error: %w", err)
+	}
+
+	keys := []string{userKey}
+	for _, sessionID := range sessionIDs {
+		keys = append(keys, getSessionRedisKey(sessionID))
+	}
+	if err := r.cache.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("Del error: %w", err)
+	}
+	return nil
+}
+
+func parseSession(sessionID string, fields map[string]string) (*auth.Session, error) {
+	userID, err := uuid.Parse(fields["user_id"])
+	if err != nil {
+		return nil, fmt.Errorf("uuid.Parse error: %w", err)
+	}
+	times := map[string]time.Time{}
+	for _, field := range []string{"created_at", "last_used_at", "expires_at"} {
+		unix, err := strconv.ParseInt(fields[field], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s error: %w", field, err)
+		}
+		times[field] = time.Unix(unix, 0)
+	}
+
+	return &auth.Session{
+		ID:     sessionID,
+		UserID: userID,
+		JWTID:  fields["jwt_id"],
+		Info: auth.SessionInfo{
+			Platform:  fields["platform"],
+			DeviceID:  fields["device_id"],
+			IP:        fields["ip"],
+			UserAgent: fields["user_agent"],
+			ClientID:  fields["client_id"],
+			Scopes:    parseScopes(fields["client_id"], fields["scope"]),
+		},
+		CreatedAt:  times["created_at"],
+		LastUsedAt: times["last_used_at"],
+		ExpiresAt:  times["expires_at"],
+	}, nil
+}
+
+// parseScopes parses the space-separated scopes of a session, only sessions of clients have scopes.
+func parseScopes(clientID string, scope string) []string {
+	if clientID == "" {
+		return nil
+	}
+	return strings.Fields(scope)
+}
+
 func getAuthTokenRedisKey(tokenID string) string {
 	return rediskey.GetRevokeAuthPrefix() + tokenID
 }
+
+func getRefreshTokenRedisKey(tokenHash string) string {
+	return rediskey.GetRefreshTokenPrefix() + tokenHash
+}
+
+func getTokenWatermarkRedisKey(userID uuid.UUID) string {
+	return rediskey.GetTokenWatermarkPrefix() + userID.String()
+}
+
+func getSessionRedisKey(sessionID string) string {
+	return rediskey.GetSessionPrefix() + sessionID
+}
+
+func getUserSessionsRedisKey(userID uuid.UUID) string {
+	return rediskey.GetUserSessionsPrefix() + userID.String()
+}
@@ -0,0 +1,89 @@
+package client_repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/uptrace/bun"
+
+	"github.com/andy74139/webserver/src/database"
+	"github.com/andy74139/webserver/src/domain/entity/client"
+)
+
+// postgresql client repository
+type postgresRepo struct {
+	db *bun.DB
+}
+
+func NewPostgresRepo(db *bun.DB) (client.Repository, error) {
+	if db == nil {
+		return nil, errors.New("db is nil")
+	}
+	return &postgresRepo{db: db}, nil
+}
+
+func (r *postgresRepo) Create(ctx context.Context, client1 *client.Client) error {
+	model := &database.OAuthClient{
+		ID:           client1.ID,
+		Name:         client1.Name,
+		SecretHash:   client1.SecretHash,
+		Scopes:       client1.Scopes,
+		RedirectURIs: client1.RedirectURIs,
+		IsPublic:     client1.IsPublic,
+		IsFirstParty: client1.IsFirstParty,
+	}
+	if _, err := r.db.NewInsert().Model(model).Returning("created_at").Exec(ctx); err != nil {
+		return fmt.Errorf("insert client error: %w", err)
+	}
+	client1.CreatedAt = model.CreatedAt
+	return nil
+}
+
+func (r *postgresRepo) Get(ctx context.Context, clientID string) (*client.Client, error) {
+	model := &database.OAuthClient{}
+	if err := r.db.NewSelect().Model(model).Where("id = ?", clientID).Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, client.ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	return newClient(model), nil
+}
+
+func (r *postgresRepo) List(ctx context.Context) ([]*client.Client, error) {
+	models := []*database.OAuthClient{}
+	if err := r.db.NewSelect().Model(&models).Order("created_at").Scan(ctx); err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	clients := make([]*client.Client, 0, len(models))
+	for _, model := range models {
+		clients = append(clients, newClient(model))
+	}
+	return clients, nil
+}
+
+func (r *postgresRepo) Delete(ctx context.Context, clientID string) error {
+	if result, err := r.db.NewDelete().Model(&database.OAuthClient{}).Where("id = ?", clientID).Exec(ctx); err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	} else if rows, err2 := result.RowsAffected(); err2 != nil {
+		// SHOULD NOT BE HERE for postgres
+		return fmt.Errorf("RowsAffected error: %w", err2)
+	} else if rows == 0 {
+		return fmt.Errorf("no client %s: %w", clientID, client.ErrNotFound)
+	}
+	return nil
+}
+
+func newClient(model *database.OAuthClient) *client.Client {
+	return &client.Client{
+		ID:           model.ID,
+		Name:         model.Name,
+		SecretHash:   model.SecretHash,
+		Scopes:       model.Scopes,
+		RedirectURIs: model.RedirectURIs,
+		IsPublic:     model.IsPublic,
+		IsFirstParty: model.IsFirstParty,
+		CreatedAt:    model.CreatedAt,
+	}
+}
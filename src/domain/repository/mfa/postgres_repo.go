@@ -0,0 +1,140 @@
+package mfa_repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
+
+	"github.com/andy74139/webserver/src/database"
+	"github.com/andy74139/webserver/src/domain/entity/mfa"
+)
+
+// postgresql mfa repository
+type postgresRepo struct {
+	db *bun.DB
+}
+
+func NewPostgresRepo(db *bun.DB) (mfa.Repository, error) {
+	if db == nil {
+		return nil, errors.New("db is nil")
+	}
+	return &postgresRepo{db: db}, nil
+}
+
+func (r *postgresRepo) SetPending(ctx context.Context, userID uuid.UUID, secretCiphertext string) error {
+	model := &database.MFATOTP{
+		UserID:             userID,
+		SecretCiphertext:   secretCiphertext,
+		RecoveryCodeHashes: []string{},
+	}
+	// a confirmed TOTP isn't replaced
+	query := r.db.NewInsert().Model(model).
+		On("CONFLICT (user_id) DO UPDATE").
+		Set("secret_ciphertext = EXCLUDED.secret_ciphertext").
+		Set("updated_at = ?", time.Now()).
+		Where("mfa_totp.confirmed_at IS NULL")
+	if result, err := query.Exec(ctx); err != nil {
+		return fmt.Errorf("upsert error: %w", err)
+	} else if rows, err2 := result.RowsAffected(); err2 != nil {
+		// SHOULD NOT BE HERE for postgres
+		return fmt.Errorf("RowsAffected error: %w", err2)
+	} else if rows == 0 {
+		return mfa.ErrAlreadyEnabled
+	}
+	return nil
+}
+
+func (r *postgresRepo) Get(ctx context.Context, userID uuid.UUID) (*mfa.TOTP, error) {
+	model := &database.MFATOTP{}
+	if err := r.db.NewSelect().Model(model).Where("user_id = ?", userID).Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, mfa.ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	return &mfa.TOTP{
+		UserID:             model.UserID,
+		SecretCiphertext:   model.SecretCiphertext,
+		RecoveryCodeHashes: model.RecoveryCodeHashes,
+		LastUsedStep:       model.LastUsedStep,
+		ConfirmedAt:        model.ConfirmedAt,
+		CreatedAt:          model.CreatedAt,
+	}, nil
+}
+
+func (r *postgresRepo) Confirm(ctx context.Context, userID uuid.UUID, step int64, recoveryCodeHashes []string) error {
+	query := r.db.NewUpdate().Model(&database.MFATOTP{}).
+		Set("confirmed_at = ?", time.Now()).
+		Set("last_used_step = ?", step).
+		Set("recovery_code_hashes = ?", pgdialect.Array(recoveryCodeHashes)).
+		Set("updated_at = ?", time.Now()).
+		Where("user_id = ? AND confirmed_at IS NULL", userID)
+	if rows, err := execUpdate(ctx, query); err != nil {
+		return err
+	} else if rows == 0 {
+		return fmt.Errorf("no pending totp of user %s: %w", userID, mfa.ErrNotFound)
+	}
+	return nil
+}
+
+func (r *postgresRepo) UseStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	query := r.db.NewUpdate().Model(&database.MFATOTP{}).
+		Set("last_used_step = ?", step).
+		Where("user_id = ? AND last_used_step < ?", userID, step)
+	rows, err := execUpdate(ctx, query)
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+func (r *postgresRepo) UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash string) (bool, error) {
+	query := r.db.NewUpdate().Model(&database.MFATOTP{}).
+		Set("recovery_code_hashes = array_remove(recovery_code_hashes, ?)", codeHash).
+		Set("updated_at = ?", time.Now()).
+		Where("user_id = ? AND ? = ANY(recovery_code_hashes)", userID, codeHash)
+	rows, err := execUpdate(ctx, query)
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+func (r *postgresRepo) SetRecoveryCodes(ctx context.Context, userID uuid.UUID, recoveryCodeHashes []string) error {
+	query := r.db.NewUpdate().Model(&database.MFATOTP{}).
+		Set("recovery_code_hashes = ?", pgdialect.Array(recoveryCodeHashes)).
+		Set("updated_at = ?", time.Now()).
+		Where("user_id = ?", userID)
+	if rows, err := execUpdate(ctx, query); err != nil {
+		return err
+	} else if rows == 0 {
+		return fmt.Errorf("no totp of user %s: %w", userID, mfa.ErrNotFound)
+	}
+	return nil
+}
+
+func (r *postgresRepo) Delete(ctx context.Context, userID uuid.UUID) error {
+	query := r.db.NewDelete().Model(&database.MFATOTP{}).Where("user_id = ?", userID)
+	if _, err := query.Exec(ctx); err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
+	return nil
+}
+
+func execUpdate(ctx context.Context, query *bun.UpdateQuery) (int64, error) {
+	result, err := query.Exec(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("update error: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		// SHOULD NOT BE HERE for postgres
+		return 0, fmt.Errorf("RowsAffected error: %w", err)
+	}
+	return rows, nil
+}
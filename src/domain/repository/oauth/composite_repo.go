@@ -0,0 +1,140 @@
+package oauth_repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/uptrace/bun"
+
+	"github.com/andy74139/webserver/src/database"
+	"github.com/andy74139/webserver/src/database/redis"
+	"github.com/andy74139/webserver/src/domain/entity/oauth"
+)
+
+// compositeRepo keeps authorization codes in redis, which expire by redis TTL, and consents in postgresql.
+type compositeRepo struct {
+	cache *redis.Client
+	db    *bun.DB
+}
+
+func NewCompositeRepo(rdb *redis.Client, db *bun.DB) (oauth.Repository, error) {
+	if rdb == nil {
+		return nil, errors.New("redis repository can't be nil")
+	} else if db == nil {
+		return nil, errors.New("db is nil")
+	}
+	return &compositeRepo{cache: rdb, db: db}, nil
+}
+
+func (r *compositeRepo) SetCode(ctx context.Context, codeHash string, request *oauth.AuthorizationRequest, expiryDuration time.Duration) error {
+	key := getCodeRedisKey(codeHash)
+	pipe := r.cache.TxPipeline()
+	pipe.HSet(ctx, key,
+		"user_id", request.UserID.String(),
+		"client_id", request.ClientID,
+		"redirect_uri", request.RedirectURI,
+		"scope", strings.Join(request.Scopes, " "),
+		"code_challenge", request.CodeChallenge,
+	)
+	pipe.Expire(ctx, key, expiryDuration)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("HSet error: %w", err)
+	}
+	return nil
+}
+
+func (r *compositeRepo) UseCode(ctx context.Context, codeHash string) (*oauth.AuthorizationRequest, error) {
+	key := getCodeRedisKey(codeHash)
+	pipe := r.cache.TxPipeline()
+	getCmd := pipe.HGetAll(ctx, key)
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("HGetAll error: %w", err)
+	}
+	fields := getCmd.Val()
+	if len(fields) == 0 {
+		return nil, oauth.ErrNotFound
+	}
+
+	userID, err := uuid.Parse(fields["user_id"])
+	if err != nil {
+		return nil, fmt.Errorf("parse user_id error: %w", err)
+	}
+	return &oauth.AuthorizationRequest{
+		UserID:        userID,
+		ClientID:      fields["client_id"],
+		RedirectURI:   fields["redirect_uri"],
+		Scopes:        strings.Fields(fields["scope"]),
+		CodeChallenge: fields["code_challenge"],
+	}, nil
+}
+
+func (r *compositeRepo) AddConsentScopes(ctx context.Context, userID uuid.UUID, clientID string, scopes []string) error {
+	model := &database.OAuthConsent{UserID: userID, ClientID: clientID, Scopes: scopes}
+	query := r.db.NewInsert().Model(model).
+		On("CONFLICT (user_id, client_id) DO UPDATE").
+		Set("scopes = ARRAY(SELECT DISTINCT unnest(oauth_consent.scopes || EXCLUDED.scopes))").
+		Set("updated_at = ?", time.Now())
+	if _, err := query.Exec(ctx); err != nil {
+		return fmt.Errorf("insert error: %w", err)
+	}
+	return nil
+}
+
+func (r *compositeRepo) GetConsent(ctx context.Context, userID uuid.UUID, clientID string) (*oauth.Consent, error) {
+	model := &database.OAuthConsent{}
+	query := r.db.NewSelect().Model(model).Where("user_id = ? AND client_id = ?", userID, clientID)
+	if err := query.Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, oauth.ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	return toConsent(model), nil
+}
+
+func (r *compositeRepo) ListConsents(ctx context.Context, userID uuid.UUID) ([]*oauth.Consent, error) {
+	var models []*database.OAuthConsent
+	if err := r.db.NewSelect().Model(&models).Where("user_id = ?", userID).Order("created_at").Scan(ctx); err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	consents := make([]*oauth.Consent, 0, len(models))
+	for _, model := range models {
+		consents = append(consents, toConsent(model))
+	}
+	return consents, nil
+}
+
+func (r *compositeRepo) DeleteConsent(ctx context.Context, userID uuid.UUID, clientID string) error {
+	query := r.db.NewDelete().Model(&database.OAuthConsent{}).Where("user_id = ? AND client_id = ?", userID, clientID)
+	result, err := query.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		// SHOULD NOT BE HERE for postgres
+		return fmt.Errorf("RowsAffected error: %w", err)
+	} else if rows == 0 {
+		return oauth.ErrNotFound
+	}
+	return nil
+}
+
+func toConsent(model *database.OAuthConsent) *oauth.Consent {
+	return &oauth.Consent{
+		UserID:    model.UserID,
+		ClientID:  model.ClientID,
+		Scopes:    model.Scopes,
+		CreatedAt: model.CreatedAt,
+		UpdatedAt: model.UpdatedAt,
+	}
+}
+
+func getCodeRedisKey(codeHash string) string {
+	return rediskey.GetOAuthCodePrefix() + codeHash
+}
@@ -0,0 +1,97 @@
+package otp_repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/andy74139/webserver/src/database/redis"
+	"github.com/andy74139/webserver/src/domain/entity/otp"
+)
+
+// redis otp repository, challenges expire by redis TTL.
+type redisRepo struct {
+	cache *redis.Client
+}
+
+func NewRedisRepo(rdb *redis.Client) (otp.Repository, error) {
+	if rdb == nil {
+		return nil, errors.New("redis repository can't be nil")
+	}
+	return &redisRepo{cache: rdb}, nil
+}
+
+func (r *redisRepo) SetChallenge(ctx context.Context, challengeID string, challenge *otp.Challenge, expiryDuration time.Duration) error {
+	key := getChallengeRedisKey(challengeID)
+	pipe := r.cache.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.HSet(ctx, key,
+		"code_hash", challenge.CodeHash,
+		"link_nonce", challenge.LinkNonce,
+		"attempts", challenge.Attempts,
+		"sent_at", challenge.SentAt.Unix(),
+	)
+	pipe.Expire(ctx, key, expiryDuration)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("HSet error: %w", err)
+	}
+	return nil
+}
+
+func (r *redisRepo) GetChallenge(ctx context.Context, challengeID string) (*otp.Challenge, error) {
+	fields, err := r.cache.HGetAll(ctx, getChallengeRedisKey(challengeID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("HGetAll error: %w", err)
+	} else if len(fields) == 0 {
+		return nil, otp.ErrNotFound
+	}
+
+	attempts, err := strconv.Atoi(fields["attempts"])
+	if err != nil {
+		return nil, fmt.Errorf("parse attempts error: %w", err)
+	}
+	sentAt, err := strconv.ParseInt(fields["sent_at"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse sent_at error: %w", err)
+	}
+	return &otp.Challenge{
+		CodeHash:  fields["code_hash"],
+		LinkNonce: fields["link_nonce"],
+		Attempts:  attempts,
+		SentAt:    time.Unix(sentAt, 0),
+	}, nil
+}
+
+// incrAttemptsScript increases attempts only if the challenge exists, so an expired challenge isn't recreated.
+var incrAttemptsScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return nil
+end
+return redis.call("HINCRBY", KEYS[1], "attempts", 1)
+`)
+
+func (r *redisRepo) IncrAttempts(ctx context.Context, challengeID string) (int, error) {
+	attempts, err := incrAttemptsScript.Run(ctx, r.cache, []string{getChallengeRedisKey(challengeID)}).Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, otp.ErrNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("incrAttemptsScript error: %w", err)
+	}
+	return attempts, nil
+}
+
+func (r *redisRepo) DeleteChallenge(ctx context.Context, challengeID string) (bool, error) {
+	deleted, err := r.cache.Del(ctx, getChallengeRedisKey(challengeID)).Result()
+	if err != nil {
+		return false, fmt.Errorf("Del error: %w", err)
+	}
+	return deleted > 0, nil
+}
+
+func getChallengeRedisKey(challengeID string) string {
+	return rediskey.GetOTPChallengePrefix() + challengeID
+}
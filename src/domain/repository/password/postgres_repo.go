@@ -0,0 +1,105 @@
+package password_repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/driver/pgdriver"
+
+	"github.com/andy74139/webserver/src/database"
+	"github.com/andy74139/webserver/src/domain/entity/password"
+)
+
+// postgresql password credential repository
+type postgresRepo struct {
+	db *bun.DB
+}
+
+func NewPostgresRepo(db *bun.DB) (password.Repository, error) {
+	if db == nil {
+		return nil, errors.New("db is nil")
+	}
+	return &postgresRepo{db: db}, nil
+}
+
+func (r *postgresRepo) Create(ctx context.Context, credential *password.Credential, name string) (uuid.UUID, error) {
+	user1 := &database.User{Name: name}
+	err := r.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewInsert().Model(user1).Returning("id").Exec(ctx); err != nil {
+			return fmt.Errorf("insert user error: %w", err)
+		}
+		model := &database.PasswordCredential{
+			UserID:       user1.ID,
+			Email:        credential.Email,
+			PasswordHash: credential.PasswordHash,
+		}
+		if _, err := tx.NewInsert().Model(model).Exec(ctx); err != nil {
+			if pgErr := (pgdriver.Error{}); errors.As(err, &pgErr) && pgErr.Field('C') == "23505" {
+				return password.ErrEmailTaken
+			}
+			return fmt.Errorf("insert password credential error: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return user1.ID, nil
+}
+
+func (r *postgresRepo) GetByEmail(ctx context.Context, email string) (*password.Credential, error) {
+	return r.get(ctx, r.db.NewSelect().Where("email = ?", email))
+}
+
+func (r *postgresRepo) GetByUserID(ctx context.Context, userID uuid.UUID) (*password.Credential, error) {
+	return r.get(ctx, r.db.NewSelect().Where("user_id = ?", userID))
+}
+
+func (r *postgresRepo) get(ctx context.Context, query *bun.SelectQuery) (*password.Credential, error) {
+	model := &database.PasswordCredential{}
+	if err := query.Model(model).Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, password.ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	return &password.Credential{
+		UserID:          model.UserID,
+		Email:           model.Email,
+		PasswordHash:    model.PasswordHash,
+		EmailVerifiedAt: model.EmailVerifiedAt,
+		CreatedAt:       model.CreatedAt,
+	}, nil
+}
+
+func (r *postgresRepo) SetPasswordHash(ctx context.Context, userID uuid.UUID, passwordHash string) error {
+	query := r.db.NewUpdate().Model(&database.PasswordCredential{}).
+		Set("password_hash = ?", passwordHash).
+		Set("updated_at = ?", time.Now()).
+		Where("user_id = ?", userID)
+	return execUpdate(ctx, query, userID)
+}
+
+func (r *postgresRepo) SetEmailVerifiedAt(ctx context.Context, userID uuid.UUID, verifiedAt time.Time) error {
+	query := r.db.NewUpdate().Model(&database.PasswordCredential{}).
+		Set("email_verified_at = ?", verifiedAt).
+		Set("updated_at = ?", time.Now()).
+		Where("user_id = ?", userID)
+	return execUpdate(ctx, query, userID)
+}
+
+func execUpdate(ctx context.Context, query *bun.UpdateQuery, userID uuid.UUID) error {
+	if result, err := query.Exec(ctx); err != nil {
+		return fmt.Errorf("update error: %w", err)
+	} else if rows, err2 := result.RowsAffected(); err2 != nil {
+		// SHOULD NOT BE HERE for postgres
+		return fmt.Errorf("RowsAffected error: %w", err2)
+	} else if rows == 0 {
+		return fmt.Errorf("no password credential of user %s: %w", userID, password.ErrNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package ratelimit_repo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/andy74139/webserver/src/database/redis"
+	"github.com/andy74139/webserver/src/domain/entity/ratelimit"
+)
+
+// redis rate limit repository, a sliding window is a sorted set of event times in milliseconds.
+type redisRepo struct {
+	cache *redis.Client
+}
+
+func NewRedisRepo(rdb *redis.Client) (ratelimit.Repository, error) {
+	if rdb == nil {
+		return nil, errors.New("redis repository can't be nil")
+	}
+	return &redisRepo{cache: rdb}, nil
+}
+
+// addEventScript removes events out of the window, and adds the event if the window isn't full,
+// it returns {1, 0} if added, or {0, milliseconds until the oldest event leaves the window}.
+var addEventScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[3]) then
+	local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+	return {0, tonumber(oldest[2]) + window - now}
+end
+redis.call("ZADD", KEYS[1], now, ARGV[4])
+redis.call("PEXPIRE", KEYS[1], window)
+return {1, 0}
+`)
+
+func (r *redisRepo) AddEvent(ctx context.Context, key string, at time.Time, limit int, window time.Duration) (bool, time.Duration, error) {
+	// members are unique, events at the same millisecond are counted separately
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return false, 0, fmt.Errorf("rand.Read error: %w", err)
+	}
+	result, err := addEventScript.Run(ctx, r.cache, []string{rediskey.GetRateLimitPrefix() + key},
+		at.UnixMilli(), window.Milliseconds(), limit, hex.EncodeToString(b)).Int64Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("addEventScript error: %w", err)
+	} else if len(result) != 2 {
+		return false, 0, fmt.Errorf("addEventScript unexpected result %v", result)
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
+
+func (r *redisRepo) IncrFailures(ctx context.Context, account string, expiryDuration time.Duration) (int, error) {
+	key := rediskey.GetLoginFailuresPrefix() + account
+	pipe := r.cache.TxPipeline()
+	incrCmd := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, expiryDuration)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("Incr error: %w", err)
+	}
+	return int(incrCmd.Val()), nil
+}
+
+func (r *redisRepo) DeleteFailures(ctx context.Context, account string) error {
+	if err := r.cache.Del(ctx, rediskey.GetLoginFailuresPrefix()+account).Err(); err != nil {
+		return fmt.Errorf("Del error: %w", err)
+	}
+	return nil
+}
+
+func (r *redisRepo) SetLockout(ctx context.Context, account string, duration time.Duration) error {
+	if err := r.cache.Set(ctx, rediskey.GetLoginLockoutPrefix()+account, 1, duration).Err(); err != nil {
+		return fmt.Errorf("Set error: %w", err)
+	}
+	return nil
+}
+
+func (r *redisRepo) GetLockout(ctx context.Context, account string) (time.Duration, error) {
+	ttl, err := r.cache.PTTL(ctx, rediskey.GetLoginLockoutPrefix()+account).Result()
+	if err != nil {
+		return 0, fmt.Errorf("PTTL error: %w", err)
+	}
+	// negative values mean the key doesn't exist or has no TTL
+	return max(ttl, 0), nil
+}
@@ -0,0 +1,46 @@
+package sso_repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/andy74139/webserver/src/database/redis"
+	"github.com/andy74139/webserver/src/domain/entity/sso"
+)
+
+// redis sso repository, nonces expire by redis TTL.
+type redisRepo struct {
+	cache *redis.Client
+}
+
+func NewRedisRepo(rdb *redis.Client) (sso.Repository, error) {
+	if rdb == nil {
+		return nil, errors.New("redis repository can't be nil")
+	}
+	return &redisRepo{cache: rdb}, nil
+}
+
+func (r *redisRepo) SetNonce(ctx context.Context, nonceHash string, expiryDuration time.Duration) error {
+	if err := r.cache.Set(ctx, getNonceRedisKey(nonceHash), 1, expiryDuration).Err(); err != nil {
+		return fmt.Errorf("Set error: %w", err)
+	}
+	return nil
+}
+
+func (r *redisRepo) UseNonce(ctx context.Context, nonceHash string) error {
+	deleted, err := r.cache.Del(ctx, getNonceRedisKey(nonceHash)).Result()
+	if err != nil {
+		return fmt.Errorf("Del error: %w", err)
+	} else if deleted == 0 {
+		return fmt.Errorf("%w: unknown or used nonce", sso.ErrInvalidToken)
+	}
+	return nil
+}
+
+func getNonceRedisKey(nonceHash string) string {
+	return rediskey.GetSSONoncePrefix() + nonceHash
+}
@@ -0,0 +1,52 @@
+package transfer_repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/andy74139/webserver/src/database/redis"
+	"github.com/andy74139/webserver/src/domain/entity/transfer"
+)
+
+// redis transfer repository, codes expire by redis TTL.
+type redisRepo struct {
+	cache *redis.Client
+}
+
+func NewRedisRepo(rdb *redis.Client) (transfer.Repository, error) {
+	if rdb == nil {
+		return nil, errors.New("redis repository can't be nil")
+	}
+	return &redisRepo{cache: rdb}, nil
+}
+
+func (r *redisRepo) SetCode(ctx context.Context, codeHash string, userID uuid.UUID, expiryDuration time.Duration) error {
+	if err := r.cache.Set(ctx, getCodeRedisKey(codeHash), userID.String(), expiryDuration).Err(); err != nil {
+		return fmt.Errorf("Set error: %w", err)
+	}
+	return nil
+}
+
+func (r *redisRepo) UseCode(ctx context.Context, codeHash string) (uuid.UUID, error) {
+	value, err := r.cache.GetDel(ctx, getCodeRedisKey(codeHash)).Result()
+	if errors.Is(err, redis.Nil) {
+		return uuid.Nil, transfer.ErrInvalidCode
+	} else if err != nil {
+		return uuid.Nil, fmt.Errorf("GetDel error: %w", err)
+	}
+
+	userID, err := uuid.Parse(value)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("parse user ID error: %w", err)
+	}
+	return userID, nil
+}
+
+func getCodeRedisKey(codeHash string) string {
+	return rediskey.GetTransferCodePrefix() + codeHash
+}
@@ -5,9 +5,12 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
 
 	"github.com/andy74139/webserver/src/database"
 	"github.com/andy74139/webserver/src/domain/entity/user"
@@ -28,56 +31,114 @@ func NewPostgresRepo(db *bun.DB) (user.Repository, error) {
 	}, nil
 }
 
-func (r *postgresRepo) Create(ctx context.Context, platform string, deviceID string, name string) error {
-	user1 := &database.User{
-		Platform: &platform,
-		DeviceID: &deviceID,
-		Name:     name,
-	}
-
-	if _, err := r.db.NewInsert().Model(user1).Exec(ctx); err != nil {
-		return fmt.Errorf("insert user error: %w", err)
-	}
-	return nil
+func (r *postgresRepo) Create(ctx context.Context, platform string, deviceID string, name string, deviceSecretHash string) error {
+	user1 := &database.User{Name: name}
+	return r.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewInsert().Model(user1).Returning("id").Exec(ctx); err != nil {
+			return fmt.Errorf("insert user error: %w", err)
+		}
+		if ok, err := insertIdentity(ctx, tx, user1.ID, user.IdentityKindDevice, platform, deviceID, deviceSecretHash); err != nil {
+			return err
+		} else if !ok {
+			return user.ErrDeviceTaken
+		}
+		return nil
+	})
 }
 
 func (r *postgresRepo) Get(ctx context.Context, id uuid.UUID) (*user.User, error) {
 	user1 := &database.User{}
-	if err := r.db.NewSelect().Model(user1).Where("id = ?", id).Scan(ctx, user1); err != nil {
+	if err := r.db.NewSelect().Model(user1).Relation("Identities", orderIdentities).Where("id = ?", id).Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, user.ErrNotFound
+	} else if err != nil {
 		return nil, fmt.Errorf("select error: %w", err)
 	}
 
-	return &user.User{
-		ID:   user1.ID,
-		Name: user1.Name,
-	}, nil
+	return newUser(user1), nil
 }
 
 func (r *postgresRepo) GetIDByDevice(ctx context.Context, platform string, deviceID string) (uuid.UUID, error) {
-	user1 := &database.User{}
-	query := r.db.NewSelect().Model(user1).Column("id").Where("platform = ? and device_id = ?", platform, deviceID)
-	if err := query.Scan(ctx, user1); errors.Is(err, sql.ErrNoRows) {
-		return uuid.Nil, user.ErrNotFound
-	} else if err != nil {
-		return uuid.Nil, fmt.Errorf("select error: %w", err)
+	identity, err := r.getIdentity(ctx, user.IdentityKindDevice, platform, deviceID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return identity.UserID, nil
+}
+
+func (r *postgresRepo) GetDeviceSecretHash(ctx context.Context, platform string, deviceID string) (uuid.UUID, string, error) {
+	identity, err := r.getIdentity(ctx, user.IdentityKindDevice, platform, deviceID)
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+	return identity.UserID, stringValue(identity.SecretHash), nil
+}
+
+func (r *postgresRepo) SetDeviceSecretHash(ctx context.Context, platform string, deviceID string, deviceSecretHash string) (bool, error) {
+	// only a device without secret is enrolled, concurrent enrollments can't replace the secret
+	query := r.db.NewUpdate().Model(&database.UserIdentity{}).Set("secret_hash = ?", deviceSecretHash).
+		Where("kind = ? AND provider = ? AND subject = ? AND secret_hash IS NULL", user.IdentityKindDevice, platform, deviceID)
+	result, err := query.Exec(ctx)
+	if err != nil {
+		return false, fmt.Errorf("update error: %w", err)
 	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		// SHOULD NOT BE HERE for postgres
+		return false, fmt.Errorf("RowsAffected error: %w", err)
+	}
+	return rows > 0, nil
+}
+
+func (r *postgresRepo) SetDevice(ctx context.Context, id uuid.UUID, platform string, deviceID string, deviceSecretHash string) error {
+	return r.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		query := tx.NewDelete().Model(&database.UserIdentity{}).Where("user_id = ? AND kind = ?", id, user.IdentityKindDevice)
+		if result, err := query.Exec(ctx); err != nil {
+			return fmt.Errorf("delete error: %w", err)
+		} else if rows, err2 := result.RowsAffected(); err2 != nil {
+			// SHOULD NOT BE HERE for postgres
+			return fmt.Errorf("RowsAffected error: %w", err2)
+		} else if rows == 0 {
+			return fmt.Errorf("no device of user %s: %w", id.String(), user.ErrNotFound)
+		}
+
+		if ok, err := insertIdentity(ctx, tx, id, user.IdentityKindDevice, platform, deviceID, deviceSecretHash); err != nil {
+			return err
+		} else if !ok {
+			return user.ErrDeviceTaken
+		}
+		return nil
+	})
+}
 
-	return user1.ID, nil
+func (r *postgresRepo) AddIdentity(ctx context.Context, id uuid.UUID, kind string, provider string, subject string, secretHash string) (bool, error) {
+	return insertIdentity(ctx, r.db, id, kind, provider, subject, secretHash)
 }
 
 func (r *postgresRepo) GetIDBySSO(ctx context.Context, ssoProvider string, ssoAccountID string) (uuid.UUID, error) {
-	user1 := &database.User{}
-	query := r.db.NewSelect().Model(user1).Column("id").Where("sso_provider = ? and sso_account_id = ?", ssoProvider, ssoAccountID)
-	if err := query.Scan(ctx, user1); err != nil {
-		return uuid.Nil, fmt.Errorf("select error: %w", err)
+	identity, err := r.getIdentity(ctx, user.IdentityKindSSO, ssoProvider, ssoAccountID)
+	if err != nil {
+		return uuid.Nil, err
 	}
+	return identity.UserID, nil
+}
 
-	return user1.ID, nil
+// getIdentity gets the identity of a user which isn't deleted.
+func (r *postgresRepo) getIdentity(ctx context.Context, kind string, provider string, subject string) (*database.UserIdentity, error) {
+	identity := &database.UserIdentity{}
+	query := r.db.NewSelect().Model(identity).
+		Where("kind = ? AND provider = ? AND subject = ?", kind, provider, subject).
+		Where("user_id IN (?)", r.db.NewSelect().Model((*database.User)(nil)).Column("id"))
+	if err := query.Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, user.ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	return identity, nil
 }
 
 func (r *postgresRepo) CheckValidLoginUser(ctx context.Context, id uuid.UUID) (bool, error) {
 	user1 := &database.User{}
-	isExist, err := r.db.NewSelect().Model(user1).Where("id = ?", id).Exists(ctx)
+	isExist, err := r.db.NewSelect().Model(user1).Where("id = ? AND suspended_at IS NULL", id).Exists(ctx)
 	if err != nil {
 		return false, fmt.Errorf("select error: %w", err)
 	}
@@ -85,6 +146,18 @@ func (r *postgresRepo) CheckValidLoginUser(ctx context.Context, id uuid.UUID) (b
 	return isExist, nil
 }
 
+func (r *postgresRepo) GetRoles(ctx context.Context, id uuid.UUID) ([]string, error) {
+	user1 := &database.User{}
+	query := r.db.NewSelect().Model(user1).Column("roles").Where("id = ?", id)
+	if err := query.Scan(ctx, user1); errors.Is(err, sql.ErrNoRows) {
+		return nil, user.ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+
+	return user1.Roles, nil
+}
+
 func (r *postgresRepo) Update(ctx context.Context, user1 *user.User) error {
 	query := r.db.NewUpdate().Model(user1).Where("id = ?", user1.ID)
 	if user1.Name != "" {
@@ -97,41 +170,252 @@ func (r *postgresRepo) Update(ctx context.Context, user1 *user.User) error {
 		// SHOULD NOT BE HERE for postgres
 		return fmt.Errorf("RowsAffected error: %w", err2)
 	} else if rows == 0 {
-		return fmt.Errorf("no user %s", user1.ID)
+		return fmt.Errorf("no user %s: %w", user1.ID, user.ErrNotFound)
 	}
 	return nil
 }
 
-func (r *postgresRepo) AddSSO(ctx context.Context, id uuid.UUID, provider string, providerAccountID string) error {
-	query := r.db.NewUpdate().Model(&database.User{}).Where("id = ? AND platform is not NULL", id)
-	query = query.SetColumn("sso_provider", "?", provider).SetColumn("sso_account_id", "?", providerAccountID)
-	query = query.SetColumn("platform", "?", nil).SetColumn("device_id", "", nil)
+func (r *postgresRepo) ListIdentities(ctx context.Context, id uuid.UUID) ([]*user.Identity, error) {
+	identities := []*database.UserIdentity{}
+	if err := r.db.NewSelect().Model(&identities).Where("user_id = ?", id).Apply(orderIdentities).Scan(ctx); err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	return newIdentities(identities), nil
+}
+
+func (r *postgresRepo) DeleteIdentity(ctx context.Context, id uuid.UUID, identityID uuid.UUID, isLastAllowed bool) error {
+	return r.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		// the user is locked, concurrent unlinks can't remove all identities
+		var lockedID uuid.UUID
+		query := tx.NewSelect().Model((*database.User)(nil)).Column("id").Where("id = ?", id).For("UPDATE")
+		if err := query.Scan(ctx, &lockedID); errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no user %s: %w", id.String(), user.ErrNotFound)
+		} else if err != nil {
+			return fmt.Errorf("select error: %w", err)
+		}
+		count, err := tx.NewSelect().Model((*database.UserIdentity)(nil)).Where("user_id = ?", id).Count(ctx)
+		if err != nil {
+			return fmt.Errorf("count error: %w", err)
+		}
 
-	if result, err := query.Exec(ctx); err != nil {
-		return fmt.Errorf("update error: %w", err)
+		result, err := tx.NewDelete().Model((*database.UserIdentity)(nil)).Where("id = ? AND user_id = ?", identityID, id).Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("delete error: %w", err)
+		} else if rows, err2 := result.RowsAffected(); err2 != nil {
+			// SHOULD NOT BE HERE for postgres
+			return fmt.Errorf("RowsAffected error: %w", err2)
+		} else if rows == 0 {
+			return fmt.Errorf("no identity %s: %w", identityID.String(), user.ErrNotFound)
+		}
+		if count <= 1 && !isLastAllowed {
+			return user.ErrLastIdentity
+		}
+		return nil
+	})
+}
+
+func (r *postgresRepo) Delete(ctx context.Context, id uuid.UUID) error {
+	if result, err := r.db.NewDelete().Model(&database.User{}).Where("id = ?", id).Exec(ctx); err != nil {
+		return fmt.Errorf("delete error: %w", err)
 	} else if rows, err2 := result.RowsAffected(); err2 != nil {
 		// SHOULD NOT BE HERE for postgres
 		return fmt.Errorf("RowsAffected error: %w", err2)
 	} else if rows == 0 {
-		isExists, err := r.db.NewSelect().Model(&database.User{}).Where("id = ?", id).Exists(ctx)
-		if err != nil {
+		return fmt.Errorf("no user %s: %w", id.String(), user.ErrNotFound)
+	}
+	return nil
+}
+
+func (r *postgresRepo) Merge(ctx context.Context, sourceID uuid.UUID, targetID uuid.UUID) error {
+	return r.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		// users are locked in the same order, concurrent merges of them wait instead of deadlock
+		lockedIDs := []uuid.UUID{}
+		query := tx.NewSelect().Model((*database.User)(nil)).Column("id").
+			Where("id IN (?)", bun.In([]uuid.UUID{sourceID, targetID})).Order("id").For("UPDATE")
+		if err := query.Scan(ctx, &lockedIDs); err != nil {
 			return fmt.Errorf("select error: %w", err)
-		} else if !isExists {
-			return fmt.Errorf("no user: %s", id.String())
+		} else if len(lockedIDs) != 2 {
+			return fmt.Errorf("no user %s or %s: %w", sourceID.String(), targetID.String(), user.ErrNotFound)
+		}
+
+		// a user has many of them
+		for _, model := range []interface{}{
+			&database.UserIdentity{},
+			&database.WebAuthnCredential{},
+		} {
+			if _, err := tx.NewUpdate().Model(model).Set("user_id = ?", targetID).Where("user_id = ?", sourceID).Exec(ctx); err != nil {
+				return fmt.Errorf("update %T error: %w", model, err)
+			}
+		}
+		// a user has at most one of them, the target user keeps its own
+		for _, model := range []interface{}{
+			&database.PasswordCredential{},
+			&database.MFATOTP{},
+		} {
+			isExists, err := tx.NewSelect().Model(model).Where("user_id = ?", targetID).Exists(ctx)
+			if err != nil {
+				return fmt.Errorf("select %T error: %w", model, err)
+			}
+			if isExists {
+				_, err = tx.NewDelete().Model(model).Where("user_id = ?", sourceID).Exec(ctx)
+			} else {
+				_, err = tx.NewUpdate().Model(model).Set("user_id = ?", targetID).Where("user_id = ?", sourceID).Exec(ctx)
+			}
+			if err != nil {
+				return fmt.Errorf("move %T error: %w", model, err)
+			}
+		}
+		// grants of the source user are revoked instead of moved, clients and keys granted by the source user mustn't
+		// access the target user
+		for _, model := range []interface{}{
+			&database.OAuthConsent{},
+			&database.APIKey{},
+		} {
+			if _, err := tx.NewDelete().Model(model).Where("user_id = ?", sourceID).Exec(ctx); err != nil {
+				return fmt.Errorf("delete %T error: %w", model, err)
+			}
+		}
+
+		if _, err := tx.NewInsert().Model(&database.UserMerge{SourceUserID: sourceID, TargetUserID: targetID}).Exec(ctx); err != nil {
+			return fmt.Errorf("insert user merge error: %w", err)
+		}
+		if _, err := tx.NewDelete().Model(&database.User{}).Where("id = ?", sourceID).Exec(ctx); err != nil {
+			return fmt.Errorf("delete error: %w", err)
+		}
+		return nil
+	})
+}
+
+// List lists users matching the filter, and returns the count of all matched users.
+func (r *postgresRepo) List(ctx context.Context, filter *user.ListFilter) ([]*user.User, int, error) {
+	users := []*database.User{}
+	query := r.db.NewSelect().Model(&users).Relation("Identities", orderIdentities).Order("created_at", "id").Offset(filter.Offset).Limit(filter.Limit)
+	if filter.IncludeDeleted {
+		query = query.WhereAllWithDeleted()
+	}
+	if filter.Query != "" {
+		if id, err := uuid.Parse(filter.Query); err == nil {
+			query = query.Where("id = ?", id)
+		} else {
+			query = query.Where("name ILIKE ?", "%"+likeEscaper.Replace(filter.Query)+"%")
 		}
-		return fmt.Errorf("user is not device login: %s", id.String())
 	}
-	return nil
+
+	count, err := query.ScanAndCount(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("select error: %w", err)
+	}
+
+	result := make([]*user.User, 0, len(users))
+	for _, user1 := range users {
+		result = append(result, newUser(user1))
+	}
+	return result, count, nil
 }
 
-func (r *postgresRepo) Delete(ctx context.Context, id uuid.UUID) error {
-	if result, err := r.db.NewDelete().Model(&database.User{}).Where("id = ?", id).Exec(ctx); err != nil {
-		return fmt.Errorf("delete error: %w", err)
+func (r *postgresRepo) SetRoles(ctx context.Context, id uuid.UUID, roles []string) error {
+	query := r.db.NewUpdate().Model(&database.User{}).Set("roles = ?", pgdialect.Array(roles)).Where("id = ?", id)
+	return r.execUpdate(ctx, query, id)
+}
+
+// Suspend suspends the user, suspending a suspended user keeps the suspended time.
+func (r *postgresRepo) Suspend(ctx context.Context, id uuid.UUID) error {
+	query := r.db.NewUpdate().Model(&database.User{}).Set("suspended_at = COALESCE(suspended_at, ?)", time.Now()).Where("id = ?", id)
+	return r.execUpdate(ctx, query, id)
+}
+
+func (r *postgresRepo) Unsuspend(ctx context.Context, id uuid.UUID) error {
+	query := r.db.NewUpdate().Model(&database.User{}).Set("suspended_at = NULL").Where("id = ?", id)
+	return r.execUpdate(ctx, query, id)
+}
+
+// Restore restores the soft-deleted user.
+func (r *postgresRepo) Restore(ctx context.Context, id uuid.UUID) error {
+	query := r.db.NewUpdate().Model(&database.User{}).WhereDeleted().Set("deleted_at = NULL").Where("id = ?", id)
+	return r.execUpdate(ctx, query, id)
+}
+
+func (r *postgresRepo) execUpdate(ctx context.Context, query *bun.UpdateQuery, id uuid.UUID) error {
+	if result, err := query.Exec(ctx); err != nil {
+		return fmt.Errorf("update error: %w", err)
 	} else if rows, err2 := result.RowsAffected(); err2 != nil {
 		// SHOULD NOT BE HERE for postgres
 		return fmt.Errorf("RowsAffected error: %w", err2)
 	} else if rows == 0 {
-		return fmt.Errorf("no user: %s", id.String())
+		return fmt.Errorf("no user %s: %w", id.String(), user.ErrNotFound)
 	}
 	return nil
 }
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// insertIdentity links the identity to the user, and returns false if the identity is of another user.
+// Linking a linked identity updates it, and the identity of a deleted user is taken over, e.g. the device is registered
+// again after the account is deleted.
+func insertIdentity(ctx context.Context, db bun.IDB, id uuid.UUID, kind string, provider string, subject string, secretHash string) (bool, error) {
+	identity := &database.UserIdentity{
+		UserID:   id,
+		Kind:     kind,
+		Provider: provider,
+		Subject:  subject,
+		LinkedAt: time.Now(),
+	}
+	if secretHash != "" {
+		identity.SecretHash = &secretHash
+	}
+
+	query := db.NewInsert().Model(identity).
+		On("CONFLICT (kind, provider, subject) DO UPDATE").
+		Set("user_id = EXCLUDED.user_id").
+		Set("secret_hash = EXCLUDED.secret_hash").
+		Set("linked_at = EXCLUDED.linked_at").
+		Where("user_identity.user_id = EXCLUDED.user_id").
+		WhereOr("user_identity.user_id IN (?)", db.NewSelect().Model((*database.User)(nil)).Column("id").WhereDeleted())
+	result, err := query.Exec(ctx)
+	if err != nil {
+		return false, fmt.Errorf("insert identity error: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		// SHOULD NOT BE HERE for postgres
+		return false, fmt.Errorf("RowsAffected error: %w", err)
+	}
+	return rows > 0, nil
+}
+
+func orderIdentities(query *bun.SelectQuery) *bun.SelectQuery {
+	return query.Order("linked_at", "id")
+}
+
+func newUser(user1 *database.User) *user.User {
+	return &user.User{
+		ID:          user1.ID,
+		Name:        user1.Name,
+		Roles:       user1.Roles,
+		Identities:  newIdentities(user1.Identities),
+		CreatedAt:   user1.CreatedAt,
+		SuspendedAt: user1.SuspendedAt,
+		DeletedAt:   user1.DeletedAt,
+	}
+}
+
+func newIdentities(identities []*database.UserIdentity) []*user.Identity {
+	result := make([]*user.Identity, 0, len(identities))
+	for _, identity := range identities {
+		result = append(result, &user.Identity{
+			ID:       identity.ID,
+			Kind:     identity.Kind,
+			Provider: identity.Provider,
+			Subject:  identity.Subject,
+			LinkedAt: identity.LinkedAt,
+		})
+	}
+	return result
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
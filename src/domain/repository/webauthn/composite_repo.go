@@ -0,0 +1,157 @@
+package webauthn_repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/driver/pgdriver"
+
+	"github.com/andy74139/webserver/src/database"
+	"github.com/andy74139/webserver/src/database/redis"
+	"github.com/andy74139/webserver/src/domain/entity/webauthn"
+)
+
+// compositeRepo keeps challenges in redis, which expire by redis TTL, and credentials in postgresql.
+type compositeRepo struct {
+	cache *redis.Client
+	db    *bun.DB
+}
+
+func NewCompositeRepo(rdb *redis.Client, db *bun.DB) (webauthn.Repository, error) {
+	if rdb == nil {
+		return nil, errors.New("redis repository can't be nil")
+	} else if db == nil {
+		return nil, errors.New("db is nil")
+	}
+	return &compositeRepo{cache: rdb, db: db}, nil
+}
+
+func (r *compositeRepo) SetChallenge(ctx context.Context, challenge string, session *webauthn.Challenge, expiryDuration time.Duration) error {
+	key := getChallengeRedisKey(challenge)
+	pipe := r.cache.TxPipeline()
+	pipe.HSet(ctx, key, "type", session.Type, "user_id", session.UserID.String())
+	pipe.Expire(ctx, key, expiryDuration)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("HSet error: %w", err)
+	}
+	return nil
+}
+
+func (r *compositeRepo) UseChallenge(ctx context.Context, challenge string) (*webauthn.Challenge, error) {
+	key := getChallengeRedisKey(challenge)
+	pipe := r.cache.TxPipeline()
+	getCmd := pipe.HGetAll(ctx, key)
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("HGetAll error: %w", err)
+	}
+	fields := getCmd.Val()
+	if len(fields) == 0 {
+		return nil, webauthn.ErrNotFound
+	}
+
+	userID, err := uuid.Parse(fields["user_id"])
+	if err != nil {
+		return nil, fmt.Errorf("parse user_id error: %w", err)
+	}
+	return &webauthn.Challenge{Type: fields["type"], UserID: userID}, nil
+}
+
+func (r *compositeRepo) CreateCredential(ctx context.Context, credential *webauthn.Credential) error {
+	model := &database.WebAuthnCredential{
+		ID:        credential.ID,
+		UserID:    credential.UserID,
+		Name:      credential.Name,
+		PublicKey: credential.PublicKey,
+		Algorithm: credential.Algorithm,
+		SignCount: int64(credential.SignCount),
+		AAGUID:    credential.AAGUID,
+		CreatedAt: credential.CreatedAt,
+	}
+	if _, err := r.db.NewInsert().Model(model).Exec(ctx); err != nil {
+		if pgErr := (pgdriver.Error{}); errors.As(err, &pgErr) && pgErr.Field('C') == "23505" {
+			return webauthn.ErrCredentialExists
+		}
+		return fmt.Errorf("insert error: %w", err)
+	}
+	return nil
+}
+
+func (r *compositeRepo) GetCredential(ctx context.Context, credentialID string) (*webauthn.Credential, error) {
+	model := &database.WebAuthnCredential{}
+	if err := r.db.NewSelect().Model(model).Where("id = ?", credentialID).Scan(ctx); errors.Is(err, sql.ErrNoRows) {
+		return nil, webauthn.ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	return toCredential(model), nil
+}
+
+func (r *compositeRepo) ListCredentials(ctx context.Context, userID uuid.UUID) ([]*webauthn.Credential, error) {
+	var models []*database.WebAuthnCredential
+	if err := r.db.NewSelect().Model(&models).Where("user_id = ?", userID).Order("created_at").Scan(ctx); err != nil {
+		return nil, fmt.Errorf("select error: %w", err)
+	}
+	credentials := make([]*webauthn.Credential, 0, len(models))
+	for _, model := range models {
+		credentials = append(credentials, toCredential(model))
+	}
+	return credentials, nil
+}
+
+func (r *compositeRepo) UpdateSignCount(ctx context.Context, credentialID string, signCount uint32, lastUsedAt time.Time) (bool, error) {
+	// the comparison is in the query, so concurrent assertions of a cloned authenticator can't both pass
+	query := r.db.NewUpdate().Model(&database.WebAuthnCredential{}).
+		Set("sign_count = ?", signCount).
+		Set("last_used_at = ?", lastUsedAt).
+		Where("id = ? AND (sign_count < ? OR (? = 0 AND sign_count = 0))", credentialID, signCount, signCount)
+	result, err := query.Exec(ctx)
+	if err != nil {
+		return false, fmt.Errorf("update error: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		// SHOULD NOT BE HERE for postgres
+		return false, fmt.Errorf("RowsAffected error: %w", err)
+	}
+	return rows > 0, nil
+}
+
+func (r *compositeRepo) DeleteCredential(ctx context.Context, userID uuid.UUID, credentialID string) error {
+	query := r.db.NewDelete().Model(&database.WebAuthnCredential{}).Where("id = ? AND user_id = ?", credentialID, userID)
+	result, err := query.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		// SHOULD NOT BE HERE for postgres
+		return fmt.Errorf("RowsAffected error: %w", err)
+	} else if rows == 0 {
+		return webauthn.ErrNotFound
+	}
+	return nil
+}
+
+func toCredential(model *database.WebAuthnCredential) *webauthn.Credential {
+	return &webauthn.Credential{
+		ID:         model.ID,
+		UserID:     model.UserID,
+		Name:       model.Name,
+		PublicKey:  model.PublicKey,
+		Algorithm:  model.Algorithm,
+		SignCount:  uint32(model.SignCount),
+		AAGUID:     model.AAGUID,
+		CreatedAt:  model.CreatedAt,
+		LastUsedAt: model.LastUsedAt,
+	}
+}
+
+func getChallengeRedisKey(challenge string) string {
+	return rediskey.GetWebAuthnChallengePrefix() + challenge
+}
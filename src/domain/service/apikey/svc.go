@@ -0,0 +1,167 @@
+package apikey_svc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/apikey"
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+	"github.com/andy74139/webserver/src/domain/entity/user"
+	"github.com/andy74139/webserver/src/infra"
+)
+
+const (
+	keyStringPrefix = "wsk_"
+	keyPrefixLength = 5 // bytes, 8 characters in base32
+	keySecretLength = 32
+	// rotationGracePeriod is how long the old key is valid after rotating, for callers to switch to the new key
+	rotationGracePeriod = time.Hour * 24
+	// lastUsedUpdateInterval throttles writes of the last used time, keys of busy callers are verified often
+	lastUsedUpdateInterval = time.Minute
+)
+
+var now = time.Now
+
+var prefixEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+type service struct {
+	repo  apikey.Repository
+	roles auth.RoleProvider
+}
+
+func New(repo apikey.Repository, roles auth.RoleProvider) (apikey.Service, error) {
+	if repo == nil {
+		return nil, errors.New("repo is nil")
+	}
+	if roles == nil {
+		return nil, errors.New("roles is nil")
+	}
+	return &service{repo: repo, roles: roles}, nil
+}
+
+func (s *service) Create(ctx context.Context, userID uuid.UUID, name string, scopes []string, expiresAt time.Time) (*apikey.APIKey, string, error) {
+	prefix := make([]byte, keyPrefixLength)
+	secret := make([]byte, keySecretLength)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, "", fmt.Errorf("rand.Read error: %w", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", fmt.Errorf("rand.Read error: %w", err)
+	}
+	key := &apikey.APIKey{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Name:      name,
+		Prefix:    prefixEncoding.EncodeToString(prefix),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+	if key.Scopes == nil {
+		key.Scopes = []string{}
+	}
+	keyString := keyStringPrefix + key.Prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	key.Hash = hashKey(keyString)
+
+	if err := s.repo.Create(ctx, key); err != nil {
+		return nil, "", fmt.Errorf("repo.Create error: %w", err)
+	}
+	return key, keyString, nil
+}
+
+func (s *service) List(ctx context.Context, userID uuid.UUID) ([]*apikey.APIKey, error) {
+	return s.repo.List(ctx, userID)
+}
+
+func (s *service) Rotate(ctx context.Context, userID uuid.UUID, id uuid.UUID) (*apikey.APIKey, string, error) {
+	oldKey, err := s.repo.Get(ctx, userID, id)
+	if err != nil {
+		return nil, "", fmt.Errorf("repo.Get error: %w", err)
+	}
+	if !oldKey.ExpiresAt.IsZero() && !now().Before(oldKey.ExpiresAt) {
+		return nil, "", fmt.Errorf("api key %s is expired: %w", id, apikey.ErrInvalidKey)
+	}
+
+	newKey, keyString, err := s.Create(ctx, userID, oldKey.Name, oldKey.Scopes, oldKey.ExpiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	expiresAt := now().Add(rotationGracePeriod)
+	if oldKey.ExpiresAt.IsZero() || expiresAt.Before(oldKey.ExpiresAt) {
+		if err := s.repo.SetExpiresAt(ctx, oldKey.ID, expiresAt); err != nil {
+			return nil, "", fmt.Errorf("repo.SetExpiresAt error: %w", err)
+		}
+	}
+	return newKey, keyString, nil
+}
+
+func (s *service) Delete(ctx context.Context, userID uuid.UUID, id uuid.UUID) error {
+	return s.repo.Delete(ctx, userID, id)
+}
+
+func (s *service) Verify(ctx context.Context, keyString string) (*apikey.APIKey, error) {
+	rest, ok := strings.CutPrefix(keyString, keyStringPrefix)
+	if !ok {
+		return nil, apikey.ErrInvalidKey
+	}
+	prefix, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, apikey.ErrInvalidKey
+	}
+
+	key, err := s.repo.GetByPrefix(ctx, prefix)
+	if errors.Is(err, apikey.ErrNotFound) {
+		// compare anyway, unknown keys take the same time as wrong keys
+		subtle.ConstantTimeCompare([]byte(hashKey(keyString)), []byte(hashKey("")))
+		return nil, apikey.ErrInvalidKey
+	} else if err != nil {
+		return nil, fmt.Errorf("repo.GetByPrefix error: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(hashKey(keyString)), []byte(key.Hash)) != 1 {
+		return nil, apikey.ErrInvalidKey
+	}
+	if !key.ExpiresAt.IsZero() && !now().Before(key.ExpiresAt) {
+		return nil, apikey.ErrInvalidKey
+	}
+
+	// the key can't do more than its owner
+	roles, err := s.roles.GetRoles(ctx, key.UserID)
+	if errors.Is(err, user.ErrNotFound) {
+		return nil, apikey.ErrInvalidKey
+	} else if err != nil {
+		return nil, fmt.Errorf("roles.GetRoles error: %w", err)
+	}
+	granted := auth.ScopesOfRoles(roles)
+	key.Scopes = slices.DeleteFunc(key.Scopes, func(scope string) bool { return !slices.Contains(granted, scope) })
+	key.Roles = roles
+
+	// the last used time is informative, failing to write it doesn't reject the valid key
+	if lastUsedAt := now(); lastUsedAt.Sub(key.LastUsedAt) >= lastUsedUpdateInterval {
+		if err := s.repo.SetLastUsedAt(ctx, key.ID, lastUsedAt); err != nil {
+			if logger := infra.GetLogger(ctx); logger != nil {
+				logger.Warnw("repo.SetLastUsedAt error", "api_key_id", key.ID, "error", err)
+			}
+		} else {
+			key.LastUsedAt = lastUsedAt
+		}
+	}
+	return key, nil
+}
+
+// hashKey hashes key strings before storing, keys are random so that a fast hash is enough.
+func hashKey(keyString string) string {
+	sum := sha256.Sum256([]byte(keyString))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,197 @@
+package apikey_svc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/andy74139/webserver/src/domain/entity/apikey"
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+	"github.com/andy74139/webserver/src/domain/entity/user"
+)
+
+type APIKeySuite struct {
+	suite.Suite
+}
+
+func TestAPIKeySuite(t *testing.T) {
+	suite.Run(t, new(APIKeySuite))
+}
+
+// fakeRepo is an in-memory apikey.Repository.
+type fakeRepo map[uuid.UUID]*apikey.APIKey
+
+func (r fakeRepo) Create(ctx context.Context, key *apikey.APIKey) error {
+	key1 := *key
+	r[key.ID] = &key1
+	return nil
+}
+
+func (r fakeRepo) Get(ctx context.Context, userID uuid.UUID, id uuid.UUID) (*apikey.APIKey, error) {
+	key, ok := r[id]
+	if !ok || key.UserID != userID {
+		return nil, apikey.ErrNotFound
+	}
+	key1 := *key
+	return &key1, nil
+}
+
+func (r fakeRepo) GetByPrefix(ctx context.Context, prefix string) (*apikey.APIKey, error) {
+	for _, key := range r {
+		if key.Prefix == prefix {
+			key1 := *key
+			key1.Scopes = append([]string{}, key.Scopes...)
+			return &key1, nil
+		}
+	}
+	return nil, apikey.ErrNotFound
+}
+
+func (r fakeRepo) List(ctx context.Context, userID uuid.UUID) ([]*apikey.APIKey, error) {
+	keys := []*apikey.APIKey{}
+	for _, key := range r {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (r fakeRepo) SetExpiresAt(ctx context.Context, id uuid.UUID, expiresAt time.Time) error {
+	r[id].ExpiresAt = expiresAt
+	return nil
+}
+
+func (r fakeRepo) SetLastUsedAt(ctx context.Context, id uuid.UUID, lastUsedAt time.Time) error {
+	r[id].LastUsedAt = lastUsedAt
+	return nil
+}
+
+func (r fakeRepo) Delete(ctx context.Context, userID uuid.UUID, id uuid.UUID) error {
+	delete(r, id)
+	return nil
+}
+
+// failingLastUsedRepo fails to write the last used time.
+type failingLastUsedRepo struct {
+	fakeRepo
+}
+
+func (r failingLastUsedRepo) SetLastUsedAt(ctx context.Context, id uuid.UUID, lastUsedAt time.Time) error {
+	return errors.New("db is down")
+}
+
+// fakeRoles is an auth.RoleProvider.
+type fakeRoles map[uuid.UUID][]string
+
+func (r fakeRoles) GetRoles(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	roles, ok := r[userID]
+	if !ok {
+		return nil, user.ErrNotFound
+	}
+	return roles, nil
+}
+
+func (s *APIKeySuite) TestVerify() {
+	ctx := context.TODO()
+	nowTime := time.Now()
+	now = func() time.Time { return nowTime }
+	userID := uuid.New()
+	repo, roles := fakeRepo{}, fakeRoles{userID: {auth.RoleUser}}
+	svc, err := New(repo, roles)
+	s.Require().NoError(err)
+
+	// scopes beyond the roles of the owner are dropped
+	created, keyString, err := svc.Create(ctx, userID, "job", []string{auth.ScopeAccountRead, auth.ScopeAdminRead}, nowTime.Add(time.Hour))
+	s.Require().NoError(err)
+	s.True(strings.HasPrefix(keyString, "wsk_"+created.Prefix+"_"))
+	s.NotContains(repo[created.ID].Hash, keyString, "key is stored hashed")
+
+	key, err := svc.Verify(ctx, keyString)
+	s.Require().NoError(err)
+	s.Equal(userID, key.UserID)
+	s.Equal([]string{auth.ScopeAccountRead}, key.Scopes)
+	s.Equal(nowTime, repo[created.ID].LastUsedAt)
+
+	// the last used time is written at most once a minute
+	usedAt := nowTime
+	nowTime = nowTime.Add(time.Second * 30)
+	roles[userID] = []string{auth.RoleUser, auth.RoleSupport}
+	key, err = svc.Verify(ctx, keyString)
+	s.Require().NoError(err)
+	s.Equal([]string{auth.ScopeAccountRead, auth.ScopeAdminRead}, key.Scopes)
+	s.Equal(usedAt, repo[created.ID].LastUsedAt)
+	nowTime = nowTime.Add(time.Second * 30)
+	_, err = svc.Verify(ctx, keyString)
+	s.Require().NoError(err)
+	s.Equal(nowTime, repo[created.ID].LastUsedAt)
+	nowTime = usedAt
+
+	// invalid keys
+	for _, invalid := range []string{"", "wsk_", keyString + "x", "wsk_unknown_" + strings.Split(keyString, "_")[2]} {
+		_, err = svc.Verify(ctx, invalid)
+		s.ErrorIs(err, apikey.ErrInvalidKey, invalid)
+	}
+
+	// expired key
+	nowTime = nowTime.Add(time.Hour)
+	_, err = svc.Verify(ctx, keyString)
+	s.ErrorIs(err, apikey.ErrInvalidKey)
+
+	// deleted owner
+	nowTime = nowTime.Add(-time.Hour)
+	delete(roles, userID)
+	_, err = svc.Verify(ctx, keyString)
+	s.ErrorIs(err, apikey.ErrInvalidKey)
+}
+
+func (s *APIKeySuite) TestVerify_LastUsedFailure() {
+	ctx := context.TODO()
+	nowTime := time.Now()
+	now = func() time.Time { return nowTime }
+	userID := uuid.New()
+	repo := fakeRepo{}
+	svc, err := New(failingLastUsedRepo{repo}, fakeRoles{userID: {auth.RoleUser}})
+	s.Require().NoError(err)
+	created, keyString, err := svc.Create(ctx, userID, "job", []string{auth.ScopeAccountRead}, time.Time{})
+	s.Require().NoError(err)
+
+	// the valid key is accepted even if the last used time can't be written
+	key, err := svc.Verify(ctx, keyString)
+	s.Require().NoError(err)
+	s.Equal(created.ID, key.ID)
+	s.True(repo[created.ID].LastUsedAt.IsZero())
+}
+
+func (s *APIKeySuite) TestRotate() {
+	ctx := context.TODO()
+	nowTime := time.Now()
+	now = func() time.Time { return nowTime }
+	userID := uuid.New()
+	svc, err := New(fakeRepo{}, fakeRoles{userID: {auth.RoleUser}})
+	s.Require().NoError(err)
+
+	oldKey, oldKeyString, err := svc.Create(ctx, userID, "job", []string{auth.ScopeAccountRead}, time.Time{})
+	s.Require().NoError(err)
+	newKey, newKeyString, err := svc.Rotate(ctx, userID, oldKey.ID)
+	s.Require().NoError(err)
+	s.NotEqual(oldKey.Prefix, newKey.Prefix)
+	s.Equal("job", newKey.Name)
+
+	// both keys are valid in the grace period, and the old key expires after it
+	_, err = svc.Verify(ctx, oldKeyString)
+	s.NoError(err)
+	_, err = svc.Verify(ctx, newKeyString)
+	s.NoError(err)
+
+	nowTime = nowTime.Add(rotationGracePeriod)
+	_, err = svc.Verify(ctx, oldKeyString)
+	s.ErrorIs(err, apikey.ErrInvalidKey)
+	_, err = svc.Verify(ctx, newKeyString)
+	s.NoError(err)
+}
@@ -0,0 +1,61 @@
+package audit_svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/audit"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+	// maxDetailLength is the length of the detail column
+	maxDetailLength = 1024
+)
+
+// now is replaced in tests
+var now = time.Now
+
+type service struct {
+	repo audit.Repository
+}
+
+func New(repo audit.Repository) (audit.Service, error) {
+	if repo == nil {
+		return nil, errors.New("repo is nil")
+	}
+	return &service{repo: repo}, nil
+}
+
+func (s *service) Record(ctx context.Context, event *audit.Event) error {
+	if event.Action == "" || event.ActorID == uuid.Nil {
+		return audit.ErrInvalidEvent
+	}
+	if len(event.Detail) > maxDetailLength {
+		// the cut may split a character, which is dropped
+		event.Detail = strings.ToValidUTF8(event.Detail[:maxDetailLength], "")
+	}
+	event.ID = uuid.New()
+	event.CreatedAt = now()
+	if err := s.repo.Create(ctx, event); err != nil {
+		return fmt.Errorf("repo.Create error: %w", err)
+	}
+	return nil
+}
+
+func (s *service) ListByUser(ctx context.Context, userID uuid.UUID, limit int) ([]*audit.Event, error) {
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	events, err := s.repo.ListByUser(ctx, userID, min(limit, maxListLimit))
+	if err != nil {
+		return nil, fmt.Errorf("repo.ListByUser error: %w", err)
+	}
+	return events, nil
+}
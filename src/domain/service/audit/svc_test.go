@@ -0,0 +1,92 @@
+package audit_svc
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/andy74139/webserver/src/domain/entity/audit"
+)
+
+type AuditSuite struct {
+	suite.Suite
+}
+
+func TestAuditSuite(t *testing.T) {
+	suite.Run(t, new(AuditSuite))
+}
+
+// fakeRepo is an in-memory audit.Repository.
+type fakeRepo struct {
+	events []*audit.Event
+}
+
+func (r *fakeRepo) Create(ctx context.Context, event *audit.Event) error {
+	event1 := *event
+	r.events = append(r.events, &event1)
+	return nil
+}
+
+func (r *fakeRepo) ListByUser(ctx context.Context, userID uuid.UUID, limit int) ([]*audit.Event, error) {
+	var events []*audit.Event
+	for _, event := range slices.Backward(r.events) {
+		if (event.UserID == userID || event.ActorID == userID) && len(events) < limit {
+			event1 := *event
+			events = append(events, &event1)
+		}
+	}
+	return events, nil
+}
+
+func (s *AuditSuite) TestRecord() {
+	ctx := context.Background()
+	repo := &fakeRepo{}
+	svc, err := New(repo)
+	s.Require().NoError(err)
+	staffID, userID := uuid.New(), uuid.New()
+	now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	event := &audit.Event{Action: audit.ActionImpersonationIssue, ActorID: staffID, UserID: userID, Detail: "ticket 123"}
+	s.Require().NoError(svc.Record(ctx, event))
+	s.NotEqual(uuid.Nil, event.ID)
+	s.Equal(now(), event.CreatedAt)
+
+	s.ErrorIs(svc.Record(ctx, &audit.Event{ActorID: staffID, UserID: userID}), audit.ErrInvalidEvent)
+	s.ErrorIs(svc.Record(ctx, &audit.Event{Action: audit.ActionImpersonationUse, UserID: userID}), audit.ErrInvalidEvent)
+
+	// long details are cut without splitting characters
+	event = &audit.Event{Action: audit.ActionImpersonationUse, ActorID: staffID, UserID: userID, Detail: "a" + strings.Repeat("測", maxDetailLength)}
+	s.Require().NoError(svc.Record(ctx, event))
+	s.LessOrEqual(len(event.Detail), maxDetailLength)
+	s.True(strings.HasSuffix(event.Detail, "測"))
+	s.Len(repo.events, 2)
+}
+
+func (s *AuditSuite) TestListByUser() {
+	ctx := context.Background()
+	svc, err := New(&fakeRepo{})
+	s.Require().NoError(err)
+	staffID, userID, otherID := uuid.New(), uuid.New(), uuid.New()
+
+	for _, target := range []uuid.UUID{userID, otherID, userID} {
+		s.Require().NoError(svc.Record(ctx, &audit.Event{Action: audit.ActionImpersonationUse, ActorID: staffID, UserID: target}))
+	}
+
+	// events of the user, and events done by the staff
+	events, err := svc.ListByUser(ctx, userID, 0)
+	s.Require().NoError(err)
+	s.Len(events, 2)
+	events, err = svc.ListByUser(ctx, staffID, 0)
+	s.Require().NoError(err)
+	s.Len(events, 3)
+	s.Equal(userID, events[0].UserID, "latest first")
+	events, err = svc.ListByUser(ctx, staffID, 1)
+	s.Require().NoError(err)
+	s.Len(events, 1)
+}
@@ -0,0 +1,168 @@
+package auth_svc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+)
+
+// KeySet holds the keys to sign and verify tokens.
+// The active key signs new tokens; every non-retired key verifies tokens, so keys can be rotated
+// without logging out users whose tokens are signed by the previous key.
+type KeySet struct {
+	activeKey *signingKey
+	keys      map[string]*signingKey
+	jwks      *auth.JWKS
+}
+
+type signingKey struct {
+	id     string
+	method jwt.SigningMethod
+	signer crypto.Signer
+}
+
+// NewKeySet creates a key set from private keys mapped by key ID. Retired keys are dropped.
+func NewKeySet(privateKeys map[string]crypto.Signer, activeKeyID string, retiredKeyIDs []string) (*KeySet, error) {
+	if slices.Contains(retiredKeyIDs, activeKeyID) {
+		return nil, fmt.Errorf("active key %s is retired", activeKeyID)
+	}
+
+	keySet := &KeySet{keys: map[string]*signingKey{}, jwks: &auth.JWKS{Keys: []auth.JWK{}}}
+	for id, signer := range privateKeys {
+		if slices.Contains(retiredKeyIDs, id) {
+			continue
+		}
+		method, err := getSigningMethod(signer)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+		keySet.keys[id] = &signingKey{id: id, method: method, signer: signer}
+	}
+
+	activeKey, ok := keySet.keys[activeKeyID]
+	if !ok {
+		return nil, fmt.Errorf("active key %s not found", activeKeyID)
+	}
+	keySet.activeKey = activeKey
+
+	ids := make([]string, 0, len(keySet.keys))
+	for id := range keySet.keys {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		key := keySet.keys[id]
+		jwk, err := auth.NewJWK(id, key.method.Alg(), key.signer.Public())
+		if err != nil {
+			return nil, fmt.Errorf("NewJWK error: %w", err)
+		}
+		keySet.jwks.Keys = append(keySet.jwks.Keys, jwk)
+	}
+	return keySet, nil
+}
+
+// LoadKeySet loads PEM encoded private keys from a directory. The file name without extension is the key ID.
+func LoadKeySet(dir string, activeKeyID string, retiredKeyIDs []string) (*KeySet, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("filepath.Glob error: %w", err)
+	}
+
+	privateKeys := map[string]crypto.Signer{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("os.ReadFile error: %w", err)
+		}
+		signer, err := parsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse key file %s error: %w", file, err)
+		}
+		privateKeys[strings.TrimSuffix(filepath.Base(file), ".pem")] = signer
+	}
+	return NewKeySet(privateKeys, activeKeyID, retiredKeyIDs)
+}
+
+func (k *KeySet) getVerificationKey(token *jwt.Token) (interface{}, error) {
+	keyID, _ := token.Header["kid"].(string)
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", auth.ErrUnknownKey, keyID)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s for key %s", token.Method.Alg(), keyID)
+	}
+	return key.signer.Public(), nil
+}
+
+func (k *KeySet) validMethods() []string {
+	methods := []string{}
+	for _, key := range k.keys {
+		if !slices.Contains(methods, key.method.Alg()) {
+			methods = append(methods, key.method.Alg())
+		}
+	}
+	return methods
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type: %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+func getSigningMethod(signer crypto.Signer) (jwt.SigningMethod, error) {
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch key.Curve.Params().Name {
+		case "P-256":
+			return jwt.SigningMethodES256, nil
+		case "P-384":
+			return jwt.SigningMethodES384, nil
+		case "P-521":
+			return jwt.SigningMethodES512, nil
+		}
+		return nil, fmt.Errorf("unsupported curve: %s", key.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", signer)
+}
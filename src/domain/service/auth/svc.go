@@ -2,7 +2,15 @@ package auth_svc
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"expvar"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/andy74139/webserver/src/domain/entity/auth"
@@ -11,77 +19,440 @@ import (
 )
 
 const (
-	jwtIssuer                 = "https://my.domain.com"
-	jwtExpiryDuration         = time.Hour * 24 * 7
-	jwtSuggestRefreshDuration = time.Hour * 24 * 3
+	jwtIssuer                  = "https://my.domain.com"
+	jwtExpiryDuration          = time.Minute * 15
+	jwtSuggestRefreshDuration  = time.Minute * 5
+	refreshTokenExpiryDuration = time.Hour * 24 * 7
+	refreshTokenLength         = 32
+	mfaPendingExpiryDuration   = time.Minute * 5
+	// exchangedTokenExpiryDuration is short, exchanged tokens are for calls of downstream services
+	exchangedTokenExpiryDuration = time.Minute * 5
+	// impersonationExpiryDuration is short, support staff requests another token to keep debugging
+	impersonationExpiryDuration = time.Minute * 10
 )
 
-var jwtSecretKey = []byte("secret_key")
 var now = time.Now
 
+// metrics of the global watermark, they are served with other expvar variables
+var (
+	// globalValidAfterMetric is the global watermark in unix seconds seen by the instance, 0 if there is none
+	globalValidAfterMetric = expvar.NewInt("auth_global_tokens_valid_after")
+	// globalRevokedMetric counts tokens rejected by the global watermark
+	globalRevokedMetric = expvar.NewInt("auth_global_tokens_revoked")
+)
+
 type service struct {
-	repo auth.Repository
+	repo  auth.Repository
+	keys  *KeySet
+	users auth.UserProvider
 }
 
-func New(repo auth.Repository) auth.Service {
-	return &service{repo: repo}
+func New(repo auth.Repository, keys *KeySet, users auth.UserProvider) auth.Service {
+	return &service{repo: repo, keys: keys, users: users}
 }
 
-func (s *service) CreateToken(ctx context.Context, userID uuid.UUID) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    jwtIssuer,
-		Subject:   userID.String(),
-		IssuedAt:  jwt.NewNumericDate(now()),
-		ExpiresAt: jwt.NewNumericDate(now().Add(jwtExpiryDuration)),
+// CreateToken creates an access token and a refresh token of a new session.
+func (s *service) CreateToken(ctx context.Context, userID uuid.UUID, info *auth.SessionInfo) (*auth.TokenPair, error) {
+	session := &auth.Session{
 		ID:        uuid.New().String(),
+		UserID:    userID,
+		CreatedAt: now(),
+	}
+	if info != nil {
+		session.Info = *info
+	}
+	return s.createTokenPair(ctx, session)
+}
+
+// RefreshToken exchanges a refresh token for a new token pair of the same session, the refresh token is rotated.
+// Using a rotated refresh token again means it is leaked, so the whole session is revoked. Refresh tokens of users who
+// can't login are rejected afterward.
+func (s *service) RefreshToken(ctx context.Context, refreshToken string, info *auth.SessionInfo) (*auth.TokenPair, error) {
+	token, err := s.repo.UseRefreshToken(ctx, hashRefreshToken(refreshToken))
+	if errors.Is(err, auth.ErrNotFound) {
+		return nil, auth.ErrInvalidRefreshToken
+	} else if err != nil {
+		return nil, fmt.Errorf("repo.UseRefreshToken error: %w", err)
+	}
+
+	if !now().Before(token.ExpiresAt) {
+		return nil, auth.ErrInvalidRefreshToken
+	}
+	clientID := ""
+	if info != nil {
+		clientID = info.ClientID
+	}
+	if token.ClientID != clientID {
+		return nil, auth.ErrInvalidRefreshToken
+	}
+	if token.IsUsed {
+		if err := s.RevokeSession(ctx, token.SessionID); err != nil {
+			return nil, fmt.Errorf("RevokeSession error: %w", err)
+		}
+		return nil, auth.ErrRefreshTokenReused
+	}
+	if isRevoked, err := s.repo.IsRevoked(ctx, token.SessionID); err != nil {
+		return nil, fmt.Errorf("repo.IsRevoked error: %w", err)
+	} else if isRevoked {
+		return nil, auth.ErrRevokedToken
+	}
+	if err := s.verifyGlobalWatermark(ctx, token.IssuedAt); err != nil {
+		return nil, err
+	}
+	if err := s.verifyUserWatermark(ctx, token.UserID, token.IssuedAt); err != nil {
+		return nil, err
+	}
+	// suspended or deleted users don't rely on their watermarks only
+	if isValid, err := s.users.CheckValidLoginUser(ctx, token.UserID); err != nil {
+		return nil, fmt.Errorf("users.CheckValidLoginUser error: %w", err)
+	} else if !isValid {
+		return nil, fmt.Errorf("%w: user %s is not valid to login", auth.ErrInvalidRefreshToken, token.UserID)
+	}
+
+	session, err := s.repo.GetSession(ctx, token.SessionID)
+	if errors.Is(err, auth.ErrNotFound) {
+		session = &auth.Session{ID: token.SessionID, UserID: token.UserID, CreatedAt: token.AuthTime}
+	} else if err != nil {
+		return nil, fmt.Errorf("repo.GetSession error: %w", err)
+	}
+	if info != nil {
+		session.Info.IP = info.IP
+		session.Info.UserAgent = info.UserAgent
+	}
+	// the refresh token keeps the limit of the session, even if the session is lost
+	session.Info.ClientID = token.ClientID
+	session.Info.Scopes = token.Scopes
+
+	return s.createTokenPair(ctx, session)
+}
+
+// createTokenPair issues tokens of the session, and registers the session.
+func (s *service) createTokenPair(ctx context.Context, session *auth.Session) (*auth.TokenPair, error) {
+	// roles are read on each issuing, so role changes take effect by the next refresh
+	roles, err := s.users.GetRoles(ctx, session.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("roles.GetRoles error: %w", err)
+	}
+
+	scopes := auth.ScopesOfRoles(roles)
+	if session.Info.ClientID != "" {
+		scopes = slices.DeleteFunc(scopes, func(scope string) bool { return !slices.Contains(session.Info.Scopes, scope) })
+	}
+	scope := strings.Join(scopes, " ")
+
+	issuedAt, err := s.getIssuedAt(ctx, session.UserID)
+	if err != nil {
+		return nil, err
+	}
+	jwtID := uuid.New().String()
+	accessToken, err := s.signToken(&auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   session.UserID.String(),
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(issuedAt.Add(jwtExpiryDuration)),
+			ID:        jwtID,
+		},
+		SessionID: session.ID,
+		Roles:     roles,
+		Scope:     scope,
+		ClientID:  session.Info.ClientID,
+		AuthTime:  jwt.NewNumericDate(session.CreatedAt),
 	})
-	signedKey, err := token.SignedString(jwtSecretKey)
 	if err != nil {
-		return "", fmt.Errorf("SingedString error: %w", err)
+		return nil, err
+	}
+
+	refreshToken, err := generateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	record := &auth.RefreshToken{
+		UserID:    session.UserID,
+		SessionID: session.ID,
+		ClientID:  session.Info.ClientID,
+		Scopes:    session.Info.Scopes,
+		AuthTime:  session.CreatedAt,
+		IssuedAt:  issuedAt,
+		ExpiresAt: issuedAt.Add(refreshTokenExpiryDuration),
+	}
+	if err := s.repo.SetRefreshToken(ctx, hashRefreshToken(refreshToken), record, refreshTokenExpiryDuration); err != nil {
+		return nil, fmt.Errorf("repo.SetRefreshToken error: %w", err)
+	}
+
+	session.JWTID = jwtID
+	session.LastUsedAt = issuedAt
+	session.ExpiresAt = record.ExpiresAt
+	if err := s.repo.SetSession(ctx, session, refreshTokenExpiryDuration); err != nil {
+		return nil, fmt.Errorf("repo.SetSession error: %w", err)
 	}
 
+	return &auth.TokenPair{
+		AccessToken:           accessToken,
+		AccessTokenExpiresAt:  issuedAt.Add(jwtExpiryDuration),
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: record.ExpiresAt,
+		Scope:                 scope,
+	}, nil
+}
+
+func (s *service) CreateClientToken(ctx context.Context, clientID string, scopes []string) (*auth.TokenPair, error) {
+	scope := strings.Join(scopes, " ")
+	issuedAt, err := s.getIssuedAt(ctx, uuid.Nil)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := s.signToken(&auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   clientID,
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(issuedAt.Add(jwtExpiryDuration)),
+			ID:        uuid.New().String(),
+		},
+		SubjectType: auth.SubjectTypeClient,
+		Scope:       scope,
+		ClientID:    clientID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &auth.TokenPair{
+		AccessToken:          accessToken,
+		AccessTokenExpiresAt: issuedAt.Add(jwtExpiryDuration),
+		Scope:                scope,
+	}, nil
+}
+
+func (s *service) ExchangeToken(ctx context.Context, subjectToken string, actorClientID string, audience string, scopes []string) (*auth.TokenPair, error) {
+	// tokens of other audiences and tokens of clients themselves can't be exchanged
+	subject, _, err := s.ParseAndVerifyToken(ctx, subjectToken)
+	if err != nil {
+		return nil, err
+	} else if subject.IsClientSubject() {
+		return nil, fmt.Errorf("%w: client token", auth.ErrInvalidToken)
+	} else if subject.Actor != nil {
+		return nil, fmt.Errorf("%w: token has an actor", auth.ErrInvalidToken)
+	}
+	subjectScopes := strings.Fields(subject.Scope)
+	if len(scopes) == 0 {
+		scopes = subjectScopes
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(subjectScopes, scope) {
+			return nil, auth.ErrInvalidScope
+		}
+	}
+
+	// the token doesn't outlive the subject token
+	issuedAt := now()
+	expiresAt := issuedAt.Add(exchangedTokenExpiryDuration)
+	if subject.ExpiresAt.Time.Before(expiresAt) {
+		expiresAt = subject.ExpiresAt.Time
+	}
+	scope := strings.Join(scopes, " ")
+	accessToken, err := s.signToken(&auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   subject.Subject,
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			ID:        uuid.New().String(),
+		},
+		// the session is kept, so revoking the session revokes exchanged tokens
+		SessionID: subject.SessionID,
+		Scope:     scope,
+		ClientID:  actorClientID,
+		Actor:     &auth.Actor{Subject: actorClientID, SubjectType: auth.SubjectTypeClient},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &auth.TokenPair{
+		AccessToken:          accessToken,
+		AccessTokenExpiresAt: expiresAt,
+		Scope:                scope,
+	}, nil
+}
+
+func (s *service) CreateImpersonationToken(ctx context.Context, userID uuid.UUID, actorID uuid.UUID) (*auth.TokenPair, error) {
+	roles, err := s.users.GetRoles(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("roles.GetRoles error: %w", err)
+	}
+	// the staff doesn't gain privileges of the user beyond regular users
+	userScopes := auth.ScopesOfRoles([]string{auth.RoleUser})
+	scopes := slices.DeleteFunc(auth.ScopesOfRoles(roles), func(scope string) bool { return !slices.Contains(userScopes, scope) })
+	scope := strings.Join(scopes, " ")
+
+	// no auth_time, so endpoints requiring a recent login reject it
+	issuedAt := now()
+	accessToken, err := s.signToken(&auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   userID.String(),
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(issuedAt.Add(impersonationExpiryDuration)),
+			ID:        uuid.New().String(),
+		},
+		Roles: []string{auth.RoleUser},
+		Scope: scope,
+		Actor: &auth.Actor{Subject: actorID.String(), SubjectType: auth.SubjectTypeUser},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &auth.TokenPair{
+		AccessToken:          accessToken,
+		AccessTokenExpiresAt: issuedAt.Add(impersonationExpiryDuration),
+		Scope:                scope,
+	}, nil
+}
+
+func (s *service) signToken(claims *auth.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.keys.activeKey.method, claims)
+	token.Header["kid"] = s.keys.activeKey.id
+	signedKey, err := token.SignedString(s.keys.activeKey.signer)
+	if err != nil {
+		return "", fmt.Errorf("SingedString error: %w", err)
+	}
 	return signedKey, nil
 }
 
-func (s *service) ParseToken(ctx context.Context, jwtToken string) (*jwt.RegisteredClaims, error) {
-	claims := &jwt.RegisteredClaims{}
-	_, err := jwt.ParseWithClaims(jwtToken, claims, func(token *jwt.Token) (interface{}, error) { return jwtSecretKey, nil })
+func (s *service) ParseToken(ctx context.Context, jwtToken string) (*auth.Claims, error) {
+	claims := &auth.Claims{}
+	_, err := jwt.ParseWithClaims(jwtToken, claims, s.keys.getVerificationKey, jwt.WithValidMethods(s.keys.validMethods()))
 	if err != nil {
-		return nil, fmt.Errorf("jwt.Parse error: %w", err)
+		return nil, fmt.Errorf("%w: jwt.Parse error: %w", auth.ErrInvalidToken, err)
 	}
 	return claims, nil
 }
 
-func (s *service) ParseAndVerifyToken(ctx context.Context, jwtToken string) (*jwt.RegisteredClaims, bool, error) {
-	claim, err := s.ParseToken(ctx, jwtToken)
+// CreateMFAPendingToken creates a token without scopes and refresh token, it is exchanged for a session after the second factor.
+func (s *service) CreateMFAPendingToken(ctx context.Context, userID uuid.UUID, info *auth.SessionInfo) (string, time.Time, error) {
+	pending := &auth.MFAPending{}
+	if info != nil {
+		pending.Platform = info.Platform
+		pending.DeviceID = info.DeviceID
+	}
+	issuedAt := now()
+	expiresAt := issuedAt.Add(mfaPendingExpiryDuration)
+	token, err := s.signToken(&auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   userID.String(),
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			ID:        uuid.New().String(),
+		},
+		MFAPending: pending,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+func (s *service) ParseMFAPendingToken(ctx context.Context, jwtToken string) (*auth.Claims, error) {
+	claims, err := s.verifyToken(ctx, jwtToken)
+	if err != nil {
+		return nil, err
+	} else if claims.MFAPending == nil {
+		return nil, fmt.Errorf("%w: not an mfa_pending token", auth.ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// ParseAndVerifyToken verifies an access token, and returns whether it is suggested to refresh.
+func (s *service) ParseAndVerifyToken(ctx context.Context, jwtToken string, audiences ...string) (*auth.Claims, bool, error) {
+	claims, err := s.verifyToken(ctx, jwtToken)
 	if err != nil {
 		return nil, false, err
+	} else if claims.MFAPending != nil {
+		return nil, false, fmt.Errorf("%w: mfa_pending token", auth.ErrInvalidToken)
+	}
+	if len(claims.Audience) > 0 && !slices.ContainsFunc(claims.Audience, func(audience string) bool {
+		return slices.Contains(audiences, audience)
+	}) {
+		return nil, false, fmt.Errorf("%w: invalid audience: %v", auth.ErrInvalidToken, claims.Audience)
+	}
+
+	isSuggestRefresh := claims.ExpiresAt.Sub(now()) <= jwtSuggestRefreshDuration
+	return claims, isSuggestRefresh, nil
+}
+
+// verifyToken verifies the signature, claims, and revocations of a token.
+func (s *service) verifyToken(ctx context.Context, jwtToken string) (*auth.Claims, error) {
+	claim, err := s.ParseToken(ctx, jwtToken)
+	if err != nil {
+		return nil, err
 	}
 
 	// verify
 	issuer, err := claim.GetIssuer()
 	if err != nil {
-		return nil, false, fmt.Errorf("GetIssuer error: %w", err)
+		return nil, fmt.Errorf("%w: GetIssuer error: %w", auth.ErrInvalidToken, err)
 	} else if issuer != jwtIssuer {
-		return nil, false, fmt.Errorf("invalid issuer: %s", issuer)
+		return nil, fmt.Errorf("%w: invalid issuer: %s", auth.ErrInvalidToken, issuer)
 	}
 
-	if _, err := claim.GetSubject(); err != nil {
-		return nil, false, fmt.Errorf("GetSubject error: %w", err)
-	}
-	expiryDur, err := claim.GetExpirationTime()
+	subject, err := claim.GetSubject()
 	if err != nil {
-		return nil, false, fmt.Errorf("GetExpirationTime error: %w", err)
+		return nil, fmt.Errorf("%w: GetSubject error: %w", auth.ErrInvalidToken, err)
+	}
+	var userID uuid.UUID
+	switch claim.SubjectType {
+	case "":
+		userID, err = uuid.Parse(subject)
+		if err != nil {
+			return nil, fmt.Errorf("%w: uuid.Parse subject error: %w", auth.ErrInvalidToken, err)
+		}
+	case auth.SubjectTypeClient:
+		if subject == "" {
+			return nil, fmt.Errorf("%w: empty client subject", auth.ErrInvalidToken)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown subject type: %s", auth.ErrInvalidToken, claim.SubjectType)
+	}
+	if claim.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: no expiration time", auth.ErrInvalidToken)
 	}
 
-	if isRevoked, err := s.repo.IsRevoked(ctx, claim.ID); err != nil {
-		return nil, false, fmt.Errorf("repo.IsRevoked error: %w", err)
-	} else if isRevoked {
-		return nil, false, auth.ErrRevokedToken
+	for _, id := range []string{claim.ID, claim.SessionID} {
+		if id == "" {
+			continue
+		}
+		if isRevoked, err := s.repo.IsRevoked(ctx, id); err != nil {
+			return nil, fmt.Errorf("repo.IsRevoked error: %w", err)
+		} else if isRevoked {
+			return nil, auth.ErrRevokedToken
+		}
+	}
+	if claim.IssuedAt == nil {
+		return nil, fmt.Errorf("%w: no issued at", auth.ErrInvalidToken)
+	}
+	if err := s.verifyGlobalWatermark(ctx, claim.IssuedAt.Time); err != nil {
+		return nil, err
+	}
+	if claim.IsClientSubject() {
+		return claim, nil
+	}
+	if err := s.verifyUserWatermark(ctx, userID, claim.IssuedAt.Time); err != nil {
+		return nil, err
+	}
+	// logging out the staff everywhere revokes its impersonation tokens as well
+	if claim.IsImpersonation() {
+		actorID, err := uuid.Parse(claim.Actor.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("%w: uuid.Parse actor error: %w", auth.ErrInvalidToken, err)
+		}
+		if err := s.verifyUserWatermark(ctx, actorID, claim.IssuedAt.Time); err != nil {
+			return nil, err
+		}
 	}
 
-	isSuggestRefresh := expiryDur.Sub(now()) <= jwtSuggestRefreshDuration
-	return claim, isSuggestRefresh, nil
+	return claim, nil
 }
 
 func (s *service) RevokeToken(ctx context.Context, jwtID string, jwtExpiryTime time.Time) error {
@@ -91,3 +462,148 @@ func (s *service) RevokeToken(ctx context.Context, jwtID string, jwtExpiryTime t
 	}
 	return nil
 }
+
+// RevokeSession revokes all access and refresh tokens of a session, and removes it from the session registry.
+func (s *service) RevokeSession(ctx context.Context, sessionID string) error {
+	// refresh tokens of the session are issued before now, so they expire within refreshTokenExpiryDuration
+	if err := s.RevokeToken(ctx, sessionID, now().Add(refreshTokenExpiryDuration)); err != nil {
+		return err
+	}
+
+	session, err := s.repo.GetSession(ctx, sessionID)
+	if errors.Is(err, auth.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("repo.GetSession error: %w", err)
+	}
+	if err := s.repo.DeleteSession(ctx, session.UserID, sessionID); err != nil {
+		return fmt.Errorf("repo.DeleteSession error: %w", err)
+	}
+	return nil
+}
+
+// ListSessions lists unexpired sessions of the user.
+func (s *service) ListSessions(ctx context.Context, userID uuid.UUID) ([]*auth.Session, error) {
+	sessions, err := s.repo.ListSessions(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("repo.ListSessions error: %w", err)
+	}
+	slices.SortFunc(sessions, func(a, b *auth.Session) int { return b.LastUsedAt.Compare(a.LastUsedAt) })
+	return sessions, nil
+}
+
+// RevokeUserTokens revokes all tokens of the user issued until now, i.e. logs out all sessions of the user.
+func (s *service) RevokeUserTokens(ctx context.Context, userID uuid.UUID) error {
+	// token issued time is in seconds, the watermark is rounded up so tokens issued earlier within the same second are
+	// revoked as well. Tokens issued afterward take the watermark as their issued time, see getIssuedAt.
+	validAfter := now().Truncate(time.Second).Add(time.Second)
+	if err := s.repo.SetTokensValidAfter(ctx, userID, validAfter, refreshTokenExpiryDuration); err != nil {
+		return fmt.Errorf("repo.SetTokensValidAfter error: %w", err)
+	}
+	if err := s.repo.DeleteUserSessions(ctx, userID); err != nil {
+		return fmt.Errorf("repo.DeleteUserSessions error: %w", err)
+	}
+	return nil
+}
+
+// RevokeAllTokens sets the global watermark, sessions are kept but their refresh tokens are rejected by the watermark.
+func (s *service) RevokeAllTokens(ctx context.Context) (time.Time, error) {
+	// the cutoff is rounded up as RevokeUserTokens
+	validAfter := now().Truncate(time.Second).Add(time.Second)
+	if err := s.repo.SetGlobalTokensValidAfter(ctx, validAfter, refreshTokenExpiryDuration); err != nil {
+		return time.Time{}, fmt.Errorf("repo.SetGlobalTokensValidAfter error: %w", err)
+	}
+	setGlobalValidAfterMetric(validAfter)
+	return validAfter, nil
+}
+
+// GetGlobalTokensValidAfter reads the global watermark from the repository on every call, as watermarks of users,
+// so every instance sees RevokeAllTokens at once.
+func (s *service) GetGlobalTokensValidAfter(ctx context.Context) (time.Time, error) {
+	validAfter, err := s.repo.GetGlobalTokensValidAfter(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("repo.GetGlobalTokensValidAfter error: %w", err)
+	}
+	setGlobalValidAfterMetric(validAfter)
+	return validAfter, nil
+}
+
+func setGlobalValidAfterMetric(validAfter time.Time) {
+	if validAfter.IsZero() {
+		globalValidAfterMetric.Set(0)
+	} else {
+		globalValidAfterMetric.Set(validAfter.Unix())
+	}
+}
+
+// getIssuedAt returns the issued time of new tokens of the user, or of clients if userID is nil. Watermarks are rounded
+// up to the next second, tokens issued right after revoking take the watermark so that they aren't revoked by it.
+func (s *service) getIssuedAt(ctx context.Context, userID uuid.UUID) (time.Time, error) {
+	issuedAt := now()
+	validAfter, err := s.GetGlobalTokensValidAfter(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if userID != uuid.Nil {
+		userValidAfter, err := s.repo.GetTokensValidAfter(ctx, userID)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("repo.GetTokensValidAfter error: %w", err)
+		}
+		validAfter = maxTime(validAfter, userValidAfter)
+	}
+	return maxTime(issuedAt, validAfter), nil
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.Before(b) {
+		return b
+	}
+	return a
+}
+
+func (s *service) VerifyIssuedAt(ctx context.Context, userID uuid.UUID, issuedAt time.Time) error {
+	if err := s.verifyGlobalWatermark(ctx, issuedAt); err != nil {
+		return err
+	}
+	return s.verifyUserWatermark(ctx, userID, issuedAt)
+}
+
+// verifyGlobalWatermark rejects tokens issued before RevokeAllTokens, the error has the cutoff for logs.
+func (s *service) verifyGlobalWatermark(ctx context.Context, issuedAt time.Time) error {
+	validAfter, err := s.GetGlobalTokensValidAfter(ctx)
+	if err != nil {
+		return err
+	} else if issuedAt.Before(validAfter) {
+		globalRevokedMetric.Add(1)
+		return fmt.Errorf("%w: issued before the global cutoff %s", auth.ErrRevokedToken, validAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (s *service) verifyUserWatermark(ctx context.Context, userID uuid.UUID, issuedAt time.Time) error {
+	validAfter, err := s.repo.GetTokensValidAfter(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("repo.GetTokensValidAfter error: %w", err)
+	} else if issuedAt.Before(validAfter) {
+		return auth.ErrRevokedToken
+	}
+	return nil
+}
+
+func (s *service) GetJWKS(ctx context.Context) *auth.JWKS {
+	return s.keys.jwks
+}
+
+func generateRefreshToken() (string, error) {
+	b := make([]byte, refreshTokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("rand.Read error: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashRefreshToken hashes refresh tokens before storing, so leaked storage can't be used to refresh.
+func hashRefreshToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
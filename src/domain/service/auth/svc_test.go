@@ -2,26 +2,192 @@ package auth_svc
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/suite"
+
+	"github.com/andy74139/webserver/src/domain/entity/auth"
 )
 
 type AuthSuite struct {
 	suite.Suite
+
+	keys map[string]crypto.Signer
 }
 
 func TestAuthSuite(t *testing.T) {
 	suite.Run(t, new(AuthSuite))
 }
 
+func (s *AuthSuite) SetupSuite() {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	s.Require().NoError(err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	s.Require().NoError(err)
+
+	s.keys = map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey, "ed": edKey}
+}
+
+// fakeRepo is an in-memory auth.Repository.
+type fakeRepo struct {
+	mu            sync.Mutex
+	revoked       map[string]bool
+	refreshTokens map[string]*auth.RefreshToken
+	watermarks    map[uuid.UUID]time.Time
+	sessions      map[string]*auth.Session
+}
+
+func newFakeRepo() *fakeRepo {
+	return &fakeRepo{
+		revoked:       map[string]bool{},
+		refreshTokens: map[string]*auth.RefreshToken{},
+		watermarks:    map[uuid.UUID]time.Time{},
+		sessions:      map[string]*auth.Session{},
+	}
+}
+
+func (r *fakeRepo) SetRevoked(ctx context.Context, jwtID string, expiryDuration time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.revoked[jwtID] = true
+	return nil
+}
+
+func (r *fakeRepo) IsRevoked(ctx context.Context, jwtID string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.revoked[jwtID], nil
+}
+
+func (r *fakeRepo) SetRefreshToken(ctx context.Context, tokenHash string, token *auth.RefreshToken, expiryDuration time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	token1 := *token
+	r.refreshTokens[tokenHash] = &token1
+	return nil
+}
+
+func (r *fakeRepo) UseRefreshToken(ctx context.Context, tokenHash string) (*auth.RefreshToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	token, ok := r.refreshTokens[tokenHash]
+	if !ok {
+		return nil, auth.ErrNotFound
+	}
+	result := *token
+	token.IsUsed = true
+	return &result, nil
+}
+
+func (r *fakeRepo) SetTokensValidAfter(ctx context.Context, userID uuid.UUID, validAfter time.Time, expiryDuration time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.watermarks[userID] = validAfter
+	return nil
+}
+
+func (r *fakeRepo) GetTokensValidAfter(ctx context.Context, userID uuid.UUID) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.watermarks[userID], nil
+}
+
+func (r *fakeRepo) SetGlobalTokensValidAfter(ctx context.Context, validAfter time.Time, expiryDuration time.Duration) error {
+	return r.SetTokensValidAfter(ctx, uuid.Nil, validAfter, expiryDuration)
+}
+
+func (r *fakeRepo) GetGlobalTokensValidAfter(ctx context.Context) (time.Time, error) {
+	return r.GetTokensValidAfter(ctx, uuid.Nil)
+}
+
+func (r *fakeRepo) SetSession(ctx context.Context, session *auth.Session, expiryDuration time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	session1 := *session
+	r.sessions[session.ID] = &session1
+	return nil
+}
+
+func (r *fakeRepo) GetSession(ctx context.Context, sessionID string) (*auth.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	session, ok := r.sessions[sessionID]
+	if !ok {
+		return nil, auth.ErrNotFound
+	}
+	result := *session
+	return &result, nil
+}
+
+func (r *fakeRepo) ListSessions(ctx context.Context, userID uuid.UUID) ([]*auth.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions := []*auth.Session{}
+	for _, session := range r.sessions {
+		if session.UserID == userID {
+			result := *session
+			sessions = append(sessions, &result)
+		}
+	}
+	return sessions, nil
+}
+
+func (r *fakeRepo) DeleteSession(ctx context.Context, userID uuid.UUID, sessionID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, sessionID)
+	return nil
+}
+
+func (r *fakeRepo) DeleteUserSessions(ctx context.Context, userID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, session := range r.sessions {
+		if session.UserID == userID {
+			delete(r.sessions, id)
+		}
+	}
+	return nil
+}
+
+// fakeRoles is an auth.UserProvider, users have the user role by default. Users of nil roles can't login, e.g.
+// suspended users.
+type fakeRoles map[uuid.UUID][]string
+
+func (r fakeRoles) CheckValidLoginUser(ctx context.Context, userID uuid.UUID) (bool, error) {
+	roles, ok := r[userID]
+	return !ok || roles != nil, nil
+}
+
+func (r fakeRoles) GetRoles(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	if roles, ok := r[userID]; ok {
+		return roles, nil
+	}
+	return []string{auth.RoleUser}, nil
+}
+
+func (s *AuthSuite) newKeySet(activeKeyID string, retiredKeyIDs ...string) *KeySet {
+	keySet, err := NewKeySet(s.keys, activeKeyID, retiredKeyIDs)
+	s.Require().NoError(err)
+	return keySet
+}
+
 func (s *AuthSuite) TestJWT_HappyCase() {
 	ctx := context.TODO()
-	svc := New(nil)
+	svc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{})
 	nowTime := time.Now()
 
 	// override now() used in app
@@ -29,12 +195,12 @@ func (s *AuthSuite) TestJWT_HappyCase() {
 
 	// encode JWT
 	userID := uuid.New()
-	token, err := svc.CreateToken(ctx, userID)
+	token, err := svc.CreateToken(ctx, userID, nil)
 	s.Require().NoError(err)
-	fmt.Println(token)
+	fmt.Println(token.AccessToken)
 
 	// decode JWT
-	cliams, err := svc.ParseToken(ctx, token)
+	cliams, err := svc.ParseToken(ctx, token.AccessToken)
 	s.Require().NoError(err)
 
 	issuer, _ := cliams.GetIssuer()
@@ -50,19 +216,623 @@ func (s *AuthSuite) TestJWT_HappyCase() {
 func (s *AuthSuite) TestJWT_TimeExpired() {
 	ctx := context.TODO()
 	nowTime := time.Now().Add(-jwtExpiryDuration)
-	svc := New(nil)
+	svc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{})
 
 	// override now() used in app
 	now = func() time.Time { return nowTime }
 
 	// encode JWT
 	userID := uuid.New()
-	token, err := svc.CreateToken(ctx, userID)
+	token, err := svc.CreateToken(ctx, userID, nil)
 	s.Require().NoError(err)
-	fmt.Println(token)
+	fmt.Println(token.AccessToken)
 
 	// decode JWT
 	nowTime = nowTime.Add(jwtExpiryDuration)
-	_, err = svc.ParseToken(ctx, token)
+	_, err = svc.ParseToken(ctx, token.AccessToken)
 	s.Require().ErrorIs(err, jwt.ErrTokenExpired)
 }
+
+func (s *AuthSuite) TestJWT_SigningAlgorithms() {
+	ctx := context.TODO()
+	now = time.Now
+
+	for keyID, alg := range map[string]string{"rsa": "RS256", "ec": "ES256", "ed": "EdDSA"} {
+		svc := New(newFakeRepo(), s.newKeySet(keyID), fakeRoles{})
+		token, err := svc.CreateToken(ctx, uuid.New(), nil)
+		s.Require().NoError(err)
+
+		parsed, _, err := jwt.NewParser().ParseUnverified(token.AccessToken, &auth.Claims{})
+		s.Require().NoError(err)
+		s.Equal(alg, parsed.Method.Alg())
+		s.Equal(keyID, parsed.Header["kid"])
+
+		_, err = svc.ParseToken(ctx, token.AccessToken)
+		s.NoError(err, keyID)
+	}
+}
+
+func (s *AuthSuite) TestJWT_KeyRotation() {
+	ctx := context.TODO()
+	now = time.Now
+
+	oldSvc := New(newFakeRepo(), s.newKeySet("rsa"), fakeRoles{})
+	token, err := oldSvc.CreateToken(ctx, uuid.New(), nil)
+	s.Require().NoError(err)
+
+	// the previous key still verifies after the active key is rotated
+	rotatedSvc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{})
+	_, err = rotatedSvc.ParseToken(ctx, token.AccessToken)
+	s.NoError(err)
+
+	// the retired key doesn't
+	retiredSvc := New(newFakeRepo(), s.newKeySet("ed", "rsa"), fakeRoles{})
+	_, err = retiredSvc.ParseToken(ctx, token.AccessToken)
+	s.Error(err)
+}
+
+func (s *AuthSuite) TestJWT_SymmetricTokenRejected() {
+	ctx := context.TODO()
+	svc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{})
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Issuer: jwtIssuer, Subject: uuid.NewString()})
+	token.Header["kid"] = "ed"
+	signedKey, err := token.SignedString([]byte("secret_key"))
+	s.Require().NoError(err)
+
+	_, err = svc.ParseToken(ctx, signedKey)
+	s.Error(err)
+}
+
+func (s *AuthSuite) TestJWKS() {
+	ctx := context.TODO()
+	now = time.Now
+	svc := New(newFakeRepo(), s.newKeySet("ec", "rsa"), fakeRoles{})
+
+	jwks := svc.GetJWKS(ctx)
+	s.Require().Len(jwks.Keys, 2)
+
+	token, err := svc.CreateToken(ctx, uuid.New(), nil)
+	s.Require().NoError(err)
+
+	// a downstream service verifies the token by the published keys only
+	_, err = jwt.Parse(token.AccessToken, func(t *jwt.Token) (interface{}, error) {
+		for _, jwk := range jwks.Keys {
+			if jwk.KeyID == t.Header["kid"] {
+				return jwk.PublicKey()
+			}
+		}
+		return nil, auth.ErrUnknownKey
+	})
+	s.NoError(err)
+}
+
+func (s *AuthSuite) TestRefreshToken_Rotation() {
+	ctx := context.TODO()
+	now = time.Now
+	svc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{})
+
+	userID := uuid.New()
+	token, err := svc.CreateToken(ctx, userID, nil)
+	s.Require().NoError(err)
+	claims, _, err := svc.ParseAndVerifyToken(ctx, token.AccessToken)
+	s.Require().NoError(err)
+
+	refreshed, err := svc.RefreshToken(ctx, token.RefreshToken, nil)
+	s.Require().NoError(err)
+	s.NotEqual(token.RefreshToken, refreshed.RefreshToken)
+
+	refreshedClaims, _, err := svc.ParseAndVerifyToken(ctx, refreshed.AccessToken)
+	s.Require().NoError(err)
+	s.Equal(userID.String(), refreshedClaims.Subject)
+	s.Equal(claims.SessionID, refreshedClaims.SessionID)
+	s.NotEqual(claims.ID, refreshedClaims.ID)
+
+	_, err = svc.RefreshToken(ctx, "unknown", nil)
+	s.ErrorIs(err, auth.ErrInvalidRefreshToken)
+}
+
+func (s *AuthSuite) TestRefreshToken_ReuseRevokesSession() {
+	ctx := context.TODO()
+	now = time.Now
+	svc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{})
+
+	token, err := svc.CreateToken(ctx, uuid.New(), nil)
+	s.Require().NoError(err)
+	refreshed, err := svc.RefreshToken(ctx, token.RefreshToken, nil)
+	s.Require().NoError(err)
+
+	// the rotated refresh token is replayed
+	_, err = svc.RefreshToken(ctx, token.RefreshToken, nil)
+	s.ErrorIs(err, auth.ErrRefreshTokenReused)
+
+	// all tokens of the session are revoked
+	_, err = svc.RefreshToken(ctx, refreshed.RefreshToken, nil)
+	s.ErrorIs(err, auth.ErrRevokedToken)
+	_, _, err = svc.ParseAndVerifyToken(ctx, refreshed.AccessToken)
+	s.ErrorIs(err, auth.ErrRevokedToken)
+
+	// other sessions are not affected
+	other, err := svc.CreateToken(ctx, uuid.New(), nil)
+	s.Require().NoError(err)
+	_, _, err = svc.ParseAndVerifyToken(ctx, other.AccessToken)
+	s.NoError(err)
+}
+
+func (s *AuthSuite) TestRefreshToken_InvalidUser() {
+	ctx := context.TODO()
+	now = time.Now
+	userID := uuid.New()
+	roles := fakeRoles{}
+	svc := New(newFakeRepo(), s.newKeySet("ed"), roles)
+
+	token, err := svc.CreateToken(ctx, userID, nil)
+	s.Require().NoError(err)
+	refreshed, err := svc.RefreshToken(ctx, token.RefreshToken, nil)
+	s.Require().NoError(err)
+
+	// the user is suspended, without revoking tokens
+	roles[userID] = nil
+	_, err = svc.RefreshToken(ctx, refreshed.RefreshToken, nil)
+	s.ErrorIs(err, auth.ErrInvalidRefreshToken)
+
+	// replaying a rotated refresh token still revokes the session
+	_, err = svc.RefreshToken(ctx, token.RefreshToken, nil)
+	s.ErrorIs(err, auth.ErrRefreshTokenReused)
+	_, _, err = svc.ParseAndVerifyToken(ctx, refreshed.AccessToken)
+	s.ErrorIs(err, auth.ErrRevokedToken)
+}
+
+func (s *AuthSuite) TestRefreshToken_Expired() {
+	ctx := context.TODO()
+	nowTime := time.Now()
+	now = func() time.Time { return nowTime }
+	svc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{})
+
+	token, err := svc.CreateToken(ctx, uuid.New(), nil)
+	s.Require().NoError(err)
+
+	nowTime = nowTime.Add(refreshTokenExpiryDuration)
+	_, err = svc.RefreshToken(ctx, token.RefreshToken, nil)
+	s.ErrorIs(err, auth.ErrInvalidRefreshToken)
+}
+
+func (s *AuthSuite) TestRevokeUserTokens() {
+	ctx := context.TODO()
+	nowTime := time.Now()
+	now = func() time.Time { return nowTime }
+	svc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{})
+
+	userID := uuid.New()
+	token1, err := svc.CreateToken(ctx, userID, nil)
+	s.Require().NoError(err)
+	token2, err := svc.CreateToken(ctx, userID, nil)
+	s.Require().NoError(err)
+	otherToken, err := svc.CreateToken(ctx, uuid.New(), nil)
+	s.Require().NoError(err)
+
+	nowTime = nowTime.Add(time.Second)
+	s.Require().NoError(svc.RevokeUserTokens(ctx, userID))
+
+	// all tokens of the user are revoked
+	for _, token := range []*auth.TokenPair{token1, token2} {
+		_, _, err = svc.ParseAndVerifyToken(ctx, token.AccessToken)
+		s.ErrorIs(err, auth.ErrRevokedToken)
+		_, err = svc.RefreshToken(ctx, token.RefreshToken, nil)
+		s.ErrorIs(err, auth.ErrRevokedToken)
+	}
+
+	// tokens of other users and new tokens are valid
+	_, _, err = svc.ParseAndVerifyToken(ctx, otherToken.AccessToken)
+	s.NoError(err)
+	newToken, err := svc.CreateToken(ctx, userID, nil)
+	s.Require().NoError(err)
+	_, _, err = svc.ParseAndVerifyToken(ctx, newToken.AccessToken)
+	s.NoError(err)
+}
+
+func (s *AuthSuite) TestRevokeUserTokens_SameSecond() {
+	ctx := context.TODO()
+	nowTime := time.Now().Truncate(time.Second)
+	now = func() time.Time { return nowTime }
+	svc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{})
+
+	// the token is issued and revoked within the same second
+	userID := uuid.New()
+	token, err := svc.CreateToken(ctx, userID, nil)
+	s.Require().NoError(err)
+	nowTime = nowTime.Add(time.Millisecond * 300)
+	s.Require().NoError(svc.RevokeUserTokens(ctx, userID))
+	nowTime = nowTime.Add(time.Millisecond * 300)
+
+	_, _, err = svc.ParseAndVerifyToken(ctx, token.AccessToken)
+	s.ErrorIs(err, auth.ErrRevokedToken)
+	_, err = svc.RefreshToken(ctx, token.RefreshToken, nil)
+	s.ErrorIs(err, auth.ErrRevokedToken)
+
+	// the token reissued right after revoking is issued at the watermark, and it is refreshed within the same second
+	newToken, err := svc.CreateToken(ctx, userID, nil)
+	s.Require().NoError(err)
+	claims, _, err := svc.ParseAndVerifyToken(ctx, newToken.AccessToken)
+	s.Require().NoError(err)
+	s.Equal(nowTime.Truncate(time.Second).Add(time.Second), claims.IssuedAt.Time)
+	refreshed, err := svc.RefreshToken(ctx, newToken.RefreshToken, nil)
+	s.Require().NoError(err)
+	_, _, err = svc.ParseAndVerifyToken(ctx, refreshed.AccessToken)
+	s.NoError(err)
+}
+
+func (s *AuthSuite) TestRevokeAllTokens() {
+	ctx := context.TODO()
+	nowTime := time.Now()
+	now = func() time.Time { return nowTime }
+	repo := newFakeRepo()
+	svc := New(repo, s.newKeySet("ed"), fakeRoles{})
+	otherSvc := New(repo, s.newKeySet("ed"), fakeRoles{})
+
+	validAfter, err := svc.GetGlobalTokensValidAfter(ctx)
+	s.Require().NoError(err)
+	s.True(validAfter.IsZero())
+	userToken, err := svc.CreateToken(ctx, uuid.New(), nil)
+	s.Require().NoError(err)
+	clientToken, err := svc.CreateClientToken(ctx, uuid.New().String(), []string{auth.ScopeUsersRead})
+	s.Require().NoError(err)
+	_, _, err = otherSvc.ParseAndVerifyToken(ctx, userToken.AccessToken)
+	s.Require().NoError(err)
+
+	// tokens issued earlier within the second of the cutoff are revoked as well
+	nowTime = nowTime.Truncate(time.Second).Add(time.Second)
+	sameSecondToken, err := svc.CreateToken(ctx, uuid.New(), nil)
+	s.Require().NoError(err)
+	nowTime = nowTime.Add(time.Millisecond * 500)
+	validAfter, err = svc.RevokeAllTokens(ctx)
+	s.Require().NoError(err)
+	s.Equal(nowTime.Truncate(time.Second).Add(time.Second), validAfter)
+	s.Equal(validAfter.Unix(), globalValidAfterMetric.Value())
+
+	// tokens of users and clients are revoked at once by all instances
+	revoked := globalRevokedMetric.Value()
+	for _, token := range []*auth.TokenPair{userToken, clientToken, sameSecondToken} {
+		_, _, err = svc.ParseAndVerifyToken(ctx, token.AccessToken)
+		s.ErrorIs(err, auth.ErrRevokedToken)
+		s.ErrorContains(err, validAfter.Format(time.RFC3339))
+		_, _, err = otherSvc.ParseAndVerifyToken(ctx, token.AccessToken)
+		s.ErrorIs(err, auth.ErrRevokedToken)
+	}
+	_, err = svc.RefreshToken(ctx, userToken.RefreshToken, nil)
+	s.ErrorIs(err, auth.ErrRevokedToken)
+	s.Equal(revoked+7, globalRevokedMetric.Value())
+
+	// new logins right after revoking are issued at the cutoff, and valid
+	newToken, err := svc.CreateToken(ctx, uuid.New(), nil)
+	s.Require().NoError(err)
+	_, _, err = otherSvc.ParseAndVerifyToken(ctx, newToken.AccessToken)
+	s.NoError(err)
+	otherValidAfter, err := otherSvc.GetGlobalTokensValidAfter(ctx)
+	s.Require().NoError(err)
+	s.Equal(validAfter, otherValidAfter)
+}
+
+func (s *AuthSuite) TestSessions() {
+	ctx := context.TODO()
+	nowTime := time.Now()
+	now = func() time.Time { return nowTime }
+	svc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{})
+
+	userID := uuid.New()
+	phone, err := svc.CreateToken(ctx, userID, &auth.SessionInfo{Platform: "ios", DeviceID: "phone", IP: "1.1.1.1"})
+	s.Require().NoError(err)
+	nowTime = nowTime.Add(time.Minute)
+	laptop, err := svc.CreateToken(ctx, userID, &auth.SessionInfo{Platform: "web", DeviceID: "laptop", IP: "2.2.2.2"})
+	s.Require().NoError(err)
+	_, err = svc.CreateToken(ctx, uuid.New(), nil)
+	s.Require().NoError(err)
+
+	// sessions are listed by last used time
+	sessions, err := svc.ListSessions(ctx, userID)
+	s.Require().NoError(err)
+	s.Require().Len(sessions, 2)
+	s.Equal("laptop", sessions[0].Info.DeviceID)
+	s.Equal("phone", sessions[1].Info.DeviceID)
+
+	// refreshing keeps the session, and updates the client address
+	createdAt := sessions[1].CreatedAt
+	nowTime = nowTime.Add(time.Minute)
+	phone, err = svc.RefreshToken(ctx, phone.RefreshToken, &auth.SessionInfo{IP: "3.3.3.3"})
+	s.Require().NoError(err)
+	claims, _, err := svc.ParseAndVerifyToken(ctx, phone.AccessToken)
+	s.Require().NoError(err)
+	sessions, err = svc.ListSessions(ctx, userID)
+	s.Require().NoError(err)
+	s.Require().Len(sessions, 2)
+	s.Equal(claims.SessionID, sessions[0].ID)
+	s.Equal(claims.ID, sessions[0].JWTID)
+	s.Equal("ios", sessions[0].Info.Platform)
+	s.Equal("3.3.3.3", sessions[0].Info.IP)
+	s.Equal(createdAt, sessions[0].CreatedAt)
+
+	// revoking a session removes it, and keeps the other sessions valid
+	s.Require().NoError(svc.RevokeSession(ctx, claims.SessionID))
+	_, _, err = svc.ParseAndVerifyToken(ctx, phone.AccessToken)
+	s.ErrorIs(err, auth.ErrRevokedToken)
+	_, _, err = svc.ParseAndVerifyToken(ctx, laptop.AccessToken)
+	s.NoError(err)
+	sessions, err = svc.ListSessions(ctx, userID)
+	s.Require().NoError(err)
+	s.Require().Len(sessions, 1)
+	s.Equal("laptop", sessions[0].Info.DeviceID)
+
+	// logging out everywhere removes all sessions
+	s.Require().NoError(svc.RevokeUserTokens(ctx, userID))
+	sessions, err = svc.ListSessions(ctx, userID)
+	s.Require().NoError(err)
+	s.Empty(sessions)
+}
+
+func (s *AuthSuite) TestRolesAndScopes() {
+	ctx := context.TODO()
+	now = time.Now
+	userID, supportID := uuid.New(), uuid.New()
+	roles := fakeRoles{supportID: {auth.RoleUser, auth.RoleSupport}}
+	svc := New(newFakeRepo(), s.newKeySet("ed"), roles)
+
+	token, err := svc.CreateToken(ctx, userID, nil)
+	s.Require().NoError(err)
+	claims, _, err := svc.ParseAndVerifyToken(ctx, token.AccessToken)
+	s.Require().NoError(err)
+	s.Equal([]string{auth.RoleUser}, claims.Roles)
+	s.Equal("account:read account:write", claims.Scope)
+	s.True(claims.HasScope(auth.ScopeAccountWrite))
+	s.False(claims.HasScope(auth.ScopeAdminRead))
+	s.False(claims.HasRole(auth.RoleAdmin, auth.RoleSupport))
+
+	token, err = svc.CreateToken(ctx, supportID, nil)
+	s.Require().NoError(err)
+	claims, _, err = svc.ParseAndVerifyToken(ctx, token.AccessToken)
+	s.Require().NoError(err)
+	s.True(claims.HasScope(auth.ScopeAdminRead))
+	s.False(claims.HasScope(auth.ScopeAdminWrite))
+	s.True(claims.HasRole(auth.RoleAdmin, auth.RoleSupport))
+
+	// role changes take effect by refreshing
+	roles[supportID] = []string{auth.RoleUser}
+	token, err = svc.RefreshToken(ctx, token.RefreshToken, nil)
+	s.Require().NoError(err)
+	claims, _, err = svc.ParseAndVerifyToken(ctx, token.AccessToken)
+	s.Require().NoError(err)
+	s.False(claims.HasScope(auth.ScopeAdminRead))
+	s.False(claims.HasRole(auth.RoleSupport))
+}
+
+func (s *AuthSuite) TestClientSessions() {
+	ctx := context.TODO()
+	now = time.Now
+	svc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{})
+	userID := uuid.New()
+
+	// scopes of client tokens are the consented scopes within the roles of the user
+	info := &auth.SessionInfo{Platform: "oauth", ClientID: "client-1", Scopes: []string{auth.ScopeAccountRead, auth.ScopeAdminRead}}
+	token, err := svc.CreateToken(ctx, userID, info)
+	s.Require().NoError(err)
+	s.Equal(auth.ScopeAccountRead, token.Scope)
+	claims, _, err := svc.ParseAndVerifyToken(ctx, token.AccessToken)
+	s.Require().NoError(err)
+	s.Equal("client-1", claims.ClientID)
+	s.Equal(auth.ScopeAccountRead, claims.Scope)
+	s.False(claims.IsAuthenticatedWithin(time.Now(), time.Hour))
+
+	// refresh tokens of clients are refreshed by the client only, and keep the scopes
+	_, err = svc.RefreshToken(ctx, token.RefreshToken, nil)
+	s.ErrorIs(err, auth.ErrInvalidRefreshToken)
+	token, err = svc.CreateToken(ctx, userID, info)
+	s.Require().NoError(err)
+	_, err = svc.RefreshToken(ctx, token.RefreshToken, &auth.SessionInfo{ClientID: "client-2"})
+	s.ErrorIs(err, auth.ErrInvalidRefreshToken)
+	token, err = svc.CreateToken(ctx, userID, info)
+	s.Require().NoError(err)
+	token, err = svc.RefreshToken(ctx, token.RefreshToken, &auth.SessionInfo{ClientID: "client-1"})
+	s.Require().NoError(err)
+	claims, _, err = svc.ParseAndVerifyToken(ctx, token.AccessToken)
+	s.Require().NoError(err)
+	s.Equal("client-1", claims.ClientID)
+	s.Equal(auth.ScopeAccountRead, claims.Scope)
+
+	// refresh tokens of users can't be used by clients
+	token, err = svc.CreateToken(ctx, userID, nil)
+	s.Require().NoError(err)
+	_, err = svc.RefreshToken(ctx, token.RefreshToken, &auth.SessionInfo{ClientID: "client-1"})
+	s.ErrorIs(err, auth.ErrInvalidRefreshToken)
+}
+
+func (s *AuthSuite) TestClientToken() {
+	ctx := context.TODO()
+	now = time.Now
+	svc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{})
+	clientID := uuid.New().String()
+
+	token, err := svc.CreateClientToken(ctx, clientID, []string{auth.ScopeUsersRead})
+	s.Require().NoError(err)
+	s.Empty(token.RefreshToken)
+	s.Equal(auth.ScopeUsersRead, token.Scope)
+	claims, _, err := svc.ParseAndVerifyToken(ctx, token.AccessToken)
+	s.Require().NoError(err)
+	s.True(claims.IsClientSubject())
+	s.Equal(clientID, claims.Subject)
+	s.Equal(clientID, claims.ClientID)
+	s.True(claims.HasScope(auth.ScopeUsersRead))
+	s.Empty(claims.Roles)
+	s.False(claims.IsAuthenticatedWithin(time.Now(), time.Hour))
+
+	// tokens of users aren't of clients, even if they are issued to clients
+	token, err = svc.CreateToken(ctx, uuid.New(), &auth.SessionInfo{ClientID: clientID, Scopes: []string{auth.ScopeAccountRead}})
+	s.Require().NoError(err)
+	claims, _, err = svc.ParseAndVerifyToken(ctx, token.AccessToken)
+	s.Require().NoError(err)
+	s.False(claims.IsClientSubject())
+
+	// unknown subject types are rejected
+	jwtString, err := svc.(*service).signToken(&auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   clientID,
+			IssuedAt:  jwt.NewNumericDate(now()),
+			ExpiresAt: jwt.NewNumericDate(now().Add(time.Minute)),
+			ID:        uuid.New().String(),
+		},
+		SubjectType: "device",
+	})
+	s.Require().NoError(err)
+	_, _, err = svc.ParseAndVerifyToken(ctx, jwtString)
+	s.ErrorIs(err, auth.ErrInvalidToken)
+}
+
+func (s *AuthSuite) TestExchangeToken() {
+	ctx := context.TODO()
+	now = time.Now
+	svc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{})
+	userID := uuid.New()
+
+	userToken, err := svc.CreateToken(ctx, userID, nil)
+	s.Require().NoError(err)
+	userClaims, _, err := svc.ParseAndVerifyToken(ctx, userToken.AccessToken, "orders")
+	s.Require().NoError(err, "tokens without audiences are accepted by all")
+
+	token, err := svc.ExchangeToken(ctx, userToken.AccessToken, "gateway", "orders", []string{auth.ScopeAccountRead})
+	s.Require().NoError(err)
+	s.Empty(token.RefreshToken)
+	s.Equal(auth.ScopeAccountRead, token.Scope)
+	s.WithinDuration(time.Now().Add(exchangedTokenExpiryDuration), token.AccessTokenExpiresAt, time.Second)
+
+	// exchanged tokens are accepted by the audience only
+	claims, _, err := svc.ParseAndVerifyToken(ctx, token.AccessToken, "orders")
+	s.Require().NoError(err)
+	s.Equal(userID.String(), claims.Subject)
+	s.Equal(jwt.ClaimStrings{"orders"}, claims.Audience)
+	s.Equal(&auth.Actor{Subject: "gateway", SubjectType: auth.SubjectTypeClient}, claims.Actor)
+	s.False(claims.IsImpersonation())
+	s.Equal(userClaims.SessionID, claims.SessionID)
+	s.True(claims.HasScope(auth.ScopeAccountRead))
+	s.False(claims.HasScope(auth.ScopeAccountWrite))
+	s.Empty(claims.Roles)
+	s.False(claims.IsAuthenticatedWithin(time.Now(), time.Hour))
+	_, _, err = svc.ParseAndVerifyToken(ctx, token.AccessToken)
+	s.ErrorIs(err, auth.ErrInvalidToken)
+	_, _, err = svc.ParseAndVerifyToken(ctx, token.AccessToken, "billing")
+	s.ErrorIs(err, auth.ErrInvalidToken)
+
+	// all scopes of the subject token by default, and never more
+	token, err = svc.ExchangeToken(ctx, userToken.AccessToken, "gateway", "orders", nil)
+	s.Require().NoError(err)
+	s.Equal(userClaims.Scope, token.Scope)
+	_, err = svc.ExchangeToken(ctx, userToken.AccessToken, "gateway", "orders", []string{auth.ScopeAdminRead})
+	s.ErrorIs(err, auth.ErrInvalidScope)
+
+	// exchanged tokens and tokens of clients can't be exchanged
+	_, err = svc.ExchangeToken(ctx, token.AccessToken, "gateway", "orders", nil)
+	s.ErrorIs(err, auth.ErrInvalidToken)
+	clientToken, err := svc.CreateClientToken(ctx, uuid.New().String(), []string{auth.ScopeUsersRead})
+	s.Require().NoError(err)
+	_, err = svc.ExchangeToken(ctx, clientToken.AccessToken, "gateway", "orders", nil)
+	s.ErrorIs(err, auth.ErrInvalidToken)
+
+	// exchanged tokens are revoked with the session of the subject token
+	s.Require().NoError(svc.RevokeSession(ctx, userClaims.SessionID))
+	_, _, err = svc.ParseAndVerifyToken(ctx, token.AccessToken, "orders")
+	s.ErrorIs(err, auth.ErrRevokedToken)
+	_, err = svc.ExchangeToken(ctx, userToken.AccessToken, "gateway", "orders", nil)
+	s.ErrorIs(err, auth.ErrRevokedToken)
+}
+
+func (s *AuthSuite) TestImpersonationToken() {
+	ctx := context.TODO()
+	nowTime := time.Now()
+	now = func() time.Time { return nowTime }
+	staffID, userID, supportID := uuid.New(), uuid.New(), uuid.New()
+	svc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{supportID: {auth.RoleUser, auth.RoleSupport}})
+
+	token, err := svc.CreateImpersonationToken(ctx, userID, staffID)
+	s.Require().NoError(err)
+	s.Empty(token.RefreshToken)
+	s.Equal(nowTime.Add(impersonationExpiryDuration).Unix(), token.AccessTokenExpiresAt.Unix())
+	claims, _, err := svc.ParseAndVerifyToken(ctx, token.AccessToken)
+	s.Require().NoError(err)
+	s.Equal(userID.String(), claims.Subject)
+	s.True(claims.IsImpersonation())
+	s.Equal(staffID.String(), claims.Actor.Subject)
+	s.Empty(claims.SessionID)
+	s.False(claims.IsAuthenticatedWithin(time.Now(), time.Hour))
+	s.True(claims.HasScope(auth.ScopeAccountWrite))
+
+	// scopes of staff aren't granted by impersonating staff
+	staffToken, err := svc.CreateImpersonationToken(ctx, supportID, staffID)
+	s.Require().NoError(err)
+	s.Equal(auth.ScopeAccountRead+" "+auth.ScopeAccountWrite, staffToken.Scope)
+
+	// impersonation tokens can't be exchanged
+	_, err = svc.ExchangeToken(ctx, token.AccessToken, "gateway", "orders", nil)
+	s.ErrorIs(err, auth.ErrInvalidToken)
+
+	// logging out the staff, or the user, everywhere revokes the token
+	nowTime = nowTime.Add(time.Second)
+	s.Require().NoError(svc.RevokeUserTokens(ctx, staffID))
+	_, _, err = svc.ParseAndVerifyToken(ctx, token.AccessToken)
+	s.ErrorIs(err, auth.ErrRevokedToken)
+	token, err = svc.CreateImpersonationToken(ctx, userID, staffID)
+	s.Require().NoError(err)
+	nowTime = nowTime.Add(time.Second)
+	s.Require().NoError(svc.RevokeUserTokens(ctx, userID))
+	_, _, err = svc.ParseAndVerifyToken(ctx, token.AccessToken)
+	s.ErrorIs(err, auth.ErrRevokedToken)
+}
+
+func (s *AuthSuite) TestMFAPendingToken() {
+	ctx := context.TODO()
+	nowTime := time.Now()
+	now = func() time.Time { return nowTime }
+	svc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{})
+
+	userID := uuid.New()
+	pendingToken, _, err := svc.CreateMFAPendingToken(ctx, userID, &auth.SessionInfo{Platform: "ios", DeviceID: "phone"})
+	s.Require().NoError(err)
+
+	// mfa_pending tokens aren't access tokens, and access tokens aren't mfa_pending tokens
+	_, _, err = svc.ParseAndVerifyToken(ctx, pendingToken)
+	s.ErrorIs(err, auth.ErrInvalidToken)
+	claims, err := svc.ParseMFAPendingToken(ctx, pendingToken)
+	s.Require().NoError(err)
+	s.Equal(userID.String(), claims.Subject)
+	s.Equal("phone", claims.MFAPending.DeviceID)
+	s.Empty(claims.Scope)
+
+	token, err := svc.CreateToken(ctx, userID, nil)
+	s.Require().NoError(err)
+	_, err = svc.ParseMFAPendingToken(ctx, token.AccessToken)
+	s.ErrorIs(err, auth.ErrInvalidToken)
+
+	// auth time is the login time, it is kept by refreshing
+	loginTime := nowTime
+	nowTime = nowTime.Add(time.Hour)
+	token, err = svc.RefreshToken(ctx, token.RefreshToken, nil)
+	s.Require().NoError(err)
+	claims, _, err = svc.ParseAndVerifyToken(ctx, token.AccessToken)
+	s.Require().NoError(err)
+	s.Equal(loginTime.Unix(), claims.AuthTime.Unix())
+}
+
+func (s *AuthSuite) TestIsAuthenticatedWithin() {
+	ctx := context.TODO()
+	svc := New(newFakeRepo(), s.newKeySet("ed"), fakeRoles{})
+	token, err := svc.CreateToken(ctx, uuid.New(), nil)
+	s.Require().NoError(err)
+	claims, _, err := svc.ParseAndVerifyToken(ctx, token.AccessToken)
+	s.Require().NoError(err)
+	authTime := claims.AuthTime.Time
+
+	s.True(claims.IsAuthenticatedWithin(authTime, time.Minute))
+	s.True(claims.IsAuthenticatedWithin(authTime.Add(time.Minute), time.Minute), "just inside")
+	s.False(claims.IsAuthenticatedWithin(authTime.Add(time.Minute+time.Nanosecond), time.Minute), "just outside")
+
+	// tokens of OAuth clients never are
+	claims.ClientID = "client-1"
+	s.False(claims.IsAuthenticatedWithin(authTime, time.Minute))
+}
@@ -0,0 +1,115 @@
+package client_svc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/client"
+)
+
+const clientSecretLength = 32
+
+type service struct {
+	repo client.Repository
+}
+
+func New(repo client.Repository) (client.Service, error) {
+	if repo == nil {
+		return nil, errors.New("repo is nil")
+	}
+	return &service{repo: repo}, nil
+}
+
+func (s *service) Create(ctx context.Context, registration *client.Registration) (*client.Client, string, error) {
+	for _, redirectURI := range registration.RedirectURIs {
+		if !isValidRedirectURI(redirectURI) {
+			return nil, "", fmt.Errorf("%w: %s", client.ErrInvalidRedirectURI, redirectURI)
+		}
+	}
+
+	client1 := &client.Client{
+		ID:           uuid.New().String(),
+		Name:         registration.Name,
+		Scopes:       registration.Scopes,
+		RedirectURIs: registration.RedirectURIs,
+		IsPublic:     registration.IsPublic,
+		IsFirstParty: registration.IsFirstParty,
+	}
+	if client1.Scopes == nil {
+		client1.Scopes = []string{}
+	}
+	if client1.RedirectURIs == nil {
+		client1.RedirectURIs = []string{}
+	}
+
+	secret := ""
+	if !client1.IsPublic {
+		b := make([]byte, clientSecretLength)
+		if _, err := rand.Read(b); err != nil {
+			return nil, "", fmt.Errorf("rand.Read error: %w", err)
+		}
+		secret = base64.RawURLEncoding.EncodeToString(b)
+		client1.SecretHash = hashSecret(secret)
+	}
+	if err := s.repo.Create(ctx, client1); err != nil {
+		return nil, "", fmt.Errorf("repo.Create error: %w", err)
+	}
+	return client1, secret, nil
+}
+
+// Authenticate verifies the client credentials, it returns client.ErrInvalidCredentials for unknown clients or wrong secrets.
+func (s *service) Authenticate(ctx context.Context, clientID string, secret string) (*client.Client, error) {
+	client1, err := s.repo.Get(ctx, clientID)
+	if errors.Is(err, client.ErrNotFound) {
+		// compare anyway, unknown clients take the same time as wrong secrets
+		subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(hashSecret("")))
+		return nil, client.ErrInvalidCredentials
+	} else if err != nil {
+		return nil, fmt.Errorf("repo.Get error: %w", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(client1.SecretHash)) != 1 || client1.IsPublic {
+		return nil, client.ErrInvalidCredentials
+	}
+	return client1, nil
+}
+
+func (s *service) Get(ctx context.Context, clientID string) (*client.Client, error) {
+	return s.repo.Get(ctx, clientID)
+}
+
+func (s *service) List(ctx context.Context) ([]*client.Client, error) {
+	return s.repo.List(ctx)
+}
+
+func (s *service) Delete(ctx context.Context, clientID string) error {
+	return s.repo.Delete(ctx, clientID)
+}
+
+// hashSecret hashes client secrets before storing, secrets are random so that a fast hash is enough.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// isValidRedirectURI checks the redirect URI is absolute without fragment (RFC 6749 3.1.2), custom schemes of native apps are allowed.
+func isValidRedirectURI(redirectURI string) bool {
+	u, err := url.Parse(redirectURI)
+	if err != nil || !u.IsAbs() || u.Fragment != "" || u.Opaque != "" {
+		return false
+	}
+	// web apps must be https, except local development
+	if u.Scheme == "http" {
+		return u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1" || u.Hostname() == "::1"
+	}
+	return u.Host != "" || u.Scheme != "https"
+}
@@ -0,0 +1,92 @@
+package client_svc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/andy74139/webserver/src/domain/entity/client"
+)
+
+type ClientSuite struct {
+	suite.Suite
+}
+
+func TestClientSuite(t *testing.T) {
+	suite.Run(t, new(ClientSuite))
+}
+
+// fakeRepo is an in-memory client.Repository.
+type fakeRepo map[string]*client.Client
+
+func (r fakeRepo) Create(ctx context.Context, client1 *client.Client) error {
+	r[client1.ID] = client1
+	return nil
+}
+
+func (r fakeRepo) Get(ctx context.Context, clientID string) (*client.Client, error) {
+	client1, ok := r[clientID]
+	if !ok {
+		return nil, client.ErrNotFound
+	}
+	return client1, nil
+}
+
+func (r fakeRepo) List(ctx context.Context) ([]*client.Client, error) {
+	clients := []*client.Client{}
+	for _, client1 := range r {
+		clients = append(clients, client1)
+	}
+	return clients, nil
+}
+
+func (r fakeRepo) Delete(ctx context.Context, clientID string) error {
+	delete(r, clientID)
+	return nil
+}
+
+func (s *ClientSuite) TestAuthenticate() {
+	ctx := context.TODO()
+	repo := fakeRepo{}
+	svc, err := New(repo)
+	s.Require().NoError(err)
+
+	created, secret, err := svc.Create(ctx, &client.Registration{Name: "billing", Scopes: []string{"token:introspect"}})
+	s.Require().NoError(err)
+	s.NotEmpty(secret)
+	s.NotContains(repo[created.ID].SecretHash, secret, "secret is stored hashed")
+
+	client1, err := svc.Authenticate(ctx, created.ID, secret)
+	s.Require().NoError(err)
+	s.Equal("billing", client1.Name)
+	s.True(client1.HasScope("token:introspect"))
+
+	_, err = svc.Authenticate(ctx, created.ID, secret+"x")
+	s.ErrorIs(err, client.ErrInvalidCredentials)
+	_, err = svc.Authenticate(ctx, "unknown", secret)
+	s.ErrorIs(err, client.ErrInvalidCredentials)
+}
+
+func (s *ClientSuite) TestCreatePublicClient() {
+	ctx := context.TODO()
+	repo := fakeRepo{}
+	svc, err := New(repo)
+	s.Require().NoError(err)
+
+	for _, redirectURI := range []string{"/callback", "https://app.example.com/callback#fragment", "http://app.example.com/callback", "https:///callback"} {
+		_, _, err := svc.Create(ctx, &client.Registration{Name: "web", IsPublic: true, RedirectURIs: []string{redirectURI}})
+		s.ErrorIs(err, client.ErrInvalidRedirectURI, redirectURI)
+	}
+
+	redirectURIs := []string{"https://app.example.com/callback", "http://localhost:3000/callback", "com.example.app:/callback"}
+	created, secret, err := svc.Create(ctx, &client.Registration{Name: "web", IsPublic: true, RedirectURIs: redirectURIs})
+	s.Require().NoError(err)
+	s.Empty(secret)
+	s.True(created.HasRedirectURI("https://app.example.com/callback"))
+	s.False(created.HasRedirectURI("https://app.example.com/callback/"))
+
+	// public clients have no secret to authenticate
+	_, err = svc.Authenticate(ctx, created.ID, "")
+	s.ErrorIs(err, client.ErrInvalidCredentials)
+}
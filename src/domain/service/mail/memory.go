@@ -0,0 +1,44 @@
+package mail_svc
+
+import (
+	"context"
+	"sync"
+
+	"github.com/andy74139/webserver/src/domain/entity/mail"
+)
+
+// MemorySender keeps emails in memory instead of sending them, for tests and local development.
+type MemorySender struct {
+	mu       sync.Mutex
+	messages []*mail.Message
+}
+
+func NewMemorySender() *MemorySender {
+	return &MemorySender{}
+}
+
+func (s *MemorySender) Send(ctx context.Context, message *mail.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+// Messages returns sent emails, in sent order.
+func (s *MemorySender) Messages() []*mail.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*mail.Message{}, s.messages...)
+}
+
+// Last returns the last email sent to the address, or nil if none.
+func (s *MemorySender) Last(to string) *mail.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if s.messages[i].To == to {
+			return s.messages[i]
+		}
+	}
+	return nil
+}
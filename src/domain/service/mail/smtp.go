@@ -0,0 +1,95 @@
+package mail_svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/andy74139/webserver/src/domain/entity/mail"
+)
+
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	// From is the sender address, e.g. "WebServer <no-reply@my.domain.com>"
+	From string
+}
+
+// smtpSender sends emails by an SMTP server, it authenticates by PLAIN auth if the username is set.
+type smtpSender struct {
+	config SMTPConfig
+	from   string
+}
+
+func NewSMTPSender(config SMTPConfig) (mail.Sender, error) {
+	if config.Host == "" || config.Port == "" {
+		return nil, errors.New("smtp host or port is empty")
+	}
+	from, err := netmailAddress(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address %q: %w", config.From, err)
+	}
+	return &smtpSender{config: config, from: from}, nil
+}
+
+func (s *smtpSender) Send(ctx context.Context, message *mail.Message) error {
+	to, err := netmailAddress(message.To)
+	if err != nil {
+		return fmt.Errorf("invalid to address: %w", err)
+	}
+
+	var auth smtp.Auth
+	if s.config.Username != "" {
+		auth = smtp.PlainAuth("", s.config.Username, s.config.Password, s.config.Host)
+	}
+	addr := net.JoinHostPort(s.config.Host, s.config.Port)
+
+	// smtp.SendMail doesn't take a context, it is sent in background and the caller stops waiting if ctx is done
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(addr, auth, s.from, []string{to}, s.buildMessage(message))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("smtp.SendMail error: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("smtp.SendMail error: %w", ctx.Err())
+	}
+}
+
+func (s *smtpSender) buildMessage(message *mail.Message) []byte {
+	builder := &strings.Builder{}
+	builder.WriteString("From: " + s.config.From + "\r\n")
+	builder.WriteString("To: " + message.To + "\r\n")
+	builder.WriteString("Subject: " + headerEscape(message.Subject) + "\r\n")
+	builder.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	builder.WriteString("MIME-Version: 1.0\r\n")
+	builder.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	builder.WriteString("\r\n")
+	builder.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+	return []byte(builder.String())
+}
+
+// headerEscape removes line breaks, so header values can't inject headers.
+func headerEscape(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+// netmailAddress returns the bare address, e.g. "no-reply@my.domain.com" of "WebServer <no-reply@my.domain.com>".
+func netmailAddress(address string) (string, error) {
+	parsed, err := netmail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+	return parsed.Address, nil
+}
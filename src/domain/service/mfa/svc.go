@@ -0,0 +1,243 @@
+package mfa_svc
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/mfa"
+)
+
+const (
+	recoveryCodeCount = 10
+	// recoveryCodeLength is the number of base32 characters, 50 bits of randomness
+	recoveryCodeLength = 10
+)
+
+// now is replaced in tests
+var now = time.Now
+
+type service struct {
+	repo   mfa.Repository
+	issuer string
+	aead   cipher.AEAD
+}
+
+// New creates the mfa service, TOTP secrets are encrypted by a key derived from secretKey.
+func New(repo mfa.Repository, issuer string, secretKey []byte) (mfa.Service, error) {
+	if repo == nil {
+		return nil, errors.New("repo is nil")
+	} else if len(secretKey) < 32 {
+		return nil, errors.New("secret key is shorter than 32 bytes")
+	}
+	key := sha256.Sum256(secretKey)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("aes.NewCipher error: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cipher.NewGCM error: %w", err)
+	}
+	return &service{repo: repo, issuer: issuer, aead: aead}, nil
+}
+
+func (s *service) Enroll(ctx context.Context, userID uuid.UUID, accountName string) (*mfa.Enrollment, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("rand.Read error: %w", err)
+	}
+	ciphertext, err := s.encrypt(userID, secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.SetPending(ctx, userID, ciphertext); errors.Is(err, mfa.ErrAlreadyEnabled) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("repo.SetPending error: %w", err)
+	}
+
+	return &mfa.Enrollment{
+		Secret: base32NoPadding.EncodeToString(secret),
+		URI:    totpURI(s.issuer, accountName, secret),
+	}, nil
+}
+
+func (s *service) Confirm(ctx context.Context, userID uuid.UUID, code string) ([]string, error) {
+	totp, err := s.getTOTP(ctx, userID)
+	if err != nil {
+		return nil, err
+	} else if totp.IsEnabled() {
+		return nil, mfa.ErrAlreadyEnabled
+	}
+
+	secret, err := s.decrypt(userID, totp.SecretCiphertext)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := matchTOTPStep(secret, normalizeCode(code), now())
+	if !ok {
+		return nil, mfa.ErrInvalidCode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.Confirm(ctx, userID, step, hashes); errors.Is(err, mfa.ErrNotFound) {
+		// enrolled again, or confirmed concurrently
+		return nil, mfa.ErrInvalidCode
+	} else if err != nil {
+		return nil, fmt.Errorf("repo.Confirm error: %w", err)
+	}
+	return codes, nil
+}
+
+func (s *service) GetStatus(ctx context.Context, userID uuid.UUID) (*mfa.Status, error) {
+	totp, err := s.repo.Get(ctx, userID)
+	if errors.Is(err, mfa.ErrNotFound) {
+		return &mfa.Status{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("repo.Get error: %w", err)
+	}
+	return &mfa.Status{
+		Enabled:           totp.IsEnabled(),
+		RecoveryCodesLeft: len(totp.RecoveryCodeHashes),
+	}, nil
+}
+
+func (s *service) Verify(ctx context.Context, userID uuid.UUID, code string) error {
+	totp, err := s.getTOTP(ctx, userID)
+	if errors.Is(err, mfa.ErrNotFound) {
+		return mfa.ErrNotEnabled
+	} else if err != nil {
+		return err
+	} else if !totp.IsEnabled() {
+		return mfa.ErrNotEnabled
+	}
+
+	code = normalizeCode(code)
+	if len(code) == totpDigits {
+		secret, err := s.decrypt(userID, totp.SecretCiphertext)
+		if err != nil {
+			return err
+		}
+		step, ok := matchTOTPStep(secret, code, now())
+		if !ok {
+			return mfa.ErrInvalidCode
+		}
+		// a code can't be replayed, neither codes of earlier steps
+		if ok, err := s.repo.UseStep(ctx, userID, step); err != nil {
+			return fmt.Errorf("repo.UseStep error: %w", err)
+		} else if !ok {
+			return mfa.ErrInvalidCode
+		}
+		return nil
+	}
+
+	if ok, err := s.repo.UseRecoveryCode(ctx, userID, hashRecoveryCode(code)); err != nil {
+		return fmt.Errorf("repo.UseRecoveryCode error: %w", err)
+	} else if !ok {
+		return mfa.ErrInvalidCode
+	}
+	return nil
+}
+
+func (s *service) Disable(ctx context.Context, userID uuid.UUID) error {
+	if err := s.repo.Delete(ctx, userID); err != nil {
+		return fmt.Errorf("repo.Delete error: %w", err)
+	}
+	return nil
+}
+
+func (s *service) RegenerateRecoveryCodes(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	totp, err := s.getTOTP(ctx, userID)
+	if errors.Is(err, mfa.ErrNotFound) {
+		return nil, mfa.ErrNotEnabled
+	} else if err != nil {
+		return nil, err
+	} else if !totp.IsEnabled() {
+		return nil, mfa.ErrNotEnabled
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.SetRecoveryCodes(ctx, userID, hashes); err != nil {
+		return nil, fmt.Errorf("repo.SetRecoveryCodes error: %w", err)
+	}
+	return codes, nil
+}
+
+func (s *service) getTOTP(ctx context.Context, userID uuid.UUID) (*mfa.TOTP, error) {
+	totp, err := s.repo.Get(ctx, userID)
+	if errors.Is(err, mfa.ErrNotFound) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("repo.Get error: %w", err)
+	}
+	return totp, nil
+}
+
+// encrypt encrypts the secret by AES-GCM, the user ID is authenticated, so a ciphertext can't be moved to another user.
+func (s *service) encrypt(userID uuid.UUID, secret []byte) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("rand.Read error: %w", err)
+	}
+	sealed := s.aead.Seal(nonce, nonce, secret, userID[:])
+	return base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *service) decrypt(userID uuid.UUID, ciphertext string) ([]byte, error) {
+	sealed, err := base64.RawStdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("decode secret error: %w", err)
+	} else if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("decode secret error: too short")
+	}
+	nonceSize := s.aead.NonceSize()
+	secret, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], userID[:])
+	if err != nil {
+		return nil, fmt.Errorf("aead.Open error: %w", err)
+	}
+	return secret, nil
+}
+
+// generateRecoveryCodes returns codes shown to the user, e.g. abcde-fghij, and their hashes.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, recoveryCodeLength*5/8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, fmt.Errorf("rand.Read error: %w", err)
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(b))
+		codes = append(codes, code[:recoveryCodeLength/2]+"-"+code[recoveryCodeLength/2:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a normalized recovery code, recovery codes are random enough for plain hashes.
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeCode removes separators and spaces that users may type.
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
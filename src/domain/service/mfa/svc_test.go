@@ -0,0 +1,158 @@
+package mfa_svc
+
+import (
+	"context"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/andy74139/webserver/src/domain/entity/mfa"
+)
+
+type MFASuite struct {
+	suite.Suite
+}
+
+func TestMFASuite(t *testing.T) {
+	suite.Run(t, new(MFASuite))
+}
+
+// fakeRepo is an in-memory mfa.Repository.
+type fakeRepo map[uuid.UUID]*mfa.TOTP
+
+func (r fakeRepo) SetPending(ctx context.Context, userID uuid.UUID, secretCiphertext string) error {
+	if totp, ok := r[userID]; ok && totp.IsEnabled() {
+		return mfa.ErrAlreadyEnabled
+	}
+	r[userID] = &mfa.TOTP{UserID: userID, SecretCiphertext: secretCiphertext}
+	return nil
+}
+
+func (r fakeRepo) Get(ctx context.Context, userID uuid.UUID) (*mfa.TOTP, error) {
+	totp, ok := r[userID]
+	if !ok {
+		return nil, mfa.ErrNotFound
+	}
+	totp1 := *totp
+	totp1.RecoveryCodeHashes = slices.Clone(totp.RecoveryCodeHashes)
+	return &totp1, nil
+}
+
+func (r fakeRepo) Confirm(ctx context.Context, userID uuid.UUID, step int64, recoveryCodeHashes []string) error {
+	totp, ok := r[userID]
+	if !ok || totp.IsEnabled() {
+		return mfa.ErrNotFound
+	}
+	totp.ConfirmedAt = time.Now()
+	totp.LastUsedStep = step
+	totp.RecoveryCodeHashes = recoveryCodeHashes
+	return nil
+}
+
+func (r fakeRepo) UseStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	totp, ok := r[userID]
+	if !ok || totp.LastUsedStep >= step {
+		return false, nil
+	}
+	totp.LastUsedStep = step
+	return true, nil
+}
+
+func (r fakeRepo) UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash string) (bool, error) {
+	totp, ok := r[userID]
+	if !ok || !slices.Contains(totp.RecoveryCodeHashes, codeHash) {
+		return false, nil
+	}
+	totp.RecoveryCodeHashes = slices.DeleteFunc(totp.RecoveryCodeHashes, func(hash string) bool { return hash == codeHash })
+	return true, nil
+}
+
+func (r fakeRepo) SetRecoveryCodes(ctx context.Context, userID uuid.UUID, recoveryCodeHashes []string) error {
+	totp, ok := r[userID]
+	if !ok {
+		return mfa.ErrNotFound
+	}
+	totp.RecoveryCodeHashes = recoveryCodeHashes
+	return nil
+}
+
+func (r fakeRepo) Delete(ctx context.Context, userID uuid.UUID) error {
+	delete(r, userID)
+	return nil
+}
+
+func (s *MFASuite) TestTOTPCode() {
+	// test vectors of RFC 6238, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	s.Equal("287082", totpCode(secret, totpStep(time.Unix(59, 0))))
+	s.Equal("081804", totpCode(secret, totpStep(time.Unix(1111111109, 0))))
+	s.Equal("005924", totpCode(secret, totpStep(time.Unix(1234567890, 0))))
+
+	uri, err := url.Parse(totpURI("Web Server", "capoo@example.com", secret))
+	s.Require().NoError(err)
+	s.Equal("otpauth", uri.Scheme)
+	s.Equal("totp", uri.Host)
+	s.Equal("/Web Server:capoo@example.com", uri.Path)
+	s.Equal("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", uri.Query().Get("secret"))
+	s.Equal("Web Server", uri.Query().Get("issuer"))
+}
+
+func (s *MFASuite) TestEnrollAndVerify() {
+	defer func() { now = time.Now }()
+	ctx := context.TODO()
+	repo := fakeRepo{}
+	svc, err := New(repo, "WebServer", []byte(strings.Repeat("k", 32)))
+	s.Require().NoError(err)
+	userID := uuid.New()
+	nowTime := time.Now()
+	now = func() time.Time { return nowTime }
+
+	status, err := svc.GetStatus(ctx, userID)
+	s.Require().NoError(err)
+	s.False(status.Enabled)
+	s.ErrorIs(svc.Verify(ctx, userID, "123456"), mfa.ErrNotEnabled)
+
+	enrollment, err := svc.Enroll(ctx, userID, "capoo@example.com")
+	s.Require().NoError(err)
+	s.NotContains(repo[userID].SecretCiphertext, enrollment.Secret)
+	secret, err := base32NoPadding.DecodeString(enrollment.Secret)
+	s.Require().NoError(err)
+
+	// unconfirmed TOTP isn't enabled
+	s.ErrorIs(svc.Verify(ctx, userID, totpCode(secret, totpStep(nowTime))), mfa.ErrNotEnabled)
+	_, err = svc.Confirm(ctx, userID, "000000x")
+	s.ErrorIs(err, mfa.ErrInvalidCode)
+	recoveryCodes, err := svc.Confirm(ctx, userID, totpCode(secret, totpStep(nowTime)))
+	s.Require().NoError(err)
+	s.Len(recoveryCodes, recoveryCodeCount)
+	_, err = svc.Enroll(ctx, userID, "capoo@example.com")
+	s.ErrorIs(err, mfa.ErrAlreadyEnabled)
+
+	// the confirmed code and earlier codes can't be replayed
+	s.ErrorIs(svc.Verify(ctx, userID, totpCode(secret, totpStep(nowTime))), mfa.ErrInvalidCode)
+	nowTime = nowTime.Add(totpPeriod * time.Second)
+	s.ErrorIs(svc.Verify(ctx, userID, totpCode(secret, totpStep(nowTime)-totpSkew-1)), mfa.ErrInvalidCode)
+	s.NoError(svc.Verify(ctx, userID, totpCode(secret, totpStep(nowTime))))
+
+	// recovery codes are used once, and are case and separator insensitive
+	s.NoError(svc.Verify(ctx, userID, strings.ToUpper(recoveryCodes[0])))
+	s.ErrorIs(svc.Verify(ctx, userID, recoveryCodes[0]), mfa.ErrInvalidCode)
+	s.NoError(svc.Verify(ctx, userID, strings.ReplaceAll(recoveryCodes[1], "-", "")))
+	status, err = svc.GetStatus(ctx, userID)
+	s.Require().NoError(err)
+	s.True(status.Enabled)
+	s.Equal(recoveryCodeCount-2, status.RecoveryCodesLeft)
+
+	newCodes, err := svc.RegenerateRecoveryCodes(ctx, userID)
+	s.Require().NoError(err)
+	s.ErrorIs(svc.Verify(ctx, userID, recoveryCodes[2]), mfa.ErrInvalidCode)
+	s.NoError(svc.Verify(ctx, userID, newCodes[0]))
+
+	s.Require().NoError(svc.Disable(ctx, userID))
+	s.ErrorIs(svc.Verify(ctx, userID, newCodes[1]), mfa.ErrNotEnabled)
+}
@@ -0,0 +1,124 @@
+package oauth_svc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/oauth"
+)
+
+const (
+	// codeExpiryDuration is short, codes are exchanged by clients right after redirection (RFC 6749 4.1.2)
+	codeExpiryDuration = time.Minute
+	codeLength         = 32
+)
+
+var (
+	// codeChallengePattern is a base64url SHA-256 hash without padding
+	codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+	// codeVerifierPattern is the code verifier of RFC 7636 4.1
+	codeVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+)
+
+type service struct {
+	repo oauth.Repository
+}
+
+func New(repo oauth.Repository) (oauth.Service, error) {
+	if repo == nil {
+		return nil, errors.New("repo is nil")
+	}
+	return &service{repo: repo}, nil
+}
+
+func (s *service) CreateCode(ctx context.Context, request *oauth.AuthorizationRequest) (string, error) {
+	if !codeChallengePattern.MatchString(request.CodeChallenge) {
+		return "", oauth.ErrInvalidCodeChallenge
+	}
+
+	b := make([]byte, codeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("rand.Read error: %w", err)
+	}
+	code := base64.RawURLEncoding.EncodeToString(b)
+	if err := s.repo.SetCode(ctx, hashCode(code), request, codeExpiryDuration); err != nil {
+		return "", fmt.Errorf("repo.SetCode error: %w", err)
+	}
+	return code, nil
+}
+
+func (s *service) ExchangeCode(ctx context.Context, code string, clientID string, redirectURI string, codeVerifier string) (*oauth.AuthorizationRequest, error) {
+	if code == "" {
+		return nil, oauth.ErrInvalidGrant
+	}
+	// the code is consumed even if the verification fails, a leaked code can't be guessed with many verifiers
+	request, err := s.repo.UseCode(ctx, hashCode(code))
+	if errors.Is(err, oauth.ErrNotFound) {
+		return nil, oauth.ErrInvalidGrant
+	} else if err != nil {
+		return nil, fmt.Errorf("repo.UseCode error: %w", err)
+	}
+
+	if request.ClientID != clientID || request.RedirectURI != redirectURI {
+		return nil, oauth.ErrInvalidGrant
+	}
+	if !codeVerifierPattern.MatchString(codeVerifier) {
+		return nil, oauth.ErrInvalidGrant
+	}
+	sum := sha256.Sum256([]byte(codeVerifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(challenge), []byte(request.CodeChallenge)) != 1 {
+		return nil, oauth.ErrInvalidGrant
+	}
+	return request, nil
+}
+
+func (s *service) HasConsent(ctx context.Context, userID uuid.UUID, clientID string, scopes []string) (bool, error) {
+	consent, err := s.repo.GetConsent(ctx, userID, clientID)
+	if errors.Is(err, oauth.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("repo.GetConsent error: %w", err)
+	}
+	return consent.HasScopes(scopes), nil
+}
+
+func (s *service) GrantConsent(ctx context.Context, userID uuid.UUID, clientID string, scopes []string) error {
+	if err := s.repo.AddConsentScopes(ctx, userID, clientID, scopes); err != nil {
+		return fmt.Errorf("repo.AddConsentScopes error: %w", err)
+	}
+	return nil
+}
+
+func (s *service) ListConsents(ctx context.Context, userID uuid.UUID) ([]*oauth.Consent, error) {
+	consents, err := s.repo.ListConsents(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("repo.ListConsents error: %w", err)
+	}
+	return consents, nil
+}
+
+func (s *service) RevokeConsent(ctx context.Context, userID uuid.UUID, clientID string) error {
+	if err := s.repo.DeleteConsent(ctx, userID, clientID); errors.Is(err, oauth.ErrNotFound) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("repo.DeleteConsent error: %w", err)
+	}
+	return nil
+}
+
+// hashCode hides codes in repository keys.
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
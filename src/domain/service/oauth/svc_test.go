@@ -0,0 +1,228 @@
+package oauth_svc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/andy74139/webserver/src/domain/entity/oauth"
+)
+
+type OAuthSuite struct {
+	suite.Suite
+}
+
+func TestOAuthSuite(t *testing.T) {
+	suite.Run(t, new(OAuthSuite))
+}
+
+type consentKey struct {
+	userID   uuid.UUID
+	clientID string
+}
+
+// fakeRepo is an in-memory oauth.Repository.
+type fakeRepo struct {
+	codes    map[string]*oauth.AuthorizationRequest
+	consents map[consentKey]*oauth.Consent
+}
+
+func newFakeRepo() *fakeRepo {
+	return &fakeRepo{codes: map[string]*oauth.AuthorizationRequest{}, consents: map[consentKey]*oauth.Consent{}}
+}
+
+func (r *fakeRepo) SetCode(ctx context.Context, codeHash string, request *oauth.AuthorizationRequest, expiryDuration time.Duration) error {
+	request1 := *request
+	r.codes[codeHash] = &request1
+	return nil
+}
+
+func (r *fakeRepo) UseCode(ctx context.Context, codeHash string) (*oauth.AuthorizationRequest, error) {
+	request, ok := r.codes[codeHash]
+	if !ok {
+		return nil, oauth.ErrNotFound
+	}
+	delete(r.codes, codeHash)
+	return request, nil
+}
+
+func (r *fakeRepo) AddConsentScopes(ctx context.Context, userID uuid.UUID, clientID string, scopes []string) error {
+	key := consentKey{userID: userID, clientID: clientID}
+	consent, ok := r.consents[key]
+	if !ok {
+		consent = &oauth.Consent{UserID: userID, ClientID: clientID, CreatedAt: time.Now()}
+		r.consents[key] = consent
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(consent.Scopes, scope) {
+			consent.Scopes = append(consent.Scopes, scope)
+		}
+	}
+	return nil
+}
+
+func (r *fakeRepo) GetConsent(ctx context.Context, userID uuid.UUID, clientID string) (*oauth.Consent, error) {
+	consent, ok := r.consents[consentKey{userID: userID, clientID: clientID}]
+	if !ok {
+		return nil, oauth.ErrNotFound
+	}
+	consent1 := *consent
+	return &consent1, nil
+}
+
+func (r *fakeRepo) ListConsents(ctx context.Context, userID uuid.UUID) ([]*oauth.Consent, error) {
+	var consents []*oauth.Consent
+	for key, consent := range r.consents {
+		if key.userID == userID {
+			consent1 := *consent
+			consents = append(consents, &consent1)
+		}
+	}
+	return consents, nil
+}
+
+func (r *fakeRepo) DeleteConsent(ctx context.Context, userID uuid.UUID, clientID string) error {
+	key := consentKey{userID: userID, clientID: clientID}
+	if _, ok := r.consents[key]; !ok {
+		return oauth.ErrNotFound
+	}
+	delete(r.consents, key)
+	return nil
+}
+
+// testClient is the client side of the authorization code flow, it keeps the PKCE verifier of its request.
+type testClient struct {
+	id          string
+	redirectURI string
+	verifier    string
+}
+
+func newTestClient() *testClient {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return &testClient{
+		id:          "client-1",
+		redirectURI: "https://app.example.com/callback",
+		verifier:    base64.RawURLEncoding.EncodeToString(b),
+	}
+}
+
+func (c *testClient) challenge() string {
+	sum := sha256.Sum256([]byte(c.verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authorize is the approval of the user, it returns the code redirected to the client.
+func (c *testClient) authorize(s *OAuthSuite, svc oauth.Service, userID uuid.UUID, scopes []string) string {
+	code, err := svc.CreateCode(context.Background(), &oauth.AuthorizationRequest{
+		UserID:        userID,
+		ClientID:      c.id,
+		RedirectURI:   c.redirectURI,
+		Scopes:        scopes,
+		CodeChallenge: c.challenge(),
+	})
+	s.Require().NoError(err)
+	s.NotEmpty(code)
+	return code
+}
+
+func (s *OAuthSuite) TestAuthorizationCode() {
+	ctx := context.Background()
+	svc, err := New(newFakeRepo())
+	s.Require().NoError(err)
+	userID := uuid.New()
+
+	// the code is exchanged once
+	client := newTestClient()
+	code := client.authorize(s, svc, userID, []string{"account:read"})
+	request, err := svc.ExchangeCode(ctx, code, client.id, client.redirectURI, client.verifier)
+	s.Require().NoError(err)
+	s.Equal(userID, request.UserID)
+	s.Equal(client.id, request.ClientID)
+	s.Equal([]string{"account:read"}, request.Scopes)
+	_, err = svc.ExchangeCode(ctx, code, client.id, client.redirectURI, client.verifier)
+	s.ErrorIs(err, oauth.ErrInvalidGrant)
+
+	// a wrong verifier consumes the code, it can't be retried
+	code = client.authorize(s, svc, userID, []string{"account:read"})
+	other := newTestClient()
+	_, err = svc.ExchangeCode(ctx, code, client.id, client.redirectURI, other.verifier)
+	s.ErrorIs(err, oauth.ErrInvalidGrant)
+	_, err = svc.ExchangeCode(ctx, code, client.id, client.redirectURI, client.verifier)
+	s.ErrorIs(err, oauth.ErrInvalidGrant)
+
+	// codes are bound to the client and the redirect URI
+	code = client.authorize(s, svc, userID, nil)
+	_, err = svc.ExchangeCode(ctx, code, "client-2", client.redirectURI, client.verifier)
+	s.ErrorIs(err, oauth.ErrInvalidGrant)
+	code = client.authorize(s, svc, userID, nil)
+	_, err = svc.ExchangeCode(ctx, code, client.id, "https://app.example.com/other", client.verifier)
+	s.ErrorIs(err, oauth.ErrInvalidGrant)
+
+	// invalid verifiers and codes
+	code = client.authorize(s, svc, userID, nil)
+	_, err = svc.ExchangeCode(ctx, code, client.id, client.redirectURI, "short")
+	s.ErrorIs(err, oauth.ErrInvalidGrant)
+	_, err = svc.ExchangeCode(ctx, "", client.id, client.redirectURI, client.verifier)
+	s.ErrorIs(err, oauth.ErrInvalidGrant)
+	_, err = svc.ExchangeCode(ctx, "unknown", client.id, client.redirectURI, client.verifier)
+	s.ErrorIs(err, oauth.ErrInvalidGrant)
+
+	// only S256 challenges are accepted
+	for _, challenge := range []string{"", "plain-verifier", client.verifier + "="} {
+		_, err = svc.CreateCode(ctx, &oauth.AuthorizationRequest{
+			UserID:        userID,
+			ClientID:      client.id,
+			RedirectURI:   client.redirectURI,
+			CodeChallenge: challenge,
+		})
+		s.ErrorIs(err, oauth.ErrInvalidCodeChallenge, challenge)
+	}
+}
+
+func (s *OAuthSuite) TestConsent() {
+	ctx := context.Background()
+	svc, err := New(newFakeRepo())
+	s.Require().NoError(err)
+	userID := uuid.New()
+
+	ok, err := svc.HasConsent(ctx, userID, "client-1", []string{"account:read"})
+	s.Require().NoError(err)
+	s.False(ok)
+
+	// scopes are added to the consent
+	s.Require().NoError(svc.GrantConsent(ctx, userID, "client-1", []string{"account:read"}))
+	s.Require().NoError(svc.GrantConsent(ctx, userID, "client-1", []string{"account:write"}))
+	ok, err = svc.HasConsent(ctx, userID, "client-1", []string{"account:read", "account:write"})
+	s.Require().NoError(err)
+	s.True(ok)
+	ok, err = svc.HasConsent(ctx, userID, "client-1", []string{"account:read", "admin:read"})
+	s.Require().NoError(err)
+	s.False(ok)
+
+	// consents are of the user and the client
+	ok, err = svc.HasConsent(ctx, userID, "client-2", []string{"account:read"})
+	s.Require().NoError(err)
+	s.False(ok)
+	ok, err = svc.HasConsent(ctx, uuid.New(), "client-1", []string{"account:read"})
+	s.Require().NoError(err)
+	s.False(ok)
+
+	consents, err := svc.ListConsents(ctx, userID)
+	s.Require().NoError(err)
+	s.Require().Len(consents, 1)
+	s.Equal("client-1", consents[0].ClientID)
+
+	s.Require().NoError(svc.RevokeConsent(ctx, userID, "client-1"))
+	s.ErrorIs(svc.RevokeConsent(ctx, userID, "client-1"), oauth.ErrNotFound)
+	ok, err = svc.HasConsent(ctx, userID, "client-1", []string{"account:read"})
+	s.Require().NoError(err)
+	s.False(ok)
+}
@@ -0,0 +1,279 @@
+package otp_svc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/andy74139/webserver/src/domain/entity/mail"
+	"github.com/andy74139/webserver/src/domain/entity/otp"
+)
+
+const (
+	defaultCodeLength     = 6
+	defaultCodeTTL        = 10 * time.Minute
+	defaultMaxAttempts    = 5
+	defaultResendInterval = time.Minute
+)
+
+// now is replaced in tests
+var now = time.Now
+
+type Config struct {
+	// Secret signs magic links and hashes codes, it must be shared by all servers
+	Secret []byte
+	// LinkURL is the page of magic links, the page sends the token of the link to the verification endpoint
+	LinkURL        string
+	CodeLength     int
+	CodeTTL        time.Duration
+	MaxAttempts    int
+	ResendInterval time.Duration
+}
+
+type service struct {
+	repo   otp.Repository
+	sender mail.Sender
+	config Config
+}
+
+func New(repo otp.Repository, sender mail.Sender, config Config) (otp.Service, error) {
+	if repo == nil {
+		return nil, errors.New("repo is nil")
+	} else if sender == nil {
+		return nil, errors.New("sender is nil")
+	} else if len(config.Secret) < 32 {
+		return nil, errors.New("secret is shorter than 32 bytes")
+	}
+	if _, err := url.Parse(config.LinkURL); err != nil || config.LinkURL == "" {
+		return nil, fmt.Errorf("invalid link url %q", config.LinkURL)
+	}
+
+	if config.CodeLength <= 0 {
+		config.CodeLength = defaultCodeLength
+	}
+	if config.CodeTTL <= 0 {
+		config.CodeTTL = defaultCodeTTL
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+	if config.ResendInterval <= 0 {
+		config.ResendInterval = defaultResendInterval
+	}
+	return &service{repo: repo, sender: sender, config: config}, nil
+}
+
+func (s *service) Send(ctx context.Context, purpose otp.Purpose, email string) error {
+	challengeID := s.getChallengeID(purpose, email)
+	if challenge, err := s.repo.GetChallenge(ctx, challengeID); err == nil {
+		if now().Before(challenge.SentAt.Add(s.config.ResendInterval)) {
+			return otp.ErrTooSoon
+		}
+	} else if !errors.Is(err, otp.ErrNotFound) {
+		return fmt.Errorf("repo.GetChallenge error: %w", err)
+	}
+
+	code, err := generateCode(s.config.CodeLength)
+	if err != nil {
+		return err
+	}
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return fmt.Errorf("rand.Read error: %w", err)
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(nonceBytes)
+	sentAt := now()
+	link, err := s.buildLink(&linkPayload{
+		Purpose:   purpose,
+		Email:     email,
+		Nonce:     nonce,
+		ExpiresAt: sentAt.Add(s.config.CodeTTL).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	challenge := &otp.Challenge{
+		CodeHash:  s.hashCode(challengeID, code),
+		LinkNonce: nonce,
+		SentAt:    sentAt,
+	}
+	if err := s.repo.SetChallenge(ctx, challengeID, challenge, s.config.CodeTTL); err != nil {
+		return fmt.Errorf("repo.SetChallenge error: %w", err)
+	}
+
+	if err := s.sender.Send(ctx, s.buildMessage(purpose, email, code, link)); err != nil {
+		return fmt.Errorf("sender.Send error: %w", err)
+	}
+	return nil
+}
+
+func (s *service) VerifyCode(ctx context.Context, purpose otp.Purpose, email string, code string) error {
+	challengeID := s.getChallengeID(purpose, email)
+	challenge, err := s.repo.GetChallenge(ctx, challengeID)
+	if errors.Is(err, otp.ErrNotFound) {
+		return otp.ErrInvalidCode
+	} else if err != nil {
+		return fmt.Errorf("repo.GetChallenge error: %w", err)
+	}
+
+	// attempts are counted before comparing, so concurrent guesses can't exceed the limit
+	attempts, err := s.repo.IncrAttempts(ctx, challengeID)
+	if errors.Is(err, otp.ErrNotFound) {
+		return otp.ErrInvalidCode
+	} else if err != nil {
+		return fmt.Errorf("repo.IncrAttempts error: %w", err)
+	}
+	if attempts > s.config.MaxAttempts {
+		if _, err := s.repo.DeleteChallenge(ctx, challengeID); err != nil {
+			return fmt.Errorf("repo.DeleteChallenge error: %w", err)
+		}
+		return otp.ErrTooManyAttempts
+	}
+
+	if subtle.ConstantTimeCompare([]byte(s.hashCode(challengeID, code)), []byte(challenge.CodeHash)) != 1 {
+		return otp.ErrInvalidCode
+	}
+	return s.consume(ctx, challengeID)
+}
+
+func (s *service) VerifyLink(ctx context.Context, purpose otp.Purpose, token string) (string, error) {
+	payload, err := s.parseLinkToken(token)
+	if err != nil || payload.Purpose != purpose || now().Unix() >= payload.ExpiresAt {
+		return "", otp.ErrInvalidCode
+	}
+
+	challengeID := s.getChallengeID(purpose, payload.Email)
+	challenge, err := s.repo.GetChallenge(ctx, challengeID)
+	if errors.Is(err, otp.ErrNotFound) {
+		return "", otp.ErrInvalidCode
+	} else if err != nil {
+		return "", fmt.Errorf("repo.GetChallenge error: %w", err)
+	}
+	// the link of a replaced code is invalid
+	if subtle.ConstantTimeCompare([]byte(payload.Nonce), []byte(challenge.LinkNonce)) != 1 {
+		return "", otp.ErrInvalidCode
+	}
+
+	if err := s.consume(ctx, challengeID); err != nil {
+		return "", err
+	}
+	return payload.Email, nil
+}
+
+// consume deletes the challenge, only the caller which deletes it succeeds.
+func (s *service) consume(ctx context.Context, challengeID string) error {
+	deleted, err := s.repo.DeleteChallenge(ctx, challengeID)
+	if err != nil {
+		return fmt.Errorf("repo.DeleteChallenge error: %w", err)
+	} else if !deleted {
+		return otp.ErrInvalidCode
+	}
+	return nil
+}
+
+// getChallengeID hides the email in repository keys.
+func (s *service) getChallengeID(purpose otp.Purpose, email string) string {
+	hash := sha256.Sum256([]byte(string(purpose) + ":" + email))
+	return hex.EncodeToString(hash[:])
+}
+
+// hashCode hashes the code with the secret, codes are too short to be kept by plain hashes.
+func (s *service) hashCode(challengeID string, code string) string {
+	mac := hmac.New(sha256.New, s.config.Secret)
+	mac.Write([]byte("code:" + challengeID + ":" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type linkPayload struct {
+	Purpose   otp.Purpose `json:"p"`
+	Email     string      `json:"e"`
+	Nonce     string      `json:"n"`
+	ExpiresAt int64       `json:"x"`
+}
+
+// buildLink returns the magic link, of which token is <base64url payload>.<base64url signature>.
+func (s *service) buildLink(payload *linkPayload) (string, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal error: %w", err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payloadBytes)
+	token := encoded + "." + base64.RawURLEncoding.EncodeToString(s.signLink(encoded))
+
+	query := url.Values{}
+	query.Set("purpose", string(payload.Purpose))
+	query.Set("token", token)
+	separator := "?"
+	if strings.Contains(s.config.LinkURL, "?") {
+		separator = "&"
+	}
+	return s.config.LinkURL + separator + query.Encode(), nil
+}
+
+func (s *service) parseLinkToken(token string) (*linkPayload, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errors.New("malformed token")
+	}
+	signatureBytes, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, fmt.Errorf("decode signature error: %w", err)
+	}
+	if !hmac.Equal(signatureBytes, s.signLink(encoded)) {
+		return nil, errors.New("invalid signature")
+	}
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decode payload error: %w", err)
+	}
+	payload := &linkPayload{}
+	if err := json.Unmarshal(payloadBytes, payload); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal error: %w", err)
+	}
+	return payload, nil
+}
+
+func (s *service) signLink(encodedPayload string) []byte {
+	mac := hmac.New(sha256.New, s.config.Secret)
+	mac.Write([]byte("link:" + encodedPayload))
+	return mac.Sum(nil)
+}
+
+func (s *service) buildMessage(purpose otp.Purpose, email string, code string, link string) *mail.Message {
+	subject := "Your login code"
+	action := "sign in"
+	if purpose == otp.PurposeVerifyEmail {
+		subject = "Verify your email"
+		action = "verify your email"
+	}
+	minutes := int(s.config.CodeTTL.Minutes())
+	body := fmt.Sprintf("Your code is %s, enter it to %s.\n\nOr open the link: %s\n\nThe code and link expire in %d minutes. If you didn't request it, ignore this email.\n",
+		code, action, link, minutes)
+	return &mail.Message{To: email, Subject: subject, Body: body}
+}
+
+// generateCode returns a random numeric code.
+func generateCode(length int) (string, error) {
+	builder := &strings.Builder{}
+	for i := 0; i < length; i++ {
+		digit, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", fmt.Errorf("rand.Int error: %w", err)
+		}
+		builder.WriteByte(byte('0' + digit.Int64()))
+	}
+	return builder.String(), nil
+}
@@ -0,0 +1,152 @@
+package otp_svc
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/andy74139/webserver/src/domain/entity/otp"
+	"github.com/andy74139/webserver/src/domain/service/mail"
+)
+
+type OTPSuite struct {
+	suite.Suite
+}
+
+func TestOTPSuite(t *testing.T) {
+	suite.Run(t, new(OTPSuite))
+}
+
+// fakeRepo is an in-memory otp.Repository, challenges don't expire.
+type fakeRepo map[string]*otp.Challenge
+
+func (r fakeRepo) SetChallenge(ctx context.Context, challengeID string, challenge *otp.Challenge, expiryDuration time.Duration) error {
+	challenge1 := *challenge
+	r[challengeID] = &challenge1
+	return nil
+}
+
+func (r fakeRepo) GetChallenge(ctx context.Context, challengeID string) (*otp.Challenge, error) {
+	challenge, ok := r[challengeID]
+	if !ok {
+		return nil, otp.ErrNotFound
+	}
+	challenge1 := *challenge
+	return &challenge1, nil
+}
+
+func (r fakeRepo) IncrAttempts(ctx context.Context, challengeID string) (int, error) {
+	challenge, ok := r[challengeID]
+	if !ok {
+		return 0, otp.ErrNotFound
+	}
+	challenge.Attempts++
+	return challenge.Attempts, nil
+}
+
+func (r fakeRepo) DeleteChallenge(ctx context.Context, challengeID string) (bool, error) {
+	_, ok := r[challengeID]
+	delete(r, challengeID)
+	return ok, nil
+}
+
+const email = "capoo@example.com"
+
+var codePattern = regexp.MustCompile(`code is (\d+)`)
+
+func (s *OTPSuite) newService(repo otp.Repository, sender *mail_svc.MemorySender) otp.Service {
+	svc, err := New(repo, sender, Config{
+		Secret:  []byte(strings.Repeat("s", 32)),
+		LinkURL: "https://my.domain.com/magic",
+	})
+	s.Require().NoError(err)
+	return svc
+}
+
+// sent returns the code and token of the last email.
+func (s *OTPSuite) sent(sender *mail_svc.MemorySender) (string, string) {
+	message := sender.Last(email)
+	s.Require().NotNil(message)
+	code := codePattern.FindStringSubmatch(message.Body)
+	s.Require().Len(code, 2)
+
+	start := strings.Index(message.Body, "https://")
+	end := strings.Index(message.Body[start:], "\n")
+	link, err := url.Parse(message.Body[start : start+end])
+	s.Require().NoError(err)
+	return code[1], link.Query().Get("token")
+}
+
+func (s *OTPSuite) TestVerifyCode() {
+	defer func() { now = time.Now }()
+	ctx := context.TODO()
+	sender := mail_svc.NewMemorySender()
+	svc := s.newService(fakeRepo{}, sender)
+
+	s.Require().NoError(svc.Send(ctx, otp.PurposeLogin, email))
+	code, _ := s.sent(sender)
+	s.Len(code, defaultCodeLength)
+
+	// resend is throttled
+	s.ErrorIs(svc.Send(ctx, otp.PurposeLogin, email), otp.ErrTooSoon)
+
+	// code of another purpose or email is invalid
+	s.ErrorIs(svc.VerifyCode(ctx, otp.PurposeVerifyEmail, email, code), otp.ErrInvalidCode)
+	s.ErrorIs(svc.VerifyCode(ctx, otp.PurposeLogin, "dog@example.com", code), otp.ErrInvalidCode)
+
+	s.NoError(svc.VerifyCode(ctx, otp.PurposeLogin, email, code))
+	// code is consumed
+	s.ErrorIs(svc.VerifyCode(ctx, otp.PurposeLogin, email, code), otp.ErrInvalidCode)
+
+	// too many attempts invalidates the code
+	now = func() time.Time { return time.Now().Add(2 * defaultResendInterval) }
+	s.Require().NoError(svc.Send(ctx, otp.PurposeLogin, email))
+	code, _ = s.sent(sender)
+	for i := 0; i < defaultMaxAttempts; i++ {
+		s.ErrorIs(svc.VerifyCode(ctx, otp.PurposeLogin, email, "wrong"), otp.ErrInvalidCode)
+	}
+	s.ErrorIs(svc.VerifyCode(ctx, otp.PurposeLogin, email, code), otp.ErrTooManyAttempts)
+	s.ErrorIs(svc.VerifyCode(ctx, otp.PurposeLogin, email, code), otp.ErrInvalidCode)
+}
+
+func (s *OTPSuite) TestVerifyLink() {
+	defer func() { now = time.Now }()
+	ctx := context.TODO()
+	sender := mail_svc.NewMemorySender()
+	svc := s.newService(fakeRepo{}, sender)
+
+	s.Require().NoError(svc.Send(ctx, otp.PurposeLogin, email))
+	_, token := s.sent(sender)
+
+	// tampered token, or token of another purpose is invalid
+	_, err := svc.VerifyLink(ctx, otp.PurposeLogin, token+"x")
+	s.ErrorIs(err, otp.ErrInvalidCode)
+	_, err = svc.VerifyLink(ctx, otp.PurposeVerifyEmail, token)
+	s.ErrorIs(err, otp.ErrInvalidCode)
+
+	got, err := svc.VerifyLink(ctx, otp.PurposeLogin, token)
+	s.Require().NoError(err)
+	s.Equal(email, got)
+	_, err = svc.VerifyLink(ctx, otp.PurposeLogin, token)
+	s.ErrorIs(err, otp.ErrInvalidCode)
+
+	// link of a replaced code is invalid
+	now = func() time.Time { return time.Now().Add(2 * defaultResendInterval) }
+	s.Require().NoError(svc.Send(ctx, otp.PurposeLogin, email))
+	_, oldToken := s.sent(sender)
+	now = func() time.Time { return time.Now().Add(4 * defaultResendInterval) }
+	s.Require().NoError(svc.Send(ctx, otp.PurposeLogin, email))
+	_, token = s.sent(sender)
+	_, err = svc.VerifyLink(ctx, otp.PurposeLogin, oldToken)
+	s.ErrorIs(err, otp.ErrInvalidCode)
+
+	// expired link is invalid
+	now = func() time.Time { return time.Now().Add(4*defaultResendInterval + defaultCodeTTL) }
+	_, err = svc.VerifyLink(ctx, otp.PurposeLogin, token)
+	s.ErrorIs(err, otp.ErrInvalidCode)
+}
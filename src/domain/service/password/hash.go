@@ -0,0 +1,77 @@
+package password_svc
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2id parameters, the minimum recommended by OWASP.
+// Hashes of older parameters are verified by their own parameters, and rehashed at login.
+const (
+	argon2Memory  = 19 * 1024 // KiB
+	argon2Time    = 2
+	argon2Threads = 1
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+var defaultArgon2Params = argon2Params{memory: argon2Memory, time: argon2Time, threads: argon2Threads}
+
+// hashPassword hashes the password by argon2id in PHC string format, e.g. $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("rand.Read error: %w", err)
+	}
+	return encodeHash(defaultArgon2Params, salt, password), nil
+}
+
+func encodeHash(params argon2Params, salt []byte, password string) string {
+	key := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.memory, params.time, params.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// verifyPassword compares the password with the hash in constant time.
+// It also returns whether the hash should be rehashed by the current parameters.
+func verifyPassword(password string, encoded string) (bool, bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, false, errors.New("unknown hash format")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false, fmt.Errorf("unknown argon2 version: %s", parts[2])
+	}
+	params := argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return false, false, fmt.Errorf("parse argon2 parameters error: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, fmt.Errorf("decode salt error: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, fmt.Errorf("decode key error: %w", err)
+	}
+
+	actual := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(actual, key) != 1 {
+		return false, false, nil
+	}
+	return true, params != defaultArgon2Params || len(key) != argon2KeyLen, nil
+}
@@ -0,0 +1,143 @@
+package password_svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/password"
+)
+
+// dummyHash is verified when the email is unknown, so that unknown emails take the same time as wrong passwords.
+var dummyHash = encodeHash(defaultArgon2Params, make([]byte, argon2SaltLen), "")
+
+type service struct {
+	repo   password.Repository
+	policy password.Policy
+}
+
+func New(repo password.Repository, policy password.Policy) (password.Service, error) {
+	if repo == nil {
+		return nil, errors.New("repo is nil")
+	}
+	return &service{repo: repo, policy: policy}, nil
+}
+
+func (s *service) Register(ctx context.Context, email string, password1 string, name string) (uuid.UUID, error) {
+	email, err := password.NormalizeEmail(email)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if err := s.policy.Validate(password1); err != nil {
+		return uuid.Nil, err
+	}
+	hash, err := hashPassword(password1)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	userID, err := s.repo.Create(ctx, &password.Credential{Email: email, PasswordHash: hash}, name)
+	if errors.Is(err, password.ErrEmailTaken) {
+		return uuid.Nil, err
+	} else if err != nil {
+		return uuid.Nil, fmt.Errorf("repo.Create error: %w", err)
+	}
+	return userID, nil
+}
+
+func (s *service) Login(ctx context.Context, email string, password1 string) (uuid.UUID, error) {
+	email, err := password.NormalizeEmail(email)
+	if err != nil {
+		return uuid.Nil, password.ErrInvalidCredentials
+	}
+
+	credential, err := s.repo.GetByEmail(ctx, email)
+	if errors.Is(err, password.ErrNotFound) {
+		_, _, _ = verifyPassword(password1, dummyHash)
+		return uuid.Nil, password.ErrInvalidCredentials
+	} else if err != nil {
+		return uuid.Nil, fmt.Errorf("repo.GetByEmail error: %w", err)
+	}
+
+	if err := s.verify(ctx, credential, password1); err != nil {
+		return uuid.Nil, err
+	}
+	return credential.UserID, nil
+}
+
+func (s *service) ChangePassword(ctx context.Context, userID uuid.UUID, oldPassword string, newPassword string) error {
+	credential, err := s.repo.GetByUserID(ctx, userID)
+	if errors.Is(err, password.ErrNotFound) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("repo.GetByUserID error: %w", err)
+	}
+	if err := s.verify(ctx, credential, oldPassword); err != nil {
+		return err
+	}
+	if err := s.policy.Validate(newPassword); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.SetPasswordHash(ctx, userID, hash); err != nil {
+		return fmt.Errorf("repo.SetPasswordHash error: %w", err)
+	}
+	return nil
+}
+
+func (s *service) GetByEmail(ctx context.Context, email string) (*password.Credential, error) {
+	email, err := password.NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	credential, err := s.repo.GetByEmail(ctx, email)
+	if errors.Is(err, password.ErrNotFound) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("repo.GetByEmail error: %w", err)
+	}
+	return credential, nil
+}
+
+func (s *service) GetByUserID(ctx context.Context, userID uuid.UUID) (*password.Credential, error) {
+	credential, err := s.repo.GetByUserID(ctx, userID)
+	if errors.Is(err, password.ErrNotFound) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("repo.GetByUserID error: %w", err)
+	}
+	return credential, nil
+}
+
+func (s *service) SetEmailVerified(ctx context.Context, userID uuid.UUID) error {
+	if err := s.repo.SetEmailVerifiedAt(ctx, userID, time.Now()); errors.Is(err, password.ErrNotFound) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("repo.SetEmailVerifiedAt error: %w", err)
+	}
+	return nil
+}
+
+func (s *service) verify(ctx context.Context, credential *password.Credential, password1 string) error {
+	ok, needsRehash, err := verifyPassword(password1, credential.PasswordHash)
+	if err != nil {
+		return fmt.Errorf("verifyPassword error: %w", err)
+	} else if !ok {
+		return password.ErrInvalidCredentials
+	}
+
+	if needsRehash {
+		// ignore error, it is rehashed at the next login
+		if hash, err := hashPassword(password1); err == nil {
+			_ = s.repo.SetPasswordHash(ctx, credential.UserID, hash)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package password_svc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/andy74139/webserver/src/domain/entity/password"
+)
+
+type PasswordSuite struct {
+	suite.Suite
+}
+
+func TestPasswordSuite(t *testing.T) {
+	suite.Run(t, new(PasswordSuite))
+}
+
+// fakeRepo is an in-memory password.Repository.
+type fakeRepo map[string]*password.Credential
+
+func (r fakeRepo) Create(ctx context.Context, credential *password.Credential, name string) (uuid.UUID, error) {
+	if _, ok := r[credential.Email]; ok {
+		return uuid.Nil, password.ErrEmailTaken
+	}
+	credential.UserID = uuid.New()
+	r[credential.Email] = credential
+	return credential.UserID, nil
+}
+
+func (r fakeRepo) GetByEmail(ctx context.Context, email string) (*password.Credential, error) {
+	credential, ok := r[email]
+	if !ok {
+		return nil, password.ErrNotFound
+	}
+	return credential, nil
+}
+
+func (r fakeRepo) GetByUserID(ctx context.Context, userID uuid.UUID) (*password.Credential, error) {
+	for _, credential := range r {
+		if credential.UserID == userID {
+			return credential, nil
+		}
+	}
+	return nil, password.ErrNotFound
+}
+
+func (r fakeRepo) SetPasswordHash(ctx context.Context, userID uuid.UUID, passwordHash string) error {
+	credential, err := r.GetByUserID(context.TODO(), userID)
+	if err != nil {
+		return err
+	}
+	credential.PasswordHash = passwordHash
+	return nil
+}
+
+func (r fakeRepo) SetEmailVerifiedAt(ctx context.Context, userID uuid.UUID, verifiedAt time.Time) error {
+	credential, err := r.GetByUserID(context.TODO(), userID)
+	if err != nil {
+		return err
+	}
+	credential.EmailVerifiedAt = verifiedAt
+	return nil
+}
+
+func (s *PasswordSuite) TestRegisterAndLogin() {
+	ctx := context.TODO()
+	repo := fakeRepo{}
+	svc, err := New(repo, password.Policy{MinLength: 10, MaxLength: 64, MinCharClasses: 2})
+	s.Require().NoError(err)
+
+	userID, err := svc.Register(ctx, " Capoo@Example.com", "capoo-is-cute", "Capoo")
+	s.Require().NoError(err)
+	s.Contains(repo, "capoo@example.com")
+	s.Contains(repo["capoo@example.com"].PasswordHash, "$argon2id$v=19$m=19456,t=2,p=1$")
+
+	_, err = svc.Register(ctx, "capoo@example.com", "capoo-is-cute", "Capoo")
+	s.ErrorIs(err, password.ErrEmailTaken)
+	_, err = svc.Register(ctx, "not an email", "capoo-is-cute", "Capoo")
+	s.ErrorIs(err, password.ErrInvalidEmail)
+	for _, weak := range []string{"short-1", "onlylowercase", string(make([]rune, 65))} {
+		_, err = svc.Register(ctx, "dog@example.com", weak, "Dog")
+		s.ErrorIs(err, password.ErrWeakPassword, weak)
+	}
+
+	loginID, err := svc.Login(ctx, "CAPOO@example.com", "capoo-is-cute")
+	s.Require().NoError(err)
+	s.Equal(userID, loginID)
+	_, err = svc.Login(ctx, "capoo@example.com", "capoo-is-cute!")
+	s.ErrorIs(err, password.ErrInvalidCredentials)
+	_, err = svc.Login(ctx, "unknown@example.com", "capoo-is-cute")
+	s.ErrorIs(err, password.ErrInvalidCredentials)
+
+	s.Require().NoError(svc.ChangePassword(ctx, userID, "capoo-is-cute", "capoo-is-very-cute"))
+	_, err = svc.Login(ctx, "capoo@example.com", "capoo-is-cute")
+	s.ErrorIs(err, password.ErrInvalidCredentials)
+	_, err = svc.Login(ctx, "capoo@example.com", "capoo-is-very-cute")
+	s.NoError(err)
+}
+
+func (s *PasswordSuite) TestRehash() {
+	ctx := context.TODO()
+	repo := fakeRepo{}
+	svc, err := New(repo, password.Policy{})
+	s.Require().NoError(err)
+
+	// a hash of older parameters is rehashed at login
+	oldHash := encodeHash(argon2Params{memory: 8 * 1024, time: 1, threads: 1}, []byte("0123456789abcdef"), "capoo-is-cute")
+	userID, err := repo.Create(ctx, &password.Credential{Email: "capoo@example.com", PasswordHash: oldHash}, "Capoo")
+	s.Require().NoError(err)
+
+	loginID, err := svc.Login(ctx, "capoo@example.com", "capoo-is-cute")
+	s.Require().NoError(err)
+	s.Equal(userID, loginID)
+	s.Contains(repo["capoo@example.com"].PasswordHash, "$m=19456,t=2,p=1$")
+}
@@ -0,0 +1,114 @@
+package ratelimit_svc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/andy74139/webserver/src/domain/entity/ratelimit"
+)
+
+const (
+	defaultLockoutThreshold = 5
+	defaultLockoutBase      = time.Minute
+	defaultLockoutMax       = time.Hour
+	defaultFailureWindow    = 24 * time.Hour
+)
+
+// now is replaced in tests
+var now = time.Now
+
+type Config struct {
+	// LockoutThreshold is the failures to lock an account out
+	LockoutThreshold int
+	// LockoutBase is the lockout duration at the threshold, it doubles for each further failure, up to LockoutMax
+	LockoutBase time.Duration
+	LockoutMax  time.Duration
+	// FailureWindow is how long failures are remembered after the last failure
+	FailureWindow time.Duration
+}
+
+type service struct {
+	repo   ratelimit.Repository
+	config Config
+}
+
+func New(repo ratelimit.Repository, config Config) (ratelimit.Service, error) {
+	if repo == nil {
+		return nil, errors.New("repo is nil")
+	}
+	if config.LockoutThreshold <= 0 {
+		config.LockoutThreshold = defaultLockoutThreshold
+	}
+	if config.LockoutBase <= 0 {
+		config.LockoutBase = defaultLockoutBase
+	}
+	if config.LockoutMax < config.LockoutBase {
+		config.LockoutMax = max(defaultLockoutMax, config.LockoutBase)
+	}
+	if config.FailureWindow <= 0 {
+		config.FailureWindow = defaultFailureWindow
+	}
+	return &service{repo: repo, config: config}, nil
+}
+
+func (s *service) Allow(ctx context.Context, rule ratelimit.Rule, key string) (bool, time.Duration, error) {
+	if rule.Limit <= 0 || rule.Window <= 0 {
+		return false, 0, fmt.Errorf("invalid rule %q: limit %d, window %s", rule.Name, rule.Limit, rule.Window)
+	}
+	allowed, retryAfter, err := s.repo.AddEvent(ctx, rule.Name+":"+string(rule.Key)+":"+hashKey(key), now(), rule.Limit, rule.Window)
+	if err != nil {
+		return false, 0, fmt.Errorf("repo.AddEvent error: %w", err)
+	}
+	return allowed, retryAfter, nil
+}
+
+func (s *service) GetLockout(ctx context.Context, account string) (time.Duration, error) {
+	duration, err := s.repo.GetLockout(ctx, hashKey(account))
+	if err != nil {
+		return 0, fmt.Errorf("repo.GetLockout error: %w", err)
+	}
+	return duration, nil
+}
+
+func (s *service) RecordFailure(ctx context.Context, account string) (time.Duration, error) {
+	account = hashKey(account)
+	failures, err := s.repo.IncrFailures(ctx, account, s.config.FailureWindow)
+	if err != nil {
+		return 0, fmt.Errorf("repo.IncrFailures error: %w", err)
+	}
+	if failures < s.config.LockoutThreshold {
+		return 0, nil
+	}
+
+	duration := s.lockoutDuration(failures)
+	if err := s.repo.SetLockout(ctx, account, duration); err != nil {
+		return 0, fmt.Errorf("repo.SetLockout error: %w", err)
+	}
+	return duration, nil
+}
+
+func (s *service) RecordSuccess(ctx context.Context, account string) error {
+	if err := s.repo.DeleteFailures(ctx, hashKey(account)); err != nil {
+		return fmt.Errorf("repo.DeleteFailures error: %w", err)
+	}
+	return nil
+}
+
+// lockoutDuration doubles the base duration for each failure over the threshold.
+func (s *service) lockoutDuration(failures int) time.Duration {
+	duration := s.config.LockoutBase
+	for i := s.config.LockoutThreshold; i < failures && duration < s.config.LockoutMax; i++ {
+		duration *= 2
+	}
+	return min(duration, s.config.LockoutMax)
+}
+
+// hashKey bounds the length of keys, and hides emails and IPs in repository keys.
+func hashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:16])
+}
@@ -0,0 +1,143 @@
+package ratelimit_svc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/andy74139/webserver/src/domain/entity/ratelimit"
+)
+
+type RateLimitSuite struct {
+	suite.Suite
+}
+
+func TestRateLimitSuite(t *testing.T) {
+	suite.Run(t, new(RateLimitSuite))
+}
+
+// fakeRepo is an in-memory ratelimit.Repository, failures don't expire.
+type fakeRepo struct {
+	events   map[string][]time.Time
+	failures map[string]int
+	lockouts map[string]time.Time
+}
+
+func newFakeRepo() *fakeRepo {
+	return &fakeRepo{events: map[string][]time.Time{}, failures: map[string]int{}, lockouts: map[string]time.Time{}}
+}
+
+func (r *fakeRepo) AddEvent(ctx context.Context, key string, at time.Time, limit int, window time.Duration) (bool, time.Duration, error) {
+	events := []time.Time{}
+	for _, event := range r.events[key] {
+		if event.After(at.Add(-window)) {
+			events = append(events, event)
+		}
+	}
+	r.events[key] = events
+	if len(events) >= limit {
+		return false, events[0].Add(window).Sub(at), nil
+	}
+	r.events[key] = append(events, at)
+	return true, 0, nil
+}
+
+func (r *fakeRepo) IncrFailures(ctx context.Context, account string, expiryDuration time.Duration) (int, error) {
+	r.failures[account]++
+	return r.failures[account], nil
+}
+
+func (r *fakeRepo) DeleteFailures(ctx context.Context, account string) error {
+	delete(r.failures, account)
+	return nil
+}
+
+func (r *fakeRepo) SetLockout(ctx context.Context, account string, duration time.Duration) error {
+	r.lockouts[account] = now().Add(duration)
+	return nil
+}
+
+func (r *fakeRepo) GetLockout(ctx context.Context, account string) (time.Duration, error) {
+	return max(r.lockouts[account].Sub(now()), 0), nil
+}
+
+func (s *RateLimitSuite) TestAllow() {
+	defer func() { now = time.Now }()
+	ctx := context.TODO()
+	svc, err := New(newFakeRepo(), Config{})
+	s.Require().NoError(err)
+	nowTime := time.Now()
+	now = func() time.Time { return nowTime }
+	rule := ratelimit.Rule{Name: "login", Key: ratelimit.KeyIP, Limit: 3, Window: time.Minute}
+
+	for i := 0; i < 3; i++ {
+		allowed, _, err := svc.Allow(ctx, rule, "203.0.113.1")
+		s.Require().NoError(err)
+		s.True(allowed)
+		nowTime = nowTime.Add(10 * time.Second)
+	}
+	allowed, retryAfter, err := svc.Allow(ctx, rule, "203.0.113.1")
+	s.Require().NoError(err)
+	s.False(allowed)
+	s.Equal(30*time.Second, retryAfter)
+
+	// keys and rules are counted separately
+	allowed, _, err = svc.Allow(ctx, rule, "203.0.113.2")
+	s.Require().NoError(err)
+	s.True(allowed)
+	allowed, _, err = svc.Allow(ctx, ratelimit.Rule{Name: "register", Key: ratelimit.KeyIP, Limit: 1, Window: time.Minute}, "203.0.113.1")
+	s.Require().NoError(err)
+	s.True(allowed)
+
+	// the window slides, the first request leaves it
+	nowTime = nowTime.Add(30 * time.Second)
+	allowed, _, err = svc.Allow(ctx, rule, "203.0.113.1")
+	s.Require().NoError(err)
+	s.True(allowed)
+	allowed, _, err = svc.Allow(ctx, rule, "203.0.113.1")
+	s.Require().NoError(err)
+	s.False(allowed)
+}
+
+func (s *RateLimitSuite) TestLockout() {
+	defer func() { now = time.Now }()
+	ctx := context.TODO()
+	svc, err := New(newFakeRepo(), Config{LockoutThreshold: 3, LockoutBase: time.Minute, LockoutMax: 5 * time.Minute})
+	s.Require().NoError(err)
+	nowTime := time.Now()
+	now = func() time.Time { return nowTime }
+	account := "capoo@example.com"
+
+	for i := 0; i < 2; i++ {
+		duration, err := svc.RecordFailure(ctx, account)
+		s.Require().NoError(err)
+		s.Zero(duration)
+	}
+	// a success resets failures
+	s.NoError(svc.RecordSuccess(ctx, account))
+	for i := 0; i < 2; i++ {
+		duration, err := svc.RecordFailure(ctx, account)
+		s.Require().NoError(err)
+		s.Zero(duration)
+	}
+
+	// lockouts grow exponentially, up to the max
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		duration, err := svc.RecordFailure(ctx, account)
+		s.Require().NoError(err)
+		s.Equal(expected, duration)
+		lockout, err := svc.GetLockout(ctx, account)
+		s.Require().NoError(err)
+		s.Equal(expected, lockout)
+		nowTime = nowTime.Add(expected)
+	}
+	lockout, err := svc.GetLockout(ctx, account)
+	s.Require().NoError(err)
+	s.Zero(lockout)
+
+	lockout, err = svc.GetLockout(ctx, "another@example.com")
+	s.Require().NoError(err)
+	s.Zero(lockout)
+}
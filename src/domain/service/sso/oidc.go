@@ -0,0 +1,379 @@
+package sso_svc
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+	"github.com/andy74139/webserver/src/domain/entity/sso"
+)
+
+const (
+	discoveryCacheDuration = time.Hour
+	jwksCacheDuration      = time.Hour
+	// jwksMinRefreshInterval limits refetching keys when tokens with unknown key IDs are received
+	jwksMinRefreshInterval = time.Minute
+	idTokenLeeway          = time.Minute
+)
+
+var now = time.Now
+
+var errIssuerUnavailable = errors.New("issuer unavailable")
+
+type OIDCConfig struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	HTTPClient   *http.Client
+}
+
+// oidcProvider verifies ID tokens of an OpenID Connect issuer.
+// The discovery document and keys of the issuer are cached.
+type oidcProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	// mu guards the cache only, fetches are made without holding it so cached keys are served during a slow fetch
+	mu             sync.Mutex
+	discovery      *discoveryDocument
+	discoveredAt   time.Time
+	discoveryFetch *fetchCall
+	keys           map[string]crypto.PublicKey
+	keysFetchedAt  time.Time
+	keysFetch      *fetchCall
+}
+
+// fetchCall is an in-flight fetch, concurrent requests wait for it instead of fetching again.
+type fetchCall struct {
+	done chan struct{}
+	err  error
+}
+
+func (c *fetchCall) finish(err error) {
+	c.err = err
+	close(c.done)
+}
+
+func (c *fetchCall) wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce           string   `json:"nonce,omitempty"`
+	AuthorizedParty string   `json:"azp,omitempty"`
+	Email           string   `json:"email,omitempty"`
+	EmailVerified   flexBool `json:"email_verified,omitempty"`
+}
+
+// flexBool accepts both boolean and string, some providers send "true" for email_verified.
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case bool:
+		*b = flexBool(v)
+	case string:
+		*b = flexBool(v == "true")
+	}
+	return nil
+}
+
+func NewOIDCProvider(config OIDCConfig) (sso.Provider, error) {
+	if config.Name == "" || config.Issuer == "" || config.ClientID == "" {
+		return nil, errors.New("name, issuer and client ID are required")
+	}
+	client := config.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &oidcProvider{config: config, client: client}, nil
+}
+
+func (p *oidcProvider) Name() string {
+	return p.config.Name
+}
+
+func (p *oidcProvider) VerifyIDToken(ctx context.Context, idToken string, nonce string) (*sso.Identity, error) {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &idTokenClaims{}
+	_, err = jwt.ParseWithClaims(idToken, claims,
+		func(token *jwt.Token) (interface{}, error) { return p.getKey(ctx, token) },
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(idTokenLeeway),
+		jwt.WithTimeFunc(now),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", sso.ErrInvalidToken, err)
+	}
+
+	// the token is issued to other clients as well, it must be authorized to us
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID {
+		return nil, fmt.Errorf("%w: invalid authorized party %s", sso.ErrInvalidToken, claims.AuthorizedParty)
+	}
+	// tokens without nonce can't be bound to our flow, they may be replayed from elsewhere
+	if nonce == "" || claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", sso.ErrInvalidToken)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: no subject", sso.ErrInvalidToken)
+	}
+
+	return &sso.Identity{
+		Provider:      p.config.Name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+	}, nil
+}
+
+func (p *oidcProvider) ExchangeCode(ctx context.Context, code string, redirectURI string, codeVerifier string, nonce string) (*sso.Identity, error) {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", p.config.ClientID)
+	if codeVerifier != "" {
+		form.Set("code_verifier", codeVerifier)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("read token response error: %w", err)
+	}
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("%w: token endpoint responds %d: %s", sso.ErrInvalidToken, resp.StatusCode, body)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint responds %d: %s", resp.StatusCode, body)
+	}
+
+	tokenResp := &struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := json.Unmarshal(body, tokenResp); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal token response error: %w", err)
+	} else if tokenResp.IDToken == "" {
+		return nil, fmt.Errorf("%w: no id_token in token response", sso.ErrInvalidToken)
+	}
+	return p.VerifyIDToken(ctx, tokenResp.IDToken, nonce)
+}
+
+func (p *oidcProvider) getDiscovery(ctx context.Context) (*discoveryDocument, error) {
+	p.mu.Lock()
+	cached := p.discovery
+	if cached != nil && now().Sub(p.discoveredAt) < discoveryCacheDuration {
+		p.mu.Unlock()
+		return cached, nil
+	}
+	call, isFetching := p.discoveryFetch, p.discoveryFetch != nil
+	if !isFetching {
+		call = &fetchCall{done: make(chan struct{})}
+		p.discoveryFetch = call
+	}
+	p.mu.Unlock()
+
+	if isFetching {
+		if cached != nil {
+			// keep using the stale document while another request refetches it
+			return cached, nil
+		}
+		if err := call.wait(ctx); err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.discovery, nil
+	}
+
+	discovery, err := p.fetchDiscovery(ctx)
+	p.mu.Lock()
+	if err == nil {
+		p.discovery = discovery
+		p.discoveredAt = now()
+	}
+	p.discoveryFetch = nil
+	p.mu.Unlock()
+	call.finish(err)
+
+	if errors.Is(err, errIssuerUnavailable) && cached != nil {
+		// keep using the stale document if the issuer is temporarily unavailable
+		return cached, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return discovery, nil
+}
+
+func (p *oidcProvider) fetchDiscovery(ctx context.Context) (*discoveryDocument, error) {
+	discovery := &discoveryDocument{}
+	discoveryURL := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, discoveryURL, discovery); err != nil {
+		return nil, fmt.Errorf("get discovery document error: %w: %w", errIssuerUnavailable, err)
+	}
+	if discovery.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("issuer mismatch: %s", discovery.Issuer)
+	}
+	if discovery.JWKSURI == "" {
+		return nil, errors.New("no jwks_uri in discovery document")
+	}
+	return discovery, nil
+}
+
+func (p *oidcProvider) getKey(ctx context.Context, token *jwt.Token) (crypto.PublicKey, error) {
+	keyID, _ := token.Header["kid"].(string)
+
+	p.mu.Lock()
+	keys := p.keys
+	isStale := keys == nil || now().Sub(p.keysFetchedAt) >= jwksCacheDuration
+	_, isKnown := keys[keyID]
+	if !isStale && (isKnown || now().Sub(p.keysFetchedAt) < jwksMinRefreshInterval) {
+		p.mu.Unlock()
+		return lookupKey(keys, keyID)
+	}
+	call, isFetching := p.keysFetch, p.keysFetch != nil
+	if !isFetching {
+		call = &fetchCall{done: make(chan struct{})}
+		p.keysFetch = call
+	}
+	jwksURI := p.discovery.JWKSURI
+	p.mu.Unlock()
+
+	if isFetching {
+		if isKnown {
+			// keep using the stale keys while another request refetches them
+			return lookupKey(keys, keyID)
+		}
+		if err := call.wait(ctx); err != nil && keys == nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		keys = p.keys
+		p.mu.Unlock()
+		return lookupKey(keys, keyID)
+	}
+
+	fetched, err := p.fetchKeys(ctx, jwksURI)
+	p.mu.Lock()
+	if err == nil {
+		p.keys = fetched
+		p.keysFetchedAt = now()
+		keys = fetched
+	}
+	p.keysFetch = nil
+	p.mu.Unlock()
+	call.finish(err)
+
+	if err != nil && keys == nil {
+		return nil, err
+	}
+	return lookupKey(keys, keyID)
+}
+
+func lookupKey(keys map[string]crypto.PublicKey, keyID string) (crypto.PublicKey, error) {
+	if key, ok := keys[keyID]; ok {
+		return key, nil
+	} else if keyID == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key ID: %s", keyID)
+}
+
+func (p *oidcProvider) fetchKeys(ctx context.Context, jwksURI string) (map[string]crypto.PublicKey, error) {
+	jwks := &auth.JWKS{}
+	if err := p.getJSON(ctx, jwksURI, jwks); err != nil {
+		return nil, fmt.Errorf("get jwks error: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			// skip keys we can't use, e.g. unsupported curves
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	return keys, nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, url string, result any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("http.NewRequest error: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(result); err != nil {
+		return fmt.Errorf("json.Decode error: %w", err)
+	}
+	return nil
+}
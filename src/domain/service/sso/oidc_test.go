@@ -0,0 +1,328 @@
+package sso_svc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/andy74139/webserver/src/domain/entity/auth"
+	"github.com/andy74139/webserver/src/domain/entity/sso"
+)
+
+const (
+	testClientID     = "webserver"
+	testClientSecret = "capoo"
+)
+
+// fakeIdP is an in-process OpenID Connect issuer.
+type fakeIdP struct {
+	server *httptest.Server
+
+	mu          sync.Mutex
+	keyID       string
+	key         crypto.Signer
+	codes       map[string]*idTokenClaims
+	jwksFetches int
+	// jwksRelease holds jwks responses until it is closed, if set
+	jwksRelease chan struct{}
+}
+
+// fakeNonceRepo keeps nonces in memory, they don't expire.
+type fakeNonceRepo struct {
+	mu     sync.Mutex
+	nonces map[string]bool
+}
+
+func (r *fakeNonceRepo) SetNonce(ctx context.Context, nonceHash string, expiryDuration time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nonces[nonceHash] = true
+	return nil
+}
+
+func (r *fakeNonceRepo) UseNonce(ctx context.Context, nonceHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.nonces[nonceHash] {
+		return sso.ErrInvalidToken
+	}
+	delete(r.nonces, nonceHash)
+	return nil
+}
+
+func newFakeIdP() *fakeIdP {
+	idp := &fakeIdP{codes: map[string]*idTokenClaims{}}
+	idp.rotateKey("key-1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(&discoveryDocument{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		idp.jwksFetches++
+		release := idp.jwksRelease
+		idp.mu.Unlock()
+		if release != nil {
+			<-release
+		}
+
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		jwk, _ := auth.NewJWK(idp.keyID, "ES256", idp.key.Public())
+		_ = json.NewEncoder(w).Encode(&auth.JWKS{Keys: []auth.JWK{jwk}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != testClientID || clientSecret != testClientSecret {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		idp.mu.Lock()
+		claims, ok := idp.codes[r.PostFormValue("code")]
+		delete(idp.codes, r.PostFormValue("code"))
+		idp.mu.Unlock()
+		if !ok || r.PostFormValue("grant_type") != "authorization_code" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(claims)})
+	})
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *fakeIdP) rotateKey(keyID string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.keyID = keyID
+	idp.key = key
+}
+
+func (idp *fakeIdP) claims(subject string, nonce string) *idTokenClaims {
+	return &idTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    idp.server.URL,
+			Subject:   subject,
+			Audience:  jwt.ClaimStrings{testClientID},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		Nonce:         nonce,
+		Email:         subject + "@capoo.com",
+		EmailVerified: true,
+	}
+}
+
+func (idp *fakeIdP) sign(claims *idTokenClaims) string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return idp.signWithKeyID(claims, idp.keyID)
+}
+
+// signWithKeyID should be called with idp.mu locked.
+func (idp *fakeIdP) signWithKeyID(claims *idTokenClaims, keyID string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = keyID
+	signed, err := token.SignedString(idp.key)
+	if err != nil {
+		panic(err)
+	}
+	return signed
+}
+
+type OIDCSuite struct {
+	suite.Suite
+
+	idp *fakeIdP
+	svc sso.Service
+}
+
+func TestOIDCSuite(t *testing.T) {
+	suite.Run(t, new(OIDCSuite))
+}
+
+func (s *OIDCSuite) SetupTest() {
+	now = time.Now
+	s.idp = newFakeIdP()
+	provider, err := NewOIDCProvider(OIDCConfig{
+		Name:         "capoo",
+		Issuer:       s.idp.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+	})
+	s.Require().NoError(err)
+	s.svc, err = New(&fakeNonceRepo{nonces: map[string]bool{}}, provider)
+	s.Require().NoError(err)
+}
+
+func (s *OIDCSuite) createNonce() string {
+	nonce, expiresAt, err := s.svc.CreateNonce(context.TODO())
+	s.Require().NoError(err)
+	s.NotEmpty(nonce)
+	s.True(expiresAt.After(time.Now()))
+	return nonce
+}
+
+func (s *OIDCSuite) TearDownTest() {
+	s.idp.server.Close()
+}
+
+func (s *OIDCSuite) TestVerifyIDToken_HappyCase() {
+	ctx := context.TODO()
+	nonce := s.createNonce()
+	idToken := s.idp.sign(s.idp.claims("user-1", nonce))
+
+	identity, err := s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", IDToken: idToken, Nonce: nonce})
+	s.Require().NoError(err)
+	s.Equal(&sso.Identity{Provider: "capoo", Subject: "user-1", Email: "user-1@capoo.com", EmailVerified: true}, identity)
+}
+
+func (s *OIDCSuite) TestVerifyIDToken_Replay() {
+	ctx := context.TODO()
+	nonce := s.createNonce()
+	idToken := s.idp.sign(s.idp.claims("user-1", nonce))
+	_, err := s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", IDToken: idToken, Nonce: nonce})
+	s.Require().NoError(err)
+
+	// a leaked ID token is replayed without its nonce, or with the used nonce
+	_, err = s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", IDToken: idToken})
+	s.ErrorIs(err, sso.ErrInvalidToken)
+	_, err = s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", IDToken: idToken, Nonce: nonce})
+	s.ErrorIs(err, sso.ErrInvalidToken)
+
+	// a fresh nonce doesn't match the nonce of the token
+	_, err = s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", IDToken: idToken, Nonce: s.createNonce()})
+	s.ErrorIs(err, sso.ErrInvalidToken)
+
+	// tokens without nonce are rejected even with a valid nonce
+	_, err = s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", IDToken: s.idp.sign(s.idp.claims("user-1", "")), Nonce: s.createNonce()})
+	s.ErrorIs(err, sso.ErrInvalidToken)
+
+	// nonces are not issued by us
+	_, err = s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", IDToken: s.idp.sign(s.idp.claims("user-1", "nonce-1")), Nonce: "nonce-1"})
+	s.ErrorIs(err, sso.ErrInvalidToken)
+}
+
+func (s *OIDCSuite) TestVerifyIDToken_InvalidClaims() {
+	ctx := context.TODO()
+
+	cases := map[string]func(c *idTokenClaims){
+		"audience": func(c *idTokenClaims) { c.Audience = jwt.ClaimStrings{"other"} },
+		"issuer":   func(c *idTokenClaims) { c.Issuer = "https://evil.com" },
+		"expired":  func(c *idTokenClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour)) },
+		"nonce":    func(c *idTokenClaims) { c.Nonce = "other" },
+		"azp": func(c *idTokenClaims) {
+			c.Audience = jwt.ClaimStrings{testClientID, "other"}
+			c.AuthorizedParty = "other"
+		},
+	}
+	for name, modify := range cases {
+		nonce := s.createNonce()
+		claims := s.idp.claims("user-1", nonce)
+		modify(claims)
+		_, err := s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", IDToken: s.idp.sign(claims), Nonce: nonce})
+		s.ErrorIs(err, sso.ErrInvalidToken, name)
+	}
+
+	_, err := s.svc.Verify(ctx, &sso.Credential{Provider: "unknown", IDToken: "token"})
+	s.ErrorIs(err, sso.ErrUnknownProvider)
+}
+
+func (s *OIDCSuite) TestVerifyIDToken_KeyCache() {
+	ctx := context.TODO()
+	nowTime := time.Now()
+	now = func() time.Time { return nowTime }
+
+	for i := 0; i < 3; i++ {
+		nonce := s.createNonce()
+		_, err := s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", IDToken: s.idp.sign(s.idp.claims("user-1", nonce)), Nonce: nonce})
+		s.Require().NoError(err)
+	}
+	s.Equal(1, s.idp.jwksFetches)
+
+	// the issuer rotates keys, unknown key ID is refetched but limited by jwksMinRefreshInterval
+	s.idp.rotateKey("key-2")
+	nonce := s.createNonce()
+	_, err := s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", IDToken: s.idp.sign(s.idp.claims("user-1", nonce)), Nonce: nonce})
+	s.ErrorIs(err, sso.ErrInvalidToken)
+
+	nowTime = nowTime.Add(jwksMinRefreshInterval)
+	nonce = s.createNonce()
+	_, err = s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", IDToken: s.idp.sign(s.idp.claims("user-1", nonce)), Nonce: nonce})
+	s.NoError(err)
+	s.Equal(2, s.idp.jwksFetches)
+}
+
+func (s *OIDCSuite) TestVerifyIDToken_SlowKeyFetch() {
+	ctx := context.TODO()
+	nowTime := time.Now()
+	now = func() time.Time { return nowTime }
+	nonce := s.createNonce()
+	_, err := s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", IDToken: s.idp.sign(s.idp.claims("user-1", nonce)), Nonce: nonce})
+	s.Require().NoError(err)
+
+	// a token with unknown key ID refetches keys from a slow issuer
+	nowTime = nowTime.Add(jwksMinRefreshInterval)
+	release := make(chan struct{})
+	unknownNonce := s.createNonce()
+	s.idp.mu.Lock()
+	s.idp.jwksRelease = release
+	unknownToken := s.idp.signWithKeyID(s.idp.claims("user-2", unknownNonce), "key-2")
+	s.idp.mu.Unlock()
+	unknownErr := make(chan error)
+	go func() {
+		_, err := s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", IDToken: unknownToken, Nonce: unknownNonce})
+		unknownErr <- err
+	}()
+	s.Eventually(func() bool {
+		s.idp.mu.Lock()
+		defer s.idp.mu.Unlock()
+		return s.idp.jwksFetches == 2
+	}, time.Second, time.Millisecond*10)
+
+	// tokens of cached keys are verified meanwhile
+	nonce = s.createNonce()
+	_, err = s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", IDToken: s.idp.sign(s.idp.claims("user-1", nonce)), Nonce: nonce})
+	s.NoError(err)
+
+	close(release)
+	s.ErrorIs(<-unknownErr, sso.ErrInvalidToken)
+	s.Equal(2, s.idp.jwksFetches)
+}
+
+func (s *OIDCSuite) TestExchangeCode() {
+	ctx := context.TODO()
+	nonce := s.createNonce()
+	s.idp.codes["code-1"] = s.idp.claims("user-2", nonce)
+
+	identity, err := s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", Code: "code-1", RedirectURI: "https://my.domain.com/callback", Nonce: nonce})
+	s.Require().NoError(err)
+	s.Equal("user-2", identity.Subject)
+
+	// codes are one-time
+	nonce = s.createNonce()
+	_, err = s.svc.Verify(ctx, &sso.Credential{Provider: "capoo", Code: "code-1", RedirectURI: "https://my.domain.com/callback", Nonce: nonce})
+	s.ErrorIs(err, sso.ErrInvalidToken)
+}
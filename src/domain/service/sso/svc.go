@@ -0,0 +1,84 @@
+package sso_svc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/andy74139/webserver/src/domain/entity/sso"
+)
+
+const (
+	nonceExpiryDuration = 10 * time.Minute
+	nonceLength         = 32
+)
+
+type service struct {
+	repo      sso.Repository
+	providers map[string]sso.Provider
+}
+
+func New(repo sso.Repository, providers ...sso.Provider) (sso.Service, error) {
+	if repo == nil {
+		return nil, errors.New("repo is nil")
+	}
+	s := &service{repo: repo, providers: map[string]sso.Provider{}}
+	for _, provider := range providers {
+		if provider == nil {
+			return nil, errors.New("provider is nil")
+		}
+		if _, ok := s.providers[provider.Name()]; ok {
+			return nil, fmt.Errorf("duplicated provider: %s", provider.Name())
+		}
+		s.providers[provider.Name()] = provider
+	}
+	return s, nil
+}
+
+func (s *service) CreateNonce(ctx context.Context) (string, time.Time, error) {
+	b := make([]byte, nonceLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, fmt.Errorf("rand.Read error: %w", err)
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	if err := s.repo.SetNonce(ctx, hashNonce(nonce), nonceExpiryDuration); err != nil {
+		return "", time.Time{}, fmt.Errorf("repo.SetNonce error: %w", err)
+	}
+	return nonce, now().Add(nonceExpiryDuration), nil
+}
+
+func (s *service) Verify(ctx context.Context, credential *sso.Credential) (*sso.Identity, error) {
+	provider, ok := s.providers[credential.Provider]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", sso.ErrUnknownProvider, credential.Provider)
+	}
+	if credential.IDToken == "" && credential.Code == "" {
+		return nil, fmt.Errorf("%w: no ID token or authorization code", sso.ErrInvalidToken)
+	}
+
+	// the nonce is consumed before verifying, so a leaked ID token can't be replayed with it
+	if credential.Nonce == "" {
+		return nil, fmt.Errorf("%w: no nonce", sso.ErrInvalidToken)
+	}
+	if err := s.repo.UseNonce(ctx, hashNonce(credential.Nonce)); errors.Is(err, sso.ErrInvalidToken) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("repo.UseNonce error: %w", err)
+	}
+
+	if credential.IDToken != "" {
+		return provider.VerifyIDToken(ctx, credential.IDToken, credential.Nonce)
+	}
+	return provider.ExchangeCode(ctx, credential.Code, credential.RedirectURI, credential.CodeVerifier, credential.Nonce)
+}
+
+// hashNonce hides nonces in repository keys.
+func hashNonce(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,103 @@
+package transfer_svc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/transfer"
+)
+
+const (
+	codeExpiryDuration = 15 * time.Minute
+	// codeAlphabet has no confusing characters, e.g. 0 and O, 1 and I
+	codeAlphabet    = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	codeLength      = 12
+	codeGroupLength = 4
+)
+
+// now is replaced in tests
+var now = time.Now
+
+type service struct {
+	repo transfer.Repository
+}
+
+func New(repo transfer.Repository) (transfer.Service, error) {
+	if repo == nil {
+		return nil, errors.New("repo is nil")
+	}
+	return &service{repo: repo}, nil
+}
+
+func (s *service) CreateCode(ctx context.Context, userID uuid.UUID) (string, time.Time, error) {
+	code, err := generateCode()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if err := s.repo.SetCode(ctx, hashCode(code), userID, codeExpiryDuration); err != nil {
+		return "", time.Time{}, fmt.Errorf("repo.SetCode error: %w", err)
+	}
+	return formatCode(code), now().Add(codeExpiryDuration), nil
+}
+
+func (s *service) RedeemCode(ctx context.Context, code string) (uuid.UUID, error) {
+	code = normalizeCode(code)
+	if len(code) != codeLength {
+		return uuid.Nil, transfer.ErrInvalidCode
+	}
+	userID, err := s.repo.UseCode(ctx, hashCode(code))
+	if errors.Is(err, transfer.ErrInvalidCode) {
+		return uuid.Nil, err
+	} else if err != nil {
+		return uuid.Nil, fmt.Errorf("repo.UseCode error: %w", err)
+	}
+	return userID, nil
+}
+
+// generateCode returns a random code of 60 bits, it is typed on the new device.
+func generateCode() (string, error) {
+	builder := &strings.Builder{}
+	for i := 0; i < codeLength; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeAlphabet))))
+		if err != nil {
+			return "", fmt.Errorf("rand.Int error: %w", err)
+		}
+		builder.WriteByte(codeAlphabet[n.Int64()])
+	}
+	return builder.String(), nil
+}
+
+// formatCode groups the code by dashes, e.g. ABCD-EFGH-JKLM.
+func formatCode(code string) string {
+	groups := make([]string, 0, codeLength/codeGroupLength)
+	for i := 0; i < len(code); i += codeGroupLength {
+		groups = append(groups, code[i:min(i+codeGroupLength, len(code))])
+	}
+	return strings.Join(groups, "-")
+}
+
+// normalizeCode accepts typed codes of any case, with or without dashes and spaces.
+func normalizeCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// hashCode hides codes in repository keys.
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
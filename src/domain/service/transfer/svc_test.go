@@ -0,0 +1,66 @@
+package transfer_svc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/andy74139/webserver/src/domain/entity/transfer"
+)
+
+type TransferSuite struct {
+	suite.Suite
+}
+
+func TestTransferSuite(t *testing.T) {
+	suite.Run(t, new(TransferSuite))
+}
+
+// fakeRepo is an in-memory transfer.Repository, codes don't expire.
+type fakeRepo map[string]uuid.UUID
+
+func (r fakeRepo) SetCode(ctx context.Context, codeHash string, userID uuid.UUID, expiryDuration time.Duration) error {
+	r[codeHash] = userID
+	return nil
+}
+
+func (r fakeRepo) UseCode(ctx context.Context, codeHash string) (uuid.UUID, error) {
+	userID, ok := r[codeHash]
+	if !ok {
+		return uuid.Nil, transfer.ErrInvalidCode
+	}
+	delete(r, codeHash)
+	return userID, nil
+}
+
+func (s *TransferSuite) TestRedeemCode() {
+	ctx := context.TODO()
+	repo := fakeRepo{}
+	svc, err := New(repo)
+	s.Require().NoError(err)
+	userID := uuid.New()
+
+	code, expiresAt, err := svc.CreateCode(ctx, userID)
+	s.Require().NoError(err)
+	s.Regexp(`^[A-Z2-9]{4}-[A-Z2-9]{4}-[A-Z2-9]{4}$`, code)
+	s.True(expiresAt.After(time.Now()))
+	s.NotContains(repo, strings.ReplaceAll(code, "-", ""))
+
+	_, err = svc.RedeemCode(ctx, "ABCD-EFGH-JKLM")
+	s.ErrorIs(err, transfer.ErrInvalidCode)
+	_, err = svc.RedeemCode(ctx, "")
+	s.ErrorIs(err, transfer.ErrInvalidCode)
+
+	// typed codes may be lower case without dashes
+	redeemedUserID, err := svc.RedeemCode(ctx, strings.ToLower(strings.ReplaceAll(code, "-", " ")))
+	s.Require().NoError(err)
+	s.Equal(userID, redeemedUserID)
+
+	// a code is redeemed once
+	_, err = svc.RedeemCode(ctx, code)
+	s.ErrorIs(err, transfer.ErrInvalidCode)
+}
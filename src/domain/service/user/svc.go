@@ -2,7 +2,13 @@ package user_svc
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 
 	"github.com/google/uuid"
 
@@ -23,8 +29,15 @@ func New(userRepo user.Repository) (user.Service, error) {
 	}, nil
 }
 
-func (s *service) Create(ctx context.Context, platform string, deviceID string, name string) error {
-	return s.userRepo.Create(ctx, platform, deviceID, name)
+func (s *service) Create(ctx context.Context, platform string, deviceID string, name string) (string, error) {
+	deviceSecret, err := generateDeviceSecret()
+	if err != nil {
+		return "", err
+	}
+	if err := s.userRepo.Create(ctx, platform, deviceID, name, hashDeviceSecret(deviceSecret)); err != nil {
+		return "", err
+	}
+	return deviceSecret, nil
 }
 
 func (s *service) Get(ctx context.Context, id uuid.UUID) (*user.User, error) {
@@ -35,6 +48,64 @@ func (s *service) GetIDByDevice(ctx context.Context, platform string, deviceID s
 	return s.userRepo.GetIDByDevice(ctx, platform, deviceID)
 }
 
+func (s *service) LoginByDevice(ctx context.Context, platform string, deviceID string, deviceSecret string) (uuid.UUID, string, error) {
+	userID, deviceSecretHash, err := s.userRepo.GetDeviceSecretHash(ctx, platform, deviceID)
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+
+	if deviceSecretHash != "" {
+		if subtle.ConstantTimeCompare([]byte(hashDeviceSecret(deviceSecret)), []byte(deviceSecretHash)) != 1 {
+			return uuid.Nil, "", user.ErrInvalidDeviceSecret
+		}
+		return userID, "", nil
+	}
+
+	// the device was registered before device secrets, it is enrolled by the first login
+	newDeviceSecret, err := generateDeviceSecret()
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+	if ok, err := s.userRepo.SetDeviceSecretHash(ctx, platform, deviceID, hashDeviceSecret(newDeviceSecret)); err != nil {
+		return uuid.Nil, "", fmt.Errorf("userRepo.SetDeviceSecretHash error: %w", err)
+	} else if !ok {
+		// another login enrolled it
+		return uuid.Nil, "", user.ErrInvalidDeviceSecret
+	}
+	return userID, newDeviceSecret, nil
+}
+
+func (s *service) SetDevice(ctx context.Context, id uuid.UUID, platform string, deviceID string) (string, error) {
+	if userID, err := s.userRepo.GetIDByDevice(ctx, platform, deviceID); err == nil && userID != id {
+		return "", user.ErrDeviceTaken
+	} else if err != nil && !errors.Is(err, user.ErrNotFound) {
+		return "", fmt.Errorf("userRepo.GetIDByDevice error: %w", err)
+	}
+
+	deviceSecret, err := generateDeviceSecret()
+	if err != nil {
+		return "", err
+	}
+	if err := s.userRepo.SetDevice(ctx, id, platform, deviceID, hashDeviceSecret(deviceSecret)); err != nil {
+		return "", err
+	}
+	return deviceSecret, nil
+}
+
+func (s *service) AddDevice(ctx context.Context, id uuid.UUID, platform string, deviceID string) (string, error) {
+	deviceSecret, err := generateDeviceSecret()
+	if err != nil {
+		return "", err
+	}
+	// linking a linked device replaces its secret, the old secret can't login any more
+	if ok, err := s.userRepo.AddIdentity(ctx, id, user.IdentityKindDevice, platform, deviceID, hashDeviceSecret(deviceSecret)); err != nil {
+		return "", fmt.Errorf("userRepo.AddIdentity error: %w", err)
+	} else if !ok {
+		return "", user.ErrDeviceTaken
+	}
+	return deviceSecret, nil
+}
+
 func (s *service) GetIDBySSO(ctx context.Context, ssoProvider string, ssoAccountID string) (uuid.UUID, error) {
 	return s.userRepo.GetIDBySSO(ctx, ssoProvider, ssoAccountID)
 }
@@ -43,14 +114,72 @@ func (s *service) CheckValidLoginUser(ctx context.Context, id uuid.UUID) (bool,
 	return s.userRepo.CheckValidLoginUser(ctx, id)
 }
 
+func (s *service) GetRoles(ctx context.Context, id uuid.UUID) ([]string, error) {
+	return s.userRepo.GetRoles(ctx, id)
+}
+
 func (s *service) Update(ctx context.Context, user1 *user.User) error {
 	return s.userRepo.Update(ctx, user1)
 }
 
 func (s *service) AddSSO(ctx context.Context, id uuid.UUID, provider string, providerAccountID string) error {
-	return s.userRepo.AddSSO(ctx, id, provider, providerAccountID)
+	if ok, err := s.userRepo.AddIdentity(ctx, id, user.IdentityKindSSO, provider, providerAccountID, ""); err != nil {
+		return fmt.Errorf("userRepo.AddIdentity error: %w", err)
+	} else if !ok {
+		return user.ErrSSOTaken
+	}
+	return nil
+}
+
+func (s *service) ListIdentities(ctx context.Context, id uuid.UUID) ([]*user.Identity, error) {
+	return s.userRepo.ListIdentities(ctx, id)
+}
+
+func (s *service) UnlinkIdentity(ctx context.Context, id uuid.UUID, identityID uuid.UUID, hasOtherLoginMethods bool) error {
+	return s.userRepo.DeleteIdentity(ctx, id, identityID, hasOtherLoginMethods)
 }
 
 func (s *service) Delete(ctx context.Context, id uuid.UUID) error {
 	return s.userRepo.Delete(ctx, id)
 }
+
+func (s *service) Merge(ctx context.Context, sourceID uuid.UUID, targetID uuid.UUID) error {
+	if sourceID == targetID {
+		return user.ErrMergeSelf
+	}
+	return s.userRepo.Merge(ctx, sourceID, targetID)
+}
+
+func (s *service) List(ctx context.Context, filter *user.ListFilter) ([]*user.User, int, error) {
+	return s.userRepo.List(ctx, filter)
+}
+
+func (s *service) SetRoles(ctx context.Context, id uuid.UUID, roles []string) error {
+	return s.userRepo.SetRoles(ctx, id, roles)
+}
+
+func (s *service) Suspend(ctx context.Context, id uuid.UUID) error {
+	return s.userRepo.Suspend(ctx, id)
+}
+
+func (s *service) Unsuspend(ctx context.Context, id uuid.UUID) error {
+	return s.userRepo.Unsuspend(ctx, id)
+}
+
+func (s *service) Restore(ctx context.Context, id uuid.UUID) error {
+	return s.userRepo.Restore(ctx, id)
+}
+
+func generateDeviceSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("rand.Read error: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashDeviceSecret hashes device secrets before storing, secrets are random so that a fast hash is enough.
+func hashDeviceSecret(deviceSecret string) string {
+	sum := sha256.Sum256([]byte(deviceSecret))
+	return hex.EncodeToString(sum[:])
+}
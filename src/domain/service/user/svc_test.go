@@ -0,0 +1,354 @@
+package user_svc
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/andy74139/webserver/src/domain/entity/user"
+)
+
+type UserSuite struct {
+	suite.Suite
+}
+
+func TestUserSuite(t *testing.T) {
+	suite.Run(t, new(UserSuite))
+}
+
+type fakeDevice struct {
+	id               uuid.UUID
+	userID           uuid.UUID
+	deviceSecretHash string
+}
+
+// fakeRepo is an in-memory user.Repository of identities, other methods aren't implemented.
+type fakeRepo struct {
+	user.Repository
+	devices     map[string]*fakeDevice
+	ssoAccounts map[string]*fakeDevice
+	// consents are client IDs consented by users
+	consents map[uuid.UUID][]string
+	// apiKeys are API key prefixes of users
+	apiKeys map[uuid.UUID][]string
+}
+
+func newFakeRepo() *fakeRepo {
+	return &fakeRepo{devices: map[string]*fakeDevice{}, ssoAccounts: map[string]*fakeDevice{}, consents: map[uuid.UUID][]string{},
+		apiKeys: map[uuid.UUID][]string{}}
+}
+
+func (r *fakeRepo) identities(kind string) map[string]*fakeDevice {
+	if kind == user.IdentityKindSSO {
+		return r.ssoAccounts
+	}
+	return r.devices
+}
+
+func (r *fakeRepo) Create(ctx context.Context, platform string, deviceID string, name string, deviceSecretHash string) error {
+	if _, ok := r.devices[platform+":"+deviceID]; ok {
+		return user.ErrDeviceTaken
+	}
+	r.devices[platform+":"+deviceID] = &fakeDevice{id: uuid.New(), userID: uuid.New(), deviceSecretHash: deviceSecretHash}
+	return nil
+}
+
+func (r *fakeRepo) GetIDByDevice(ctx context.Context, platform string, deviceID string) (uuid.UUID, error) {
+	userID, _, err := r.GetDeviceSecretHash(ctx, platform, deviceID)
+	return userID, err
+}
+
+func (r *fakeRepo) SetDevice(ctx context.Context, id uuid.UUID, platform string, deviceID string, deviceSecretHash string) error {
+	isFound := false
+	for key, device := range r.devices {
+		if device.userID == id {
+			delete(r.devices, key)
+			isFound = true
+		}
+	}
+	if !isFound {
+		return user.ErrNotFound
+	}
+	r.devices[platform+":"+deviceID] = &fakeDevice{id: uuid.New(), userID: id, deviceSecretHash: deviceSecretHash}
+	return nil
+}
+
+func (r *fakeRepo) GetDeviceSecretHash(ctx context.Context, platform string, deviceID string) (uuid.UUID, string, error) {
+	device, ok := r.devices[platform+":"+deviceID]
+	if !ok {
+		return uuid.Nil, "", user.ErrNotFound
+	}
+	return device.userID, device.deviceSecretHash, nil
+}
+
+func (r *fakeRepo) SetDeviceSecretHash(ctx context.Context, platform string, deviceID string, deviceSecretHash string) (bool, error) {
+	device, ok := r.devices[platform+":"+deviceID]
+	if !ok || device.deviceSecretHash != "" {
+		return false, nil
+	}
+	device.deviceSecretHash = deviceSecretHash
+	return true, nil
+}
+
+func (r *fakeRepo) AddIdentity(ctx context.Context, id uuid.UUID, kind string, provider string, subject string, secretHash string) (bool, error) {
+	identities := r.identities(kind)
+	if identity, ok := identities[provider+":"+subject]; ok && identity.userID != id {
+		return false, nil
+	}
+	identities[provider+":"+subject] = &fakeDevice{id: uuid.New(), userID: id, deviceSecretHash: secretHash}
+	return true, nil
+}
+
+func (r *fakeRepo) GetIDBySSO(ctx context.Context, ssoProvider string, ssoAccountID string) (uuid.UUID, error) {
+	ssoAccount, ok := r.ssoAccounts[ssoProvider+":"+ssoAccountID]
+	if !ok {
+		return uuid.Nil, user.ErrNotFound
+	}
+	return ssoAccount.userID, nil
+}
+
+func (r *fakeRepo) ListIdentities(ctx context.Context, id uuid.UUID) ([]*user.Identity, error) {
+	identities := []*user.Identity{}
+	for _, kind := range []string{user.IdentityKindDevice, user.IdentityKindSSO} {
+		for key, identity := range r.identities(kind) {
+			if identity.userID == id {
+				provider, subject, _ := strings.Cut(key, ":")
+				identities = append(identities, &user.Identity{ID: identity.id, Kind: kind, Provider: provider, Subject: subject})
+			}
+		}
+	}
+	return identities, nil
+}
+
+func (r *fakeRepo) DeleteIdentity(ctx context.Context, id uuid.UUID, identityID uuid.UUID, isLastAllowed bool) error {
+	identities, _ := r.ListIdentities(ctx, id)
+	for _, identity := range identities {
+		if identity.ID != identityID {
+			continue
+		}
+		if len(identities) <= 1 && !isLastAllowed {
+			return user.ErrLastIdentity
+		}
+		delete(r.identities(identity.Kind), identity.Provider+":"+identity.Subject)
+		return nil
+	}
+	return user.ErrNotFound
+}
+
+func (r *fakeRepo) Merge(ctx context.Context, sourceID uuid.UUID, targetID uuid.UUID) error {
+	for _, kind := range []string{user.IdentityKindDevice, user.IdentityKindSSO} {
+		for _, identity := range r.identities(kind) {
+			if identity.userID == sourceID {
+				identity.userID = targetID
+			}
+		}
+	}
+	delete(r.consents, sourceID)
+	delete(r.apiKeys, sourceID)
+	return nil
+}
+
+func (s *UserSuite) TestLoginByDevice() {
+	ctx := context.TODO()
+	repo := newFakeRepo()
+	svc, err := New(repo)
+	s.Require().NoError(err)
+
+	_, _, err = svc.LoginByDevice(ctx, "android", "123456", "")
+	s.ErrorIs(err, user.ErrNotFound)
+
+	deviceSecret, err := svc.Create(ctx, "android", "123456", "Capoo")
+	s.Require().NoError(err)
+	s.NotEmpty(deviceSecret)
+	s.NotEqual(deviceSecret, repo.devices["android:123456"].deviceSecretHash)
+
+	// the device ID alone can't login
+	_, _, err = svc.LoginByDevice(ctx, "android", "123456", "")
+	s.ErrorIs(err, user.ErrInvalidDeviceSecret)
+	_, _, err = svc.LoginByDevice(ctx, "android", "123456", deviceSecret+"x")
+	s.ErrorIs(err, user.ErrInvalidDeviceSecret)
+	userID, newDeviceSecret, err := svc.LoginByDevice(ctx, "android", "123456", deviceSecret)
+	s.Require().NoError(err)
+	s.Equal(repo.devices["android:123456"].userID, userID)
+	s.Empty(newDeviceSecret)
+}
+
+func (s *UserSuite) TestEnrollDeviceSecret() {
+	ctx := context.TODO()
+	legacyUserID := uuid.New()
+	repo := newFakeRepo()
+	repo.devices["ios:abcdef"] = &fakeDevice{id: uuid.New(), userID: legacyUserID}
+	svc, err := New(repo)
+	s.Require().NoError(err)
+
+	// a device registered before device secrets is enrolled by the next login
+	userID, deviceSecret, err := svc.LoginByDevice(ctx, "ios", "abcdef", "")
+	s.Require().NoError(err)
+	s.Equal(legacyUserID, userID)
+	s.NotEmpty(deviceSecret)
+
+	// then the secret is required
+	_, _, err = svc.LoginByDevice(ctx, "ios", "abcdef", "")
+	s.ErrorIs(err, user.ErrInvalidDeviceSecret)
+	_, newDeviceSecret, err := svc.LoginByDevice(ctx, "ios", "abcdef", deviceSecret)
+	s.Require().NoError(err)
+	s.Empty(newDeviceSecret)
+}
+
+func (s *UserSuite) TestSetDevice() {
+	ctx := context.TODO()
+	repo := newFakeRepo()
+	svc, err := New(repo)
+	s.Require().NoError(err)
+	oldDeviceSecret, err := svc.Create(ctx, "android", "old-phone", "Capoo")
+	s.Require().NoError(err)
+	userID := repo.devices["android:old-phone"].userID
+	_, err = svc.Create(ctx, "ios", "taken-phone", "Tsumu")
+	s.Require().NoError(err)
+
+	_, err = svc.SetDevice(ctx, userID, "ios", "taken-phone")
+	s.ErrorIs(err, user.ErrDeviceTaken)
+	_, err = svc.SetDevice(ctx, uuid.New(), "ios", "new-phone")
+	s.ErrorIs(err, user.ErrNotFound)
+
+	deviceSecret, err := svc.SetDevice(ctx, userID, "ios", "new-phone")
+	s.Require().NoError(err)
+	loginUserID, _, err := svc.LoginByDevice(ctx, "ios", "new-phone", deviceSecret)
+	s.Require().NoError(err)
+	s.Equal(userID, loginUserID)
+	_, _, err = svc.LoginByDevice(ctx, "ios", "new-phone", oldDeviceSecret)
+	s.ErrorIs(err, user.ErrInvalidDeviceSecret)
+	_, _, err = svc.LoginByDevice(ctx, "android", "old-phone", oldDeviceSecret)
+	s.ErrorIs(err, user.ErrNotFound)
+}
+
+func (s *UserSuite) TestLinkIdentities() {
+	ctx := context.TODO()
+	repo := newFakeRepo()
+	svc, err := New(repo)
+	s.Require().NoError(err)
+	_, err = svc.Create(ctx, "android", "phone", "Capoo")
+	s.Require().NoError(err)
+	userID := repo.devices["android:phone"].userID
+	_, err = svc.Create(ctx, "android", "taken-phone", "Tsumu")
+	s.Require().NoError(err)
+	anotherUserID := repo.devices["android:taken-phone"].userID
+	_, err = svc.Create(ctx, "android", "phone", "Capoo")
+	s.ErrorIs(err, user.ErrDeviceTaken)
+
+	// devices and SSO accounts are linked together
+	deviceSecret, err := svc.AddDevice(ctx, userID, "ios", "tablet")
+	s.Require().NoError(err)
+	loginUserID, _, err := svc.LoginByDevice(ctx, "ios", "tablet", deviceSecret)
+	s.Require().NoError(err)
+	s.Equal(userID, loginUserID)
+	s.Require().NoError(svc.AddSSO(ctx, userID, "google", "capoo"))
+	s.Require().NoError(svc.AddSSO(ctx, userID, "apple", "capoo"))
+	s.Require().NoError(svc.AddSSO(ctx, userID, "google", "capoo"))
+	ssoUserID, err := svc.GetIDBySSO(ctx, "apple", "capoo")
+	s.Require().NoError(err)
+	s.Equal(userID, ssoUserID)
+	identities, err := svc.ListIdentities(ctx, userID)
+	s.Require().NoError(err)
+	s.Len(identities, 4)
+
+	// identities of another user can't be linked
+	_, err = svc.AddDevice(ctx, userID, "android", "taken-phone")
+	s.ErrorIs(err, user.ErrDeviceTaken)
+	s.ErrorIs(svc.AddSSO(ctx, anotherUserID, "google", "capoo"), user.ErrSSOTaken)
+
+	// transferring the account replaces all devices, SSO accounts are kept
+	_, err = svc.SetDevice(ctx, userID, "ios", "new-phone")
+	s.Require().NoError(err)
+	identities, err = svc.ListIdentities(ctx, userID)
+	s.Require().NoError(err)
+	s.Len(identities, 3)
+	_, err = svc.GetIDByDevice(ctx, "ios", "tablet")
+	s.ErrorIs(err, user.ErrNotFound)
+}
+
+func (s *UserSuite) TestUnlinkIdentity() {
+	ctx := context.TODO()
+	repo := newFakeRepo()
+	svc, err := New(repo)
+	s.Require().NoError(err)
+	_, err = svc.Create(ctx, "android", "phone", "Capoo")
+	s.Require().NoError(err)
+	userID := repo.devices["android:phone"].userID
+	s.Require().NoError(svc.AddSSO(ctx, userID, "google", "capoo"))
+
+	s.ErrorIs(svc.UnlinkIdentity(ctx, userID, uuid.New(), false), user.ErrNotFound)
+	s.ErrorIs(svc.UnlinkIdentity(ctx, uuid.New(), repo.devices["android:phone"].id, false), user.ErrNotFound)
+	s.Require().NoError(svc.UnlinkIdentity(ctx, userID, repo.devices["android:phone"].id, false))
+	_, err = svc.GetIDByDevice(ctx, "android", "phone")
+	s.ErrorIs(err, user.ErrNotFound)
+
+	// the last login method can't be unlinked
+	ssoAccountID := repo.ssoAccounts["google:capoo"].id
+	s.ErrorIs(svc.UnlinkIdentity(ctx, userID, ssoAccountID, false), user.ErrLastIdentity)
+	ssoUserID, err := svc.GetIDBySSO(ctx, "google", "capoo")
+	s.Require().NoError(err)
+	s.Equal(userID, ssoUserID)
+	// unless the user has another one, e.g. a password
+	s.Require().NoError(svc.UnlinkIdentity(ctx, userID, ssoAccountID, true))
+	_, err = svc.GetIDBySSO(ctx, "google", "capoo")
+	s.ErrorIs(err, user.ErrNotFound)
+}
+
+func (s *UserSuite) TestMerge() {
+	ctx := context.TODO()
+	repo := newFakeRepo()
+	svc, err := New(repo)
+	s.Require().NoError(err)
+	guestDeviceSecret, err := svc.Create(ctx, "android", "guest-phone", "Guest")
+	s.Require().NoError(err)
+	guestID := repo.devices["android:guest-phone"].userID
+	_, err = svc.Create(ctx, "ios", "phone", "Capoo")
+	s.Require().NoError(err)
+	userID := repo.devices["ios:phone"].userID
+	s.Require().NoError(svc.AddSSO(ctx, userID, "google", "capoo"))
+
+	s.ErrorIs(svc.Merge(ctx, userID, userID), user.ErrMergeSelf)
+
+	// the guest device logs in to the merged user
+	s.Require().NoError(svc.Merge(ctx, guestID, userID))
+	loginUserID, _, err := svc.LoginByDevice(ctx, "android", "guest-phone", guestDeviceSecret)
+	s.Require().NoError(err)
+	s.Equal(userID, loginUserID)
+	identities, err := svc.ListIdentities(ctx, guestID)
+	s.Require().NoError(err)
+	s.Empty(identities)
+}
+
+func (s *UserSuite) TestMergeRevokesConsents() {
+	ctx := context.TODO()
+	repo := newFakeRepo()
+	svc, err := New(repo)
+	s.Require().NoError(err)
+	guestID, userID := uuid.New(), uuid.New()
+	repo.consents[guestID] = []string{"third-party"}
+	repo.consents[userID] = []string{"first-party"}
+
+	// clients granted by the guest don't get access to the merged user
+	s.Require().NoError(svc.Merge(ctx, guestID, userID))
+	s.NotContains(repo.consents, guestID)
+	s.Equal([]string{"first-party"}, repo.consents[userID])
+}
+
+func (s *UserSuite) TestMergeRevokesAPIKeys() {
+	ctx := context.TODO()
+	repo := newFakeRepo()
+	svc, err := New(repo)
+	s.Require().NoError(err)
+	guestID, userID := uuid.New(), uuid.New()
+	repo.apiKeys[guestID] = []string{"guest"}
+	repo.apiKeys[userID] = []string{"user"}
+
+	// keys created by the guest don't get access to the merged user
+	s.Require().NoError(svc.Merge(ctx, guestID, userID))
+	s.NotContains(repo.apiKeys, guestID)
+	s.Equal([]string{"user"}, repo.apiKeys[userID])
+}
@@ -0,0 +1,305 @@
+package webauthn_svc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/andy74139/webserver/src/domain/entity/webauthn"
+)
+
+const (
+	challengeLength         = 32
+	challengeExpiryDuration = 5 * time.Minute
+)
+
+// now is replaced in tests
+var now = time.Now
+
+type Config struct {
+	// RelyingPartyID is the domain of the site, e.g. my.domain.com, passkeys are bound to it
+	RelyingPartyID   string
+	RelyingPartyName string
+	// Origins are allowed origins of web clients, e.g. https://my.domain.com
+	Origins []string
+}
+
+type service struct {
+	repo   webauthn.Repository
+	config Config
+	rpHash [32]byte
+}
+
+func New(repo webauthn.Repository, config Config) (webauthn.Service, error) {
+	if repo == nil {
+		return nil, errors.New("repo is nil")
+	} else if config.RelyingPartyID == "" {
+		return nil, errors.New("relying party ID is empty")
+	} else if len(config.Origins) == 0 {
+		return nil, errors.New("origins are empty")
+	}
+	if config.RelyingPartyName == "" {
+		config.RelyingPartyName = config.RelyingPartyID
+	}
+	return &service{repo: repo, config: config, rpHash: sha256.Sum256([]byte(config.RelyingPartyID))}, nil
+}
+
+func (s *service) BeginRegistration(ctx context.Context, userID uuid.UUID, userName string) (*webauthn.CreationOptions, error) {
+	challenge, err := s.newChallenge(ctx, &webauthn.Challenge{Type: webauthn.ChallengeTypeCreate, UserID: userID})
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := s.ListCredentials(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &webauthn.CreationOptions{
+		RelyingParty: webauthn.RelyingParty{ID: s.config.RelyingPartyID, Name: s.config.RelyingPartyName},
+		User: webauthn.UserEntity{
+			ID:          base64.RawURLEncoding.EncodeToString(userID[:]),
+			Name:        userName,
+			DisplayName: userName,
+		},
+		Challenge:          challenge,
+		Timeout:            challengeExpiryDuration.Milliseconds(),
+		ExcludeCredentials: []webauthn.CredentialDescriptor{},
+		AuthenticatorSelection: webauthn.AuthenticatorSelection{
+			ResidentKey:      "required",
+			UserVerification: "required",
+		},
+		Attestation: "none",
+	}
+	for _, algorithm := range supportedAlgorithms {
+		options.Parameters = append(options.Parameters, webauthn.CredentialParameter{Type: "public-key", Algorithm: algorithm})
+	}
+	// the authenticator doesn't create another passkey of the user
+	for _, credential := range credentials {
+		options.ExcludeCredentials = append(options.ExcludeCredentials, webauthn.CredentialDescriptor{Type: "public-key", ID: credential.ID})
+	}
+	return options, nil
+}
+
+func (s *service) FinishRegistration(ctx context.Context, userID uuid.UUID, name string, response *webauthn.AttestationResponse) (*webauthn.Credential, error) {
+	if response.Type != "public-key" {
+		return nil, fmt.Errorf("%w: unknown credential type %q", webauthn.ErrInvalidResponse, response.Type)
+	}
+	challenge, _, err := s.verifyClientData(ctx, response.Response.ClientDataJSON, webauthn.ChallengeTypeCreate)
+	if err != nil {
+		return nil, err
+	} else if challenge.UserID != userID {
+		return nil, webauthn.ErrInvalidChallenge
+	}
+
+	attestationObject, err := decodeBase64URL(response.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decode attestation object error: %w", webauthn.ErrInvalidResponse, err)
+	}
+	value, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decode attestation object error: %w", webauthn.ErrInvalidResponse, err)
+	}
+	attestation, ok := value.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: attestation object is not a map", webauthn.ErrInvalidResponse)
+	}
+	// attestation is requested as none, statements of other formats aren't verified, so authenticator models aren't trusted
+	if format, _ := attestation["fmt"].(string); format == "" {
+		return nil, fmt.Errorf("%w: no attestation format", webauthn.ErrInvalidResponse)
+	}
+	rawAuthData, _ := attestation["authData"].([]byte)
+	authData, err := s.verifyAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.flags&flagAttestedData == 0 {
+		return nil, fmt.Errorf("%w: no attested credential data", webauthn.ErrInvalidResponse)
+	}
+	if rawID, err := decodeBase64URL(response.RawID); err != nil || !bytes.Equal(rawID, authData.credentialID) {
+		return nil, fmt.Errorf("%w: credential ID mismatched", webauthn.ErrInvalidResponse)
+	}
+	key, err := parseCOSEKey(authData.publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: parseCOSEKey error: %w", webauthn.ErrInvalidResponse, err)
+	}
+
+	credential := &webauthn.Credential{
+		ID:        base64.RawURLEncoding.EncodeToString(authData.credentialID),
+		UserID:    userID,
+		Name:      name,
+		PublicKey: authData.publicKey,
+		Algorithm: key.algorithm,
+		SignCount: authData.signCount,
+		AAGUID:    authData.aaguid,
+		CreatedAt: now(),
+	}
+	if err := s.repo.CreateCredential(ctx, credential); errors.Is(err, webauthn.ErrCredentialExists) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("repo.CreateCredential error: %w", err)
+	}
+	return credential, nil
+}
+
+func (s *service) BeginLogin(ctx context.Context) (*webauthn.RequestOptions, error) {
+	challenge, err := s.newChallenge(ctx, &webauthn.Challenge{Type: webauthn.ChallengeTypeGet})
+	if err != nil {
+		return nil, err
+	}
+	return &webauthn.RequestOptions{
+		Challenge:        challenge,
+		Timeout:          challengeExpiryDuration.Milliseconds(),
+		RelyingPartyID:   s.config.RelyingPartyID,
+		AllowCredentials: []webauthn.CredentialDescriptor{},
+		UserVerification: "required",
+	}, nil
+}
+
+func (s *service) FinishLogin(ctx context.Context, response *webauthn.AssertionResponse) (uuid.UUID, error) {
+	if response.Type != "public-key" {
+		return uuid.Nil, fmt.Errorf("%w: unknown credential type %q", webauthn.ErrInvalidResponse, response.Type)
+	}
+	_, clientDataJSON, err := s.verifyClientData(ctx, response.Response.ClientDataJSON, webauthn.ChallengeTypeGet)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	rawID, err := decodeBase64URL(response.RawID)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("%w: decode credential ID error: %w", webauthn.ErrInvalidResponse, err)
+	}
+	credential, err := s.repo.GetCredential(ctx, base64.RawURLEncoding.EncodeToString(rawID))
+	if errors.Is(err, webauthn.ErrNotFound) {
+		return uuid.Nil, fmt.Errorf("%w: unknown credential", webauthn.ErrInvalidResponse)
+	} else if err != nil {
+		return uuid.Nil, fmt.Errorf("repo.GetCredential error: %w", err)
+	}
+	if response.Response.UserHandle != "" {
+		userHandle, err := decodeBase64URL(response.Response.UserHandle)
+		if err != nil || !bytes.Equal(userHandle, credential.UserID[:]) {
+			return uuid.Nil, fmt.Errorf("%w: user handle mismatched", webauthn.ErrInvalidResponse)
+		}
+	}
+
+	rawAuthData, err := decodeBase64URL(response.Response.AuthenticatorData)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("%w: decode authenticator data error: %w", webauthn.ErrInvalidResponse, err)
+	}
+	authData, err := s.verifyAuthenticatorData(rawAuthData)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	signature, err := decodeBase64URL(response.Response.Signature)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("%w: decode signature error: %w", webauthn.ErrInvalidResponse, err)
+	}
+	key, err := parseCOSEKey(credential.PublicKey)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("parseCOSEKey error: %w", err)
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	if !key.verify(append(slices.Clone(rawAuthData), clientDataHash[:]...), signature) {
+		return uuid.Nil, fmt.Errorf("%w: invalid signature", webauthn.ErrInvalidResponse)
+	}
+
+	if ok, err := s.repo.UpdateSignCount(ctx, credential.ID, authData.signCount, now()); err != nil {
+		return uuid.Nil, fmt.Errorf("repo.UpdateSignCount error: %w", err)
+	} else if !ok {
+		return uuid.Nil, webauthn.ErrSignCount
+	}
+	return credential.UserID, nil
+}
+
+func (s *service) ListCredentials(ctx context.Context, userID uuid.UUID) ([]*webauthn.Credential, error) {
+	credentials, err := s.repo.ListCredentials(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("repo.ListCredentials error: %w", err)
+	}
+	return credentials, nil
+}
+
+func (s *service) DeleteCredential(ctx context.Context, userID uuid.UUID, credentialID string) error {
+	if err := s.repo.DeleteCredential(ctx, userID, credentialID); errors.Is(err, webauthn.ErrNotFound) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("repo.DeleteCredential error: %w", err)
+	}
+	return nil
+}
+
+func (s *service) newChallenge(ctx context.Context, challenge *webauthn.Challenge) (string, error) {
+	b := make([]byte, challengeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("rand.Read error: %w", err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(b)
+	if err := s.repo.SetChallenge(ctx, encoded, challenge, challengeExpiryDuration); err != nil {
+		return "", fmt.Errorf("repo.SetChallenge error: %w", err)
+	}
+	return encoded, nil
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// verifyClientData verifies the client data of the ceremony, and uses its challenge.
+func (s *service) verifyClientData(ctx context.Context, encoded string, challengeType string) (*webauthn.Challenge, []byte, error) {
+	clientDataJSON, err := decodeBase64URL(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: decode client data error: %w", webauthn.ErrInvalidResponse, err)
+	}
+	data := &clientData{}
+	if err := json.Unmarshal(clientDataJSON, data); err != nil {
+		return nil, nil, fmt.Errorf("%w: json.Unmarshal client data error: %w", webauthn.ErrInvalidResponse, err)
+	}
+	if data.Type != challengeType {
+		return nil, nil, fmt.Errorf("%w: unexpected client data type %q", webauthn.ErrInvalidResponse, data.Type)
+	}
+	if !slices.Contains(s.config.Origins, data.Origin) || data.CrossOrigin {
+		return nil, nil, fmt.Errorf("%w: unexpected origin %q", webauthn.ErrInvalidResponse, data.Origin)
+	}
+
+	challenge, err := s.repo.UseChallenge(ctx, strings.TrimRight(data.Challenge, "="))
+	if errors.Is(err, webauthn.ErrNotFound) {
+		return nil, nil, webauthn.ErrInvalidChallenge
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("repo.UseChallenge error: %w", err)
+	} else if challenge.Type != challengeType {
+		return nil, nil, webauthn.ErrInvalidChallenge
+	}
+	return challenge, clientDataJSON, nil
+}
+
+// verifyAuthenticatorData verifies the data is of our relying party, and the user is verified.
+func (s *service) verifyAuthenticatorData(rawAuthData []byte) (*authenticatorData, error) {
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: parseAuthenticatorData error: %w", webauthn.ErrInvalidResponse, err)
+	}
+	if !bytes.Equal(authData.rpIDHash, s.rpHash[:]) {
+		return nil, fmt.Errorf("%w: relying party mismatched", webauthn.ErrInvalidResponse)
+	}
+	if authData.flags&flagUserPresent == 0 || authData.flags&flagUserVerified == 0 {
+		return nil, fmt.Errorf("%w: user is not present or verified", webauthn.ErrInvalidResponse)
+	}
+	return authData, nil
+}
+
+// decodeBase64URL decodes base64url with or without padding.
+func decodeBase64URL(encoded string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+}
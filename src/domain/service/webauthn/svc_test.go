@@ -0,0 +1,336 @@
+package webauthn_svc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/andy74139/webserver/src/domain/entity/webauthn"
+)
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://example.com"
+)
+
+type WebAuthnSuite struct {
+	suite.Suite
+}
+
+func TestWebAuthnSuite(t *testing.T) {
+	suite.Run(t, new(WebAuthnSuite))
+}
+
+// fakeRepo is an in-memory webauthn.Repository.
+type fakeRepo struct {
+	challenges  map[string]*webauthn.Challenge
+	credentials map[string]*webauthn.Credential
+}
+
+func newFakeRepo() *fakeRepo {
+	return &fakeRepo{challenges: map[string]*webauthn.Challenge{}, credentials: map[string]*webauthn.Credential{}}
+}
+
+func (r *fakeRepo) SetChallenge(ctx context.Context, challenge string, session *webauthn.Challenge, expiryDuration time.Duration) error {
+	r.challenges[challenge] = session
+	return nil
+}
+
+func (r *fakeRepo) UseChallenge(ctx context.Context, challenge string) (*webauthn.Challenge, error) {
+	session, ok := r.challenges[challenge]
+	if !ok {
+		return nil, webauthn.ErrNotFound
+	}
+	delete(r.challenges, challenge)
+	return session, nil
+}
+
+func (r *fakeRepo) CreateCredential(ctx context.Context, credential *webauthn.Credential) error {
+	if _, ok := r.credentials[credential.ID]; ok {
+		return webauthn.ErrCredentialExists
+	}
+	credential1 := *credential
+	r.credentials[credential.ID] = &credential1
+	return nil
+}
+
+func (r *fakeRepo) GetCredential(ctx context.Context, credentialID string) (*webauthn.Credential, error) {
+	credential, ok := r.credentials[credentialID]
+	if !ok {
+		return nil, webauthn.ErrNotFound
+	}
+	credential1 := *credential
+	return &credential1, nil
+}
+
+func (r *fakeRepo) ListCredentials(ctx context.Context, userID uuid.UUID) ([]*webauthn.Credential, error) {
+	var credentials []*webauthn.Credential
+	for _, credential := range r.credentials {
+		if credential.UserID == userID {
+			credential1 := *credential
+			credentials = append(credentials, &credential1)
+		}
+	}
+	return credentials, nil
+}
+
+func (r *fakeRepo) UpdateSignCount(ctx context.Context, credentialID string, signCount uint32, lastUsedAt time.Time) (bool, error) {
+	credential, ok := r.credentials[credentialID]
+	if !ok || (credential.SignCount >= signCount && (signCount != 0 || credential.SignCount != 0)) {
+		return false, nil
+	}
+	credential.SignCount = signCount
+	credential.LastUsedAt = lastUsedAt
+	return true, nil
+}
+
+func (r *fakeRepo) DeleteCredential(ctx context.Context, userID uuid.UUID, credentialID string) error {
+	credential, ok := r.credentials[credentialID]
+	if !ok || credential.UserID != userID {
+		return webauthn.ErrNotFound
+	}
+	delete(r.credentials, credentialID)
+	return nil
+}
+
+// softAuthenticator is a software ES256 authenticator of a passkey.
+type softAuthenticator struct {
+	credentialID []byte
+	userHandle   []byte
+	key          *ecdsa.PrivateKey
+	signCount    uint32
+	origin       string
+}
+
+func newSoftAuthenticator() *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	credentialID := make([]byte, 16)
+	_, _ = rand.Read(credentialID)
+	return &softAuthenticator{credentialID: credentialID, key: key, origin: testOrigin}
+}
+
+func (a *softAuthenticator) clientData(clientDataType string, challenge string) []byte {
+	data, _ := json.Marshal(map[string]any{"type": clientDataType, "challenge": challenge, "origin": a.origin})
+	return data
+}
+
+func (a *softAuthenticator) authData(flags byte, attestedData []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attestedData...)
+}
+
+func (a *softAuthenticator) create(options *webauthn.CreationOptions) *webauthn.AttestationResponse {
+	a.userHandle, _ = base64.RawURLEncoding.DecodeString(options.User.ID)
+	coseKey := encodeCBOR(map[int]any{
+		coseKeyType:      coseKeyTypeEC2,
+		coseKeyAlgorithm: coseAlgES256,
+		coseKeyCurve:     coseCurveP256,
+		coseKeyX:         a.key.X.FillBytes(make([]byte, 32)),
+		coseKeyY:         a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	attestedData := make([]byte, 16) // zero AAGUID
+	attestedData = binary.BigEndian.AppendUint16(attestedData, uint16(len(a.credentialID)))
+	attestedData = append(append(attestedData, a.credentialID...), coseKey...)
+
+	attestationObject := encodeCBOR(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(flagUserPresent|flagUserVerified|flagAttestedData, attestedData),
+	})
+	response := &webauthn.AttestationResponse{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: base64.RawURLEncoding.EncodeToString(a.credentialID),
+		Type:  "public-key",
+	}
+	response.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(a.clientData(webauthn.ChallengeTypeCreate, options.Challenge))
+	response.Response.AttestationObject = base64.RawURLEncoding.EncodeToString(attestationObject)
+	return response
+}
+
+func (a *softAuthenticator) get(options *webauthn.RequestOptions) *webauthn.AssertionResponse {
+	a.signCount++
+	clientDataJSON := a.clientData(webauthn.ChallengeTypeGet, options.Challenge)
+	authData := a.authData(flagUserPresent|flagUserVerified, nil)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+
+	response := &webauthn.AssertionResponse{
+		ID:    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		RawID: base64.RawURLEncoding.EncodeToString(a.credentialID),
+		Type:  "public-key",
+	}
+	response.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientDataJSON)
+	response.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+	response.Response.Signature = base64.RawURLEncoding.EncodeToString(signature)
+	response.Response.UserHandle = base64.RawURLEncoding.EncodeToString(a.userHandle)
+	return response
+}
+
+// encodeCBOR encodes ints, strings, byte strings and maps of them, for the authenticator.
+func encodeCBOR(value any) []byte {
+	header := func(major byte, n int) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 256:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		}
+	}
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return header(1, -1-v)
+		}
+		return header(0, v)
+	case string:
+		return append(header(3, len(v)), v...)
+	case []byte:
+		return append(header(2, len(v)), v...)
+	case map[int]any:
+		data := header(5, len(v))
+		for key, item := range v {
+			data = append(append(data, encodeCBOR(key)...), encodeCBOR(item)...)
+		}
+		return data
+	case map[string]any:
+		data := header(5, len(v))
+		for key, item := range v {
+			data = append(append(data, encodeCBOR(key)...), encodeCBOR(item)...)
+		}
+		return data
+	}
+	panic("unsupported cbor value")
+}
+
+func (s *WebAuthnSuite) newService() (webauthn.Service, *fakeRepo) {
+	repo := newFakeRepo()
+	svc, err := New(repo, Config{RelyingPartyID: testRPID, RelyingPartyName: "Example", Origins: []string{testOrigin}})
+	s.Require().NoError(err)
+	return svc, repo
+}
+
+func (s *WebAuthnSuite) TestRegisterAndLogin() {
+	ctx := context.TODO()
+	svc, repo := s.newService()
+	userID := uuid.New()
+	authenticator := newSoftAuthenticator()
+
+	options, err := svc.BeginRegistration(ctx, userID, "capoo@example.com")
+	s.Require().NoError(err)
+	s.Equal(testRPID, options.RelyingParty.ID)
+	s.Empty(options.ExcludeCredentials)
+	credential, err := svc.FinishRegistration(ctx, userID, "phone", authenticator.create(options))
+	s.Require().NoError(err)
+	s.Equal(base64.RawURLEncoding.EncodeToString(authenticator.credentialID), credential.ID)
+	s.Equal(coseAlgES256, credential.Algorithm)
+
+	// registered passkeys are excluded, and can't be registered again
+	options, err = svc.BeginRegistration(ctx, userID, "capoo@example.com")
+	s.Require().NoError(err)
+	s.Len(options.ExcludeCredentials, 1)
+	_, err = svc.FinishRegistration(ctx, userID, "phone", authenticator.create(options))
+	s.ErrorIs(err, webauthn.ErrCredentialExists)
+
+	requestOptions, err := svc.BeginLogin(ctx)
+	s.Require().NoError(err)
+	assertion := authenticator.get(requestOptions)
+	loginUserID, err := svc.FinishLogin(ctx, assertion)
+	s.Require().NoError(err)
+	s.Equal(userID, loginUserID)
+	s.Equal(uint32(1), repo.credentials[credential.ID].SignCount)
+
+	// the challenge is answered once
+	_, err = svc.FinishLogin(ctx, assertion)
+	s.ErrorIs(err, webauthn.ErrInvalidChallenge)
+
+	credentials, err := svc.ListCredentials(ctx, userID)
+	s.Require().NoError(err)
+	s.Len(credentials, 1)
+	s.ErrorIs(svc.DeleteCredential(ctx, uuid.New(), credential.ID), webauthn.ErrNotFound)
+	s.NoError(svc.DeleteCredential(ctx, userID, credential.ID))
+	requestOptions, err = svc.BeginLogin(ctx)
+	s.Require().NoError(err)
+	_, err = svc.FinishLogin(ctx, authenticator.get(requestOptions))
+	s.ErrorIs(err, webauthn.ErrInvalidResponse)
+}
+
+func (s *WebAuthnSuite) TestRegistrationOfAnotherUser() {
+	ctx := context.TODO()
+	svc, _ := s.newService()
+
+	options, err := svc.BeginRegistration(ctx, uuid.New(), "capoo@example.com")
+	s.Require().NoError(err)
+	_, err = svc.FinishRegistration(ctx, uuid.New(), "phone", newSoftAuthenticator().create(options))
+	s.ErrorIs(err, webauthn.ErrInvalidChallenge)
+}
+
+func (s *WebAuthnSuite) TestInvalidAssertion() {
+	ctx := context.TODO()
+	svc, _ := s.newService()
+	userID := uuid.New()
+	authenticator := newSoftAuthenticator()
+	options, err := svc.BeginRegistration(ctx, userID, "capoo@example.com")
+	s.Require().NoError(err)
+	_, err = svc.FinishRegistration(ctx, userID, "phone", authenticator.create(options))
+	s.Require().NoError(err)
+
+	// phishing origin
+	authenticator.origin = "https://example.com.evil"
+	requestOptions, err := svc.BeginLogin(ctx)
+	s.Require().NoError(err)
+	_, err = svc.FinishLogin(ctx, authenticator.get(requestOptions))
+	s.ErrorIs(err, webauthn.ErrInvalidResponse)
+	authenticator.origin = testOrigin
+
+	// tampered signature
+	requestOptions, err = svc.BeginLogin(ctx)
+	s.Require().NoError(err)
+	assertion := authenticator.get(requestOptions)
+	signature, _ := base64.RawURLEncoding.DecodeString(assertion.Response.Signature)
+	signature[len(signature)-1] ^= 0xff
+	assertion.Response.Signature = base64.RawURLEncoding.EncodeToString(signature)
+	_, err = svc.FinishLogin(ctx, assertion)
+	s.ErrorIs(err, webauthn.ErrInvalidResponse)
+
+	// another user handle
+	requestOptions, err = svc.BeginLogin(ctx)
+	s.Require().NoError(err)
+	assertion = authenticator.get(requestOptions)
+	otherUserID := uuid.New()
+	assertion.Response.UserHandle = base64.RawURLEncoding.EncodeToString(otherUserID[:])
+	_, err = svc.FinishLogin(ctx, assertion)
+	s.ErrorIs(err, webauthn.ErrInvalidResponse)
+
+	requestOptions, err = svc.BeginLogin(ctx)
+	s.Require().NoError(err)
+	_, err = svc.FinishLogin(ctx, authenticator.get(requestOptions))
+	s.Require().NoError(err)
+
+	// a cloned authenticator has a stale sign count
+	authenticator.signCount--
+	requestOptions, err = svc.BeginLogin(ctx)
+	s.Require().NoError(err)
+	_, err = svc.FinishLogin(ctx, authenticator.get(requestOptions))
+	s.ErrorIs(err, webauthn.ErrSignCount)
+}
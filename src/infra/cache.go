@@ -0,0 +1,67 @@
+package infra
+
+import (
+	"sync"
+	"time"
+)
+
+// TTLCache is an in-memory cache of which entries expire at given times, it keeps at most maxSize entries.
+type TTLCache[K comparable, V any] struct {
+	mu      sync.Mutex
+	entries map[K]ttlCacheEntry[V]
+	maxSize int
+}
+
+type ttlCacheEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+func NewTTLCache[K comparable, V any](maxSize int) *TTLCache[K, V] {
+	return &TTLCache[K, V]{entries: map[K]ttlCacheEntry[V]{}, maxSize: maxSize}
+}
+
+func (c *TTLCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !time.Now().Before(entry.expiresAt) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+func (c *TTLCache[K, V]) Set(key K, value V, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxSize {
+		c.evict()
+	}
+	c.entries[key] = ttlCacheEntry[V]{value: value, expiresAt: expiresAt}
+}
+
+func (c *TTLCache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// evict deletes expired entries, or a random entry if none is expired.
+func (c *TTLCache[K, V]) evict() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.entries) < c.maxSize {
+		return
+	}
+	for key := range c.entries {
+		delete(c.entries, key)
+		return
+	}
+}